@@ -0,0 +1,1340 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/google/uuid"
+	"github.com/grafeas/grafeas/go/name"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	vulnpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"golang.org/x/net/context"
+	fieldmaskpb "google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FakeStore is an in-memory Store, for testing code that uses the store without a
+// MySQL server. It returns the same results and errors as MySQLStore, except that:
+//   - filters can only be equality tests joined by AND, e.g.
+//     kind="VULNERABILITY" AND resource.uri="https://gcr.io/p/a";
+//   - page tokens are not encrypted and do not expire;
+//   - SearchOccurrences ranks occurrences by how often they contain the words searched;
+//   - there are no transactions: WithTx calls fn with a nil *sql.Tx, and the calls fn
+//     makes to the store are neither isolated nor rolled back;
+//   - strict note references, orphaned occurrence prevention, read-only mode and the
+//     audit log are not supported.
+type FakeStore struct {
+	clock Clock
+
+	mu          sync.Mutex
+	lastID      int64
+	projects    map[string]*fakeProject
+	notes       map[fakeKey]*fakeNote
+	occurrences map[fakeKey]*fakeOccurrence
+}
+
+var _ Store = (*FakeStore)(nil)
+
+// fakeKey identifies a note or an occurrence by its project ID and its own ID.
+type fakeKey struct {
+	pID, id string
+}
+
+// fakeProject, fakeNote and fakeOccurrence are the rows of the fake store. Their ids
+// order them like the AUTO_INCREMENT ids of the tables of MySQLStore.
+type fakeProject struct {
+	id         int64
+	p          *prpb.Project
+	createTime time.Time
+}
+
+type fakeNote struct {
+	id int64
+	n  *pb.Note
+}
+
+type fakeOccurrence struct {
+	id int64
+	o  *pb.Occurrence
+	// notePID and noteID are the note of the occurrence when it was created, which
+	// updates do not change, like the note_project_id and note_id columns.
+	notePID, noteID string
+	upsertKey       string
+}
+
+// NewFakeStore returns an empty FakeStore, which takes the creation and update times
+// it sets from clock, or from the wall clock when clock is nil.
+func NewFakeStore(clock Clock) *FakeStore {
+	if clock == nil {
+		clock = wallClock{}
+	}
+	return &FakeStore{
+		clock:       clock,
+		projects:    map[string]*fakeProject{},
+		notes:       map[fakeKey]*fakeNote{},
+		occurrences: map[fakeKey]*fakeOccurrence{},
+	}
+}
+
+// nextID returns the id of a new row. f.mu must be held.
+func (f *FakeStore) nextID() int64 {
+	f.lastID++
+	return f.lastID
+}
+
+// timestampNow returns the current time of the store's Clock as a Timestamp.
+func (f *FakeStore) timestampNow() *tspb.Timestamp {
+	ts, err := ptypes.TimestampProto(f.clock.Now())
+	if err != nil {
+		panic("storage: Clock.Now() out of Timestamp range")
+	}
+	return ts
+}
+
+// CreateProject adds the specified project to the store
+func (f *FakeStore) CreateProject(ctx context.Context, pID string, p *prpb.Project) (*prpb.Project, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, status.Error(codes.InvalidArgument, "project must not be nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pName := name.FormatProject(pID)
+	if _, ok := f.projects[pID]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "Project with name %q already exists", pName)
+	}
+	p = proto.Clone(p).(*prpb.Project)
+	p.Name = pName
+	f.projects[pID] = &fakeProject{id: f.nextID(), p: proto.Clone(p).(*prpb.Project), createTime: f.clock.Now().UTC()}
+	return p, nil
+}
+
+// UpdateProject updates the existing project with the given pID, like
+// MySQLStore.UpdateProject.
+func (f *FakeStore) UpdateProject(ctx context.Context, pID string, p *prpb.Project, mask *fieldmaskpb.FieldMask) (*prpb.Project, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, status.Error(codes.InvalidArgument, "project must not be nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pName := name.FormatProject(pID)
+	row, ok := f.projects[pID]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Project with name %q does not Exist", pName)
+	}
+	p = proto.Clone(p).(*prpb.Project)
+	if len(mask.GetPaths()) > 0 {
+		existing := proto.Clone(row.p).(*prpb.Project)
+		if err := applyFieldMask(existing, p, mask); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid update mask: %v", err)
+		}
+		p = existing
+	}
+	p.Name = pName
+	row.p = proto.Clone(p).(*prpb.Project)
+	return p, nil
+}
+
+// DeleteProject deletes the project with the given pID along with all of its notes and
+// occurrences.
+func (f *FakeStore) DeleteProject(ctx context.Context, pID string) error {
+	if err := checkProjectID(pID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.projects[pID]; !ok {
+		return status.Errorf(codes.NotFound, "Project with name %q does not Exist", name.FormatProject(pID))
+	}
+	for k := range f.occurrences {
+		if k.pID == pID {
+			delete(f.occurrences, k)
+		}
+	}
+	for k := range f.notes {
+		if k.pID == pID {
+			delete(f.notes, k)
+		}
+	}
+	delete(f.projects, pID)
+	return nil
+}
+
+// GetProject returns the project with the given pID from the store
+func (f *FakeStore) GetProject(ctx context.Context, pID string) (*prpb.Project, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, ok := f.projects[pID]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Project with name %q does not Exist", name.FormatProject(pID))
+	}
+	return proto.Clone(row.p).(*prpb.Project), nil
+}
+
+// ProjectCreateTime returns the time the project with the given pID was created.
+func (f *FakeStore) ProjectCreateTime(ctx context.Context, pID string) (time.Time, error) {
+	if err := checkProjectID(pID); err != nil {
+		return time.Time{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, ok := f.projects[pID]
+	if !ok {
+		return time.Time{}, status.Errorf(codes.NotFound, "Project with name %q does not Exist", name.FormatProject(pID))
+	}
+	return row.createTime, nil
+}
+
+// ListProjects returns up to pageSize number of projects beginning at pageToken (or from
+// start if pageToken is the empty string). Like MySQLStore.ListProjects, it ignores
+// filter.
+func (f *FakeStore) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) ([]*prpb.Project, string, error) {
+	after, err := decodeFakePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rows []*fakeProject
+	for _, row := range f.projects {
+		if row.id > after {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].id < rows[j].id })
+	n, next := fakePage(len(rows), pageSize, func(i int) int64 { return rows[i].id })
+	var projects []*prpb.Project
+	for _, row := range rows[:n] {
+		projects = append(projects, proto.Clone(row.p).(*prpb.Project))
+	}
+	return projects, next, nil
+}
+
+// newOccurrence returns a copy of o for insertion into project pID with ID oID, or a
+// random ID when oID is empty, along with its ID and the project and ID of its note.
+func (f *FakeStore) newOccurrence(pID, oID string, o *pb.Occurrence) (*pb.Occurrence, fakeOccurrence, error) {
+	if o == nil {
+		return nil, fakeOccurrence{}, status.Error(codes.InvalidArgument, "occurrence must not be nil")
+	}
+	o = proto.Clone(o).(*pb.Occurrence)
+	o.CreateTime = f.timestampNow()
+	if oID == "" {
+		nr, err := uuid.NewRandom()
+		if err != nil {
+			return nil, fakeOccurrence{}, status.Error(codes.Internal, "Failed to generate UUID")
+		}
+		oID = nr.String()
+	}
+	o.Name = name.FormatOccurrence(pID, oID)
+	nPID, nID, err := name.ParseNote(o.NoteName)
+	if err != nil {
+		return nil, fakeOccurrence{}, status.Error(codes.InvalidArgument, "Invalid note name")
+	}
+	return o, fakeOccurrence{o: proto.Clone(o).(*pb.Occurrence), notePID: nPID, noteID: nID}, nil
+}
+
+// CreateOccurrence adds the specified occurrence, with the ID set in ctx by
+// WithOccurrenceID if there is one, like MySQLStore.CreateOccurrence.
+func (f *FakeStore) CreateOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (*pb.Occurrence, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	oID, _ := ctx.Value(occurrenceIDKey{}).(string)
+	if oID != "" && !validOccurrenceID.MatchString(oID) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid occurrence ID %q", oID)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	created, row, err := f.newOccurrence(pID, oID, o)
+	if err != nil {
+		return nil, err
+	}
+	_, id, _ := name.ParseOccurrence(created.Name)
+	key := fakeKey{pID, id}
+	if existing, ok := f.occurrences[key]; ok {
+		err := status.Errorf(codes.AlreadyExists, "Occurrence with name %q/%q already exists", pID, id)
+		if oID == "" {
+			return nil, err
+		}
+		return fakeOccurrenceOf(key, existing), err
+	}
+	row.id = f.nextID()
+	f.occurrences[key] = &row
+	return created, nil
+}
+
+// UpsertOccurrence creates the specified occurrence or replaces the occurrence of the
+// same note and resource upserted before, like MySQLStore.UpsertOccurrence.
+func (f *FakeStore) UpsertOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (*pb.Occurrence, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	created, row, err := f.newOccurrence(pID, "", o)
+	if err != nil {
+		return nil, err
+	}
+	key := string(upsertKey(row.notePID, row.noteID, o.GetResource().GetUri()))
+	for k, existing := range f.occurrences {
+		if k.pID != pID || existing.upsertKey != key {
+			continue
+		}
+		created.Name = existing.o.Name
+		created.UpdateTime = created.CreateTime
+		created.CreateTime = existing.o.CreateTime
+		existing.o = created
+		return fakeOccurrenceOf(k, existing), nil
+	}
+	_, id, _ := name.ParseOccurrence(created.Name)
+	row.id = f.nextID()
+	row.upsertKey = key
+	f.occurrences[fakeKey{pID, id}] = &row
+	return created, nil
+}
+
+// BatchCreateOccurrences creates the specified occurrences, all of them or, if one is
+// invalid, none.
+func (f *FakeStore) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*pb.Occurrence) ([]*pb.Occurrence, []error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, []error{err}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	created := make([]*pb.Occurrence, 0, len(occs))
+	rows := make([]fakeOccurrence, 0, len(occs))
+	for _, o := range occs {
+		occ, row, err := f.newOccurrence(pID, "", o)
+		if err != nil {
+			return nil, []error{err}
+		}
+		created = append(created, occ)
+		rows = append(rows, row)
+	}
+	for i := range rows {
+		_, id, _ := name.ParseOccurrence(created[i].Name)
+		rows[i].id = f.nextID()
+		f.occurrences[fakeKey{pID, id}] = &rows[i]
+	}
+	return created, []error{}
+}
+
+// DeleteOccurrence deletes the occurrence with the given pID and oID
+func (f *FakeStore) DeleteOccurrence(ctx context.Context, pID, oID string) error {
+	if err := checkOccurrenceName(pID, oID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey{pID, oID}
+	if _, ok := f.occurrences[key]; !ok {
+		return status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	}
+	delete(f.occurrences, key)
+	return nil
+}
+
+// DeleteOccurrences deletes the occurrences of project pID with the IDs oIDs, and
+// returns the number of occurrences deleted.
+func (f *FakeStore) DeleteOccurrences(ctx context.Context, pID string, oIDs []string) (int64, error) {
+	if err := checkProjectID(pID); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var deleted int64
+	for _, oID := range oIDs {
+		key := fakeKey{pID, oID}
+		if _, ok := f.occurrences[key]; ok {
+			delete(f.occurrences, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// DeleteOccurrencesByNote deletes the occurrences of the note with pID and nID, in any
+// project, and returns the number of occurrences deleted.
+func (f *FakeStore) DeleteOccurrencesByNote(ctx context.Context, pID, nID string) (int64, error) {
+	if err := checkNoteName(pID, nID); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.deleteNoteOccurrences(pID, nID), nil
+}
+
+// deleteNoteOccurrences deletes the occurrences of the note with pID and nID and
+// returns their number. f.mu must be held.
+func (f *FakeStore) deleteNoteOccurrences(pID, nID string) int64 {
+	var deleted int64
+	for k, row := range f.occurrences {
+		if row.notePID == pID && row.noteID == nID {
+			delete(f.occurrences, k)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// DeleteExpiredOccurrences deletes the occurrences of project pID created before
+// olderThan, and returns the number of occurrences deleted.
+func (f *FakeStore) DeleteExpiredOccurrences(ctx context.Context, pID string, olderThan time.Time) (int64, error) {
+	if err := checkProjectID(pID); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Creation times are compared at the microsecond precision of the create_time
+	// column.
+	cutoff := olderThan.Truncate(time.Microsecond)
+	var deleted int64
+	for k, row := range f.occurrences {
+		if k.pID != pID || row.o.CreateTime == nil {
+			continue
+		}
+		created, err := ptypes.Timestamp(row.o.CreateTime)
+		if err == nil && created.Truncate(time.Microsecond).Before(cutoff) {
+			delete(f.occurrences, k)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// DeleteAllOccurrences deletes the occurrences of project pID like
+// MySQLStore.DeleteAllOccurrences.
+func (f *FakeStore) DeleteAllOccurrences(ctx context.Context, pID string) (int64, error) {
+	if err := checkProjectID(pID); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var deleted int64
+	for k := range f.occurrences {
+		if k.pID == pID {
+			delete(f.occurrences, k)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// DeleteAllNotes deletes the notes of project pID like MySQLStore.DeleteAllNotes.
+func (f *FakeStore) DeleteAllNotes(ctx context.Context, pID string) (int64, error) {
+	if err := checkProjectID(pID); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var deleted int64
+	for k := range f.notes {
+		if k.pID == pID {
+			delete(f.notes, k)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// UpdateOccurrence updates the existing occurrence with the given pID and oID, like
+// MySQLStore.UpdateOccurrence.
+func (f *FakeStore) UpdateOccurrence(ctx context.Context, pID, oID string, o *pb.Occurrence, mask *fieldmaskpb.FieldMask) (*pb.Occurrence, error) {
+	if err := checkOccurrenceName(pID, oID); err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return nil, status.Error(codes.InvalidArgument, "occurrence must not be nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey{pID, oID}
+	row, ok := f.occurrences[key]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	}
+	o = proto.Clone(o).(*pb.Occurrence)
+	if len(mask.GetPaths()) > 0 {
+		existing := fakeOccurrenceOf(key, row)
+		if err := applyFieldMask(existing, o, mask); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid update mask: %v", err)
+		}
+		o = existing
+	}
+	o.UpdateTime = f.timestampNow()
+	row.o = proto.Clone(o).(*pb.Occurrence)
+	return o, nil
+}
+
+// fakeOccurrenceOf returns a copy of the occurrence of row, which has key, with its
+// name set.
+func fakeOccurrenceOf(key fakeKey, row *fakeOccurrence) *pb.Occurrence {
+	o := proto.Clone(row.o).(*pb.Occurrence)
+	o.Name = name.FormatOccurrence(key.pID, key.id)
+	return o
+}
+
+// GetOccurrence returns the occurrence with pID and oID
+func (f *FakeStore) GetOccurrence(ctx context.Context, pID, oID string) (*pb.Occurrence, error) {
+	if err := checkOccurrenceName(pID, oID); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey{pID, oID}
+	row, ok := f.occurrences[key]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	}
+	return fakeOccurrenceOf(key, row), nil
+}
+
+// GetOccurrenceForUpdate returns the occurrence with pID and oID. The fake store has
+// no transactions, so tx is ignored.
+func (f *FakeStore) GetOccurrenceForUpdate(ctx context.Context, tx *sql.Tx, pID, oID string) (*pb.Occurrence, error) {
+	return f.GetOccurrence(ctx, pID, oID)
+}
+
+// GetOccurrences returns the occurrences of project pID with the IDs oIDs, keyed by ID.
+// Occurrences that do not exist are left out of the map.
+func (f *FakeStore) GetOccurrences(ctx context.Context, pID string, oIDs []string) (map[string]*pb.Occurrence, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	occs := make(map[string]*pb.Occurrence, len(oIDs))
+	for _, oID := range oIDs {
+		key := fakeKey{pID, oID}
+		if row, ok := f.occurrences[key]; ok {
+			occs[oID] = fakeOccurrenceOf(key, row)
+		}
+	}
+	return occs, nil
+}
+
+// matchingOccurrences returns the rows of the occurrences matching filter for which
+// keep returns true, ordered by id. f.mu must be held.
+func (f *FakeStore) matchingOccurrences(filter string, keep func(fakeKey, *fakeOccurrence) bool) ([]*fakeOccurrence, error) {
+	conditions, err := parseFakeFilter(filter, false)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+	}
+	var rows []*fakeOccurrence
+	for k, row := range f.occurrences {
+		if !keep(k, row) {
+			continue
+		}
+		ok, err := fakeMatches(row.o, occurrenceKind(row.o), conditions)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Failed to marshal Occurrence")
+		}
+		if ok {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].id < rows[j].id })
+	return rows, nil
+}
+
+// listOccurrences returns the page of pageSize following pageToken of the occurrences
+// matching filter for which keep returns true, and the token of the next page.
+func (f *FakeStore) listOccurrences(filter, pageToken string, pageSize int32, keep func(fakeKey, *fakeOccurrence) bool) ([]*pb.Occurrence, string, error) {
+	after, err := decodeFakePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows, err := f.matchingOccurrences(filter, func(k fakeKey, row *fakeOccurrence) bool {
+		return row.id > after && keep(k, row)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	n, next := fakePage(len(rows), int(pageSize), func(i int) int64 { return rows[i].id })
+	var os []*pb.Occurrence
+	for _, row := range rows[:n] {
+		os = append(os, proto.Clone(row.o).(*pb.Occurrence))
+	}
+	return os, next, nil
+}
+
+// countOccurrences returns the number of occurrences matching filter for which keep
+// returns true.
+func (f *FakeStore) countOccurrences(filter string, keep func(fakeKey, *fakeOccurrence) bool) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows, err := f.matchingOccurrences(filter, keep)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(rows)), nil
+}
+
+// ListOccurrences returns up to pageSize number of occurrences for this project beginning
+// at pageToken, or from start if pageToken is the empty string.
+func (f *FakeStore) ListOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error) {
+	return f.listOccurrences(filter, pageToken, pageSize, inProject(pID))
+}
+
+// ListOccurrencesWithCount is like ListOccurrences, and also returns the total number of
+// occurrences of the project matching filter.
+func (f *FakeStore) ListOccurrencesWithCount(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, int64, error) {
+	os, next, err := f.ListOccurrences(ctx, pID, filter, pageToken, pageSize)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	total, err := f.countOccurrences(filter, inProject(pID))
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return os, next, total, nil
+}
+
+// inProject returns a function keeping the occurrences of project pID.
+func inProject(pID string) func(fakeKey, *fakeOccurrence) bool {
+	return func(k fakeKey, _ *fakeOccurrence) bool { return k.pID == pID }
+}
+
+// ListRecentOccurrences is like ListOccurrences, but returns the most recently updated
+// occurrences first, like MySQLStore.ListRecentOccurrences.
+func (f *FakeStore) ListRecentOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error) {
+	lastTime, lastID, err := decodeFakeTimePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows, err := f.matchingOccurrences(filter, func(k fakeKey, row *fakeOccurrence) bool {
+		t := fakeModifyTime(row.o)
+		return k.pID == pID && (t.Before(lastTime) || t.Equal(lastTime) && row.id < lastID)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		ti, tj := fakeModifyTime(rows[i].o), fakeModifyTime(rows[j].o)
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return rows[i].id > rows[j].id
+	})
+	limit := limitPageSize(int(pageSize), defaultMaxPageSize)
+	next := ""
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[limit-1]
+		next = fmt.Sprintf("%d:%d", fakeModifyTime(last.o).UnixNano(), last.id)
+	}
+	var os []*pb.Occurrence
+	for _, row := range rows {
+		os = append(os, proto.Clone(row.o).(*pb.Occurrence))
+	}
+	return os, next, nil
+}
+
+// fakeModifyTime returns the modification time of o as stored in the modify_time
+// column: its update time, or its creation time if it was never updated, to the
+// microsecond.
+func fakeModifyTime(o *pb.Occurrence) time.Time {
+	ts := o.UpdateTime
+	if ts == nil {
+		ts = o.CreateTime
+	}
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Microsecond)
+}
+
+// IterateOccurrences calls fn for each occurrence of project pID matching filter, and
+// returns the first error returned by fn.
+func (f *FakeStore) IterateOccurrences(ctx context.Context, pID, filter string, fn func(*pb.Occurrence) error) error {
+	pageToken := ""
+	for {
+		os, nextPageToken, err := f.ListOccurrences(ctx, pID, filter, pageToken, iteratePageSize)
+		if err != nil {
+			return err
+		}
+		for _, o := range os {
+			if err := fn(o); err != nil {
+				return err
+			}
+		}
+		if nextPageToken == "" {
+			return nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+// CreateNote adds the specified note
+func (f *FakeStore) CreateNote(ctx context.Context, pID, nID, uID string, n *pb.Note) (*pb.Note, error) {
+	if err := checkNoteName(pID, nID); err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, status.Error(codes.InvalidArgument, "note must not be nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey{pID, nID}
+	if _, ok := f.notes[key]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "Note with name %q/%q already exists", pID, nID)
+	}
+	n = proto.Clone(n).(*pb.Note)
+	n.Name = name.FormatNote(pID, nID)
+	n.CreateTime = f.timestampNow()
+	f.notes[key] = &fakeNote{id: f.nextID(), n: proto.Clone(n).(*pb.Note)}
+	return n, nil
+}
+
+// BatchCreateNotes creates the specified notes, skipping those that cannot be created
+// like MySQLStore.BatchCreateNotes.
+func (f *FakeStore) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*pb.Note) ([]*pb.Note, []error) {
+	nIDs := make([]string, 0, len(notes))
+	for nID := range notes {
+		nIDs = append(nIDs, nID)
+	}
+	sort.Strings(nIDs)
+
+	errs := []error{}
+	created := []*pb.Note{}
+	for _, nID := range nIDs {
+		note, err := f.CreateNote(ctx, pID, nID, uID, notes[nID])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		created = append(created, note)
+	}
+	return created, errs
+}
+
+// DeleteNote deletes the note with the given pID and nID
+func (f *FakeStore) DeleteNote(ctx context.Context, pID, nID string) error {
+	return f.deleteNote(pID, nID, false)
+}
+
+// DeleteNoteAndOccurrences deletes the note with the given pID and nID together with
+// its occurrences.
+func (f *FakeStore) DeleteNoteAndOccurrences(ctx context.Context, pID, nID string) error {
+	return f.deleteNote(pID, nID, true)
+}
+
+// deleteNote deletes the note with pID and nID, and its occurrences if
+// withOccurrences is set.
+func (f *FakeStore) deleteNote(pID, nID string, withOccurrences bool) error {
+	if err := checkNoteName(pID, nID); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := fakeKey{pID, nID}
+	if _, ok := f.notes[key]; !ok {
+		return status.Errorf(codes.NotFound, "Note with name %q/%q does not Exist", pID, nID)
+	}
+	if withOccurrences {
+		f.deleteNoteOccurrences(pID, nID)
+	}
+	delete(f.notes, key)
+	return nil
+}
+
+// UpdateNote updates the existing note with the given pID and nID, like
+// MySQLStore.UpdateNote.
+func (f *FakeStore) UpdateNote(ctx context.Context, pID, nID string, n *pb.Note, mask *fieldmaskpb.FieldMask) (*pb.Note, error) {
+	if err := checkNoteName(pID, nID); err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, status.Error(codes.InvalidArgument, "note must not be nil")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	nName := name.FormatNote(pID, nID)
+	row, ok := f.notes[fakeKey{pID, nID}]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Note with name %q/%q does not Exist", pID, nID)
+	}
+	n = proto.Clone(n).(*pb.Note)
+	if len(mask.GetPaths()) > 0 {
+		existing := proto.Clone(row.n).(*pb.Note)
+		existing.Name = nName
+		if err := applyFieldMask(existing, n, mask); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid update mask: %v", err)
+		}
+		n = existing
+	}
+	n.Name = nName
+	n.CreateTime = row.n.CreateTime
+	n.UpdateTime = f.timestampNow()
+	row.n = proto.Clone(n).(*pb.Note)
+	return n, nil
+}
+
+// GetNote returns the note with project (pID) and note ID (nID)
+func (f *FakeStore) GetNote(ctx context.Context, pID, nID string) (*pb.Note, error) {
+	if err := checkNoteName(pID, nID); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	row, ok := f.notes[fakeKey{pID, nID}]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Note with name %q/%q does not Exist", pID, nID)
+	}
+	n := proto.Clone(row.n).(*pb.Note)
+	n.Name = name.FormatNote(pID, nID)
+	return n, nil
+}
+
+// GetNotes returns the notes of project pID with the IDs nIDs, keyed by ID. Notes that
+// do not exist are left out of the map.
+func (f *FakeStore) GetNotes(ctx context.Context, pID string, nIDs []string) (map[string]*pb.Note, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	notes := make(map[string]*pb.Note, len(nIDs))
+	for _, nID := range nIDs {
+		if row, ok := f.notes[fakeKey{pID, nID}]; ok {
+			n := proto.Clone(row.n).(*pb.Note)
+			n.Name = name.FormatNote(pID, nID)
+			notes[nID] = n
+		}
+	}
+	return notes, nil
+}
+
+// GetOccurrenceNote gets the note of the specified occurrence.
+func (f *FakeStore) GetOccurrenceNote(ctx context.Context, pID, oID string) (*pb.Note, error) {
+	o, err := f.GetOccurrence(ctx, pID, oID)
+	if err != nil {
+		return nil, err
+	}
+	nPID, nID, err := name.ParseNote(o.NoteName)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid Note name")
+	}
+	return f.GetNote(ctx, nPID, nID)
+}
+
+// matchingNotes returns the rows of the notes of project pID matching filter that
+// follow the row with id after, ordered by id. f.mu must be held.
+func (f *FakeStore) matchingNotes(pID, filter string, after int64) ([]*fakeNote, error) {
+	conditions, err := parseFakeFilter(filter, true)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+	}
+	var rows []*fakeNote
+	for k, row := range f.notes {
+		if k.pID != pID || row.id <= after {
+			continue
+		}
+		ok, err := fakeMatches(row.n, row.n.Kind, conditions)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Failed to marshal Note")
+		}
+		if ok {
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].id < rows[j].id })
+	return rows, nil
+}
+
+// ListNotes returns up to pageSize number of notes for this project (pID) beginning
+// at pageToken, or from start if pageToken is the empty string.
+func (f *FakeStore) ListNotes(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Note, string, error) {
+	after, err := decodeFakePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows, err := f.matchingNotes(pID, filter, after)
+	if err != nil {
+		return nil, "", err
+	}
+	n, next := fakePage(len(rows), int(pageSize), func(i int) int64 { return rows[i].id })
+	var ns []*pb.Note
+	for _, row := range rows[:n] {
+		ns = append(ns, proto.Clone(row.n).(*pb.Note))
+	}
+	return ns, next, nil
+}
+
+// ListNotesWithCount is like ListNotes, and also returns the total number of notes of
+// the project matching filter.
+func (f *FakeStore) ListNotesWithCount(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Note, string, int64, error) {
+	ns, next, err := f.ListNotes(ctx, pID, filter, pageToken, pageSize)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows, err := f.matchingNotes(pID, filter, 0)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return ns, next, int64(len(rows)), nil
+}
+
+// IterateNotes calls fn for each note of project pID matching filter, and returns the
+// first error returned by fn.
+func (f *FakeStore) IterateNotes(ctx context.Context, pID, filter string, fn func(*pb.Note) error) error {
+	pageToken := ""
+	for {
+		ns, nextPageToken, err := f.ListNotes(ctx, pID, filter, pageToken, iteratePageSize)
+		if err != nil {
+			return err
+		}
+		for _, n := range ns {
+			if err := fn(n); err != nil {
+				return err
+			}
+		}
+		if nextPageToken == "" {
+			return nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+// ListAllNotes returns all notes of project pID matching filter, or a
+// ResourceExhausted error if there are more than maxListAllNotes of them.
+func (f *FakeStore) ListAllNotes(ctx context.Context, pID, filter string) ([]*pb.Note, error) {
+	var ns []*pb.Note
+	err := f.IterateNotes(ctx, pID, filter, func(n *pb.Note) error {
+		if len(ns) == maxListAllNotes {
+			return status.Errorf(codes.ResourceExhausted, "Project %q has more than %d notes", pID, maxListAllNotes)
+		}
+		ns = append(ns, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// noteOf returns a function keeping the occurrences of the note with pID and nID.
+func noteOf(pID, nID string) func(fakeKey, *fakeOccurrence) bool {
+	return func(_ fakeKey, row *fakeOccurrence) bool { return row.notePID == pID && row.noteID == nID }
+}
+
+// ListNoteOccurrences returns up to pageSize number of occurrences of the note with pID
+// and nID, in any project, beginning at pageToken, or from start if pageToken is the
+// empty string.
+func (f *FakeStore) ListNoteOccurrences(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error) {
+	if _, err := f.GetNote(ctx, pID, nID); err != nil {
+		return nil, "", err
+	}
+	return f.listOccurrences(filter, pageToken, pageSize, noteOf(pID, nID))
+}
+
+// ListNoteOccurrencesWithCount is like ListNoteOccurrences, and also returns the total
+// number of occurrences of the note matching filter.
+func (f *FakeStore) ListNoteOccurrencesWithCount(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, int64, error) {
+	os, next, err := f.ListNoteOccurrences(ctx, pID, nID, filter, pageToken, pageSize)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	total, err := f.countOccurrences(filter, noteOf(pID, nID))
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return os, next, total, nil
+}
+
+// GetVulnerabilityOccurrencesSummary gets a summary of the vulnerability occurrences
+// of project projectID matching filter, with one entry per resource and severity.
+func (f *FakeStore) GetVulnerabilityOccurrencesSummary(ctx context.Context, projectID, filter string) (*pb.VulnerabilityOccurrencesSummary, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows, err := f.matchingOccurrences(filter, func(k fakeKey, row *fakeOccurrence) bool {
+		return k.pID == projectID && row.o.GetVulnerability() != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	type summaryKey struct {
+		uri      string
+		severity vulnpb.Severity
+	}
+	counts := map[summaryKey]*pb.VulnerabilityOccurrencesSummary_FixableTotalByDigest{}
+	summary := &pb.VulnerabilityOccurrencesSummary{}
+	for _, row := range rows {
+		v := row.o.GetVulnerability()
+		key := summaryKey{uri: row.o.GetResource().GetUri(), severity: v.Severity}
+		c, ok := counts[key]
+		if !ok {
+			c = &pb.VulnerabilityOccurrencesSummary_FixableTotalByDigest{
+				Resource: &pb.Resource{Uri: key.uri},
+				Severity: key.severity,
+			}
+			counts[key] = c
+			summary.Counts = append(summary.Counts, c)
+		}
+		c.TotalCount++
+		if isFixable(v) {
+			c.FixableCount++
+		}
+	}
+	// Order the entries like the GROUP BY of MySQLStore.
+	sort.Slice(summary.Counts, func(i, j int) bool {
+		a, b := summary.Counts[i], summary.Counts[j]
+		if a.Resource.Uri != b.Resource.Uri {
+			return a.Resource.Uri < b.Resource.Uri
+		}
+		return a.Severity < b.Severity
+	})
+	return summary, nil
+}
+
+// GetProjectStatistics counts the occurrences and notes of project pID.
+func (f *FakeStore) GetProjectStatistics(ctx context.Context, pID string) (*ProjectStats, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := &ProjectStats{OccurrencesByKind: map[cpb.NoteKind]int64{}}
+	for k, row := range f.occurrences {
+		if k.pID == pID {
+			stats.OccurrencesByKind[occurrenceKind(row.o)]++
+			stats.Occurrences++
+		}
+	}
+	for k := range f.notes {
+		if k.pID == pID {
+			stats.Notes++
+		}
+	}
+	return stats, nil
+}
+
+// SearchOccurrences returns the occurrences of project pID whose text contains words
+// of query like MySQLStore.SearchOccurrences, ranked by the number of times the words
+// appear rather than by the server's relevance. Words shorter than 3 characters are
+// ignored, but stopwords are not.
+func (f *FakeStore) SearchOccurrences(ctx context.Context, pID, query string, pageSize int32) ([]*pb.Occurrence, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	if len(strings.Fields(query)) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Search query is empty")
+	}
+	words := map[string]bool{}
+	for _, word := range fakeSearchWords(query) {
+		if len(word) >= 3 {
+			words[word] = true
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	type match struct {
+		row   *fakeOccurrence
+		score int
+	}
+	var matches []match
+	for k, row := range f.occurrences {
+		if k.pID != pID {
+			continue
+		}
+		text := row.o.Remediation
+		if v := row.o.GetVulnerability(); v != nil {
+			text += " " + v.ShortDescription + " " + v.LongDescription
+		}
+		score := 0
+		for _, word := range fakeSearchWords(text) {
+			if words[word] {
+				score++
+			}
+		}
+		if score > 0 {
+			matches = append(matches, match{row, score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].row.id < matches[j].row.id
+	})
+	limit := limitPageSize(int(pageSize), defaultMaxPageSize)
+	var os []*pb.Occurrence
+	for i := 0; i < len(matches) && i < limit; i++ {
+		os = append(os, proto.Clone(matches[i].row.o).(*pb.Occurrence))
+	}
+	return os, nil
+}
+
+// fakeSearchWordPattern matches the words of searched text.
+var fakeSearchWordPattern = regexp.MustCompile(`[\pL\pN_]+`)
+
+// fakeSearchWords returns the lowercased words of text.
+func fakeSearchWords(text string) []string {
+	return fakeSearchWordPattern.FindAllString(strings.ToLower(text), -1)
+}
+
+// ListAuditEvents returns no events, as the fake store has no audit log.
+func (f *FakeStore) ListAuditEvents(ctx context.Context, pID, pageToken string, pageSize int32) ([]*AuditEvent, string, error) {
+	if err := checkProjectID(pID); err != nil {
+		return nil, "", err
+	}
+	return nil, "", nil
+}
+
+// ExportProject writes the notes and occurrences of project pID to w like
+// MySQLStore.ExportProject.
+func (f *FakeStore) ExportProject(ctx context.Context, pID string, w io.Writer) error {
+	if err := checkProjectID(pID); err != nil {
+		return err
+	}
+	return exportProject(ctx, f, pID, w)
+}
+
+// ImportProject creates the notes and occurrences exported to r in project pID like
+// MySQLStore.ImportProject, except that each is inserted on its own.
+func (f *FakeStore) ImportProject(ctx context.Context, pID string, r io.Reader) error {
+	if err := checkProjectID(pID); err != nil {
+		return err
+	}
+	return readExport(r, pID, func(n *pb.Note, o *pb.Occurrence) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if n != nil {
+			_, nID, _ := name.ParseNote(n.Name)
+			if err := checkNoteName(pID, nID); err != nil {
+				return err
+			}
+			key := fakeKey{pID, nID}
+			if _, ok := f.notes[key]; ok {
+				return status.Error(codes.AlreadyExists, "An imported Note already exists")
+			}
+			if n.CreateTime == nil {
+				n.CreateTime = f.timestampNow()
+			}
+			f.notes[key] = &fakeNote{id: f.nextID(), n: n}
+			return nil
+		}
+		_, oID, _ := name.ParseOccurrence(o.Name)
+		_, row, err := f.newOccurrence(pID, oID, o)
+		if err != nil {
+			return err
+		}
+		key := fakeKey{pID, oID}
+		if _, ok := f.occurrences[key]; ok {
+			return status.Error(codes.AlreadyExists, "An imported Occurrence already exists")
+		}
+		if o.CreateTime != nil {
+			row.o.CreateTime = o.CreateTime
+		}
+		row.id = f.nextID()
+		f.occurrences[key] = &row
+		return nil
+	})
+}
+
+// WithTx calls fn with a nil transaction, as the fake store has no transactions.
+func (f *FakeStore) WithTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return fn(nil)
+}
+
+// Healthcheck always succeeds.
+func (f *FakeStore) Healthcheck(ctx context.Context) error {
+	return nil
+}
+
+// Stats returns empty statistics, as the fake store has no connection pool.
+func (f *FakeStore) Stats() sql.DBStats {
+	return sql.DBStats{}
+}
+
+// Close does nothing.
+func (f *FakeStore) Close() error {
+	return nil
+}
+
+// fakePage returns how many of n rows fit in a page of pageSize, limited like the
+// pages of MySQLStore, and the token of the next page, made from the id of the last
+// row of the page, or the empty string when there is no next page.
+func fakePage(n, pageSize int, id func(int) int64) (int, string) {
+	limit := limitPageSize(pageSize, defaultMaxPageSize)
+	if n <= limit {
+		return n, ""
+	}
+	return limit, strconv.FormatInt(id(limit-1), 10)
+}
+
+// decodeFakePageToken returns the id of the last row of the previous page encoded in
+// pageToken by fakePage, or 0 when pageToken is empty.
+func decodeFakePageToken(pageToken string) (int64, error) {
+	if pageToken == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(pageToken, 10, 64)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, "Invalid page token")
+	}
+	return id, nil
+}
+
+// decodeFakeTimePageToken returns the modification time and id of the last row of the
+// previous page of ListRecentOccurrences, or the latest possible time and id when
+// pageToken is empty.
+func decodeFakeTimePageToken(pageToken string) (time.Time, int64, error) {
+	if pageToken == "" {
+		return maxModifyTime, math.MaxInt64, nil
+	}
+	var nanos, id int64
+	if _, err := fmt.Sscanf(pageToken, "%d:%d", &nanos, &id); err != nil {
+		return time.Time{}, 0, status.Error(codes.InvalidArgument, "Invalid page token")
+	}
+	return time.Unix(0, nanos).UTC(), id, nil
+}
+
+// fakeFilterAnd separates the equality tests of the filters of the fake store.
+var fakeFilterAnd = regexp.MustCompile(`\s+AND\s+`)
+
+// fakeFilterTerm matches an equality test of a field against a string, a number or a
+// boolean.
+var fakeFilterTerm = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_.]*)\s*=\s*("(?:[^"\\]|\\.)*"|-?[0-9]+(?:\.[0-9]+)?|true|false)\s*$`)
+
+// fakeCondition is an equality test of the field at path against value, a value of
+// the JSON representation of the stored data.
+type fakeCondition struct {
+	path  []string
+	value interface{}
+}
+
+// parseFakeFilter parses filter, equality tests joined by AND, into its conditions.
+// Filters of notes cannot test the fields only occurrences have columns for.
+func parseFakeFilter(filter string, notes bool) ([]fakeCondition, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+	var conditions []fakeCondition
+	for _, term := range fakeFilterAnd.Split(filter, -1) {
+		m := fakeFilterTerm.FindStringSubmatch(term)
+		if m == nil {
+			return nil, fmt.Errorf("unsupported filter term %q; the fake store only supports field = value terms joined by AND", term)
+		}
+		field, literal := m[1], m[2]
+		var value interface{}
+		switch {
+		case strings.HasPrefix(literal, `"`):
+			s, err := strconv.Unquote(literal)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s: %v", literal, err)
+			}
+			value = s
+			if field == "kind" {
+				kind, ok := noteKindValue(s)
+				if !ok {
+					return nil, fmt.Errorf("unknown kind %q", s)
+				}
+				value = float64(kind)
+			}
+			if severityFields[field] {
+				severity, ok := vulnpb.Severity_value[s]
+				if !ok {
+					return nil, fmt.Errorf("unknown severity %q", s)
+				}
+				value = float64(severity)
+			}
+		case literal == "true" || literal == "false":
+			value = literal == "true"
+		default:
+			n, err := strconv.ParseFloat(literal, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s: %v", literal, err)
+			}
+			value = n
+		}
+		if _, ok := occurrenceColumns[field]; ok {
+			if notes {
+				return nil, fmt.Errorf("%s can only be filtered on for occurrences", field)
+			}
+			field = "resource.uri"
+		}
+		conditions = append(conditions, fakeCondition{path: strings.Split(field, "."), value: value})
+	}
+	return conditions, nil
+}
+
+// fakeMatches reports whether m, whose kind is kind, satisfies all the conditions.
+func fakeMatches(m proto.Message, kind cpb.NoteKind, conditions []fakeCondition) (bool, error) {
+	if len(conditions) == 0 {
+		return true, nil
+	}
+	data, err := documentMarshaler.MarshalToString(m)
+	if err != nil {
+		return false, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return false, err
+	}
+	for _, c := range conditions {
+		var value interface{} = doc
+		if len(c.path) == 1 && c.path[0] == "kind" {
+			value = float64(kind)
+		} else {
+			for _, field := range c.path {
+				fields, ok := value.(map[string]interface{})
+				if !ok {
+					value = nil
+					break
+				}
+				value = fields[field]
+			}
+		}
+		if value != c.value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
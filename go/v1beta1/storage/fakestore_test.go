@@ -0,0 +1,348 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	vulnpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"golang.org/x/net/context"
+	fieldmaskpb "google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// noteOccurrence returns a vulnerability occurrence of note nName on resource uri.
+func noteOccurrence(nName, uri string, severity vulnpb.Severity) *pb.Occurrence {
+	o := vulnerabilityOccurrence(uri, severity, severity == vulnpb.Severity_HIGH)
+	o.NoteName = nName
+	return o
+}
+
+// describe returns a text representation of v, a result of a store method, for
+// comparing the results of two stores.
+func describe(v interface{}) string {
+	switch v := v.(type) {
+	case proto.Message:
+		return proto.CompactTextString(v)
+	case []*pb.Occurrence:
+		var s []string
+		for _, o := range v {
+			s = append(s, describe(o))
+		}
+		return "[" + strings.Join(s, ", ") + "]"
+	case []*pb.Note:
+		var s []string
+		for _, n := range v {
+			s = append(s, describe(n))
+		}
+		return "[" + strings.Join(s, ", ") + "]"
+	case []*prpb.Project:
+		var s []string
+		for _, p := range v {
+			s = append(s, describe(p))
+		}
+		return "[" + strings.Join(s, ", ") + "]"
+	case map[string]*pb.Occurrence:
+		var s []string
+		for id, o := range v {
+			s = append(s, id+": "+describe(o))
+		}
+		sort.Strings(s)
+		return "{" + strings.Join(s, ", ") + "}"
+	case map[string]*pb.Note:
+		var s []string
+		for id, n := range v {
+			s = append(s, id+": "+describe(n))
+		}
+		sort.Strings(s)
+		return "{" + strings.Join(s, ", ") + "}"
+	case []interface{}:
+		var s []string
+		for _, e := range v {
+			s = append(s, describe(e))
+		}
+		return "(" + strings.Join(s, "; ") + ")"
+	}
+	return fmt.Sprint(v)
+}
+
+// allOccurrencePages lists the occurrences of every page returned by list with pages
+// of two, along with the number of pages.
+func allOccurrencePages(list func(token string) ([]*pb.Occurrence, string, error)) (interface{}, error) {
+	var all []*pb.Occurrence
+	token := ""
+	for pages := 1; ; pages++ {
+		os, next, err := list(token)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, os...)
+		if next == "" || pages > 10 {
+			return []interface{}{all, pages}, nil
+		}
+		token = next
+	}
+}
+
+// fakeStoreScript is a sequence of operations whose results must be the same on
+// FakeStore and MySQLStore.
+var fakeStoreScript = []struct {
+	desc string
+	run  func(ctx context.Context, s Store) (interface{}, error)
+}{
+	{"create project", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.CreateProject(ctx, "p", &prpb.Project{})
+	}},
+	{"create existing project", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.CreateProject(ctx, "p", &prpb.Project{})
+	}},
+	{"get missing project", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.GetProject(ctx, "missing")
+	}},
+	{"create notes", func(ctx context.Context, s Store) (interface{}, error) {
+		ns, errs := s.BatchCreateNotes(ctx, "p", "u", map[string]*pb.Note{
+			"n1": {ShortDescription: "CVE-2019-1000", Kind: cpb.NoteKind_VULNERABILITY},
+			"n2": {ShortDescription: "build", Kind: cpb.NoteKind_BUILD},
+		})
+		if len(errs) > 0 {
+			return ns, errs[0]
+		}
+		return ns, nil
+	}},
+	{"create existing note", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.CreateNote(ctx, "p", "n1", "u", &pb.Note{})
+	}},
+	{"create occurrences", func(ctx context.Context, s Store) (interface{}, error) {
+		var created []*pb.Occurrence
+		for i, o := range []*pb.Occurrence{
+			noteOccurrence("projects/p/notes/n1", "https://gcr.io/p/a", vulnpb.Severity_HIGH),
+			noteOccurrence("projects/p/notes/n1", "https://gcr.io/p/b", vulnpb.Severity_LOW),
+			noteOccurrence("projects/p/notes/n1", "https://gcr.io/p/a", vulnpb.Severity_LOW),
+			noteOccurrence("projects/p/notes/n2", "https://gcr.io/p/a", vulnpb.Severity_HIGH),
+			{NoteName: "projects/p/notes/n2", Resource: &pb.Resource{Uri: "https://gcr.io/p/c"}},
+		} {
+			c, err := s.CreateOccurrence(WithOccurrenceID(ctx, fmt.Sprintf("o%d", i+1)), "p", "u", o)
+			if err != nil {
+				return nil, err
+			}
+			created = append(created, c)
+		}
+		return created, nil
+	}},
+	{"create occurrence in another project", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.CreateOccurrence(WithOccurrenceID(ctx, "o6"), "other", "u", &pb.Occurrence{NoteName: "projects/p/notes/n1"})
+	}},
+	{"create existing occurrence", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.CreateOccurrence(WithOccurrenceID(ctx, "o1"), "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n2"})
+	}},
+	{"get missing occurrence", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.GetOccurrence(ctx, "p", "o9")
+	}},
+	{"list occurrences", func(ctx context.Context, s Store) (interface{}, error) {
+		return allOccurrencePages(func(token string) ([]*pb.Occurrence, string, error) {
+			return s.ListOccurrences(ctx, "p", "", token, 2)
+		})
+	}},
+	{"list occurrences of a resource", func(ctx context.Context, s Store) (interface{}, error) {
+		return allOccurrencePages(func(token string) ([]*pb.Occurrence, string, error) {
+			return s.ListOccurrences(ctx, "p", `resource.uri="https://gcr.io/p/a" AND kind="VULNERABILITY"`, token, 2)
+		})
+	}},
+	{"count occurrences", func(ctx context.Context, s Store) (interface{}, error) {
+		os, _, total, err := s.ListOccurrencesWithCount(ctx, "p", `resource_url="https://gcr.io/p/a"`, "", 1)
+		return []interface{}{os, total}, err
+	}},
+	{"list with invalid token", func(ctx context.Context, s Store) (interface{}, error) {
+		return allOccurrencePages(func(token string) ([]*pb.Occurrence, string, error) {
+			return s.ListOccurrences(ctx, "p", "", "garbage", 2)
+		})
+	}},
+	{"update occurrence", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.UpdateOccurrence(ctx, "p", "o2", &pb.Occurrence{Remediation: "upgrade"}, &fieldmaskpb.FieldMask{Paths: []string{"remediation"}})
+	}},
+	{"update missing occurrence", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.UpdateOccurrence(ctx, "p", "o9", &pb.Occurrence{}, nil)
+	}},
+	{"list recent occurrences", func(ctx context.Context, s Store) (interface{}, error) {
+		return allOccurrencePages(func(token string) ([]*pb.Occurrence, string, error) {
+			return s.ListRecentOccurrences(ctx, "p", "", token, 2)
+		})
+	}},
+	{"update note", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.UpdateNote(ctx, "p", "n1", &pb.Note{ShortDescription: "openssl"}, &fieldmaskpb.FieldMask{Paths: []string{"short_description"}})
+	}},
+	{"list vulnerability notes", func(ctx context.Context, s Store) (interface{}, error) {
+		ns, next, total, err := s.ListNotesWithCount(ctx, "p", `kind="VULNERABILITY"`, "", 10)
+		return []interface{}{ns, next, total}, err
+	}},
+	{"get occurrence note", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.GetOccurrenceNote(ctx, "p", "o4")
+	}},
+	{"get occurrences and notes", func(ctx context.Context, s Store) (interface{}, error) {
+		os, err := s.GetOccurrences(ctx, "p", []string{"o1", "o3", "o9"})
+		if err != nil {
+			return nil, err
+		}
+		ns, err := s.GetNotes(ctx, "p", []string{"n2", "n9"})
+		return []interface{}{os, ns}, err
+	}},
+	{"list note occurrences", func(ctx context.Context, s Store) (interface{}, error) {
+		return allOccurrencePages(func(token string) ([]*pb.Occurrence, string, error) {
+			return s.ListNoteOccurrences(ctx, "p", "n1", "", token, 2)
+		})
+	}},
+	{"summarize vulnerabilities", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.GetVulnerabilityOccurrencesSummary(ctx, "p", "")
+	}},
+	{"get project statistics", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.GetProjectStatistics(ctx, "p")
+	}},
+	{"delete occurrence", func(ctx context.Context, s Store) (interface{}, error) {
+		return nil, s.DeleteOccurrence(ctx, "p", "o3")
+	}},
+	{"delete missing occurrence", func(ctx context.Context, s Store) (interface{}, error) {
+		return nil, s.DeleteOccurrence(ctx, "p", "o3")
+	}},
+	{"delete occurrences", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.DeleteOccurrences(ctx, "p", []string{"o2", "o9"})
+	}},
+	{"delete occurrences of note", func(ctx context.Context, s Store) (interface{}, error) {
+		return s.DeleteOccurrencesByNote(ctx, "p", "n2")
+	}},
+	{"delete note", func(ctx context.Context, s Store) (interface{}, error) {
+		return nil, s.DeleteNote(ctx, "p", "n2")
+	}},
+	{"delete missing note", func(ctx context.Context, s Store) (interface{}, error) {
+		return nil, s.DeleteNote(ctx, "p", "n2")
+	}},
+	{"delete note and occurrences", func(ctx context.Context, s Store) (interface{}, error) {
+		return nil, s.DeleteNoteAndOccurrences(ctx, "p", "n1")
+	}},
+	{"list remaining occurrences", func(ctx context.Context, s Store) (interface{}, error) {
+		os, _, err := s.ListOccurrences(ctx, "other", "", "", 10)
+		return os, err
+	}},
+	{"delete project", func(ctx context.Context, s Store) (interface{}, error) {
+		return nil, s.DeleteProject(ctx, "p")
+	}},
+	{"list projects", func(ctx context.Context, s Store) (interface{}, error) {
+		ps, next, err := s.ListProjects(ctx, "", 10, "")
+		return []interface{}{ps, next}, err
+	}},
+}
+
+func TestFakeStoreMatchesMySQLStore(t *testing.T) {
+	cfg := testConfig(t)
+	clock := &fixedClock{t: time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)}
+	cfg.Clock = clock
+	pg := newTestStore(t, cfg)
+	fake := NewFakeStore(clock)
+	ctx := context.Background()
+
+	for i, step := range fakeStoreScript {
+		clock.t = clock.t.Add(time.Second)
+		want, wantErr := step.run(ctx, pg)
+		got, gotErr := step.run(ctx, fake)
+		if status.Code(gotErr) != status.Code(wantErr) {
+			t.Fatalf("step %d (%s): FakeStore returned %v, MySQLStore %v", i, step.desc, gotErr, wantErr)
+		}
+		if describe(got) != describe(want) {
+			t.Errorf("step %d (%s): FakeStore returned %s, MySQLStore %s", i, step.desc, describe(got), describe(want))
+		}
+	}
+}
+
+func TestFakeStore(t *testing.T) {
+	s := NewFakeStore(nil)
+	ctx := context.Background()
+	if _, err := s.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	if _, err := s.CreateNote(ctx, "p", "n", "u", &pb.Note{}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("second CreateNote() got %v, want AlreadyExists", err)
+	}
+	if _, err := s.GetNote(ctx, "p", "missing"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetNote() of a missing note got %v, want NotFound", err)
+	}
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		uri := fmt.Sprintf("https://gcr.io/p/%d", i%2)
+		o, err := s.CreateOccurrence(ctx, "p", "u", noteOccurrence("projects/p/notes/n", uri, vulnpb.Severity_LOW))
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		if i%2 == 1 {
+			want = append(want, o.Name)
+		}
+	}
+	var got []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("ListOccurrences() did not stop returning page tokens")
+		}
+		os, next, err := s.ListOccurrences(ctx, "p", `resource.uri = "https://gcr.io/p/1"`, token, 1)
+		if err != nil {
+			t.Fatalf("ListOccurrences() failed: %v", err)
+		}
+		for _, o := range os {
+			got = append(got, o.Name)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("ListOccurrences() = %v, want %v", got, want)
+	}
+
+	if _, _, err := s.ListOccurrences(ctx, "p", `resource.uri != "x"`, "", 10); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListOccurrences() with an unsupported filter got %v, want InvalidArgument", err)
+	}
+	if _, _, err := s.ListNotes(ctx, "p", "", "garbage", 10); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListNotes() with an invalid token got %v, want InvalidArgument", err)
+	}
+}
+
+func TestFakeStoreExportImport(t *testing.T) {
+	testExportImport(t, NewFakeStore(nil))
+}
+
+func TestFakeStoreSearchOccurrences(t *testing.T) {
+	testSearchOccurrences(t, NewFakeStore(nil))
+}
+
+func TestFakeStoreDeleteAll(t *testing.T) {
+	testDeleteAll(t, NewFakeStore(nil))
+}
+
+func TestFakeStoreUpdateNoteKeepsCreateTime(t *testing.T) {
+	testUpdateNoteKeepsCreateTime(t, NewFakeStore(nil))
+}
+
+func TestFakeStoreFilterNotesOnOccurrenceColumns(t *testing.T) {
+	testFilterNotesOnOccurrenceColumns(t, NewFakeStore(nil))
+}
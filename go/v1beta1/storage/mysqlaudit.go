@@ -0,0 +1,147 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Entity types of audit events.
+const (
+	AuditProject    = "project"
+	AuditNote       = "note"
+	AuditOccurrence = "occurrence"
+)
+
+// AuditEvent is a change made through the store, as recorded in the audit log when
+// AuditLog is configured.
+type AuditEvent struct {
+	// Operation is the name of the Store method making the change, e.g. "CreateNote".
+	Operation string
+	// EntityType is the type of the changed entity, one of AuditProject, AuditNote and
+	// AuditOccurrence, and EntityID its ID within project ProjectID. Bulk deletes of
+	// occurrences are recorded against the note or project whose occurrences they
+	// delete.
+	EntityType string
+	ProjectID  string
+	EntityID   string
+	// UserID is the user creating the entity, or the user set with WithUser for other
+	// changes; it is empty when unknown.
+	UserID string
+	Time   time.Time
+}
+
+// auditEvent returns the event of operation on the entity of entityType with pID and
+// id, made now by uID.
+func (pg *MySQLStore) auditEvent(operation, entityType, pID, id string, uID sql.NullString) *AuditEvent {
+	return &AuditEvent{Operation: operation, EntityType: entityType, ProjectID: pID, EntityID: id, UserID: uID.String, Time: pg.now()}
+}
+
+// recordAudit writes events to the audit log in tx, if the audit log is enabled.
+// Writing them in the transaction of the change means that they are rolled back with
+// it.
+func (pg *MySQLStore) recordAudit(ctx context.Context, tx execer, events ...*AuditEvent) error {
+	if !pg.auditLog || len(events) == 0 {
+		return nil
+	}
+	rows := make([][]interface{}, 0, len(events))
+	for _, ev := range events {
+		rows = append(rows, []interface{}{ev.Operation, ev.EntityType, ev.ProjectID, ev.EntityID, nullString(ev.UserID), ev.Time.UTC()})
+	}
+	for _, chunk := range insertChunks(rows) {
+		query, args := multiRowInsert(pg.prefixed(mysqlInsertAuditEvents), mysqlInsertAuditEventRow, chunk)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execAudited runs the single statement write query like pg.writer().ExecContext. When
+// the audit log is enabled, it runs it in a transaction that also records ev if the
+// statement changes any rows, so that writes changing nothing, such as deletes of
+// missing rows, are not recorded.
+func (pg *MySQLStore) execAudited(ctx context.Context, ev *AuditEvent, query string, args ...interface{}) (sql.Result, error) {
+	if !pg.auditLog {
+		return pg.writer().ExecContext(ctx, query, args...)
+	}
+	var result sql.Result
+	err := pg.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if result, err = tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+		count, err := result.RowsAffected()
+		if err != nil || count == 0 {
+			return err
+		}
+		return pg.recordAudit(ctx, tx, ev)
+	})
+	return result, err
+}
+
+// ListAuditEvents returns the audit events of project pID, oldest first. Events are
+// only recorded while AuditLog is configured, and only for changes made through the
+// store's methods, not by statements run with WithTx.
+func (pg *MySQLStore) ListAuditEvents(ctx context.Context, pID, pageToken string, pageSize int32) (_ []*AuditEvent, _ string, err error) {
+	defer pg.observe(ctx, "ListAuditEvents", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return nil, "", err
+	}
+	id, err := pg.decodePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	// Fetch one row more than the page to tell whether there is a next page.
+	limit := pg.pageLimit(int(pageSize))
+	rows, err := pg.reader(ctx).QueryContext(ctx, pg.prefixed(mysqlListAuditEvents), pID, id, limit+1)
+	if err != nil {
+		return nil, "", status.Error(codes.Internal, "Failed to list audit events from database")
+	}
+	defer rows.Close()
+	var events []*AuditEvent
+	var lastID int64
+	morePages := false
+	for rows.Next() {
+		if len(events) == limit {
+			morePages = true
+			break
+		}
+		ev := &AuditEvent{ProjectID: pID}
+		var uID sql.NullString
+		if err := rows.Scan(&lastID, &ev.Operation, &ev.EntityType, &ev.EntityID, &uID, &ev.Time); err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to scan audit event row")
+		}
+		ev.UserID = uID.String
+		ev.Time = ev.Time.UTC()
+		events = append(events, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", status.Error(codes.Internal, "Failed to list audit events from database")
+	}
+	if !morePages {
+		return events, "", nil
+	}
+	encryptedPage, err := pg.encodePageToken(lastID)
+	if err != nil {
+		return nil, "", status.Error(codes.Internal, "Failed to paginate audit events")
+	}
+	return events, encryptedPage, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/grafeas/grafeas/go/config"
+)
+
+// Clock tells the store the current time, which it uses for the creation and update
+// times of projects, notes and occurrences. It is set with the Clock field of the
+// config, so that tests can use a fixed time.
+type Clock interface {
+	Now() time.Time
+}
+
+// wallClock is the Clock used when none is configured, which returns the system time.
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+// newClock returns the Clock configured by config, or the wall clock when none is
+// configured.
+func newClock(config *config.MySQLConfig) Clock {
+	if config.Clock == nil {
+		return wallClock{}
+	}
+	return config.Clock
+}
+
+// now returns the current time of the store's Clock, falling back to the wall clock
+// for stores that were not created by NewMySQLStore.
+func (pg *MySQLStore) now() time.Time {
+	if pg.clock == nil {
+		return time.Now()
+	}
+	return pg.clock.Now()
+}
+
+// timestampNow returns the current time of the store's Clock as a Timestamp.
+func (pg *MySQLStore) timestampNow() *tspb.Timestamp {
+	ts, err := ptypes.TimestampProto(pg.now())
+	if err != nil {
+		// Like ptypes.TimestampNow, as only a broken Clock returns such a time.
+		panic("storage: Clock.Now() out of Timestamp range")
+	}
+	return ts
+}
+
+// truncateTimestamp returns ts truncated to the microsecond precision of the
+// DATETIME(6) columns holding timestamps, so that the timestamps of the stored data
+// and of the columns are equal.
+func truncateTimestamp(ts *tspb.Timestamp) *tspb.Timestamp {
+	if ts == nil {
+		return nil
+	}
+	return &tspb.Timestamp{Seconds: ts.Seconds, Nanos: ts.Nanos / 1000 * 1000}
+}
+
+// datetimeValue returns the value of a DATETIME(6) column holding ts, NULL for nil
+// or invalid timestamps.
+func datetimeValue(ts *tspb.Timestamp) interface{} {
+	t, err := ptypes.Timestamp(ts)
+	if err != nil {
+		return nil
+	}
+	return t.UTC().Format(mysqlDatetimeFormat)
+}
+
+// timestampFromColumn returns the timestamp held by a DATETIME(6) column, nil for
+// NULL.
+func timestampFromColumn(t sql.NullTime) *tspb.Timestamp {
+	if !t.Valid {
+		return nil
+	}
+	ts, err := ptypes.TimestampProto(t.Time)
+	if err != nil {
+		return nil
+	}
+	return ts
+}
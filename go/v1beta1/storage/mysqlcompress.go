@@ -0,0 +1,256 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	vulnpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+)
+
+// Formats of the compressed_details column, given by its first byte. Encrypted
+// details hold a fernet token whose plaintext is details in one of the other formats.
+const (
+	detailsJSON   byte = 0
+	detailsGzip   byte = 1
+	detailsFernet byte = 2
+)
+
+// errDocumentTooLarge is returned by marshalStored for notes and occurrences whose JSON
+// is larger than the configured MaxDocumentBytes.
+var errDocumentTooLarge = errors.New("document too large")
+
+// marshalStored encodes a note or occurrence for storage in the data and
+// compressed_details columns. When compression is configured, the details of m, which
+// hold most of its size, are gzip-compressed into compressed_details and left out of
+// data, so they cannot be filtered on; the rest of m stays in data as JSON.
+// When a data key is configured, all of m is encrypted into compressed_details, and
+// data only holds the fields that indexed columns are generated from; see
+// marshalEncrypted. Otherwise, m is stored in data and compressed_details is NULL.
+//
+// It returns errDocumentTooLarge if the JSON of m, before compression, is larger than
+// maxDocumentBytes.
+func (pg *MySQLStore) marshalStored(m proto.Message) (string, []byte, error) {
+	if len(pg.dataKeys) > 0 {
+		return pg.marshalEncrypted(m)
+	}
+	rest, details := splitDetails(m)
+	if !pg.compressDocuments || details == nil {
+		data, err := marshalDocument(m)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(data) > pg.documentLimit() {
+			return "", nil, errDocumentTooLarge
+		}
+		return data, nil, nil
+	}
+	data, err := marshalDocument(rest)
+	if err != nil {
+		return "", nil, err
+	}
+	detailsData, err := marshalDocument(details)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(data)+len(detailsData) > pg.documentLimit() {
+		return "", nil, errDocumentTooLarge
+	}
+	stored, err := pg.encodeDetails(detailsData)
+	if err != nil {
+		return "", nil, err
+	}
+	return data, stored, nil
+}
+
+// marshalEncrypted encodes m for storage with a data key: its JSON without its name
+// and timestamps, compressed when compression is configured, is encrypted into
+// compressed_details, and data holds the JSON of unencryptedFields(m). unmarshalStored
+// merges the decrypted document into the data like details, so the name and
+// timestamps are those of the data, which the upsert of an occurrence keeps.
+func (pg *MySQLStore) marshalEncrypted(m proto.Message) (string, []byte, error) {
+	document, err := marshalDocument(m)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(document) > pg.documentLimit() {
+		return "", nil, errDocumentTooLarge
+	}
+	data, err := marshalDocument(unencryptedFields(m))
+	if err != nil {
+		return "", nil, err
+	}
+	if document, err = marshalDocument(withoutNameAndTimes(m)); err != nil {
+		return "", nil, err
+	}
+	stored, err := pg.encodeDetails(document)
+	if err != nil {
+		return "", nil, err
+	}
+	encrypted, err := pg.encryptDetails(stored)
+	if err != nil {
+		return "", nil, err
+	}
+	return data, encrypted, nil
+}
+
+// encodeDetails returns the compressed_details value holding the JSON detailsData,
+// gzip-compressed when compression is configured.
+func (pg *MySQLStore) encodeDetails(detailsData string) ([]byte, error) {
+	var b bytes.Buffer
+	if !pg.compressDocuments {
+		b.WriteByte(detailsJSON)
+		b.WriteString(detailsData)
+		return b.Bytes(), nil
+	}
+	b.WriteByte(detailsGzip)
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte(detailsData)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// unencryptedFields returns a copy of the note or occurrence m holding only the fields
+// left in data when m is encrypted: its name, kind and timestamps and, for
+// vulnerability notes, the severity, from which the indexed columns of notes are
+// generated.
+func unencryptedFields(m proto.Message) proto.Message {
+	switch m := m.(type) {
+	case *pb.Occurrence:
+		return &pb.Occurrence{Name: m.Name, Kind: m.Kind, CreateTime: m.CreateTime, UpdateTime: m.UpdateTime}
+	case *pb.Note:
+		n := &pb.Note{Name: m.Name, Kind: m.Kind, CreateTime: m.CreateTime, UpdateTime: m.UpdateTime}
+		if v := m.GetVulnerability(); v != nil {
+			n.Type = &pb.Note_Vulnerability{Vulnerability: &vulnpb.Vulnerability{Severity: v.Severity}}
+		}
+		return n
+	}
+	return m
+}
+
+// withoutNameAndTimes returns a copy of the note or occurrence m without its name,
+// creation time and update time.
+func withoutNameAndTimes(m proto.Message) proto.Message {
+	switch m := m.(type) {
+	case *pb.Occurrence:
+		o := proto.Clone(m).(*pb.Occurrence)
+		o.Name, o.CreateTime, o.UpdateTime = "", nil, nil
+		return o
+	case *pb.Note:
+		n := proto.Clone(m).(*pb.Note)
+		n.Name, n.CreateTime, n.UpdateTime = "", nil, nil
+		return n
+	}
+	return m
+}
+
+// documentLimit returns maxDocumentBytes, or the default maximum when it is not set.
+func (pg *MySQLStore) documentLimit() int {
+	if pg.maxDocumentBytes <= 0 {
+		return defaultMaxDocumentBytes
+	}
+	return pg.maxDocumentBytes
+}
+
+// unmarshalStored decodes the data and compressed_details columns into m. Rows written
+// without compression or encryption have NULL compressed_details. The document in
+// compressed_details, the details of m or, for rows written with a data key, all of
+// it, is merged into the data.
+func (pg *MySQLStore) unmarshalStored(data string, compressed []byte, m proto.Message) error {
+	if err := unmarshalDocument(data, m); err != nil {
+		return err
+	}
+	if len(compressed) == 0 {
+		return nil
+	}
+	if compressed[0] == detailsFernet {
+		var err error
+		if compressed, err = pg.decryptDetails(compressed[1:]); err != nil {
+			return err
+		}
+		if len(compressed) == 0 {
+			return errors.New("empty encrypted details")
+		}
+	}
+	var detailsData []byte
+	switch compressed[0] {
+	case detailsJSON:
+		detailsData = compressed[1:]
+	case detailsGzip:
+		r, err := gzip.NewReader(bytes.NewReader(compressed[1:]))
+		if err != nil {
+			return err
+		}
+		if detailsData, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown compressed details format %d", compressed[0])
+	}
+	details := proto.Clone(m)
+	details.Reset()
+	if err := unmarshalDocument(string(detailsData), details); err != nil {
+		return err
+	}
+	proto.Merge(m, details)
+	return nil
+}
+
+// unmarshalOccurrence decodes the occurrence stored in data and compressed into o
+// like unmarshalStored, with the creation and update times of its createTime and
+// updateTime columns, which are the source of truth for them: occurrences written by
+// older versions may lack them in their data.
+func (pg *MySQLStore) unmarshalOccurrence(data string, compressed []byte, createTime, updateTime sql.NullTime, o *pb.Occurrence) error {
+	if err := pg.unmarshalStored(data, compressed, o); err != nil {
+		return err
+	}
+	o.CreateTime = timestampFromColumn(createTime)
+	o.UpdateTime = timestampFromColumn(updateTime)
+	return nil
+}
+
+// splitDetails returns a copy of the note or occurrence m without its details, and a
+// message of the same type holding only the details. It returns a nil details message
+// when m has no details.
+func splitDetails(m proto.Message) (rest, details proto.Message) {
+	switch m := m.(type) {
+	case *pb.Occurrence:
+		if m.Details == nil {
+			return m, nil
+		}
+		r := proto.Clone(m).(*pb.Occurrence)
+		r.Details = nil
+		return r, &pb.Occurrence{Details: m.Details}
+	case *pb.Note:
+		if m.Type == nil {
+			return m, nil
+		}
+		r := proto.Clone(m).(*pb.Note)
+		r.Type = nil
+		return r, &pb.Note{Type: m.Type}
+	}
+	return m, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grafeas/grafeas/go/config"
+)
+
+// validateConfig returns an error naming the first field of config that is missing
+// or invalid, so that a misconfiguration is reported before connecting rather than as
+// a driver error. Unset optional fields are valid; they fall back to their defaults.
+func validateConfig(config *config.MySQLConfig) error {
+	if config.Host == "" {
+		return errors.New("host is required")
+	}
+	if config.DbName == "" {
+		return errors.New("dbname is required")
+	}
+	if err := checkDbName(config.DbName); err != nil {
+		return err
+	}
+	if err := checkPort("port", config.Port); err != nil {
+		return err
+	}
+	if err := checkPort("replicaport", config.ReplicaPort); err != nil {
+		return err
+	}
+	switch config.SSLMode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("invalid sslmode %q; must be one of disable, require, verify-ca, verify-full", config.SSLMode)
+	}
+	if config.MaxOpenConns > 0 && config.MaxIdleConns > config.MaxOpenConns {
+		return fmt.Errorf("invalid maxidleconns %d; must not exceed maxopenconns %d", config.MaxIdleConns, config.MaxOpenConns)
+	}
+	return checkTablePrefix(config.TablePrefix)
+}
+
+// checkPort returns an error if port, the value of the field named field, is not a
+// TCP port. Zero is valid and selects the default port.
+func checkPort(field string, port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid %s %d; must be between 1 and 65535", field, port)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+
+	"github.com/fernet/fernet-go"
+	"github.com/grafeas/grafeas/go/config"
+)
+
+// newDataKeys returns the keys encrypting notes and occurrences, the configured
+// DataKey followed by the SecondaryDataKeys, or no keys when DataKey is not set, in
+// which case notes and occurrences are written unencrypted.
+func newDataKeys(config *config.MySQLConfig) ([]*fernet.Key, error) {
+	if config.DataKey == "" {
+		if len(config.SecondaryDataKeys) > 0 {
+			return nil, errors.New("secondary data keys require a data key")
+		}
+		return nil, nil
+	}
+	var keys []*fernet.Key
+	for _, encoded := range append([]string{config.DataKey}, config.SecondaryDataKeys...) {
+		key, err := fernet.DecodeKey(encoded)
+		if err != nil {
+			return nil, errors.New("invalid data key; must be 32-bit URL-safe base64")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// encryptDetails returns the compressed_details value holding the value stored,
+// encrypted with the primary data key.
+func (pg *MySQLStore) encryptDetails(stored []byte) ([]byte, error) {
+	token, err := fernet.EncryptAndSign(stored, pg.dataKeys[0])
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{detailsFernet}, token...), nil
+}
+
+// decryptDetails returns the compressed_details value encrypted in token by
+// encryptDetails with any of the data keys.
+func (pg *MySQLStore) decryptDetails(token []byte) ([]byte, error) {
+	if len(pg.dataKeys) == 0 {
+		return nil, errors.New("encrypted details but no data key")
+	}
+	// Stored details do not expire, so the age of the token is not checked.
+	stored := fernet.VerifyAndDecrypt(token, -1, pg.dataKeys)
+	if stored == nil {
+		return nil, errors.New("failed to decrypt details")
+	}
+	if len(stored) > 0 && stored[0] == detailsFernet {
+		return nil, errors.New("nested encrypted details")
+	}
+	return stored, nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// importBatchSize is the number of notes and occurrences ImportProject inserts in
+// one transaction.
+const importBatchSize = 500
+
+// exportLine is a line of an export, holding either a note or an occurrence.
+type exportLine struct {
+	Note       json.RawMessage `json:"note,omitempty"`
+	Occurrence json.RawMessage `json:"occurrence,omitempty"`
+}
+
+// exportProject writes the notes of project pID and then its occurrences to w, one
+// JSON object per line of the form {"note": ...} or {"occurrence": ...}. The notes and
+// occurrences are read from s a page at a time.
+func exportProject(ctx context.Context, s Store, pID string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	err := s.IterateNotes(ctx, pID, "", func(n *pb.Note) error {
+		return writeExportLine(bw, "note", n)
+	})
+	if err != nil {
+		return err
+	}
+	err = s.IterateOccurrences(ctx, pID, "", func(o *pb.Occurrence) error {
+		return writeExportLine(bw, "occurrence", o)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeExportLine writes m to w as the line of an export with key.
+func writeExportLine(w io.Writer, key string, m proto.Message) error {
+	data, err := marshalDocument(m)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to marshal %s for export", key)
+	}
+	_, err = fmt.Fprintf(w, "{%q:%s}\n", key, data)
+	return err
+}
+
+// readExport reads the export of exportProject from r, calling fn with each note or
+// occurrence in turn, renamed into project pID. Occurrences of notes of the exported
+// project are made occurrences of the notes of the same ID in pID. It stops at the
+// first error returned by fn and returns it, and returns an InvalidArgument error if
+// r does not hold an export.
+func readExport(r io.Reader, pID string, fn func(*pb.Note, *pb.Occurrence) error) error {
+	d := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var l exportLine
+		err := d.Decode(&l)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "Invalid export at line %d: %v", line, err)
+		}
+		switch {
+		case l.Note != nil && l.Occurrence == nil:
+			var n pb.Note
+			if err := unmarshalDocument(string(l.Note), &n); err != nil {
+				return status.Errorf(codes.InvalidArgument, "Invalid note at line %d of export: %v", line, err)
+			}
+			_, nID, err := name.ParseNote(n.Name)
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, "Invalid note name %q at line %d of export", n.Name, line)
+			}
+			n.Name = name.FormatNote(pID, nID)
+			if err := fn(&n, nil); err != nil {
+				return err
+			}
+		case l.Occurrence != nil && l.Note == nil:
+			var o pb.Occurrence
+			if err := unmarshalDocument(string(l.Occurrence), &o); err != nil {
+				return status.Errorf(codes.InvalidArgument, "Invalid occurrence at line %d of export: %v", line, err)
+			}
+			exported, oID, err := name.ParseOccurrence(o.Name)
+			if err != nil || !validOccurrenceID.MatchString(oID) {
+				return status.Errorf(codes.InvalidArgument, "Invalid occurrence name %q at line %d of export", o.Name, line)
+			}
+			o.Name = name.FormatOccurrence(pID, oID)
+			if nPID, nID, err := name.ParseNote(o.NoteName); err == nil && nPID == exported {
+				o.NoteName = name.FormatNote(pID, nID)
+			}
+			if err := fn(nil, &o); err != nil {
+				return err
+			}
+		default:
+			return status.Errorf(codes.InvalidArgument, "Invalid export at line %d: want a note or an occurrence", line)
+		}
+	}
+}
+
+// ExportProject writes the notes and occurrences of project pID to w, in the format
+// read by ImportProject: one JSON object per line, {"note": ...} for each note and
+// then {"occurrence": ...} for each occurrence. They are read a page at a time, so
+// any number can be exported, but the export is not a consistent snapshot of a
+// project that changes meanwhile.
+func (pg *MySQLStore) ExportProject(ctx context.Context, pID string, w io.Writer) (err error) {
+	defer pg.observe(ctx, "ExportProject", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return err
+	}
+	return exportProject(ctx, pg, pID, w)
+}
+
+// ImportProject creates the notes and occurrences written by ExportProject to r in
+// project pID, keeping their IDs and creation times. Occurrences of notes of the
+// exported project become occurrences of the imported notes. They are inserted in
+// batches of importBatchSize, each in its own transaction, so if the import fails,
+// for instance with an AlreadyExists error because a note or occurrence already
+// exists, the batches inserted before stay.
+func (pg *MySQLStore) ImportProject(ctx context.Context, pID string, r io.Reader) (err error) {
+	defer pg.observe(ctx, "ImportProject", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return err
+	}
+	var notes []*pb.Note
+	var occs []*pb.Occurrence
+	flush := func() error {
+		// Notes are inserted first, so that their occurrences can refer to them.
+		if err := pg.importNotes(ctx, pID, notes); err != nil {
+			return err
+		}
+		if err := pg.importOccurrences(ctx, pID, occs); err != nil {
+			return err
+		}
+		notes, occs = notes[:0], occs[:0]
+		return nil
+	}
+	err = readExport(r, pID, func(n *pb.Note, o *pb.Occurrence) error {
+		if n != nil {
+			notes = append(notes, n)
+		} else {
+			occs = append(occs, o)
+		}
+		if len(notes)+len(occs) < importBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// importNotes inserts notes, named in project pID, in one transaction.
+func (pg *MySQLStore) importNotes(ctx context.Context, pID string, notes []*pb.Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+	uID := userFromContext(ctx)
+	rows := make([][]interface{}, 0, len(notes))
+	events := make([]*AuditEvent, 0, len(notes))
+	for _, n := range notes {
+		_, nID, _ := name.ParseNote(n.Name)
+		if err := checkNoteName(pID, nID); err != nil {
+			return err
+		}
+		if n.CreateTime == nil {
+			n.CreateTime = pg.timestampNow()
+		}
+		note, details, err := pg.marshalStored(n)
+		if err == errDocumentTooLarge {
+			return status.Error(codes.InvalidArgument, "note too large")
+		}
+		if err != nil {
+			return status.Error(codes.Internal, "Failed to marshal Note")
+		}
+		rows = append(rows, []interface{}{pID, nID, note, details, uID})
+		events = append(events, pg.auditEvent("ImportProject", AuditNote, pID, nID, uID))
+	}
+	err := pg.withTx(ctx, func(tx *sql.Tx) error {
+		for _, chunk := range insertChunks(rows) {
+			query, args := multiRowInsert(pg.prefixed(mysqlInsertNotes), mysqlInsertNoteRow, chunk)
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		return pg.recordAudit(ctx, tx, events...)
+	})
+	if isDuplicateEntry(err) {
+		return status.Error(codes.AlreadyExists, "An imported Note already exists")
+	}
+	if err != nil {
+		pg.log().Errorf("Failed to import Notes in database: %v", err)
+		return status.Error(codes.Internal, "Failed to import Notes in database")
+	}
+	return nil
+}
+
+// importOccurrences inserts occs, named in project pID, in one transaction.
+func (pg *MySQLStore) importOccurrences(ctx context.Context, pID string, occs []*pb.Occurrence) error {
+	if len(occs) == 0 {
+		return nil
+	}
+	uID := userFromContext(ctx)
+	rows := make([][]interface{}, 0, len(occs))
+	events := make([]*AuditEvent, 0, len(occs))
+	for _, o := range occs {
+		_, oID, _ := name.ParseOccurrence(o.Name)
+		createTime := o.CreateTime
+		if createTime == nil {
+			createTime = pg.timestampNow()
+		}
+		_, row, err := pg.newOccurrenceRow(ctx, pID, uID.String, oID, o, createTime)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+		events = append(events, pg.auditEvent("ImportProject", AuditOccurrence, pID, oID, uID))
+	}
+	err := pg.withTx(ctx, func(tx *sql.Tx) error {
+		for _, chunk := range insertChunks(rows) {
+			query, args := multiRowInsert(pg.prefixed(mysqlInsertOccurrences), mysqlInsertOccurrenceRow, chunk)
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		return pg.recordAudit(ctx, tx, events...)
+	})
+	if isDuplicateEntry(err) {
+		return status.Error(codes.AlreadyExists, "An imported Occurrence already exists")
+	}
+	if err != nil {
+		pg.log().Errorf("Failed to import Occurrences in database: %v", err)
+		return status.Error(codes.Internal, "Failed to import Occurrences in database")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	fieldmaskpb "google.golang.org/genproto/protobuf/field_mask"
+)
+
+// applyFieldMask copies the fields named in mask from src into dst, which must be
+// messages of the same type. Paths use the proto field names and may descend into
+// nested messages and oneof members, e.g. "vulnerability.short_description".
+func applyFieldMask(dst, src proto.Message, mask *fieldmaskpb.FieldMask) error {
+	dv, sv := reflect.ValueOf(dst), reflect.ValueOf(src)
+	if dv.Type() != sv.Type() {
+		return fmt.Errorf("cannot apply mask from %T to %T", src, dst)
+	}
+	for _, path := range mask.GetPaths() {
+		if err := copyMaskPath(dv.Elem(), sv.Elem(), strings.Split(path, ".")); err != nil {
+			return fmt.Errorf("invalid field mask path %q: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// copyMaskPath copies the field addressed by path from the struct src into dst.
+func copyMaskPath(dst, src reflect.Value, path []string) error {
+	props := proto.GetProperties(dst.Type())
+	fieldName, rest := path[0], path[1:]
+
+	for i, p := range props.Prop {
+		if p.OrigName != fieldName || strings.HasPrefix(dst.Type().Field(i).Name, "XXX_") {
+			continue
+		}
+		if len(rest) == 0 {
+			dst.Field(i).Set(src.Field(i))
+			return nil
+		}
+		df, sf := dst.Field(i), src.Field(i)
+		if df.Kind() != reflect.Ptr || df.Type().Elem().Kind() != reflect.Struct {
+			return fmt.Errorf("%q is not a message field", fieldName)
+		}
+		if df.IsNil() {
+			df.Set(reflect.New(df.Type().Elem()))
+		}
+		if sf.IsNil() {
+			sf = reflect.New(sf.Type().Elem())
+		}
+		return copyMaskPath(df.Elem(), sf.Elem(), rest)
+	}
+
+	oneof, ok := props.OneofTypes[fieldName]
+	if !ok {
+		return fmt.Errorf("unknown field %q", fieldName)
+	}
+	df, sf := dst.Field(oneof.Field), src.Field(oneof.Field)
+	srcSet := !sf.IsNil() && sf.Elem().Type() == oneof.Type
+	if len(rest) == 0 {
+		switch {
+		case srcSet:
+			df.Set(sf)
+		case !df.IsNil() && df.Elem().Type() == oneof.Type:
+			df.Set(reflect.Zero(df.Type()))
+		}
+		return nil
+	}
+	// Descend into the message held by the oneof wrapper, creating it if needed.
+	if df.IsNil() || df.Elem().Type() != oneof.Type {
+		wrapper := reflect.New(oneof.Type.Elem())
+		wrapper.Elem().Field(0).Set(reflect.New(wrapper.Elem().Field(0).Type().Elem()))
+		df.Set(wrapper)
+	}
+	dm := df.Elem().Elem().Field(0)
+	if dm.Kind() != reflect.Ptr || dm.Type().Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%q is not a message field", fieldName)
+	}
+	if dm.IsNil() {
+		dm.Set(reflect.New(dm.Type().Elem()))
+	}
+	sm := reflect.New(dm.Type().Elem())
+	if srcSet && !sf.Elem().Elem().Field(0).IsNil() {
+		sm = sf.Elem().Elem().Field(0)
+	}
+	return copyMaskPath(dm.Elem(), sm.Elem(), rest)
+}
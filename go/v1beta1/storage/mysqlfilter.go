@@ -16,154 +16,748 @@ package storage
 
 import (
 	"fmt"
-	"log"
-	"strings"
 	"regexp"
-	"github.com/grafeas/grafeas/go/filtering/parser"
+	"strings"
+	"time"
+
+	syntax "github.com/grafeas/grafeas/cel"
 	"github.com/grafeas/grafeas/go/filtering/common"
 	"github.com/grafeas/grafeas/go/filtering/operators"
-	syntax "github.com/grafeas/grafeas/cel"
+	"github.com/grafeas/grafeas/go/filtering/parser"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	vulnpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
 )
 
 //	var fs filterSql
-//	fmt.Println("\nsql:", fs.makeSql(expr))
+//	sql, params, err := fs.ParseFilter(filter)
 
 type MysqlFilterSql struct {
 	selects int
+	// mariaDB makes the SQL unquote the JSON strings compared with strings, which
+	// MariaDB compares as JSON text; see flavorMariaDB.
+	mariaDB bool
+	// notes makes the SQL filter the notes table, which lacks the columns of
+	// occurrenceColumns.
+	notes bool
+	// params holds the values of the placeholders in the SQL built so far.
+	params []interface{}
+}
+
+// comparisonOperators maps the filter comparison functions to their SQL operators.
+var comparisonOperators = map[string]string{
+	operators.Equals:        "=",
+	operators.Greater:       ">",
+	operators.GreaterEquals: ">=",
+	operators.Less:          "<",
+	operators.LessEquals:    "<=",
+	operators.NotEquals:     "!=",
+}
+
+func (fs *MysqlFilterSql) sqlFromCall(func_name string, args []*syntax.Expr) (string, error) {
+	if sql_op, ok := comparisonOperators[func_name]; ok {
+		return fs.sqlFromComparison(sql_op, args)
 	}
 
-func (fs *MysqlFilterSql) sqlFromCall(func_name string, args []*syntax.Expr) string {
+	if func_name == operators.In {
+		return fs.sqlFromIn(args)
+	}
+	if func_name == operators.LogicalNot {
+		return fs.sqlFromNot(args)
+	}
+	if func_name == operators.Has {
+		if len(args) != 1 {
+			return "", fmt.Errorf("has() expects 1 field, got %d arguments", len(args))
+		}
+		return sqlFromHas(args[0])
+	}
 
 	var sql_op string
 	switch func_name {
-		case operators.Equals:
-			sql_op = "="
-		case operators.Greater:
-			sql_op = ">"
-		case operators.GreaterEquals:
-			sql_op = ">="
-		case operators.Less:
-			sql_op = "<"
-		case operators.LessEquals:
-			sql_op = "<="
-		case operators.NotEquals:
-			sql_op = "!="
-		case operators.LogicalAnd:
-			sql_op = "AND"
-		case operators.LogicalOr:
-			sql_op = "OR"
-        case operators.Index:
-			sql_op = "["
-		default:
-			sql_op = ""
+	case operators.LogicalAnd:
+		sql_op = "AND"
+	case operators.LogicalOr:
+		sql_op = "OR"
+	default:
+		return "", fmt.Errorf("unsupported operator %q", func_name)
+	}
+	if len(args) != 2 {
+		return "", fmt.Errorf("operator %s expects 2 operands, got %d", sql_op, len(args))
 	}
 	var arg_names []string
 	for _, arg := range args {
-		arg_names = append(arg_names, fs.makeSql(arg))
+		arg_name, err := fs.makeSql(arg)
+		if err != nil {
+			return "", err
+		}
+		arg_names = append(arg_names, arg_name)
+	}
+	return fmt.Sprintf("(%s %s %s)", arg_names[0], sql_op, arg_names[1]), nil
+}
+
+// sqlFromIndex translates an element of a list field, written field[0] in filters,
+// into the path of the element in the data. Only constant indexes are supported, as
+// the path cannot hold placeholders.
+func (fs *MysqlFilterSql) sqlFromIndex(args []*syntax.Expr) (string, error) {
+	if len(args) != 2 || !isFieldExpr(args[0]) {
+		return "", fmt.Errorf("only fields can be indexed")
+	}
+	index, ok := args[1].GetConstExpr().GetConstantKind().(*syntax.Constant_Int64Value)
+	if !ok || index.Int64Value < 0 {
+		return "", fmt.Errorf("index of a field must be a non-negative integer")
+	}
+	fs.selects++
+	operand, err := fs.makeSql(args[0])
+	fs.selects--
+	if err != nil {
+		return "", err
 	}
-	if sql_op == "[" {
-		return fmt.Sprintf("%s[%s]", arg_names[0], arg_names[1])
-	} else if sql_op != "" {
-		return fmt.Sprintf("(%s %s %s)", arg_names[0], sql_op, arg_names[1])
-	} else {
-		return fmt.Sprintf("%s(%s)", func_name, strings.Join(arg_names, ", "))
+	path := fmt.Sprintf("%s[%d]", operand, index.Int64Value)
+	if fs.selects == 0 {
+		return jsonExtract(path), nil
 	}
+	return path, nil
 }
 
-func (fs *MysqlFilterSql) sqlFromSelect(select_node syntax.Expr_Select) string {
-	operand := fs.makeSql(select_node.GetOperand())
-	field := select_node.GetField()
-	return fmt.Sprintf("%s.%s", operand, field)
+// indexedColumns maps the fields that can be filtered on that are copied from the
+// data into columns of their own to those columns.
+var indexedColumns = map[string]string{
+	"kind": "kind",
+}
+
+// occurrenceColumns maps the fields that can be filtered on that are copied from the
+// data of occurrences into columns of their own, which notes do not have, to those
+// columns.
+var occurrenceColumns = map[string]string{
+	"resource_url": "resource_url",
+	"resourceUrl":  "resource_url",
+}
+
+// indexedColumn returns the column holding the field name when it is copied from the
+// data into a column of its own. It returns an error for fields only occurrences
+// have a column for when fs filters notes.
+func (fs *MysqlFilterSql) indexedColumn(name string) (string, bool, error) {
+	if column, ok := occurrenceColumns[name]; ok {
+		if fs.notes {
+			return "", false, fmt.Errorf("%s can only be filtered on for occurrences", name)
+		}
+		return column, true, nil
+	}
+	column, ok := indexedColumns[name]
+	return column, ok, nil
+}
+
+// timestampColumns maps the timestamp fields that can be filtered on to the indexed
+// columns holding them.
+var timestampColumns = map[string]string{
+	"create_time": "create_time",
+	"createTime":  "create_time",
+	"update_time": "update_time",
+	"updateTime":  "update_time",
+}
+
+// scoreFields maps the CVSS score fields that can be filtered on, under their proto
+// and JSON names, to their path in the data.
+var scoreFields = map[string]string{
+	"vulnerability.cvss_score": "vulnerability.cvss_score",
+	"vulnerability.cvssScore":  "vulnerability.cvss_score",
+}
+
+// severityFields are the names of the vulnerability severity field, which is
+// compared on the indexed severity column.
+var severityFields = map[string]bool{
+	"vulnerability.severity": true,
+}
+
+// sqlFromComparison translates a comparison between a field and a constant. When an
+// ordering comparison is against a number, the field is cast to a number so that it is
+// not compared as a JSON value of another type. On MariaDB, a field compared with a
+// string is unquoted, as MySQL does implicitly. Timestamp and severity fields are
+// compared on their indexed columns, and CVSS scores as numbers with one decimal, which never match
+// occurrences without a score.
+func (fs *MysqlFilterSql) sqlFromComparison(sql_op string, args []*syntax.Expr) (string, error) {
+	if len(args) != 2 {
+		return "", fmt.Errorf("comparison %s expects 2 operands, got %d", sql_op, len(args))
+	}
+	if !(isFieldExpr(args[0]) && args[1].GetConstExpr() != nil) && !(args[0].GetConstExpr() != nil && isFieldExpr(args[1])) {
+		return "", fmt.Errorf("comparison %s must be between a field and a value", sql_op)
+	}
+	var arg_names []string
+	for i, arg := range args {
+		if column, ok := timestampColumn(arg); ok {
+			arg_names = append(arg_names, column)
+			continue
+		}
+		if column, ok := timestampColumn(args[1-i]); ok {
+			value, err := fs.timestampValue(column, arg)
+			if err != nil {
+				return "", err
+			}
+			arg_names = append(arg_names, value)
+			continue
+		}
+		if isSeverityField(arg) {
+			arg_names = append(arg_names, "severity")
+			continue
+		}
+		if isSeverityField(args[1-i]) {
+			value, err := fs.severityValue(arg)
+			if err != nil {
+				return "", err
+			}
+			arg_names = append(arg_names, value)
+			continue
+		}
+		if isKindField(args[1-i]) {
+			value, err := fs.kindValue(arg)
+			if err != nil {
+				return "", err
+			}
+			arg_names = append(arg_names, value)
+			continue
+		}
+		if path, ok := scoreField(arg); ok {
+			if !isNumericComparison(args) {
+				return "", fmt.Errorf("%s must be compared with a number", path)
+			}
+			arg_names = append(arg_names, fmt.Sprintf("CAST(%s AS DECIMAL(4,1))", jsonExtract(path)))
+			continue
+		}
+		arg_name, err := fs.makeSql(arg)
+		if err != nil {
+			return "", err
+		}
+		if sql_op != "=" && sql_op != "!=" && isFieldExpr(arg) && isNumericComparison(args) {
+			arg_name = fmt.Sprintf("CAST(%s AS DECIMAL(65,30))", arg_name)
+		} else if fs.mariaDB && strings.HasPrefix(arg_name, "JSON_EXTRACT(") && isStringComparison(args) {
+			arg_name = fmt.Sprintf("JSON_UNQUOTE(%s)", arg_name)
+		}
+		arg_names = append(arg_names, arg_name)
+	}
+	return fmt.Sprintf("(%s %s %s)", arg_names[0], sql_op, arg_names[1]), nil
+}
+
+// sqlFromIn translates a test of a field against a list of constants, written
+// field IN ("a", "b") in filters. JSON_UNQUOTE is applied to the field because MySQL
+// compares a JSON value against an IN list as its JSON text, quotes included.
+func (fs *MysqlFilterSql) sqlFromIn(args []*syntax.Expr) (string, error) {
+	if len(args) != 2 || !isFieldExpr(args[0]) || args[1].GetListExpr() == nil {
+		return "", fmt.Errorf("IN must test a field against a list of values")
+	}
+	elements := args[1].GetListExpr().GetElements()
+	if len(elements) == 0 {
+		return "", fmt.Errorf("IN requires at least one value")
+	}
+	column, isTimestamp := timestampColumn(args[0])
+	isSeverity := isSeverityField(args[0])
+	if isSeverity {
+		column = "severity"
+	} else if !isTimestamp {
+		field, err := fs.makeSql(args[0])
+		if err != nil {
+			return "", err
+		}
+		column = field
+		if _, ok, _ := fs.indexedColumn(args[0].GetIdentExpr().GetName()); !ok {
+			column = fmt.Sprintf("JSON_UNQUOTE(%s)", field)
+		}
+	}
+	isKind := isKindField(args[0])
+	placeholders := make([]string, len(elements))
+	for i, element := range elements {
+		c := element.GetConstExpr()
+		if c == nil {
+			return "", fmt.Errorf("IN values must be constants")
+		}
+		var err error
+		switch {
+		case isTimestamp:
+			placeholders[i], err = fs.timestampValue(column, element)
+		case isSeverity:
+			placeholders[i], err = fs.severityValue(element)
+		case isKind:
+			placeholders[i], err = fs.kindValue(element)
+		default:
+			placeholders[i], err = fs.getConstantValue(*c)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("(%s IN (%s))", column, strings.Join(placeholders, ", ")), nil
+}
+
+// sqlFromNot translates a negated condition, written NOT cond or -cond in filters.
+// A negated equality becomes an inequality; other conditions are wrapped in NOT.
+func (fs *MysqlFilterSql) sqlFromNot(args []*syntax.Expr) (string, error) {
+	if len(args) != 1 || isFieldExpr(args[0]) || args[0].GetConstExpr() != nil || args[0].GetListExpr() != nil {
+		return "", fmt.Errorf("NOT must be applied to a condition")
+	}
+	if call := args[0].GetCallExpr(); call.GetFunction() == operators.Equals {
+		return fs.sqlFromComparison(comparisonOperators[operators.NotEquals], call.GetArgs())
+	}
+	condition, err := fs.makeSql(args[0])
+	if err != nil {
+		return "", err
+	}
+	return "(NOT " + condition + ")", nil
+}
+
+// fieldNamePattern matches the names of the fields of a path tested by has().
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqlFromHas translates a test of the presence of a field in the data JSON column,
+// written has(vulnerability.cvss_v3) in filters.
+func sqlFromHas(node *syntax.Expr) (string, error) {
+	path, err := fieldPath(node)
+	if err != nil {
+		return "", fmt.Errorf("has() must be applied to a field: %v", err)
+	}
+	return "JSON_CONTAINS_PATH(data, 'one', '$." + path + "')", nil
+}
+
+// fieldPath returns the dotted path of the field node refers to, e.g.
+// vulnerability.severity.
+func fieldPath(node *syntax.Expr) (string, error) {
+	var prefix, name string
+	switch node.GetExprKind().(type) {
+	case *syntax.Expr_IdentExpr:
+		name = node.GetIdentExpr().GetName()
+	case *syntax.Expr_SelectExpr:
+		operand, err := fieldPath(node.GetSelectExpr().GetOperand())
+		if err != nil {
+			return "", err
+		}
+		prefix = operand + "."
+		name = node.GetSelectExpr().GetField()
+	default:
+		return "", fmt.Errorf("unsupported path %v", node)
+	}
+	if !fieldNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid field name %q", name)
+	}
+	return prefix + name, nil
+}
+
+// isSeverityField reports whether node refers to the vulnerability severity.
+func isSeverityField(node *syntax.Expr) bool {
+	path, err := fieldPath(node)
+	return err == nil && severityFields[path]
+}
+
+// severityValue returns the placeholder for the severity node is compared with,
+// either the name of a Severity, e.g. "CRITICAL", or its number.
+func (fs *MysqlFilterSql) severityValue(node *syntax.Expr) (string, error) {
+	switch c := node.GetConstExpr().GetConstantKind().(type) {
+	case *syntax.Constant_StringValue:
+		severity, ok := vulnpb.Severity_value[c.StringValue]
+		if !ok {
+			return "", fmt.Errorf("unknown severity %q", c.StringValue)
+		}
+		fs.params = append(fs.params, int64(severity))
+	case *syntax.Constant_Int64Value:
+		fs.params = append(fs.params, c.Int64Value)
+	default:
+		return "", fmt.Errorf("severity must be compared with a severity name")
+	}
+	return "?", nil
+}
+
+// scoreField returns the path in the data of the CVSS score field node refers to.
+func scoreField(node *syntax.Expr) (string, bool) {
+	path, err := fieldPath(node)
+	if err != nil {
+		return "", false
+	}
+	path, ok := scoreFields[path]
+	return path, ok
+}
+
+// timestampColumn returns the column holding the timestamp field node refers to.
+func timestampColumn(node *syntax.Expr) (string, bool) {
+	column, ok := timestampColumns[node.GetIdentExpr().GetName()]
+	return column, ok
+}
+
+// timestampValue returns the placeholder for the DATETIME value of the RFC3339
+// timestamp node is compared with on column.
+func (fs *MysqlFilterSql) timestampValue(column string, node *syntax.Expr) (string, error) {
+	value, ok := node.GetConstExpr().GetConstantKind().(*syntax.Constant_StringValue)
+	if !ok {
+		return "", fmt.Errorf("%s must be compared with an RFC3339 timestamp string", column)
+	}
+	t, err := time.Parse(time.RFC3339Nano, value.StringValue)
+	if err != nil {
+		return "", fmt.Errorf("%s must be compared with an RFC3339 timestamp: %v", column, err)
+	}
+	fs.params = append(fs.params, t.UTC().Format(mysqlDatetimeFormat))
+	return "?", nil
+}
+
+// isFieldExpr reports whether node refers to a field of the stored JSON data.
+func isFieldExpr(node *syntax.Expr) bool {
+	switch node.GetExprKind().(type) {
+	case *syntax.Expr_IdentExpr, *syntax.Expr_SelectExpr:
+		return true
+	case *syntax.Expr_CallExpr:
+		return node.GetCallExpr().Function == operators.Index
+	}
+	return false
+}
+
+// isNumericComparison reports whether one of the compared operands is a number.
+func isNumericComparison(args []*syntax.Expr) bool {
+	for _, arg := range args {
+		switch arg.GetConstExpr().GetConstantKind().(type) {
+		case *syntax.Constant_Int64Value, *syntax.Constant_Uint64Value, *syntax.Constant_DoubleValue:
+			return true
+		}
+	}
+	return false
+}
+
+// isStringComparison reports whether one of the compared operands is a string.
+func isStringComparison(args []*syntax.Expr) bool {
+	for _, arg := range args {
+		if _, ok := arg.GetConstExpr().GetConstantKind().(*syntax.Constant_StringValue); ok {
+			return true
+		}
+	}
+	return false
 }
 
-func (fs *MysqlFilterSql) getConstantValue(const_expr syntax.Constant) string {
+func (fs *MysqlFilterSql) sqlFromSelect(select_node syntax.Expr_Select) (string, error) {
+	operand, err := fs.makeSql(select_node.GetOperand())
+	if err != nil {
+		return "", err
+	}
+	field := select_node.GetField()
+	return fmt.Sprintf("%s.%s", operand, field), nil
+}
 
+// getConstantValue returns a placeholder for const_expr and adds its value to the
+// params, so that values from the filter are never interpreted as SQL.
+func (fs *MysqlFilterSql) getConstantValue(const_expr syntax.Constant) (string, error) {
+	var value interface{}
 	switch const_expr.GetConstantKind().(type) {
-		case *syntax.Constant_Int64Value:
-			return fmt.Sprintf("%d", const_expr.GetInt64Value())
-		case *syntax.Constant_Uint64Value:
-			return fmt.Sprintf("%d", const_expr.GetUint64Value())
-		case *syntax.Constant_DoubleValue:
-			return fmt.Sprintf("%d", const_expr.GetDoubleValue())
-		case *syntax.Constant_StringValue:
-			return fmt.Sprintf("\"%s\"",const_expr.GetStringValue())
+	case *syntax.Constant_Int64Value:
+		value = const_expr.GetInt64Value()
+	case *syntax.Constant_Uint64Value:
+		value = const_expr.GetUint64Value()
+	case *syntax.Constant_DoubleValue:
+		value = const_expr.GetDoubleValue()
+	case *syntax.Constant_StringValue:
+		value = const_expr.GetStringValue()
+	default:
+		return "", fmt.Errorf("unsupported constant %v", const_expr)
 	}
-	return "NO CONST"
+	fs.params = append(fs.params, value)
+	return "?", nil
 }
 
-func (fs *MysqlFilterSql) makeSql (node *syntax.Expr) string  {
-	//log.Println("depth: ", fs.depth, "node:", node)
+func (fs *MysqlFilterSql) makeSql(node *syntax.Expr) (string, error) {
 	switch node.GetExprKind().(type) {
-		case *syntax.Expr_CallExpr:
-			func_node := *node.GetCallExpr()
-			return fs.sqlFromCall(func_node.Function, func_node.Args)
-		case *syntax.Expr_SelectExpr:
-			select_node := *node.GetSelectExpr()
-			fs.selects++
-			ret_str := fs.sqlFromSelect(select_node)
-			fs.selects--
-			if fs.selects == 0 {
-				return "data->'$." + ret_str + "'"
-			}  else {
-				return ret_str
-			}
-		case *syntax.Expr_IdentExpr:
-			i_expr := *node.GetIdentExpr()
-			// I'm not entirely sure this is the right thing here. 
-			// We'll see though.
-			if fs.selects > 0 {
-				return i_expr.Name 
-			} else {
-				return "data->'$." + i_expr.Name + "'"
-			}
-		case *syntax.Expr_ConstExpr:
-			c_expr := *node.GetConstExpr()
-			return fs.getConstantValue(c_expr)
-	}
-
-	return "NO SQL"
-
-}
-
-func (fs *MysqlFilterSql) ParseFilter (filter string) string  {
-
-	log.Println(filter)
-	// replace string value for kind with integer
-	kindPattern := `kind=".*?"`
-	re := regexp.MustCompile(kindPattern)
-	indices := re.FindStringIndex(filter)
-	if indices != nil {
-		int_val := 0
-		switch(filter[indices[0]+6 : indices[1]-1]) {
-		case "VULNERABILITY":
-			int_val = 1
-		case "BUILD":
-			int_val = 2
-		case "IMAGE":
-			int_val = 3
-		case "PACKAGE":
-			int_val = 4
-		case "DEPLOYMENT":
-			int_val = 5
-		case "DISCOVERY":
-			int_val = 6
-		case "ATTESTATION":
-			int_val = 7
-		case "INTOTO":
-			int_val = 8
-		}
-		filter = filter[:indices[0]+5] + fmt.Sprintf("%d", int_val) + filter[indices[1]:]
-		// log.Println(filter)
-	}
-    s := common.NewStringSource(filter, "urlParam")  // function
-    result, err := parser.Parse(s)
+	case *syntax.Expr_CallExpr:
+		func_node := *node.GetCallExpr()
+		if func_node.Function == operators.Index {
+			return fs.sqlFromIndex(func_node.Args)
+		}
+		return fs.sqlFromCall(func_node.Function, func_node.Args)
+	case *syntax.Expr_SelectExpr:
+		select_node := *node.GetSelectExpr()
+		// The has() macro is expanded to a select testing for the field.
+		if select_node.TestOnly {
+			return sqlFromHas(node)
+		}
+		fs.selects++
+		ret_str, err := fs.sqlFromSelect(select_node)
+		fs.selects--
+		if err != nil {
+			return "", err
+		}
+		if fs.selects == 0 {
+			return jsonExtract(ret_str), nil
+		}
+		return ret_str, nil
+	case *syntax.Expr_IdentExpr:
+		i_expr := *node.GetIdentExpr()
+		// Identifiers inside a select are path components of the enclosing field.
+		if fs.selects > 0 {
+			return i_expr.Name, nil
+		}
+		column, ok, err := fs.indexedColumn(i_expr.Name)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return column, nil
+		}
+		return jsonExtract(i_expr.Name), nil
+	case *syntax.Expr_ConstExpr:
+		c_expr := *node.GetConstExpr()
+		return fs.getConstantValue(c_expr)
+	}
+	return "", fmt.Errorf("unsupported expression %v", node)
+}
+
+// jsonExtract returns the SQL extracting the field at path from the data JSON column.
+func jsonExtract(path string) string {
+	return "JSON_EXTRACT(data, '$." + path + "')"
+}
+
+// isKindField reports whether node refers to the kind, which is compared on the
+// indexed kind column. The kind fields of nested messages are not.
+func isKindField(node *syntax.Expr) bool {
+	return node.GetIdentExpr().GetName() == "kind"
+}
+
+// noteKindValue returns the number of the NoteKind named kind, e.g. "BUILD", which is
+// how kinds are stored, or false if there is no such kind.
+func noteKindValue(kind string) (int64, bool) {
+	value, ok := cpb.NoteKind_value[kind]
+	return int64(value), ok
+}
+
+// kindValue returns the placeholder for the kind node is compared with, either the
+// name of a NoteKind, e.g. "BUILD", or its number.
+func (fs *MysqlFilterSql) kindValue(node *syntax.Expr) (string, error) {
+	switch c := node.GetConstExpr().GetConstantKind().(type) {
+	case *syntax.Constant_StringValue:
+		kind, ok := noteKindValue(c.StringValue)
+		if !ok {
+			return "", fmt.Errorf("unknown kind %q", c.StringValue)
+		}
+		fs.params = append(fs.params, kind)
+	case *syntax.Constant_Int64Value:
+		fs.params = append(fs.params, c.Int64Value)
+	default:
+		return "", fmt.Errorf("kind must be compared with a kind name")
+	}
+	return "?", nil
+}
+
+// rewriteInLists rewrites the IN (...) value lists of filter, which the parser does not
+// accept, as the equivalent list literals "in [...]". Quoted strings are left alone.
+func rewriteInLists(filter string) (string, error) {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(filter); i++ {
+		c := filter[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(filter) {
+				b.WriteByte(c)
+				i++
+				c = filter[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.HasPrefix(filter[i:], "IN") && isWordBoundary(filter, i, i+2):
+			rest := strings.TrimLeft(filter[i+2:], " \t\n")
+			if !strings.HasPrefix(rest, "(") {
+				break
+			}
+			start := len(filter) - len(rest) + 1
+			end, err := closingParen(filter, start)
+			if err != nil {
+				return "", err
+			}
+			if strings.TrimSpace(filter[start:end]) == "" {
+				return "", fmt.Errorf("IN requires at least one value")
+			}
+			b.WriteString("in [" + filter[start:end] + "]")
+			i = end
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// rewriteNegations rewrites the negations of filter, written NOT cond or -cond, which
+// the parser does not accept, as !(cond). The negated condition extends to the next
+// AND or OR, or to the end of its group, so NOT binds tighter than AND and OR.
+// Quoted strings are left alone, as is the minus sign of negative numbers.
+func rewriteNegations(filter string) (string, error) {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(filter); i++ {
+		c := filter[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && i+1 < len(filter) {
+				b.WriteByte(c)
+				i++
+				c = filter[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case keywordAt(filter, i, "NOT"), c == '-' && startsCondition(filter[:i]):
+			start := i + 1
+			if c == 'N' {
+				start = i + 3
+			}
+			end := conditionEnd(filter, start)
+			condition := strings.TrimSpace(filter[start:end])
+			if condition == "" || keywordAt(condition, 0, "AND") || keywordAt(condition, 0, "OR") {
+				return "", fmt.Errorf("negation at position %d must be followed by a condition", i)
+			}
+			negated, err := rewriteNegations(condition)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString("!(" + negated + ")")
+			// Continue after the condition, keeping the spaces that follow it.
+			i = start + len(strings.TrimRight(filter[start:end], " \t\n")) - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// startsCondition reports whether a condition may start after prefix, the part of
+// a filter before a minus sign, so that the sign is a negation and not part of a
+// negative number.
+func startsCondition(prefix string) bool {
+	prefix = strings.TrimRight(prefix, " \t\n")
+	if prefix == "" || strings.HasSuffix(prefix, "(") || strings.HasSuffix(prefix, "-") {
+		return true
+	}
+	for _, keyword := range []string{"AND", "OR", "NOT"} {
+		if keywordAt(prefix, len(prefix)-len(keyword), keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionEnd returns the index of filter ending the condition starting at start:
+// the next AND or OR outside parentheses, the parenthesis closing the enclosing
+// group, or the end of filter. Quoted strings are skipped.
+func conditionEnd(filter string, start int) int {
+	depth := 0
+	var quote byte
+	for i := start; i < len(filter); i++ {
+		c := filter[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case depth == 0 && (keywordAt(filter, i, "AND") || keywordAt(filter, i, "OR")):
+			return i
+		}
+	}
+	return len(filter)
+}
+
+// keywordAt reports whether keyword is the whole word at filter[i:].
+func keywordAt(filter string, i int, keyword string) bool {
+	return i >= 0 && strings.HasPrefix(filter[i:], keyword) && isWordBoundary(filter, i, i+len(keyword))
+}
+
+// isWordBoundary reports whether filter[start:end] is not part of a longer identifier.
+func isWordBoundary(filter string, start, end int) bool {
+	isIdent := func(c byte) bool {
+		return c == '_' || c == '.' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+	}
+	return (start == 0 || !isIdent(filter[start-1])) && (end == len(filter) || !isIdent(filter[end]))
+}
+
+// closingParen returns the index of the parenthesis closing the list starting at
+// filter[start], skipping quoted strings.
+func closingParen(filter string, start int) (int, error) {
+	var quote byte
+	for i := start; i < len(filter); i++ {
+		c := filter[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			return 0, fmt.Errorf("IN values must be constants")
+		case c == ')':
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated IN list")
+}
+
+// checkParentheses returns an error naming the position of the first parenthesis of
+// filter that is not balanced, skipping quoted strings.
+func checkParentheses(filter string) error {
+	var open []int
+	var quote byte
+	for i := 0; i < len(filter); i++ {
+		c := filter[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			open = append(open, i)
+		case c == ')':
+			if len(open) == 0 {
+				return fmt.Errorf("unbalanced ')' at position %d", i)
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("unbalanced '(' at position %d", open[len(open)-1])
+	}
+	return nil
+}
+
+// ParseFilter translates filter into a SQL condition on the data JSON column and the
+// values of its placeholders, or returns an error if the filter is malformed or uses
+// unsupported operators.
+func (fs *MysqlFilterSql) ParseFilter(filter string) (string, []interface{}, error) {
+	if err := checkParentheses(filter); err != nil {
+		return "", nil, fmt.Errorf("syntax error: %v", err)
+	}
+	filter, err := rewriteNegations(filter)
 	if err != nil {
-		log.Println(err)
-		return ""
-	}
-	// log.Println(result.Expr.GetCallExpr().Args[1].GetCallExpr().Args[0].GetIdentExpr().Name)
-	// log.Println(result.Expr)
-	sql := fs.makeSql(result.Expr)
-	//log.Println(sql)
-	return sql
+		return "", nil, fmt.Errorf("syntax error: %v", err)
+	}
+	filter, err = rewriteInLists(filter)
+	if err != nil {
+		return "", nil, fmt.Errorf("syntax error: %v", err)
+	}
+	s := common.NewStringSource(filter, "urlParam") // function
+	result, errs := parser.Parse(s)
+	if errs != nil {
+		return "", nil, fmt.Errorf("syntax error: %v", errs)
+	}
+	fs.params = nil
+	sql, err := fs.makeSql(result.Expr)
+	if err != nil {
+		return "", nil, err
+	}
+	return sql, fs.params, nil
 }
@@ -1,8 +1,8 @@
 package storage_test
 
 import (
+	"reflect"
 	"testing"
-	"fmt"
 
 	"github.com/grafeas/grafeas/go/v1beta1/storage"
 )
@@ -11,11 +11,480 @@ var myFilter storage.MysqlFilterSql
 
 func TestParseFilter(t *testing.T) {
 	filter := `note_name="test_note_1"`
-	actual := myFilter.ParseFilter(filter)
-	expected := `(data->'$.note_name' = "test_note_1")`
-	fmt.Println(actual)	
+	actual, params, err := myFilter.ParseFilter(filter)
+	if err != nil {
+		t.Fatalf("ParseFilter(%q) failed: %v", filter, err)
+	}
+	expected := `(JSON_EXTRACT(data, '$.note_name') = ?)`
 	if actual != expected {
-		t.Errorf("Expecting: " + expected + "\nGet: " + actual)
+		t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", filter, expected, actual)
+	}
+	if !reflect.DeepEqual(params, []interface{}{"test_note_1"}) {
+		t.Errorf("ParseFilter(%q) params = %v, want [test_note_1]", filter, params)
+	}
+}
+
+func TestParseFilterNestedPaths(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`resource.uri="https://gcr.io/p/a"`, `(JSON_EXTRACT(data, '$.resource.uri') = ?)`, []interface{}{"https://gcr.io/p/a"}},
+		{`vulnerability.cvss_version=3`, `(JSON_EXTRACT(data, '$.vulnerability.cvss_version') = ?)`, []interface{}{int64(3)}},
+		{`vulnerability.package_issue.fixed_location.package="openssl"`,
+			`(JSON_EXTRACT(data, '$.vulnerability.package_issue.fixed_location.package') = ?)`, []interface{}{"openssl"}},
+		{`vulnerability.package_issue[0].affected_package="openssl"`,
+			`(JSON_EXTRACT(data, '$.vulnerability.package_issue[0].affected_package') = ?)`, []interface{}{"openssl"}},
+		{`tags[1]="latest"`, `(JSON_EXTRACT(data, '$.tags[1]') = ?)`, []interface{}{"latest"}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterOr(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`kind="VULNERABILITY" OR kind="BUILD"`,
+			`((kind = ?) OR (kind = ?))`,
+			[]interface{}{int64(1), int64(2)}},
+		{`note_name="a" AND kind="BUILD" OR kind="VULNERABILITY"`,
+			`(((JSON_EXTRACT(data, '$.note_name') = ?) AND (kind = ?)) OR (kind = ?))`,
+			[]interface{}{"a", int64(2), int64(1)}},
+		{`kind="VULNERABILITY" OR note_name="a" AND kind="BUILD"`,
+			`((kind = ?) OR ((JSON_EXTRACT(data, '$.note_name') = ?) AND (kind = ?)))`,
+			[]interface{}{int64(1), "a", int64(2)}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterComparisons(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`vulnerability.cvss_score >= 7.5`, `(CAST(JSON_EXTRACT(data, '$.vulnerability.cvss_score') AS DECIMAL(4,1)) >= ?)`, []interface{}{7.5}},
+		{`vulnerability.cvss_score > 7`, `(CAST(JSON_EXTRACT(data, '$.vulnerability.cvss_score') AS DECIMAL(4,1)) > ?)`, []interface{}{int64(7)}},
+		{`vulnerability.cvss_score <= 4`, `(CAST(JSON_EXTRACT(data, '$.vulnerability.cvss_score') AS DECIMAL(4,1)) <= ?)`, []interface{}{int64(4)}},
+		{`vulnerability.cvss_score < 4.5`, `(CAST(JSON_EXTRACT(data, '$.vulnerability.cvss_score') AS DECIMAL(4,1)) < ?)`, []interface{}{4.5}},
+		{`vulnerability.cvssScore >= 7 AND vulnerability.cvssScore < 9`,
+			`((CAST(JSON_EXTRACT(data, '$.vulnerability.cvss_score') AS DECIMAL(4,1)) >= ?) AND (CAST(JSON_EXTRACT(data, '$.vulnerability.cvss_score') AS DECIMAL(4,1)) < ?))`,
+			[]interface{}{int64(7), int64(9)}},
+		{`vulnerability.cvssScore = 9.8`, `(CAST(JSON_EXTRACT(data, '$.vulnerability.cvss_score') AS DECIMAL(4,1)) = ?)`, []interface{}{9.8}},
+		{`resource.size > 1000`, `(CAST(JSON_EXTRACT(data, '$.resource.size') AS DECIMAL(65,30)) > ?)`, []interface{}{int64(1000)}},
+		{`note_name != "a"`, `(JSON_EXTRACT(data, '$.note_name') != ?)`, []interface{}{"a"}},
+		{`note_name > "a"`, `(JSON_EXTRACT(data, '$.note_name') > ?)`, []interface{}{"a"}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterMalformedComparisons(t *testing.T) {
+	for _, filter := range []string{
+		`1 < 2`,
+		`note_name = kind`,
+		`(note_name = "a") > 1`,
+		`vulnerability.cvss_score >= "high"`,
+	} {
+		if actual, _, err := myFilter.ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q) = %q, want error", filter, actual)
+		}
+	}
+}
+
+func TestParseFilterTimestamps(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`createTime > "2024-01-01T00:00:00Z"`, `(create_time > ?)`, []interface{}{"2024-01-01 00:00:00.000000"}},
+		{`create_time <= "2024-01-01T12:30:00.5+02:00"`, `(create_time <= ?)`, []interface{}{"2024-01-01 10:30:00.500000"}},
+		{`"2024-01-01T00:00:00Z" < updateTime`, `(? < update_time)`, []interface{}{"2024-01-01 00:00:00.000000"}},
+		{`createTime >= "2024-01-01T00:00:00Z" AND createTime < "2024-02-01T00:00:00Z"`,
+			`((create_time >= ?) AND (create_time < ?))`,
+			[]interface{}{"2024-01-01 00:00:00.000000", "2024-02-01 00:00:00.000000"}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterInvalidTimestamps(t *testing.T) {
+	for _, filter := range []string{
+		`createTime > "yesterday"`,
+		`createTime > 1704067200`,
+	} {
+		if actual, _, err := myFilter.ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q) = %q, want error", filter, actual)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		`note_name="test_note_1`,
+		`note_name=test_note_1"`,
+		`note_name:"test_note_1"`,
+		`note_name.startsWith("test")`,
+		`note_name="a" AND`,
+		`tags["a"]="latest"`,
+		`tags[note_name]="latest"`,
+		`tags[-1]="latest"`,
+	} {
+		if actual, _, err := myFilter.ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q) = %q, want error", filter, actual)
+		}
+	}
+}
+
+func TestParseFilterBindsValues(t *testing.T) {
+	filter := `note_name="x' OR '1'='1"`
+	actual, params, err := myFilter.ParseFilter(filter)
+	if err != nil {
+		t.Fatalf("ParseFilter(%q) failed: %v", filter, err)
+	}
+	if expected := `(JSON_EXTRACT(data, '$.note_name') = ?)`; actual != expected {
+		t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", filter, expected, actual)
+	}
+	if want := []interface{}{"x' OR '1'='1"}; !reflect.DeepEqual(params, want) {
+		t.Errorf("ParseFilter(%q) params = %v, want %v", filter, params, want)
+	}
+}
+
+func TestParseFilterIn(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`resource.uri IN ("https://gcr.io/p/a", "https://gcr.io/p/b")`,
+			`(JSON_UNQUOTE(JSON_EXTRACT(data, '$.resource.uri')) IN (?, ?))`,
+			[]interface{}{"https://gcr.io/p/a", "https://gcr.io/p/b"}},
+		{`kind IN ("BUILD","VULNERABILITY","DISCOVERY")`,
+			`(kind IN (?, ?, ?))`,
+			[]interface{}{int64(2), int64(1), int64(6)}},
+		{`note_name IN ("a IN (b)", "c") AND kind="BUILD"`,
+			`((JSON_UNQUOTE(JSON_EXTRACT(data, '$.note_name')) IN (?, ?)) AND (kind = ?))`,
+			[]interface{}{"a IN (b)", "c", int64(2)}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterInErrors(t *testing.T) {
+	for _, filter := range []string{
+		`kind IN ()`,
+		`kind IN ( )`,
+		`kind IN ("BUILD"`,
+		`kind IN (note_name)`,
+		`"BUILD" IN ("BUILD")`,
+	} {
+		if actual, _, err := myFilter.ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q) = %q, want error", filter, actual)
+		}
+	}
+}
+
+func TestParseFilterGrouping(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`(kind="VULNERABILITY" AND vulnerability.severity=4) OR kind="BUILD"`,
+			`(((kind = ?) AND (severity = ?)) OR (kind = ?))`,
+			[]interface{}{int64(1), int64(4), int64(2)}},
+		{`note_name="a" AND (kind="BUILD" OR kind="VULNERABILITY")`,
+			`((JSON_EXTRACT(data, '$.note_name') = ?) AND ((kind = ?) OR (kind = ?)))`,
+			[]interface{}{"a", int64(2), int64(1)}},
+		{`((note_name="a" OR note_name="b") AND (kind="BUILD" OR (kind="VULNERABILITY" AND vulnerability.severity>=4)))`,
+			`(((JSON_EXTRACT(data, '$.note_name') = ?) OR (JSON_EXTRACT(data, '$.note_name') = ?)) AND ((kind = ?) OR ((kind = ?) AND (severity >= ?))))`,
+			[]interface{}{"a", "b", int64(2), int64(1), int64(4)}},
+		{`note_name="(a"`, `(JSON_EXTRACT(data, '$.note_name') = ?)`, []interface{}{"(a"}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterUnbalancedParentheses(t *testing.T) {
+	for _, filter := range []string{
+		`(kind="BUILD"`,
+		`kind="BUILD")`,
+		`((kind="BUILD" OR kind="VULNERABILITY") AND note_name="a"`,
+		`(kind="BUILD")) OR (note_name="a"`,
+	} {
+		if actual, _, err := myFilter.ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q) = %q, want error", filter, actual)
+		}
+	}
+}
+
+func TestParseFilterIndexedColumns(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`resourceUrl="https://gcr.io/p/a"`, `(resource_url = ?)`, []interface{}{"https://gcr.io/p/a"}},
+		{`resource_url="https://gcr.io/p/a"`, `(resource_url = ?)`, []interface{}{"https://gcr.io/p/a"}},
+		{`resourceUrl IN ("https://gcr.io/p/a", "https://gcr.io/p/b")`, `(resource_url IN (?, ?))`,
+			[]interface{}{"https://gcr.io/p/a", "https://gcr.io/p/b"}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterNegation(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`-kind="BUILD"`, `(kind != ?)`, []interface{}{int64(2)}},
+		{`NOT kind="BUILD"`, `(kind != ?)`, []interface{}{int64(2)}},
+		{`NOT note_name="a" AND kind="BUILD"`,
+			`((JSON_EXTRACT(data, '$.note_name') != ?) AND (kind = ?))`,
+			[]interface{}{"a", int64(2)}},
+		{`kind="BUILD" OR -note_name="-a"`,
+			`((kind = ?) OR (JSON_EXTRACT(data, '$.note_name') != ?))`,
+			[]interface{}{int64(2), "-a"}},
+		{`NOT (kind="BUILD" OR kind="VULNERABILITY")`,
+			`(NOT ((kind = ?) OR (kind = ?)))`,
+			[]interface{}{int64(2), int64(1)}},
+		{`note_name="a" AND -(kind="BUILD" OR (kind="VULNERABILITY" AND NOT vulnerability.severity>=4))`,
+			`((JSON_EXTRACT(data, '$.note_name') = ?) AND (NOT ((kind = ?) OR ((kind = ?) AND (NOT (severity >= ?))))))`,
+			[]interface{}{"a", int64(2), int64(1), int64(4)}},
+		{`NOT kind IN ("BUILD", "VULNERABILITY")`, `(NOT (kind IN (?, ?)))`, []interface{}{int64(2), int64(1)}},
+		{`NOT NOT kind="BUILD"`, `(NOT (kind != ?))`, []interface{}{int64(2)}},
+		{`NOTE_name="a"`, `(JSON_EXTRACT(data, '$.NOTE_name') = ?)`, []interface{}{"a"}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterDanglingNegation(t *testing.T) {
+	for _, filter := range []string{
+		`NOT`,
+		`-`,
+		`kind="BUILD" AND NOT`,
+		`NOT AND kind="BUILD"`,
+		`(NOT) OR kind="BUILD"`,
+		`NOT note_name`,
+	} {
+		if actual, _, err := myFilter.ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q) = %q, want error", filter, actual)
+		}
 	}
-} 
+}
 
+func TestParseFilterHas(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+	}{
+		{`has(vulnerability.cvss_v3)`, `JSON_CONTAINS_PATH(data, 'one', '$.vulnerability.cvss_v3')`},
+		{`kind="VULNERABILITY" AND NOT has(vulnerability.cvss_score)`,
+			`((kind = ?) AND (NOT JSON_CONTAINS_PATH(data, 'one', '$.vulnerability.cvss_score')))`},
+	}
+	for _, tt := range tests {
+		actual, _, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+	}
+}
+
+func TestParseFilterMalformedHas(t *testing.T) {
+	for _, filter := range []string{
+		`has()`,
+		`has("vulnerability")`,
+		`has(vulnerability.package_issue[0])`,
+		`has(vulnerability.cvss_score = 7)`,
+	} {
+		if actual, _, err := myFilter.ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q) = %q, want error", filter, actual)
+		}
+	}
+}
+
+func TestParseFilterSeverity(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`vulnerability.severity="CRITICAL"`, `(severity = ?)`, []interface{}{int64(5)}},
+		{`vulnerability.severity >= "HIGH"`, `(severity >= ?)`, []interface{}{int64(4)}},
+		{`vulnerability.severity=2`, `(severity = ?)`, []interface{}{int64(2)}},
+		{`vulnerability.severity IN ("LOW", "MEDIUM")`, `(severity IN (?, ?))`, []interface{}{int64(2), int64(3)}},
+		{`-vulnerability.severity="MINIMAL"`, `(severity != ?)`, []interface{}{int64(1)}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterUnknownSeverity(t *testing.T) {
+	for _, filter := range []string{
+		`vulnerability.severity="SEVERE"`,
+		`vulnerability.severity="critical"`,
+		`vulnerability.severity IN ("HIGH", "SEVERE")`,
+		`vulnerability.severity=4.5`,
+	} {
+		if actual, _, err := myFilter.ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q) = %q, want error", filter, actual)
+		}
+	}
+}
+
+func TestParseFilterKind(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected string
+		params   []interface{}
+	}{
+		{`kind="BUILD"`, `(kind = ?)`, []interface{}{int64(2)}},
+		{`kind = "BUILD"`, `(kind = ?)`, []interface{}{int64(2)}},
+		{`kind != "BUILD"`, `(kind != ?)`, []interface{}{int64(2)}},
+		{`"VULNERABILITY" = kind`, `(? = kind)`, []interface{}{int64(1)}},
+		{`kind=2`, `(kind = ?)`, []interface{}{int64(2)}},
+		{`kind IN ("BUILD", 1)`, `(kind IN (?, ?))`, []interface{}{int64(2), int64(1)}},
+		// Only the kind field is a NoteKind.
+		{`details.kind="BUILD"`, `(JSON_EXTRACT(data, '$.details.kind') = ?)`, []interface{}{"BUILD"}},
+		{`note_name='kind="BUILD"'`, `(JSON_EXTRACT(data, '$.note_name') = ?)`, []interface{}{`kind="BUILD"`}},
+	}
+	for _, tt := range tests {
+		actual, params, err := myFilter.ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if actual != tt.expected {
+			t.Errorf("ParseFilter(%q)\nExpecting: %s\nGet: %s", tt.filter, tt.expected, actual)
+		}
+		if !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseFilter(%q) params = %v, want %v", tt.filter, params, tt.params)
+		}
+	}
+}
+
+func TestParseFilterUnknownKind(t *testing.T) {
+	for _, filter := range []string{
+		`kind="SBOM"`,
+		`kind = "build"`,
+		`kind != "SBOM"`,
+		`kind IN ("BUILD", "SBOM")`,
+		`kind=2.5`,
+	} {
+		if actual, _, err := myFilter.ParseFilter(filter); err == nil {
+			t.Errorf("ParseFilter(%q) = %q, want error", filter, actual)
+		}
+	}
+}
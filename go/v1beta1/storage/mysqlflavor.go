@@ -0,0 +1,70 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// serverFlavor is the database server the store is connected to, MySQL or MariaDB,
+// whose JSON support differs.
+type serverFlavor int
+
+const (
+	flavorMySQL serverFlavor = iota
+	// MariaDB stores JSON as LONGTEXT, so JSON_EXTRACT returns the JSON text of a
+	// value, quotes included, rather than a value that compares equal to a string.
+	flavorMariaDB
+)
+
+func (f serverFlavor) String() string {
+	if f == flavorMariaDB {
+		return "MariaDB"
+	}
+	return "MySQL"
+}
+
+// detectFlavor returns the flavor of the server db is connected to.
+func detectFlavor(ctx context.Context, db *sql.DB) (serverFlavor, error) {
+	var version string
+	if err := db.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version); err != nil {
+		return flavorMySQL, err
+	}
+	return flavorFromVersion(version), nil
+}
+
+// flavorFromVersion returns the flavor of a server reporting version from VERSION(),
+// e.g. "8.0.36" for MySQL and "10.11.6-MariaDB-1:10.11.6+maria~ubu2204" for MariaDB.
+func flavorFromVersion(version string) serverFlavor {
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		return flavorMariaDB
+	}
+	return flavorMySQL
+}
+
+// newFilter returns a filter translator producing SQL on occurrences for the store's
+// server.
+func (pg *MySQLStore) newFilter() *MysqlFilterSql {
+	return &MysqlFilterSql{mariaDB: pg.flavor == flavorMariaDB}
+}
+
+// newNoteFilter returns a filter translator producing SQL on notes for the store's
+// server.
+func (pg *MySQLStore) newNoteFilter() *MysqlFilterSql {
+	return &MysqlFilterSql{mariaDB: pg.flavor == flavorMariaDB, notes: true}
+}
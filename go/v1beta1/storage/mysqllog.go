@@ -0,0 +1,110 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"log"
+	"time"
+
+	"github.com/grafeas/grafeas/go/config"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Logger receives the messages logged by the store. It is set with the Logger field
+// of the config, so that the store logs through the application's logger.
+type Logger interface {
+	Errorf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+}
+
+// stdLogger is the Logger used when none is configured, which writes to the standard
+// logger of the log package.
+type stdLogger struct{}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR: "+format, args...)
+}
+
+func (stdLogger) Infof(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// newLogger returns the Logger configured by config, or the standard logger when none
+// is configured.
+func newLogger(config *config.MySQLConfig) Logger {
+	if config.Logger == nil {
+		return stdLogger{}
+	}
+	return config.Logger
+}
+
+// log returns the store's Logger, falling back to the standard logger for stores
+// that were not created by NewMySQLStore.
+func (pg *MySQLStore) log() Logger {
+	if pg.logger == nil {
+		return stdLogger{}
+	}
+	return pg.logger
+}
+
+// observe records the latency and outcome of an operation that started at start and
+// returned *errp in the metrics, and logs the operation if it was slow. It is meant
+// to be deferred. An operation failing once its context ctx is done returns a
+// DeadlineExceeded or Canceled error; see contextError.
+func (pg *MySQLStore) observe(ctx context.Context, operation string, start time.Time, errp *error) {
+	*errp = contextError(ctx, *errp)
+	pg.metrics.observe(operation, start, errp)
+	pg.logIfSlow(operation, start)
+}
+
+// observeBatch is like observe for batch operations.
+func (pg *MySQLStore) observeBatch(ctx context.Context, operation string, start time.Time, errs *[]error) {
+	for i, err := range *errs {
+		(*errs)[i] = contextError(ctx, err)
+	}
+	pg.metrics.observeBatch(operation, start, errs)
+	pg.logIfSlow(operation, start)
+}
+
+// contextError returns err, or a DeadlineExceeded or Canceled error if err is an
+// Internal error and ctx is done. The methods report database errors as Internal
+// errors, including those caused by ctx, such as its deadline passing while waiting
+// for a connection from a pool at MaxOpenConns, which callers should see as such.
+func contextError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if code := status.Code(err); code != codes.Internal && code != codes.Unknown {
+		return err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, "Deadline exceeded")
+	}
+	return status.Error(codes.Canceled, "Canceled")
+}
+
+// logIfSlow logs the name and duration of an operation that started at start if it
+// took longer than the slow query threshold. Only the operation name is logged, as
+// the arguments may be sensitive.
+func (pg *MySQLStore) logIfSlow(operation string, start time.Time) {
+	if !pg.logSlowQueries {
+		return
+	}
+	if elapsed := time.Since(start); elapsed >= pg.slowQueryThreshold {
+		pg.log().Infof("slow store operation %s took %v", operation, elapsed)
+	}
+}
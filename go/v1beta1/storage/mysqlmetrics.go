@@ -0,0 +1,114 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/status"
+)
+
+// storeMetrics records Prometheus metrics for store operations. A nil *storeMetrics
+// is valid and records nothing.
+type storeMetrics struct {
+	registerer prometheus.Registerer
+	collectors []prometheus.Collector
+	latency    *prometheus.HistogramVec
+	errors     *prometheus.CounterVec
+}
+
+// newStoreMetrics creates the operation metrics and the gauges reporting the
+// connection pool statistics of db, and registers them with registerer.
+func newStoreMetrics(db *sql.DB, registerer prometheus.Registerer) (*storeMetrics, error) {
+	m := &storeMetrics{
+		registerer: registerer,
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "grafeas",
+			Subsystem: "mysql",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of store operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation", "status_code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "grafeas",
+			Subsystem: "mysql",
+			Name:      "operation_errors_total",
+			Help:      "Number of store operations that returned an error.",
+		}, []string{"operation", "status_code"}),
+	}
+	m.collectors = []prometheus.Collector{
+		m.latency,
+		m.errors,
+		newPoolGauge("open_connections", "Number of established connections, in use or idle.", func(s sql.DBStats) float64 { return float64(s.OpenConnections) }, db),
+		newPoolGauge("in_use_connections", "Number of connections currently in use.", func(s sql.DBStats) float64 { return float64(s.InUse) }, db),
+		newPoolGauge("idle_connections", "Number of idle connections.", func(s sql.DBStats) float64 { return float64(s.Idle) }, db),
+		newPoolGauge("wait_count", "Number of times a query waited for a free connection.", func(s sql.DBStats) float64 { return float64(s.WaitCount) }, db),
+		newPoolGauge("wait_duration_seconds", "Total time queries waited for a free connection.", func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }, db),
+	}
+	for i, c := range m.collectors {
+		if err := registerer.Register(c); err != nil {
+			for _, registered := range m.collectors[:i] {
+				registerer.Unregister(registered)
+			}
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// newPoolGauge returns a gauge reporting the statistic of db selected by value.
+func newPoolGauge(name, help string, value func(sql.DBStats) float64, db *sql.DB) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "grafeas",
+		Subsystem: "mysql",
+		Name:      name,
+		Help:      help,
+	}, func() float64 { return value(db.Stats()) })
+}
+
+// observe records the latency and outcome of an operation that started at start and
+// returned *errp. It is meant to be deferred.
+func (m *storeMetrics) observe(operation string, start time.Time, errp *error) {
+	if m == nil {
+		return
+	}
+	code := status.Code(*errp).String()
+	m.latency.WithLabelValues(operation, code).Observe(time.Since(start).Seconds())
+	if *errp != nil {
+		m.errors.WithLabelValues(operation, code).Inc()
+	}
+}
+
+// observeBatch is like observe for batch operations, using the first of *errs as the
+// operation's outcome.
+func (m *storeMetrics) observeBatch(operation string, start time.Time, errs *[]error) {
+	var err error
+	if len(*errs) > 0 {
+		err = (*errs)[0]
+	}
+	m.observe(operation, start, &err)
+}
+
+// unregister removes the metrics from the registerer they were registered with.
+func (m *storeMetrics) unregister() {
+	if m == nil {
+		return
+	}
+	for _, c := range m.collectors {
+		m.registerer.Unregister(c)
+	}
+}
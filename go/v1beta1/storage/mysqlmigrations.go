@@ -0,0 +1,385 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/net/context"
+)
+
+// mysqlMigration is a schema change applied once per database. Statements should be
+// idempotent: MySQL commits DDL implicitly, so a migration interrupted part way is
+// re-run from the start.
+type mysqlMigration struct {
+	description string
+	statements  []string
+	// optional statements are run after statements, and their failures for lack of
+	// support by the server are logged rather than failing the migration.
+	optional []string
+}
+
+// mysqlMigrations are applied in order at startup; the version of a migration is its
+// position in the slice, starting at 1. Append new migrations and never modify ones
+// that have been released.
+var mysqlMigrations = []mysqlMigration{
+	{description: "create projects, notes and occurrences tables", statements: mysqlCreateTables},
+	{description: "index occurrences by note", statements: []string{
+		`CREATE INDEX occurrences_note ON occurrences (note_project_id, note_id)`,
+	}},
+	{description: "store note and occurrence data as JSON", statements: []string{
+		`ALTER TABLE notes MODIFY data JSON`,
+		`ALTER TABLE occurrences MODIFY data JSON`,
+	}},
+	// jsonpb stores timestamps as RFC3339 strings in UTC; the columns hold them
+	// truncated to the microsecond precision of DATETIME(6).
+	{description: "add indexed create_time and update_time columns", statements: []string{
+		`ALTER TABLE notes
+			ADD COLUMN create_time DATETIME(6) GENERATED ALWAYS AS
+				(CAST(REPLACE(SUBSTRING(REPLACE(JSON_UNQUOTE(JSON_EXTRACT(data, '$.create_time')), 'Z', ''), 1, 26), 'T', ' ') AS DATETIME(6))) STORED,
+			ADD COLUMN update_time DATETIME(6) GENERATED ALWAYS AS
+				(CAST(REPLACE(SUBSTRING(REPLACE(JSON_UNQUOTE(JSON_EXTRACT(data, '$.update_time')), 'Z', ''), 1, 26), 'T', ' ') AS DATETIME(6))) STORED,
+			ADD INDEX notes_create_time (project_id, create_time),
+			ADD INDEX notes_update_time (project_id, update_time)`,
+		`ALTER TABLE occurrences
+			ADD COLUMN create_time DATETIME(6) GENERATED ALWAYS AS
+				(CAST(REPLACE(SUBSTRING(REPLACE(JSON_UNQUOTE(JSON_EXTRACT(data, '$.create_time')), 'Z', ''), 1, 26), 'T', ' ') AS DATETIME(6))) STORED,
+			ADD COLUMN update_time DATETIME(6) GENERATED ALWAYS AS
+				(CAST(REPLACE(SUBSTRING(REPLACE(JSON_UNQUOTE(JSON_EXTRACT(data, '$.update_time')), 'Z', ''), 1, 26), 'T', ' ') AS DATETIME(6))) STORED,
+			ADD INDEX occurrences_create_time (project_id, create_time),
+			ADD INDEX occurrences_update_time (project_id, update_time)`,
+	}},
+	{description: "store project data as JSON", statements: []string{
+		`ALTER TABLE projects ADD COLUMN data JSON`,
+	}},
+	{description: "record project creation time", statements: []string{
+		`ALTER TABLE projects ADD COLUMN create_time DATETIME(6)`,
+		`UPDATE projects SET create_time = UTC_TIMESTAMP(6) WHERE create_time IS NULL`,
+	}},
+	{description: "record the users creating and updating notes and occurrences", statements: []string{
+		`ALTER TABLE notes
+			ADD COLUMN created_by VARCHAR(255),
+			ADD COLUMN updated_by VARCHAR(255),
+			ADD INDEX notes_created_by (project_id, created_by)`,
+		`ALTER TABLE occurrences
+			ADD COLUMN created_by VARCHAR(255),
+			ADD COLUMN updated_by VARCHAR(255),
+			ADD INDEX occurrences_created_by (project_id, created_by)`,
+	}},
+	// The kind of an occurrence is set from its details when it is written, as
+	// clients often leave the kind field unset. It is backfilled the same way.
+	{description: "add indexed kind columns", statements: []string{
+		`ALTER TABLE occurrences
+			ADD COLUMN kind INT NOT NULL DEFAULT 0,
+			ADD INDEX occurrences_kind (project_id, kind)`,
+		`UPDATE occurrences SET kind = CASE
+				WHEN JSON_CONTAINS_PATH(data, 'one', '$.vulnerability') THEN 1
+				WHEN JSON_CONTAINS_PATH(data, 'one', '$.build') THEN 2
+				WHEN JSON_CONTAINS_PATH(data, 'one', '$.derived_image') THEN 3
+				WHEN JSON_CONTAINS_PATH(data, 'one', '$.installation') THEN 4
+				WHEN JSON_CONTAINS_PATH(data, 'one', '$.deployment') THEN 5
+				WHEN JSON_CONTAINS_PATH(data, 'one', '$.discovered') THEN 6
+				WHEN JSON_CONTAINS_PATH(data, 'one', '$.attestation') THEN 7
+				WHEN JSON_CONTAINS_PATH(data, 'one', '$.intoto') THEN 8
+				ELSE CAST(IFNULL(JSON_UNQUOTE(JSON_EXTRACT(data, '$.kind')), '0') AS SIGNED)
+			END
+			WHERE kind = 0`,
+		`ALTER TABLE notes
+			ADD COLUMN kind INT GENERATED ALWAYS AS
+				(CAST(IFNULL(JSON_UNQUOTE(JSON_EXTRACT(data, '$.kind')), '0') AS SIGNED)) STORED,
+			ADD INDEX notes_kind (project_id, kind)`,
+	}},
+	// Resource URLs are indexed on a prefix, which is enough to find the occurrences
+	// of a resource and keeps the key within InnoDB's size limit.
+	{description: "add indexed resource_url column to occurrences", statements: []string{
+		`ALTER TABLE occurrences
+			ADD COLUMN resource_url VARCHAR(2048),
+			ADD INDEX occurrences_resource_url (project_id, resource_url(255))`,
+		`UPDATE occurrences SET resource_url = JSON_UNQUOTE(JSON_EXTRACT(data, '$.resource.uri'))
+			WHERE resource_url IS NULL AND JSON_EXTRACT(data, '$.resource.uri') IS NOT NULL`,
+	}},
+	{description: "add occurrence version for optimistic concurrency control", statements: []string{
+		`ALTER TABLE occurrences ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+	}},
+	// upsert_key is only set by UpsertOccurrence, so occurrences created before, or by
+	// CreateOccurrence, may share a note and resource.
+	{description: "add unique upsert_key to occurrences", statements: []string{
+		`ALTER TABLE occurrences
+			ADD COLUMN upsert_key BINARY(32),
+			ADD UNIQUE KEY occurrences_upsert_key (project_id, upsert_key)`,
+	}},
+	// compressed_details holds the details of documents written with compression
+	// enabled, starting with a byte giving their format; see marshalStored.
+	{description: "add compressed_details columns", statements: []string{
+		`ALTER TABLE notes ADD COLUMN compressed_details LONGBLOB`,
+		`ALTER TABLE occurrences ADD COLUMN compressed_details LONGBLOB`,
+	}},
+	// Occurrences are only given an update time when they are updated, so recency is
+	// ordered by the update time, falling back to the creation time. Rows that have
+	// neither sort last. The index holds the id, which breaks ties.
+	{description: "add indexed modify_time column to occurrences", statements: []string{
+		`ALTER TABLE occurrences
+			ADD COLUMN modify_time DATETIME(6) GENERATED ALWAYS AS
+				(COALESCE(update_time, create_time, '1000-01-01 00:00:00')) STORED NOT NULL,
+			ADD INDEX occurrences_modify_time (project_id, modify_time)`,
+	}},
+	// Severities are stored as the numbers of their enum values; notes and occurrences
+	// that are not vulnerabilities have a NULL severity.
+	{description: "add indexed severity columns", statements: []string{
+		`ALTER TABLE notes
+			ADD COLUMN severity INT GENERATED ALWAYS AS
+				(CAST(JSON_UNQUOTE(JSON_EXTRACT(data, '$.vulnerability.severity')) AS SIGNED)) STORED,
+			ADD INDEX notes_severity (project_id, severity)`,
+		`ALTER TABLE occurrences
+			ADD COLUMN severity INT GENERATED ALWAYS AS
+				(CAST(JSON_UNQUOTE(JSON_EXTRACT(data, '$.vulnerability.severity')) AS SIGNED)) STORED,
+			ADD INDEX occurrences_severity (project_id, severity)`,
+	}},
+	// The severity of an occurrence is set from its details when it is written, so
+	// that it is also set for occurrences whose details are compressed. Making the
+	// generated column a plain one keeps its values and index; vulnerability
+	// occurrences without a severity are backfilled with SEVERITY_UNSPECIFIED.
+	{description: "write occurrence severity with the occurrence", statements: []string{
+		`ALTER TABLE occurrences MODIFY COLUMN severity INT NULL`,
+		`UPDATE occurrences
+			SET severity = CAST(IFNULL(JSON_UNQUOTE(JSON_EXTRACT(data, '$.vulnerability.severity')), '0') AS SIGNED)
+			WHERE severity IS NULL AND JSON_CONTAINS_PATH(data, 'one', '$.vulnerability')`,
+	}},
+	// A vulnerability is fixable when a package issue has a fixed location whose
+	// version kind is not MAXIMUM (3). Version kinds are 1 to 3 and left out when
+	// unset, so an issue is fixable when its kind is 1 or 2 or missing, i.e. when
+	// there are more fixed locations than kinds. Occurrences whose details are
+	// compressed are not backfilled.
+	{description: "add fixable column to occurrences", statements: []string{
+		`ALTER TABLE occurrences ADD COLUMN fixable BOOLEAN NOT NULL DEFAULT FALSE`,
+		`UPDATE occurrences SET fixable = (
+				JSON_LENGTH(IFNULL(JSON_EXTRACT(data, '$.vulnerability.package_issue[*].fixed_location'), JSON_ARRAY())) >
+					JSON_LENGTH(IFNULL(JSON_EXTRACT(data, '$.vulnerability.package_issue[*].fixed_location.version.kind'), JSON_ARRAY()))
+				OR JSON_CONTAINS(IFNULL(JSON_EXTRACT(data, '$.vulnerability.package_issue[*].fixed_location.version.kind'), JSON_ARRAY()), '1')
+				OR JSON_CONTAINS(IFNULL(JSON_EXTRACT(data, '$.vulnerability.package_issue[*].fixed_location.version.kind'), JSON_ARRAY()), '2'))
+			WHERE severity IS NOT NULL`,
+	}},
+	// Generated occurrence IDs are stored as the 16 bytes of their UUID, and other IDs
+	// as text; see occurrenceIDValue. Existing IDs in the canonical form of an RFC 4122
+	// UUID, whose variant is given by the first digit of their fourth group, are
+	// converted. IDs are compared byte by byte from now on, so are case-sensitive.
+	{description: "store generated occurrence IDs as binary UUIDs", statements: []string{
+		`ALTER TABLE occurrences MODIFY COLUMN occurrence_id VARBINARY(36) NOT NULL`,
+		`UPDATE occurrences SET occurrence_id = UNHEX(REPLACE(occurrence_id, '-', ''))
+			WHERE occurrence_id LIKE '________-____-____-____-____________'
+				AND REPLACE(occurrence_id, '-', '') = LOWER(HEX(UNHEX(REPLACE(occurrence_id, '-', ''))))
+				AND SUBSTRING(occurrence_id, 20, 1) IN ('8', '9', 'a', 'b')`,
+	}},
+	// The audit log is append-only: the store never updates or deletes its rows.
+	{description: "create audit_log table", statements: []string{
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			operation VARCHAR(64) NOT NULL,
+			entity_type VARCHAR(16) NOT NULL,
+			project_id VARCHAR(255) NOT NULL,
+			entity_id VARCHAR(255) NOT NULL,
+			user_id VARCHAR(255),
+			event_time DATETIME(6) NOT NULL,
+			INDEX audit_log_project (project_id, id)
+		) ` + mysqlTableOptions,
+	}},
+	// search_text holds the free text of occurrences searched by SearchOccurrences.
+	// FULLTEXT indexes cannot be built on virtual generated columns, so it is stored.
+	// The details of compressed or encrypted occurrences are not in the data, so
+	// their search_text is empty. The index is optional: SearchOccurrences falls back
+	// to LIKE on servers whose storage engine cannot build it.
+	{description: "add full-text indexed search_text column to occurrences", statements: []string{
+		`ALTER TABLE occurrences
+			ADD COLUMN search_text TEXT GENERATED ALWAYS AS (CONCAT_WS(' ',
+				JSON_UNQUOTE(JSON_EXTRACT(data, '$.remediation')),
+				JSON_UNQUOTE(JSON_EXTRACT(data, '$.vulnerability.short_description')),
+				JSON_UNQUOTE(JSON_EXTRACT(data, '$.vulnerability.long_description')))) STORED`,
+	}, optional: []string{
+		`CREATE FULLTEXT INDEX occurrences_search_text ON occurrences (search_text)`,
+	}},
+	// The creation and update times of occurrences are written with the occurrence
+	// rather than generated from its data, and are the source of truth for them; see
+	// unmarshalOccurrence. Stored generated columns keep their values and indexes when
+	// made plain. Occurrences whose data lacks a creation time get the time of the
+	// upgrade, like projects.
+	{description: "write occurrence create_time and update_time columns", statements: []string{
+		`ALTER TABLE occurrences
+			MODIFY COLUMN create_time DATETIME(6) NULL,
+			MODIFY COLUMN update_time DATETIME(6) NULL`,
+		`UPDATE occurrences SET create_time = UTC_TIMESTAMP(6) WHERE create_time IS NULL`,
+	}},
+}
+
+// MySQL error numbers returned when re-running DDL that has already been applied.
+const (
+	mysqlErrDuplicateColumn  = 1060
+	mysqlErrDuplicateKeyName = 1061
+)
+
+// mysqlErrTableCantHandleFullText is the MySQL and MariaDB error number of creating a
+// FULLTEXT index on a table whose storage engine does not support them.
+const mysqlErrTableCantHandleFullText = 1214
+
+// mysqlTableOptions ends the CREATE TABLE statements, and is replaced by the default
+// character set and collation of the table when they are run, so that the tables do
+// not depend on the defaults of the database.
+const mysqlTableOptions = "/* table options */"
+
+// mysqlSchema is the schema migrated: the prefix of its table names, and the
+// character set and collation of the tables it creates.
+type mysqlSchema struct {
+	prefix, charset, collation string
+}
+
+// statement returns query with its tables prefixed and its table options set.
+func (s mysqlSchema) statement(query string) string {
+	options := fmt.Sprintf("DEFAULT CHARSET=%s COLLATE=%s", s.charset, s.collation)
+	return strings.Replace(prefixTables(s.prefix, query), mysqlTableOptions, options, -1)
+}
+
+// mysqlMigrationLock is the name of the advisory lock serializing migrations between
+// Grafeas instances starting against the same database.
+const mysqlMigrationLock = "grafeas_schema_migrations"
+
+const (
+	mysqlCreateSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT NOT NULL PRIMARY KEY,
+		description VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	) ` + mysqlTableOptions
+	mysqlSchemaVersion        = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+	mysqlInsertMigration      = `INSERT INTO schema_migrations(version, description) VALUES (?, ?)`
+	mysqlGetMigrationLock     = `SELECT GET_LOCK(?, 60)`
+	mysqlReleaseMigrationLock = `SELECT RELEASE_LOCK(?)`
+)
+
+// migrate brings schema in db up to date by applying the migrations that have not
+// been recorded in schema_migrations yet, and returns the resulting version. The
+// migrations applied are logged to logger. The tables migrated, including
+// schema_migrations, have their names prefixed with the prefix of schema.
+func migrate(ctx context.Context, db *sql.DB, logger Logger, schema mysqlSchema) (int, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, mysqlGetMigrationLock, mysqlMigrationLock).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if locked.Int64 != 1 {
+		return 0, fmt.Errorf("timed out waiting for lock %q", mysqlMigrationLock)
+	}
+	defer conn.ExecContext(ctx, mysqlReleaseMigrationLock, mysqlMigrationLock)
+
+	if _, err := conn.ExecContext(ctx, schema.statement(mysqlCreateSchemaMigrations)); err != nil {
+		return 0, err
+	}
+	var version int
+	if err := conn.QueryRowContext(ctx, schema.statement(mysqlSchemaVersion)).Scan(&version); err != nil {
+		return 0, err
+	}
+	if version > len(mysqlMigrations) {
+		return 0, fmt.Errorf("database schema version %d is newer than the latest known version %d", version, len(mysqlMigrations))
+	}
+	for ; version < len(mysqlMigrations); version++ {
+		m := mysqlMigrations[version]
+		if err := applyMigration(ctx, conn, logger, schema, version+1, m); err != nil {
+			return version, fmt.Errorf("migration %d (%s) failed: %v", version+1, m.description, err)
+		}
+		logger.Infof("applied schema migration %d: %s", version+1, m.description)
+	}
+	return version, nil
+}
+
+// applyMigration runs the statements of m on schema and records it as version in one
+// transaction. Optional statements the server does not support are logged to logger
+// and skipped.
+func applyMigration(ctx context.Context, conn *sql.Conn, logger Logger, schema mysqlSchema, version int, m mysqlMigration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range m.statements {
+		if _, err := tx.ExecContext(ctx, schema.statement(query)); err != nil && !alreadyApplied(err) {
+			return err
+		}
+	}
+	for _, query := range m.optional {
+		_, err := tx.ExecContext(ctx, schema.statement(query))
+		if unsupported(err) {
+			logger.Errorf("skipped optional statement of schema migration %d (%s): %v", version, m.description, err)
+		} else if err != nil && !alreadyApplied(err) {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, schema.statement(mysqlInsertMigration), version, m.description); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// alreadyApplied reports whether err indicates that a column or index being added by a
+// migration already exists, i.e. the statement ran before the migration was recorded.
+func alreadyApplied(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && (mysqlErr.Number == mysqlErrDuplicateColumn || mysqlErr.Number == mysqlErrDuplicateKeyName)
+}
+
+// unsupported reports whether err indicates that the server does not support a
+// feature used by an optional statement.
+func unsupported(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == mysqlErrTableCantHandleFullText
+}
+
+// mysqlListOtherCharsetColumns lists the text columns of the store's tables whose
+// character set differs from the one given.
+const mysqlListOtherCharsetColumns = `SELECT TABLE_NAME, COLUMN_NAME, CHARACTER_SET_NAME
+	FROM information_schema.COLUMNS
+	WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME IN (?, ?, ?, ?, ?)
+		AND CHARACTER_SET_NAME IS NOT NULL AND CHARACTER_SET_NAME <> ?
+	ORDER BY TABLE_NAME, ORDINAL_POSITION`
+
+// checkCharsets logs to logger the text columns of the tables of schema whose
+// character set is not the one of schema, such as tables created before their
+// character set was set explicitly in databases defaulting to latin1. Text in another
+// character set than the connection's may be garbled or rejected. The tables are not
+// converted automatically, as converting rebuilds them.
+func checkCharsets(ctx context.Context, db *sql.DB, logger Logger, schema mysqlSchema) error {
+	var args []interface{}
+	for _, table := range []string{"projects", "notes", "occurrences", "audit_log", "schema_migrations"} {
+		args = append(args, schema.prefix+table)
+	}
+	rows, err := db.QueryContext(ctx, mysqlListOtherCharsetColumns, append(args, schema.charset)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, column, charset string
+		if err := rows.Scan(&table, &column, &charset); err != nil {
+			return err
+		}
+		logger.Errorf("column %s.%s has character set %s rather than %s; convert its table with ALTER TABLE %s CONVERT TO CHARACTER SET %s COLLATE %s",
+			table, column, charset, schema.charset, quoteIdent(table), schema.charset, schema.collation)
+	}
+	return rows.Err()
+}
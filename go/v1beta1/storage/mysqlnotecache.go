@@ -0,0 +1,128 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+)
+
+// noteCache is a bounded cache of the notes returned by GetNote, evicting the least
+// recently used note when full. Notes are read far more often than they change, as
+// many occurrences refer to one note.
+//
+// The cache holds copies of the notes and returns copies, so callers cannot change
+// its entries. Entries are removed when the store updates or deletes their note, but
+// not when the note is changed by another Grafeas instance or by statements run
+// through WithTx, so a GetNote may return such a note as it was before the change.
+//
+// A nil *noteCache is valid and caches nothing.
+type noteCache struct {
+	size int
+
+	mu sync.Mutex
+	// lru holds the entries from the most to the least recently used.
+	lru     *list.List
+	entries map[noteCacheKey]*list.Element
+}
+
+type noteCacheKey struct {
+	pID, nID string
+}
+
+type noteCacheEntry struct {
+	key noteCacheKey
+	n   *pb.Note
+}
+
+// newNoteCache returns a cache of size notes, or nil when size is not positive.
+func newNoteCache(size int) *noteCache {
+	if size <= 0 {
+		return nil
+	}
+	return &noteCache{
+		size:    size,
+		lru:     list.New(),
+		entries: map[noteCacheKey]*list.Element{},
+	}
+}
+
+// get returns a copy of the cached note with pID and nID, if there is one.
+func (c *noteCache) get(pID, nID string) (*pb.Note, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[noteCacheKey{pID, nID}]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return proto.Clone(e.Value.(*noteCacheEntry).n).(*pb.Note), true
+}
+
+// add caches a copy of n as the note with pID and nID.
+func (c *noteCache) add(pID, nID string, n *pb.Note) {
+	if c == nil {
+		return
+	}
+	n = proto.Clone(n).(*pb.Note)
+	key := noteCacheKey{pID, nID}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*noteCacheEntry).n = n
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&noteCacheEntry{key: key, n: n})
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*noteCacheEntry).key)
+	}
+}
+
+// remove removes the note with pID and nID from the cache.
+func (c *noteCache) remove(pID, nID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[noteCacheKey{pID, nID}]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*noteCacheEntry).key)
+	}
+}
+
+// removeProject removes the notes of project pID from the cache.
+func (c *noteCache) removeProject(pID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if key.pID == pID {
+			c.lru.Remove(e)
+			delete(c.entries, key)
+		}
+	}
+}
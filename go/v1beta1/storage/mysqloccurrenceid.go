@@ -0,0 +1,63 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"github.com/google/uuid"
+)
+
+// occurrenceIDValue returns the value of the occurrence_id column for the occurrence
+// ID oID. The UUIDs generated by CreateOccurrence are stored as their 16 bytes rather
+// than their 36 characters, which keeps the (project_id, occurrence_id) index small.
+// Other IDs, such as those given with WithOccurrenceID, are stored as text.
+//
+// Only IDs in the canonical form of an RFC 4122 UUID are stored as bytes, so that
+// decodeOccurrenceID returns the ID unchanged. The variant bits of such a UUID make
+// its ninth byte 0x80 or above, which never occurs in IDs stored as text, as those
+// match validOccurrenceID.
+func occurrenceIDValue(oID string) []byte {
+	u, err := uuid.Parse(oID)
+	if err != nil || u.Variant() != uuid.RFC4122 || u.String() != oID {
+		return []byte(oID)
+	}
+	b, err := u.MarshalBinary()
+	if err != nil {
+		return []byte(oID)
+	}
+	return b
+}
+
+// decodeOccurrenceID returns the occurrence ID stored as the occurrence_id column value
+// v by occurrenceIDValue.
+func decodeOccurrenceID(v []byte) string {
+	if len(v) != 16 || v[8]&0xc0 != 0x80 {
+		return string(v)
+	}
+	var u uuid.UUID
+	if err := u.UnmarshalBinary(v); err != nil {
+		return string(v)
+	}
+	return u.String()
+}
+
+// inOccurrencesQuery is inQuery for queries matching occurrence_id, binding the IDs
+// oIDs in their stored form.
+func inOccurrencesQuery(query, pID string, oIDs []string) (string, []interface{}) {
+	query, args := inQuery(query, pID, oIDs)
+	for i, oID := range oIDs {
+		args[i+1] = occurrenceIDValue(oID)
+	}
+	return query, args
+}
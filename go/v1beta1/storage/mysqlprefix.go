@@ -0,0 +1,70 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// mysqlTablePrefixPattern restricts table prefixes to characters that are safe in an
+// unquoted identifier, leaving room for the table names within 64 characters.
+var mysqlTablePrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_]{0,40}$`)
+
+// mysqlTableNames matches the references to the store's tables in the statements of
+// mysqlqueries.go and mysqlmigrations.go, which all follow one of these keywords.
+var mysqlTableNames = regexp.MustCompile(`\b(FROM|INTO|UPDATE|TABLE|EXISTS|ON)(\s+)(projects|notes|occurrences|audit_log|schema_migrations)\b`)
+
+// checkTablePrefix returns an error if prefix cannot be used as a table prefix.
+func checkTablePrefix(prefix string) error {
+	if !mysqlTablePrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("invalid table prefix %q; must match %s", prefix, mysqlTablePrefixPattern)
+	}
+	return nil
+}
+
+// quoteIdent returns name quoted as a MySQL identifier, in backticks with the
+// backticks it contains doubled, so that it is never read as a keyword or as SQL.
+func quoteIdent(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// prefixTables returns query with prefix prepended to the names of the store's tables,
+// so that several stores can share a database. The prefixed names are quoted with
+// quoteIdent, although checkTablePrefix only accepts prefixes that need no quoting.
+func prefixTables(prefix, query string) string {
+	if prefix == "" {
+		return query
+	}
+	return mysqlTableNames.ReplaceAllStringFunc(query, func(match string) string {
+		m := mysqlTableNames.FindStringSubmatch(match)
+		return m[1] + m[2] + quoteIdent(prefix+m[3])
+	})
+}
+
+// prefixed returns query with the store's table prefix applied. The prefixed queries
+// are cached, as the store runs the same few queries over and over.
+func (pg *MySQLStore) prefixed(query string) string {
+	if pg.tablePrefix == "" {
+		return query
+	}
+	if q, ok := pg.prefixedQueries.Load(query); ok {
+		return q.(string)
+	}
+	q := prefixTables(pg.tablePrefix, query)
+	pg.prefixedQueries.Store(query, q)
+	return q
+}
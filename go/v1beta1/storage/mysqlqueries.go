@@ -0,0 +1,155 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+var mysqlCreateTables = []string{
+	`CREATE TABLE IF NOT EXISTS projects (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL UNIQUE
+	) ` + mysqlTableOptions,
+	`CREATE TABLE IF NOT EXISTS notes (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		project_id VARCHAR(255) NOT NULL,
+		note_id VARCHAR(255) NOT NULL,
+		data TEXT,
+		UNIQUE KEY (project_id, note_id)
+	) ` + mysqlTableOptions,
+	`CREATE TABLE IF NOT EXISTS occurrences (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		project_id VARCHAR(255) NOT NULL,
+		occurrence_id VARCHAR(36) NOT NULL,
+		note_project_id VARCHAR(255) NOT NULL,
+		note_id VARCHAR(255) NOT NULL,
+		data TEXT,
+		UNIQUE KEY (project_id, occurrence_id)
+	) ` + mysqlTableOptions,
+}
+
+const (
+	mysqlInsertProject = `INSERT INTO projects(name, data, create_time) VALUES (?, ?, ?)`
+	mysqlSearchProject = `SELECT data FROM projects WHERE name = ?`
+	mysqlUpdateProject = `UPDATE projects SET data = ? WHERE name = ?`
+	mysqlDeleteProject = `DELETE FROM projects WHERE name = ?`
+	mysqlListProjects  = `SELECT id, name, data FROM projects WHERE id > ? ORDER BY id LIMIT ?`
+
+	mysqlProjectCreateTime = `SELECT create_time FROM projects WHERE name = ?`
+
+	mysqlDeleteProjectOccurrences = `DELETE FROM occurrences WHERE project_id = ?`
+	mysqlDeleteProjectNotes       = `DELETE FROM notes WHERE project_id = ?`
+
+	// mysqlInsertOccurrences is followed by one mysqlInsertOccurrenceRow per occurrence.
+	mysqlInsertOccurrences   = `INSERT INTO occurrences(project_id, occurrence_id, note_project_id, note_id, data, created_by, kind, severity, fixable, resource_url, compressed_details, create_time, update_time) VALUES `
+	mysqlInsertOccurrenceRow = `(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	mysqlInsertOccurrence    = mysqlInsertOccurrences + mysqlInsertOccurrenceRow
+
+	// mysqlUpsertOccurrence inserts an occurrence or, when one with the same upsert_key
+	// exists, replaces its data while keeping its name and creation time. The update
+	// time is the creation time of the replaced data.
+	mysqlUpsertOccurrence = `INSERT INTO occurrences(project_id, occurrence_id, note_project_id, note_id, data, created_by, kind, severity, fixable, resource_url, compressed_details, create_time, update_time, upsert_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			data = JSON_SET(VALUES(data),
+				'$.update_time', JSON_EXTRACT(VALUES(data), '$.create_time'),
+				'$.name', JSON_EXTRACT(data, '$.name'),
+				'$.create_time', JSON_EXTRACT(data, '$.create_time')),
+			compressed_details = VALUES(compressed_details),
+			update_time = VALUES(create_time),
+			kind = VALUES(kind),
+			severity = VALUES(severity),
+			fixable = VALUES(fixable),
+			updated_by = VALUES(created_by),
+			version = version + 1`
+	mysqlSearchUpsertedOccurrence = `SELECT occurrence_id, data, compressed_details, create_time, update_time FROM occurrences WHERE project_id = ? AND upsert_key = ?`
+
+	mysqlSearchOccurrence        = `SELECT data, compressed_details, create_time, update_time FROM occurrences WHERE project_id = ? AND occurrence_id = ?`
+	mysqlSearchOccurrenceVersion = `SELECT data, compressed_details, create_time, update_time, version FROM occurrences WHERE project_id = ? AND occurrence_id = ?`
+	mysqlLockOccurrence          = `SELECT data, compressed_details, create_time, update_time FROM occurrences WHERE project_id = ? AND occurrence_id = ? FOR UPDATE`
+	mysqlUpdateOccurrence        = `UPDATE occurrences SET data = ?, compressed_details = ?, update_time = ?, kind = ?, severity = ?, fixable = ?, resource_url = ?, updated_by = ?, version = version + 1
+		WHERE project_id = ? AND occurrence_id = ? AND version = ?`
+	mysqlDeleteOccurrence = `DELETE FROM occurrences WHERE project_id = ? AND occurrence_id = ?`
+	mysqlListOccurrences  = `SELECT id, occurrence_id, data, compressed_details, create_time, update_time FROM occurrences WHERE project_id = ? %s AND id > ? ORDER BY id LIMIT ?`
+	mysqlCountOccurrences = `SELECT COUNT(*) FROM occurrences WHERE project_id = ? %s`
+
+	// mysqlDeleteExpiredOccurrences deletes one batch of occurrences created before a
+	// cutoff, using the create_time index.
+	mysqlDeleteExpiredOccurrences = `DELETE FROM occurrences WHERE project_id = ? AND create_time < ? ORDER BY create_time LIMIT ?`
+
+	// mysqlDeleteAllOccurrences and mysqlDeleteAllNotes delete one batch of the
+	// occurrences or notes of a project.
+	mysqlDeleteAllOccurrences = `DELETE FROM occurrences WHERE project_id = ? ORDER BY id LIMIT ?`
+	mysqlDeleteAllNotes       = `DELETE FROM notes WHERE project_id = ? ORDER BY id LIMIT ?`
+
+	// mysqlListRecentOccurrences pages through occurrences from the most recently
+	// modified, continuing after the modification time and id of the previous page.
+	mysqlListRecentOccurrences = `SELECT id, modify_time, occurrence_id, data, compressed_details, create_time, update_time FROM occurrences
+		WHERE project_id = ? %s AND (modify_time < ? OR (modify_time = ? AND id < ?))
+		ORDER BY modify_time DESC, id DESC LIMIT ?`
+
+	// mysqlFullTextSearchOccurrences ranks the matching occurrences by relevance, and
+	// mysqlLikeSearchOccurrences, formatted with a LIKE condition per word, returns the
+	// most recently modified first.
+	mysqlFullTextSearchOccurrences = `SELECT occurrence_id, data, compressed_details, create_time, update_time FROM occurrences
+		WHERE project_id = ? AND MATCH(search_text) AGAINST (? IN NATURAL LANGUAGE MODE)
+		ORDER BY MATCH(search_text) AGAINST (? IN NATURAL LANGUAGE MODE) DESC, id LIMIT ?`
+	mysqlLikeSearchOccurrences = `SELECT occurrence_id, data, compressed_details, create_time, update_time FROM occurrences
+		WHERE project_id = ? %s ORDER BY modify_time DESC, id DESC LIMIT ?`
+
+	// mysqlSearchOccurrences and mysqlDeleteOccurrences are formatted with the
+	// placeholders of the IDs.
+	mysqlSearchOccurrences = `SELECT occurrence_id, data, compressed_details, create_time, update_time FROM occurrences
+		WHERE project_id = ? AND occurrence_id IN (%s)`
+	mysqlDeleteOccurrences = `DELETE FROM occurrences WHERE project_id = ? AND occurrence_id IN (%s)`
+
+	// mysqlSummarizeVulnerabilityOccurrences counts the vulnerability occurrences,
+	// which are those with a severity, and the fixable ones by resource and severity.
+	mysqlSummarizeVulnerabilityOccurrences = `SELECT resource_url, severity, COUNT(*), SUM(fixable) FROM occurrences
+		WHERE project_id = ? AND severity IS NOT NULL %s
+		GROUP BY resource_url, severity ORDER BY resource_url, severity`
+
+	// mysqlCountOccurrencesByKind counts the occurrences of a project by kind, using
+	// the kind index, for the project statistics.
+	mysqlCountOccurrencesByKind = `SELECT kind, COUNT(*) FROM occurrences WHERE project_id = ? GROUP BY kind`
+
+	// mysqlInsertNotes is followed by one mysqlInsertNoteRow per note.
+	mysqlInsertNotes   = `INSERT INTO notes(project_id, note_id, data, compressed_details, created_by) VALUES `
+	mysqlInsertNoteRow = `(?, ?, ?, ?, ?)`
+	mysqlInsertNote    = mysqlInsertNotes + mysqlInsertNoteRow
+
+	mysqlSearchNote = `SELECT data, compressed_details FROM notes WHERE project_id = ? AND note_id = ?`
+	mysqlNoteExists = `SELECT 1 FROM notes WHERE project_id = ? AND note_id = ?`
+	mysqlLockNote   = `SELECT data, compressed_details FROM notes WHERE project_id = ? AND note_id = ? FOR UPDATE`
+	mysqlUpdateNote = `UPDATE notes SET data = ?, compressed_details = ?, updated_by = ? WHERE project_id = ? AND note_id = ?`
+	mysqlDeleteNote = `DELETE FROM notes WHERE project_id = ? AND note_id = ?`
+	mysqlListNotes  = `SELECT id, data, compressed_details FROM notes WHERE project_id = ? %s AND id > ? ORDER BY id LIMIT ?`
+	mysqlCountNotes = `SELECT COUNT(*) FROM notes WHERE project_id = ? %s`
+
+	// mysqlSearchNotes is formatted with the placeholders of the IDs.
+	mysqlSearchNotes = `SELECT note_id, data, compressed_details FROM notes WHERE project_id = ? AND note_id IN (%s)`
+
+	mysqlDeleteNoteOccurrences = `DELETE FROM occurrences WHERE note_project_id = ? AND note_id = ?`
+	mysqlLockNoteOccurrence    = `SELECT 1 FROM occurrences WHERE note_project_id = ? AND note_id = ? LIMIT 1 LOCK IN SHARE MODE`
+	mysqlListNoteOccurrences   = `SELECT id, project_id, occurrence_id, data, compressed_details, create_time, update_time FROM occurrences
+		WHERE note_project_id = ? AND note_id = ? %s AND id > ? ORDER BY id LIMIT ?`
+	mysqlCountNoteOccurrences = `SELECT COUNT(*) FROM occurrences WHERE note_project_id = ? AND note_id = ? %s`
+
+	// mysqlLockProjectNoteOccurrence locks an occurrence of any note of a project.
+	mysqlLockProjectNoteOccurrence = `SELECT 1 FROM occurrences WHERE note_project_id = ? LIMIT 1 LOCK IN SHARE MODE`
+
+	// mysqlInsertAuditEvents is followed by one mysqlInsertAuditEventRow per event.
+	mysqlInsertAuditEvents   = `INSERT INTO audit_log(operation, entity_type, project_id, entity_id, user_id, event_time) VALUES `
+	mysqlInsertAuditEventRow = `(?, ?, ?, ?, ?, ?)`
+	mysqlListAuditEvents     = `SELECT id, operation, entity_type, entity_id, user_id, event_time FROM audit_log
+		WHERE project_id = ? AND id > ? ORDER BY id LIMIT ?`
+)
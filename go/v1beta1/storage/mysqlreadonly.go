@@ -0,0 +1,45 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SetReadOnly puts the store in or out of read-only mode, e.g. during a migration or
+// an incident. In read-only mode, the methods creating, updating or deleting projects,
+// notes and occurrences return a FailedPrecondition error, while Get and List requests
+// are served as usual. Statements run by callers through WithTx are not affected.
+func (pg *MySQLStore) SetReadOnly(readOnly bool) {
+	pg.readOnlyMu.Lock()
+	defer pg.readOnlyMu.Unlock()
+	pg.readOnly = readOnly
+}
+
+// ReadOnly reports whether the store is in read-only mode; see SetReadOnly.
+func (pg *MySQLStore) ReadOnly() bool {
+	pg.readOnlyMu.RLock()
+	defer pg.readOnlyMu.RUnlock()
+	return pg.readOnly
+}
+
+// checkWritable returns a FailedPrecondition error if the store is in read-only mode.
+func (pg *MySQLStore) checkWritable() error {
+	if pg.ReadOnly() {
+		return status.Error(codes.FailedPrecondition, "store is read-only")
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/grafeas/grafeas/go/config"
+	"golang.org/x/net/context"
+)
+
+// primaryReadsKey is the context key marking reads that must go to the primary.
+type primaryReadsKey struct{}
+
+// ReadFromPrimary returns a context that sends the reads made with it to the primary
+// database rather than the read replica.
+//
+// Replication to the replica is asynchronous, so a read from the replica may not
+// see a write that has just been made. Callers that must read their own writes, such
+// as a Get following a Create, should use ReadFromPrimary.
+func ReadFromPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+// openReplica opens the read replica configured by config, or returns nil when no
+// replica is configured.
+func openReplica(config *config.MySQLConfig) (*sql.DB, error) {
+	if config.ReplicaHost == "" {
+		return nil, nil
+	}
+	source, err := sourceString(config, config.ReplicaHost, config.ReplicaPort, config.DbName)
+	if err != nil {
+		return nil, err
+	}
+	replica, err := sql.Open("mysql", source)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(replica, config)
+	if replica.Ping() != nil {
+		replica.Close()
+		return nil, errors.New("database replica is not alive")
+	}
+	return replica, nil
+}
+
+// reader returns the database that reads made with ctx are sent to: the read replica
+// if one is configured, and the primary otherwise or when ctx requires it.
+func (pg *MySQLStore) reader(ctx context.Context) *sql.DB {
+	if pg.replica == nil {
+		return pg.DB
+	}
+	if readsFromPrimary(ctx) {
+		return pg.DB
+	}
+	return pg.replica
+}
+
+// readsFromPrimary reports whether ctx was returned by ReadFromPrimary.
+func readsFromPrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadsKey{}).(bool)
+	return primary
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/grafeas/grafeas/go/config"
+	"golang.org/x/net/context"
+)
+
+// MySQL error numbers of transient failures that are resolved by retrying.
+const (
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+)
+
+// Retry defaults used when the corresponding config values are not set.
+const (
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 50 * time.Millisecond
+	maxRetryBackoff     = 2 * time.Second
+)
+
+// retryPolicy retries operations failing with transient errors, doubling the delay
+// between attempts. The zero value does not retry.
+type retryPolicy struct {
+	maxRetries int
+	backoff    time.Duration
+}
+
+// newRetryPolicy returns the retry policy configured by config, falling back to the
+// defaults for unset values. A negative MaxRetries disables retries.
+func newRetryPolicy(config *config.MySQLConfig) retryPolicy {
+	p := retryPolicy{maxRetries: config.MaxRetries, backoff: config.RetryBackoff}
+	if p.maxRetries == 0 {
+		p.maxRetries = defaultMaxRetries
+	}
+	if p.maxRetries < 0 {
+		p.maxRetries = 0
+	}
+	if p.backoff <= 0 {
+		p.backoff = defaultRetryBackoff
+	}
+	return p
+}
+
+// do runs op, running it again while it fails with a retryable error and retries
+// remain. It returns the error of the last attempt.
+func (p retryPolicy) do(ctx context.Context, op func() error) error {
+	backoff := p.backoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.maxRetries || !isRetryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// isRetryable reports whether err is a deadlock, a lock wait timeout or a failure to
+// begin a transaction on a broken connection, after which the failed statement or
+// transaction can be run again. Other connection errors, such as
+// mysql.ErrInvalidConn, may be returned after the server ran the statement, so a
+// write failing with them is not retried; database/sql already retries statements
+// failing with driver.ErrBadConn before they are sent.
+func isRetryable(err error) bool {
+	if _, ok := err.(beginError); ok {
+		return true
+	}
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && (mysqlErr.Number == mysqlErrDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout)
+}
+
+// beginError is a driver.ErrBadConn returned when beginning a transaction, before
+// any of its statements were sent.
+type beginError struct {
+	err error
+}
+
+func (e beginError) Error() string {
+	return e.err.Error()
+}
+
+// retryingExecer runs statements outside of a transaction with e, retrying them
+// according to policy.
+type retryingExecer struct {
+	e      execer
+	policy retryPolicy
+}
+
+func (r retryingExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := r.policy.do(ctx, func() error {
+		var err error
+		result, err = r.e.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+// writer returns the execer used for single statement writes, which retries
+// transient errors according to the store's retry policy.
+func (pg *MySQLStore) writer() execer {
+	return retryingExecer{e: pg.DB, policy: pg.retry}
+}
+
+// Startup retry defaults used when the corresponding config values are not set. They
+// give a database started at the same time as Grafeas about ten seconds to come up.
+const (
+	defaultStartupRetries       = 5
+	defaultStartupRetryInterval = 2 * time.Second
+)
+
+// startupPolicy retries connecting to the database when the store is created.
+type startupPolicy struct {
+	retries  int
+	interval time.Duration
+}
+
+// newStartupPolicy returns the startup retry policy configured by config, falling back
+// to the defaults for unset values. A negative StartupRetries disables retries.
+func newStartupPolicy(config *config.MySQLConfig) startupPolicy {
+	p := startupPolicy{retries: config.StartupRetries, interval: config.StartupRetryInterval}
+	if p.retries == 0 {
+		p.retries = defaultStartupRetries
+	}
+	if p.retries < 0 {
+		p.retries = 0
+	}
+	if p.interval <= 0 {
+		p.interval = defaultStartupRetryInterval
+	}
+	return p
+}
+
+// do runs op until it succeeds, waiting interval between attempts and logging the
+// failed ones to logger. It returns an error wrapping the last failure when all
+// attempts fail.
+func (p startupPolicy) do(logger Logger, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if attempt > p.retries {
+			return fmt.Errorf("database is not reachable after %d attempts: %v", attempt, err)
+		}
+		logger.Infof("database is not reachable, retrying in %v: %v", p.interval, err)
+		time.Sleep(p.interval)
+	}
+}
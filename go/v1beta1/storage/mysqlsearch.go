@@ -0,0 +1,114 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/grafeas/grafeas/go/name"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// mysqlErrNoFullTextIndex is the MySQL and MariaDB error number of a MATCH on columns
+// without a FULLTEXT index.
+const mysqlErrNoFullTextIndex = 1191
+
+// SearchOccurrences returns up to pageSize occurrences of project pID whose text
+// matches query, most relevant first. The text searched is the remediation and the
+// vulnerability short and long descriptions, which are matched word by word in the
+// server's natural language mode: words shorter than the server's minimum token size,
+// 3 characters by default, and stopwords are ignored.
+//
+// The details of occurrences written with CompressDocuments or a DataKey cannot be
+// searched, so SearchOccurrences fails with FailedPrecondition while either is set.
+//
+// On servers where the search_text column has no FULLTEXT index, the occurrences
+// containing every word of query are returned instead, most recently modified first.
+func (pg *MySQLStore) SearchOccurrences(ctx context.Context, pID, query string, pageSize int32) (_ []*pb.Occurrence, err error) {
+	defer pg.observe(ctx, "SearchOccurrences", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	if pg.compressDocuments || len(pg.dataKeys) > 0 {
+		return nil, status.Error(codes.FailedPrecondition, "Searching Occurrences is unavailable while documents are compressed or encrypted")
+	}
+	words := strings.Fields(query)
+	if len(words) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Search query is empty")
+	}
+	limit := pg.pageLimit(int(pageSize))
+	rows, err := pg.reader(ctx).QueryContext(ctx, pg.prefixed(mysqlFullTextSearchOccurrences), pID, query, query, limit)
+	if isNoFullTextIndex(err) {
+		likeQuery, args := likeSearchQuery(pg.prefixed(mysqlLikeSearchOccurrences), pID, words)
+		rows, err = pg.reader(ctx).QueryContext(ctx, likeQuery, append(args, limit)...)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to search Occurrences in database")
+	}
+	defer rows.Close()
+	var os []*pb.Occurrence
+	for rows.Next() {
+		var data string
+		var storedID, details []byte
+		var createTime, updateTime sql.NullTime
+		if err := rows.Scan(&storedID, &data, &details, &createTime, &updateTime); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to scan Occurrences row")
+		}
+		var o pb.Occurrence
+		if err := pg.unmarshalOccurrence(data, details, createTime, updateTime, &o); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		o.Name = name.FormatOccurrence(pID, decodeOccurrenceID(storedID))
+		os = append(os, &o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to search Occurrences in database")
+	}
+	return os, nil
+}
+
+// likeSearchQuery formats query, which has a %s for its conditions, to match the
+// search_text containing every one of words, and returns it with its arguments.
+func likeSearchQuery(query, pID string, words []string) (string, []interface{}) {
+	conditions := make([]string, len(words))
+	args := []interface{}{pID}
+	for i, word := range words {
+		conditions[i] = "AND search_text LIKE ?"
+		args = append(args, "%"+escapeLike(word)+"%")
+	}
+	return fmt.Sprintf(query, strings.Join(conditions, " ")), args
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns and the escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// escapeLike returns s escaped to match itself in a LIKE pattern.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// isNoFullTextIndex reports whether err is a MATCH failing for lack of a FULLTEXT
+// index.
+func isNoFullTextIndex(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == mysqlErrNoFullTextIndex
+}
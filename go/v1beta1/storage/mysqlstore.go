@@ -14,98 +14,616 @@
 package storage
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/fernet/fernet-go"
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
-	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/google/uuid"
 	"github.com/grafeas/grafeas/go/config"
 	"github.com/grafeas/grafeas/go/name"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
 	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	pkgpb "github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
 	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
-	"github.com/go-sql-driver/mysql"
+	vulnpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	fieldmaskpb "google.golang.org/genproto/protobuf/field_mask"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// mysqlErrDuplicateEntry is the MySQL error number for a duplicate key (ER_DUP_ENTRY).
+const mysqlErrDuplicateEntry = 1062
+
+// defaultPort is the MySQL port used when neither Port nor Host specify one.
+const defaultPort = 3306
+
+// Connection pool defaults used when the corresponding config values are not set.
+// Connections are recycled well before MySQL's wait_timeout or a proxy drops them.
+const (
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 10
+	defaultConnMaxIdleTime = 5 * time.Minute
+	defaultConnMaxLifetime = 4 * time.Minute
+)
+
+// Page size used when a List request does not specify one, and the maximum page size
+// used when MaxPageSize is not set.
+const (
+	defaultPageSize    = 100
+	defaultMaxPageSize = 1000
+)
+
+// defaultMaxDocumentBytes is the maximum size of the JSON of a note or occurrence
+// written by the store when MaxDocumentBytes is not set.
+const defaultMaxDocumentBytes = 1 << 20
+
+// defaultDeleteBatchSize is the number of occurrences deleted by each statement of
+// DeleteExpiredOccurrences when DeleteBatchSize is not set.
+const defaultDeleteBatchSize = 1000
+
+// Network timeouts used when the corresponding config values are not set, so that
+// a connection to an unresponsive server does not block a request indefinitely.
+const (
+	defaultDialTimeout  = 10 * time.Second
+	defaultReadTimeout  = 30 * time.Second
+	defaultWriteTimeout = 30 * time.Second
+)
+
+// Character set and collation used when Charset and Collation are not set. utf8mb4
+// stores all of UTF-8, unlike MySQL's utf8 and the latin1 default of older servers.
+const (
+	defaultCharset   = "utf8mb4"
+	defaultCollation = "utf8mb4_unicode_ci"
+)
+
+// mysqlDatetimeFormat is the format of DATETIME(6) values, which are stored in UTC.
+const mysqlDatetimeFormat = "2006-01-02 15:04:05.000000"
+
+// pageTokenTTL is how long a page token returned by a List method remains valid.
+const pageTokenTTL = 24 * time.Hour
+
+// mysqlDbNamePattern restricts database names to characters that are safe to
+// use as a quoted identifier.
+var mysqlDbNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// execer is implemented by both *sql.DB and *sql.Tx, so that statements can be
+// run either directly against the pool or as part of a transaction.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// userKey is the context key holding the ID of the user making a request.
+type userKey struct{}
+
+// WithUser returns a context recording uID as the user making the requests made with
+// it, so that updates can record who made them.
+func WithUser(ctx context.Context, uID string) context.Context {
+	return context.WithValue(ctx, userKey{}, uID)
+}
+
+// userFromContext returns the user recorded in ctx by WithUser, as a NULL string when
+// there is none.
+func userFromContext(ctx context.Context) sql.NullString {
+	uID, _ := ctx.Value(userKey{}).(string)
+	return nullString(uID)
+}
+
+// occurrenceIDKey is the context key holding the ID to create an occurrence with.
+type occurrenceIDKey struct{}
+
+// WithOccurrenceID returns a context making CreateOccurrence create the occurrence with
+// ID oID rather than a random one. A client retrying a create with the same ID gets
+// the occurrence created by the first attempt instead of a duplicate.
+func WithOccurrenceID(ctx context.Context, oID string) context.Context {
+	return context.WithValue(ctx, occurrenceIDKey{}, oID)
+}
+
+// validOccurrenceID matches the IDs accepted by WithOccurrenceID, which must fit the
+// occurrence_id column.
+var validOccurrenceID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,35}$`)
+
+// validID matches project and note IDs. They are segments of resource names, so they
+// must not contain '/' or spaces, and must fit the project_id and note_id columns.
+var validID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,254}$`)
+
+// checkID returns an InvalidArgument error if id, the ID of a resource of the given
+// kind, is empty or not matched by valid.
+func checkID(kind, id string, valid *regexp.Regexp) error {
+	if id == "" {
+		return status.Errorf(codes.InvalidArgument, "Empty %s ID", kind)
+	}
+	if !valid.MatchString(id) {
+		return status.Errorf(codes.InvalidArgument, "Invalid %s ID %q", kind, id)
+	}
+	return nil
+}
+
+// checkProjectID returns an InvalidArgument error if pID is not a valid project ID.
+func checkProjectID(pID string) error {
+	return checkID("project", pID, validID)
+}
+
+// checkNoteName returns an InvalidArgument error if pID or nID is not a valid ID.
+func checkNoteName(pID, nID string) error {
+	if err := checkProjectID(pID); err != nil {
+		return err
+	}
+	return checkID("note", nID, validID)
+}
+
+// checkOccurrenceName returns an InvalidArgument error if pID or oID is not a valid ID.
+func checkOccurrenceName(pID, oID string) error {
+	if err := checkProjectID(pID); err != nil {
+		return err
+	}
+	return checkID("occurrence", oID, validOccurrenceID)
+}
+
+// nullString returns s as a string column value, with the empty string stored as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Store is the interface of the storage operations of MySQLStore, so that code
+// depending on the store can be tested against a fake.
+type Store interface {
+	CreateProject(ctx context.Context, pID string, p *prpb.Project) (*prpb.Project, error)
+	UpdateProject(ctx context.Context, pID string, p *prpb.Project, mask *fieldmaskpb.FieldMask) (*prpb.Project, error)
+	DeleteProject(ctx context.Context, pID string) error
+	GetProject(ctx context.Context, pID string) (*prpb.Project, error)
+	ProjectCreateTime(ctx context.Context, pID string) (time.Time, error)
+	ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) ([]*prpb.Project, string, error)
+
+	CreateOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (*pb.Occurrence, error)
+	UpsertOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (*pb.Occurrence, error)
+	BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*pb.Occurrence) ([]*pb.Occurrence, []error)
+	DeleteOccurrence(ctx context.Context, pID, oID string) error
+	DeleteOccurrences(ctx context.Context, pID string, oIDs []string) (int64, error)
+	DeleteOccurrencesByNote(ctx context.Context, pID, nID string) (int64, error)
+	DeleteExpiredOccurrences(ctx context.Context, pID string, olderThan time.Time) (int64, error)
+	DeleteAllOccurrences(ctx context.Context, pID string) (int64, error)
+	UpdateOccurrence(ctx context.Context, pID, oID string, o *pb.Occurrence, mask *fieldmaskpb.FieldMask) (*pb.Occurrence, error)
+	GetOccurrence(ctx context.Context, pID, oID string) (*pb.Occurrence, error)
+	GetOccurrenceForUpdate(ctx context.Context, tx *sql.Tx, pID, oID string) (*pb.Occurrence, error)
+	GetOccurrences(ctx context.Context, pID string, oIDs []string) (map[string]*pb.Occurrence, error)
+	ListOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error)
+	ListOccurrencesWithCount(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, int64, error)
+	ListRecentOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error)
+	IterateOccurrences(ctx context.Context, pID, filter string, fn func(*pb.Occurrence) error) error
+
+	CreateNote(ctx context.Context, pID, nID, uID string, n *pb.Note) (*pb.Note, error)
+	BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*pb.Note) ([]*pb.Note, []error)
+	DeleteNote(ctx context.Context, pID, nID string) error
+	DeleteNoteAndOccurrences(ctx context.Context, pID, nID string) error
+	DeleteAllNotes(ctx context.Context, pID string) (int64, error)
+	UpdateNote(ctx context.Context, pID, nID string, n *pb.Note, mask *fieldmaskpb.FieldMask) (*pb.Note, error)
+	GetNote(ctx context.Context, pID, nID string) (*pb.Note, error)
+	GetNotes(ctx context.Context, pID string, nIDs []string) (map[string]*pb.Note, error)
+	GetOccurrenceNote(ctx context.Context, pID, oID string) (*pb.Note, error)
+	ListNotes(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Note, string, error)
+	ListNotesWithCount(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Note, string, int64, error)
+	IterateNotes(ctx context.Context, pID, filter string, fn func(*pb.Note) error) error
+	ListAllNotes(ctx context.Context, pID, filter string) ([]*pb.Note, error)
+	ListNoteOccurrences(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error)
+	ListNoteOccurrencesWithCount(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, int64, error)
+
+	GetVulnerabilityOccurrencesSummary(ctx context.Context, projectID, filter string) (*pb.VulnerabilityOccurrencesSummary, error)
+	GetProjectStatistics(ctx context.Context, pID string) (*ProjectStats, error)
+	SearchOccurrences(ctx context.Context, pID, query string, pageSize int32) ([]*pb.Occurrence, error)
+	ListAuditEvents(ctx context.Context, pID, pageToken string, pageSize int32) ([]*AuditEvent, string, error)
+	ExportProject(ctx context.Context, pID string, w io.Writer) error
+	ImportProject(ctx context.Context, pID string, r io.Reader) error
+
+	WithTx(ctx context.Context, fn func(*sql.Tx) error) error
+	Healthcheck(ctx context.Context) error
+	Stats() sql.DBStats
+	Close() error
+}
+
+var _ Store = (*MySQLStore)(nil)
+
 type MySQLStore struct {
 	*sql.DB
-	paginationKey string
+	// replica serves reads when a read replica is configured; see reader.
+	replica *sql.DB
+	// paginationKeys decrypt page tokens; the first one also encrypts them.
+	paginationKeys []*fernet.Key
+	maxPageSize    int
+	retry          retryPolicy
+	metrics        *storeMetrics
+	logger         Logger
+	clock          Clock
+	// logSlowQueries makes operations taking slowQueryThreshold or longer be logged.
+	logSlowQueries     bool
+	slowQueryThreshold time.Duration
+	// preventOrphans makes DeleteNote fail for notes that still have occurrences.
+	preventOrphans bool
+	// strictNoteReferences makes creating an occurrence of a missing note fail.
+	strictNoteReferences bool
+	// approximateCounts makes the List...WithCount methods return the optimizer's
+	// estimate of the total rather than counting the rows.
+	approximateCounts bool
+	// compressDocuments makes notes and occurrences be written with their details
+	// compressed; see marshalStored.
+	compressDocuments bool
+	// dataKeys decrypt notes and occurrences; the first one also encrypts them.
+	// Notes and occurrences are not encrypted when there are none; see marshalStored.
+	dataKeys []*fernet.Key
+	// maxDocumentBytes is the maximum size of the JSON of a note or occurrence written
+	// by the store; see marshalStored.
+	maxDocumentBytes int
+	// auditLog makes changes be recorded in the audit_log table; see recordAudit.
+	auditLog bool
+	// notes caches the notes returned by GetNote; see noteCache.
+	notes *noteCache
+	// deleteBatchSize is the number of rows deleted by each statement of bulk deletes.
+	deleteBatchSize int
+	// flavor is the database server, whose SQL dialect filters are translated to; see
+	// newFilter.
+	flavor serverFlavor
+	// tablePrefix is prepended to the table names in queries; see prefixed.
+	tablePrefix     string
+	prefixedQueries sync.Map
+	// readOnly makes the write methods fail; see SetReadOnly.
+	readOnlyMu sync.RWMutex
+	readOnly   bool
 }
 
 func NewMySQLStore(config *config.MySQLConfig) (*MySQLStore, error) {
-	paginationKey := config.PaginationKey
-	if paginationKey == "" {
-		log.Println("pagination key is empty, generating...")
+	if err := validateConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid mysql config: %v", err)
+	}
+	logger := newLogger(config)
+	paginationKeys, err := newPaginationKeys(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	dataKeys, err := newDataKeys(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := registerTLSConfig(config); err != nil {
+		return nil, err
+	}
+	// The database server may still be starting, e.g. when it is started alongside
+	// Grafeas, so connecting to it is retried.
+	startup := newStartupPolicy(config)
+	charset, collation := charsetAndCollation(config)
+	serverSource, err := sourceString(config, config.Host, config.Port, "mysql")
+	if err != nil {
+		return nil, err
+	}
+	err = startup.do(logger, func() error {
+		return myscreateDatabase(serverSource, config.DbName, charset, collation)
+	})
+	if err != nil {
+		return nil, err
+	}
+	source, err := sourceString(config, config.Host, config.Port, config.DbName)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", source)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(db, config)
+	if err := startup.do(logger, db.Ping); err != nil {
+		db.Close()
+		return nil, err
+	}
+	flavor, err := detectFlavor(context.Background(), db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to detect the database server version: %v", err)
+	}
+	schema := mysqlSchema{prefix: config.TablePrefix, charset: charset, collation: collation}
+	if _, err := migrate(context.Background(), db, logger, schema); err != nil {
+		db.Close()
+		logger.Errorf("error migrating database schema: %s", err)
+		return nil, err
+	}
+	if err := checkCharsets(context.Background(), db, logger, schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to check the character sets of the tables: %v", err)
+	}
+	replica, err := openReplica(config)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	logger.Infof("%s db connection created: %v", flavor, db)
+	maxPageSize := config.MaxPageSize
+	if maxPageSize <= 0 {
+		maxPageSize = defaultMaxPageSize
+	}
+	maxDocumentBytes := config.MaxDocumentBytes
+	if maxDocumentBytes <= 0 {
+		maxDocumentBytes = defaultMaxDocumentBytes
+	}
+	deleteBatchSize := config.DeleteBatchSize
+	if deleteBatchSize <= 0 {
+		deleteBatchSize = defaultDeleteBatchSize
+	}
+	return &MySQLStore{
+		DB:                   db,
+		replica:              replica,
+		paginationKeys:       paginationKeys,
+		dataKeys:             dataKeys,
+		flavor:               flavor,
+		maxPageSize:          maxPageSize,
+		retry:                newRetryPolicy(config),
+		logger:               logger,
+		clock:                newClock(config),
+		logSlowQueries:       config.LogSlowQueries || config.SlowQueryThreshold > 0,
+		slowQueryThreshold:   config.SlowQueryThreshold,
+		preventOrphans:       config.PreventOrphanedOccurrences,
+		strictNoteReferences: config.StrictNoteReferences,
+		approximateCounts:    config.ApproximateCounts,
+		compressDocuments:    config.CompressDocuments,
+		maxDocumentBytes:     maxDocumentBytes,
+		auditLog:             config.AuditLog,
+		notes:                newNoteCache(config.NoteCacheSize),
+		deleteBatchSize:      deleteBatchSize,
+		tablePrefix:          config.TablePrefix,
+		readOnly:             config.ReadOnly,
+	}, nil
+}
+
+// pageLimit returns the number of rows to fetch for a List request of pageSize,
+// using the default page size for non-positive values and capping it at the
+// maximum page size.
+func (pg *MySQLStore) pageLimit(pageSize int) int {
+	return limitPageSize(pageSize, pg.maxPageSize)
+}
+
+// limitPageSize returns pageSize, or the default page size for non-positive values,
+// capped at maxPageSize, or at the default maximum when maxPageSize is not positive.
+func limitPageSize(pageSize, maxPageSize int) int {
+	if maxPageSize <= 0 {
+		maxPageSize = defaultMaxPageSize
+	}
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return pageSize
+}
+
+// newPaginationKeys returns the keys of the page tokens configured by config: the
+// pagination key, generated if it is not set, followed by the secondary pagination
+// keys. Tokens encrypted with a secondary key are still accepted, so the pagination
+// key can be rotated by making it secondary until the tokens it encrypted expire.
+func newPaginationKeys(config *config.MySQLConfig, logger Logger) ([]*fernet.Key, error) {
+	var keys []*fernet.Key
+	if config.PaginationKey == "" {
+		logger.Infof("pagination key is empty, generating...")
 		var key fernet.Key
 		if err := key.Generate(); err != nil {
 			return nil, errors.New(fmt.Sprintf("failed to generate pagination key, %s", err))
 		}
-		paginationKey = key.Encode()
+		keys = append(keys, &key)
 	} else {
-		// Validate pagination key
-		_, err := fernet.DecodeKey(paginationKey)
+		key, err := fernet.DecodeKey(config.PaginationKey)
 		if err != nil {
 			return nil, errors.New("invalid pagination key; must be 32-bit URL-safe base64")
 		}
+		keys = append(keys, key)
 	}
-	if err := myscreateDatabase(MySCreateSourceString(config.User, config.Password, config.Host, "mysql", config.SSLMode), config.DbName); err != nil {
-		return nil, err
+	for _, encoded := range config.SecondaryPaginationKeys {
+		key, err := fernet.DecodeKey(encoded)
+		if err != nil {
+			return nil, errors.New("invalid secondary pagination key; must be 32-bit URL-safe base64")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// encodePageToken returns the page token for the page following the row with id,
+// encrypted with the primary pagination key.
+func (pg *MySQLStore) encodePageToken(id int64) (string, error) {
+	return pg.encryptPageToken(strconv.FormatInt(id, 10))
+}
+
+// encryptPageToken returns the page token holding cursor, encrypted with the primary
+// pagination key.
+func (pg *MySQLStore) encryptPageToken(cursor string) (string, error) {
+	if len(pg.paginationKeys) == 0 {
+		return "", errors.New("no pagination key")
 	}
-	db, err := sql.Open("mysql", MySCreateSourceString(config.User, config.Password, config.Host, config.DbName, config.SSLMode))
+	token, err := fernet.EncryptAndSign([]byte(cursor), pg.paginationKeys[0])
 	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// decodePageToken returns the id of the last row of the previous page encoded in
+// pageToken, or 0 when pageToken is empty. It returns an InvalidArgument error for
+// a token that is malformed, was not issued by this store or has expired.
+func (pg *MySQLStore) decodePageToken(pageToken string) (int64, error) {
+	if pageToken == "" {
+		return 0, nil
+	}
+	decrypted := fernet.VerifyAndDecrypt([]byte(pageToken), pageTokenTTL, pg.paginationKeys)
+	if decrypted == nil {
+		return 0, status.Error(codes.InvalidArgument, "Invalid or expired page token")
+	}
+	id, err := strconv.ParseInt(string(decrypted), 10, 64)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, "Invalid page token")
+	}
+	return id, nil
+}
+
+// encodeTimePageToken returns the page token for the page following the row with
+// modification time t and id, for lists ordered by modification time.
+func (pg *MySQLStore) encodeTimePageToken(t time.Time, id int64) (string, error) {
+	return pg.encryptPageToken(fmt.Sprintf("%d:%d", t.UnixNano(), id))
+}
+
+// decodeTimePageToken returns the modification time and id of the last row of the
+// previous page encoded in pageToken by encodeTimePageToken, or the latest possible
+// time and id when pageToken is empty. It returns an InvalidArgument error for a token
+// that is malformed, was not issued by this store or has expired.
+func (pg *MySQLStore) decodeTimePageToken(pageToken string) (time.Time, int64, error) {
+	if pageToken == "" {
+		return maxModifyTime, math.MaxInt64, nil
+	}
+	decrypted := fernet.VerifyAndDecrypt([]byte(pageToken), pageTokenTTL, pg.paginationKeys)
+	if decrypted == nil {
+		return time.Time{}, 0, status.Error(codes.InvalidArgument, "Invalid or expired page token")
+	}
+	parts := strings.Split(string(decrypted), ":")
+	if len(parts) != 2 {
+		return time.Time{}, 0, status.Error(codes.InvalidArgument, "Invalid page token")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, status.Error(codes.InvalidArgument, "Invalid page token")
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, status.Error(codes.InvalidArgument, "Invalid page token")
+	}
+	return time.Unix(0, nanos).UTC(), id, nil
+}
+
+// maxModifyTime is later than the modification time of any row, for the first page of
+// lists ordered by modification time.
+var maxModifyTime = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Close releases the resources held by the store and closes the connection pools,
+// waiting for queries that have already started to finish. Calls made after Close
+// return an error.
+func (pg *MySQLStore) Close() error {
+	pg.metrics.unregister()
+	if pg.replica != nil {
+		pg.replica.Close()
+	}
+	return pg.DB.Close()
+}
+
+// Stats returns the statistics of the connection pool of the primary database. A
+// growing WaitCount or WaitDuration means queries are waiting for connections and
+// MaxOpenConns may be too low. Waiting for a connection is bounded by the deadline of
+// the method's context, after which the method returns a DeadlineExceeded error.
+func (pg *MySQLStore) Stats() sql.DBStats {
+	return pg.DB.Stats()
+}
+
+// Healthcheck verifies that the database is reachable and able to serve queries,
+// returning a codes.Unavailable error when it is not.
+func (pg *MySQLStore) Healthcheck(ctx context.Context) error {
+	if err := pg.DB.PingContext(ctx); err != nil {
+		return status.Errorf(codes.Unavailable, "Database is not reachable: %v", err)
+	}
+	var one int
+	if err := pg.DB.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return status.Errorf(codes.Unavailable, "Database is not serving queries: %v", err)
+	}
+	return nil
+}
+
+// NewMySQLStoreWithMetrics creates a store like NewMySQLStore and registers Prometheus
+// metrics for its operations and connection pool with registerer. Metrics are not
+// recorded when registerer is nil.
+func NewMySQLStoreWithMetrics(config *config.MySQLConfig, registerer prometheus.Registerer) (*MySQLStore, error) {
+	pg, err := NewMySQLStore(config)
+	if err != nil || registerer == nil {
+		return pg, err
+	}
+	metrics, err := newStoreMetrics(pg.DB, registerer)
+	if err != nil {
+		pg.Close()
 		return nil, err
 	}
-	if db.Ping() != nil {
-		return nil, errors.New("database server is not alive")
+	pg.metrics = metrics
+	return pg, nil
+}
+
+// configurePool applies the connection pool settings from config to db,
+// falling back to the defaults for unset values.
+func configurePool(db *sql.DB, config *config.MySQLConfig) {
+	maxOpenConns := config.MaxOpenConns
+	if maxOpenConns <= 0 {
+		maxOpenConns = defaultMaxOpenConns
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+
+	maxIdleConns := config.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
 	}
-    for _, query := range mysqlCreateTables {
-        if _, err := db.Exec(query); err != nil {
-            db.Close()
-			log.Printf("error executing %s: %s", query, err)
-            return nil, err
-        }
-    }
-	log.Printf("MySQL db connection created: %v\n", db)
-	return &MySQLStore{
-		DB:            db,
-		paginationKey: paginationKey,
-	}, nil
+	db.SetMaxIdleConns(maxIdleConns)
+
+	connMaxIdleTime := config.ConnMaxIdleTime
+	if connMaxIdleTime <= 0 {
+		connMaxIdleTime = defaultConnMaxIdleTime
+	}
+	db.SetConnMaxIdleTime(connMaxIdleTime)
+
+	connMaxLifetime := config.ConnMaxLifetime
+	if connMaxLifetime <= 0 {
+		connMaxLifetime = defaultConnMaxLifetime
+	}
+	db.SetConnMaxLifetime(connMaxLifetime)
+}
+
+// checkDbName returns an error if dbName cannot be used as a database name.
+func checkDbName(dbName string) error {
+	if !mysqlDbNamePattern.MatchString(dbName) {
+		return fmt.Errorf("invalid database name %q; must match %s", dbName, mysqlDbNamePattern)
+	}
+	return nil
 }
 
-func myscreateDatabase(source, dbName string) error {
+// myscreateDatabase creates the database dbName with the given default character set
+// and collation unless it already exists.
+func myscreateDatabase(source, dbName, charset, collation string) error {
+	if err := checkDbName(dbName); err != nil {
+		return err
+	}
+	if !mysqlDbNamePattern.MatchString(charset) || !mysqlDbNamePattern.MatchString(collation) {
+		return fmt.Errorf("invalid charset %q or collation %q; must match %s", charset, collation, mysqlDbNamePattern)
+	}
 	db, err := sql.Open("mysql", source)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 	// Check if db exists
-	res, err := db.Query(
-		fmt.Sprintf("select count(*) from information_schema.schemata where schema_name = '%s'", dbName))
-	if err != nil {
-		return err
-	} 
-	if err, ok := err.(*mysql.MySQLError); ok {
-		return err
-	} 
 	var rowCnt int
-	res.Next()
-	res.Scan(&rowCnt)
+	err = db.QueryRow(
+		"select count(*) from information_schema.schemata where schema_name = ?", dbName).Scan(&rowCnt)
 	if err != nil {
 		return err
 	}
 	// Create database if it doesn't exist
 	if rowCnt == 0 {
-		_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s;", dbName))
+		_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s CHARACTER SET %s COLLATE %s;", quoteIdent(dbName), charset, collation))
 		if err != nil {
-			fmt.Println(err)
 			return err
 		}
 	}
@@ -113,135 +631,476 @@ func myscreateDatabase(source, dbName string) error {
 }
 
 // CreateProject adds the specified project to the store
-func (pg *MySQLStore) CreateProject(ctx context.Context, pID string, p *prpb.Project) (*prpb.Project, error) {
-	_, err := pg.DB.Exec(mysqlInsertProject, name.FormatProject(pID))
+func (pg *MySQLStore) CreateProject(ctx context.Context, pID string, p *prpb.Project) (_ *prpb.Project, err error) {
+	defer pg.observe(ctx, "CreateProject", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, status.Error(codes.InvalidArgument, "project must not be nil")
+	}
+	pName := name.FormatProject(pID)
+	p = proto.Clone(p).(*prpb.Project)
+	p.Name = pName
+	project, err := marshalDocument(p)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to marshal Project")
+	}
+	ev := pg.auditEvent("CreateProject", AuditProject, pID, pID, userFromContext(ctx))
+	_, err = pg.execAudited(ctx, ev, pg.prefixed(mysqlInsertProject), pName, project, pg.now())
+	if isDuplicateEntry(err) {
+		return nil, status.Errorf(codes.AlreadyExists, "Project with name %q already exists", pName)
+	}
 	if err != nil {
-		log.Println("Failed to insert Project in database", err)
+		pg.log().Errorf("Failed to insert Project in database: %v", err)
 		return nil, status.Error(codes.Internal, "Failed to insert Project in database")
 	}
 	return p, nil
 }
 
-// DeleteProject deletes the project with the given pID from the store
-func (pg *MySQLStore) DeleteProject(ctx context.Context, pID string) error {
+// UpdateProject updates the existing project with the given pID.
+// When mask has paths, only those fields are copied from p onto the stored project;
+// otherwise the stored project is replaced. The name of the project cannot change.
+func (pg *MySQLStore) UpdateProject(ctx context.Context, pID string, p *prpb.Project, mask *fieldmaskpb.FieldMask) (_ *prpb.Project, err error) {
+	defer pg.observe(ctx, "UpdateProject", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, status.Error(codes.InvalidArgument, "project must not be nil")
+	}
+	// MySQL reports no affected rows for an update that leaves the row unchanged, so
+	// the project is looked up first to tell a missing project apart.
+	existing, err := pg.GetProject(ReadFromPrimary(ctx), pID)
+	if err != nil {
+		return nil, err
+	}
+	p = proto.Clone(p).(*prpb.Project)
+	if len(mask.GetPaths()) > 0 {
+		if err := applyFieldMask(existing, p, mask); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid update mask: %v", err)
+		}
+		p = existing
+	}
 	pName := name.FormatProject(pID)
-	result, err := pg.DB.Exec(mysqlDeleteProject, pName)
+	p.Name = pName
+
+	project, err := marshalDocument(p)
 	if err != nil {
-		return status.Error(codes.Internal, "Failed to delete Project from database")
+		return nil, status.Error(codes.Internal, "Failed to marshal Project")
+	}
+	ev := pg.auditEvent("UpdateProject", AuditProject, pID, pID, userFromContext(ctx))
+	if _, err := pg.execAudited(ctx, ev, pg.prefixed(mysqlUpdateProject), project, pName); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to update Project")
+	}
+	return p, nil
+}
+
+// DeleteProject deletes the project with the given pID from the store, along with
+// all of its notes and occurrences, in a single transaction.
+func (pg *MySQLStore) DeleteProject(ctx context.Context, pID string) (err error) {
+	defer pg.observe(ctx, "DeleteProject", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return err
+	}
+	defer pg.notes.removeProject(pID)
+	pName := name.FormatProject(pID)
+	err = pg.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, pg.prefixed(mysqlDeleteProjectOccurrences), pID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, pg.prefixed(mysqlDeleteProjectNotes), pID); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, pg.prefixed(mysqlDeleteProject), pName)
+		if err != nil {
+			return err
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			// Roll back the deletes of a project that does not exist.
+			return status.Errorf(codes.NotFound, "Project with name %q does not Exist", pName)
+		}
+		return pg.recordAudit(ctx, tx, pg.auditEvent("DeleteProject", AuditProject, pID, pID, userFromContext(ctx)))
+	})
+	if status.Code(err) == codes.NotFound {
+		return err
 	}
-	count, err := result.RowsAffected()
 	if err != nil {
+		pg.log().Errorf("Failed to delete Project from database: %v", err)
 		return status.Error(codes.Internal, "Failed to delete Project from database")
 	}
-	if count == 0 {
-		return status.Errorf(codes.NotFound, "Project with name %q does not Exist", pName)
-	}
 	return nil
 }
 
 // GetProject returns the project with the given pID from the store
-func (pg *MySQLStore) GetProject(ctx context.Context, pID string) (*prpb.Project, error) {
+func (pg *MySQLStore) GetProject(ctx context.Context, pID string) (_ *prpb.Project, err error) {
+	defer pg.observe(ctx, "GetProject", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
 	pName := name.FormatProject(pID)
-	var exists bool
-	err := pg.DB.QueryRow(mysqlProjectExists, pName).Scan(&exists)
-	if err != nil {
+	var data sql.NullString
+	err = pg.reader(ctx).QueryRowContext(ctx, pg.prefixed(mysqlSearchProject), pName).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, status.Errorf(codes.NotFound, "Project with name %q does not Exist", pName)
+	case err != nil:
 		return nil, status.Error(codes.Internal, "Failed to query Project from database")
 	}
-	if !exists {
-		return nil, status.Errorf(codes.NotFound, "Project with name %q does not Exist", pName)
+	p, err := projectFromRow(pName, data)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to unmarshal Project from database")
 	}
-	return &prpb.Project{Name: pName}, nil
+	return p, nil
+}
+
+// ProjectCreateTime returns the time the project with the given pID was created. The
+// v1beta1 Project message has no field for it, so it is returned separately. Projects
+// created before creation times were recorded report the time the store was upgraded.
+func (pg *MySQLStore) ProjectCreateTime(ctx context.Context, pID string) (_ time.Time, err error) {
+	defer pg.observe(ctx, "ProjectCreateTime", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return time.Time{}, err
+	}
+	pName := name.FormatProject(pID)
+	var createTime sql.NullTime
+	err = pg.reader(ctx).QueryRowContext(ctx, pg.prefixed(mysqlProjectCreateTime), pName).Scan(&createTime)
+	switch {
+	case err == sql.ErrNoRows:
+		return time.Time{}, status.Errorf(codes.NotFound, "Project with name %q does not Exist", pName)
+	case err != nil:
+		return time.Time{}, status.Error(codes.Internal, "Failed to query Project from database")
+	}
+	if !createTime.Valid {
+		return time.Time{}, nil
+	}
+	return createTime.Time.UTC(), nil
+}
+
+// projectFromRow returns the project stored in a row of the projects table. Rows
+// created before project data was stored only have a name.
+func projectFromRow(pName string, data sql.NullString) (*prpb.Project, error) {
+	p := &prpb.Project{}
+	if data.Valid {
+		if err := unmarshalDocument(data.String, p); err != nil {
+			return nil, err
+		}
+	}
+	p.Name = pName
+	return p, nil
 }
 
 // ListProjects returns up to pageSize number of projects beginning at pageToken (or from
 // start if pageToken is the empty string).
-func (pg *MySQLStore) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) ([]*prpb.Project, string, error) {
-	var rows *sql.Rows
-	id := decryptInt64(pageToken, pg.paginationKey, 0)
-    rows, err := pg.DB.Query(mysqlListProjects, id, pageSize)
+func (pg *MySQLStore) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) (_ []*prpb.Project, _ string, err error) {
+	defer pg.observe(ctx, "ListProjects", time.Now(), &err)
+	id, err := pg.decodePageToken(pageToken)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to list Projects from database")
+		return nil, "", err
 	}
-	count, err := pg.count(mysqlProjectCount)
+	// Fetch one row more than the page to tell whether there is a next page.
+	limit := pg.pageLimit(pageSize)
+	rows, err := pg.reader(ctx).QueryContext(ctx, pg.prefixed(mysqlListProjects), id, limit+1)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to count Projects from database")
+		return nil, "", status.Error(codes.Internal, "Failed to list Projects from database")
 	}
+	defer rows.Close()
 	var projects []*prpb.Project
 	var lastId int64
+	morePages := false
 	for rows.Next() {
+		if len(projects) == limit {
+			morePages = true
+			break
+		}
 		var name string
-		err := rows.Scan(&lastId, &name)
+		var data sql.NullString
+		err := rows.Scan(&lastId, &name, &data)
 		if err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to scan Project row")
 		}
-		projects = append(projects, &prpb.Project{Name: name})
+		p, err := projectFromRow(name, data)
+		if err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Project from database")
+		}
+		projects = append(projects, p)
 	}
-	if count == lastId {
+	if err := rows.Err(); err != nil {
+		return nil, "", status.Error(codes.Internal, "Failed to list Projects from database")
+	}
+	if !morePages {
 		return projects, "", nil
 	}
-	encryptedPage, err := encryptInt64(lastId, pg.paginationKey)
+	encryptedPage, err := pg.encodePageToken(lastId)
 	if err != nil {
 		return nil, "", status.Error(codes.Internal, "Failed to paginate projects")
 	}
 	return projects, encryptedPage, nil
 }
 
-// CreateOccurrence adds the specified occurrence
-func (pg *MySQLStore) CreateOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (*pb.Occurrence, error) {
-	o = proto.Clone(o).(*pb.Occurrence)
-	o.CreateTime = ptypes.TimestampNow()
+// CreateOccurrence adds the specified occurrence. It is created with the ID set in ctx
+// by WithOccurrenceID if there is one, which must be up to 36 letters, digits, '-' or
+// '_'. If an occurrence with that ID already exists, it is returned along with an
+// AlreadyExists error.
+func (pg *MySQLStore) CreateOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (_ *pb.Occurrence, err error) {
+	defer pg.observe(ctx, "CreateOccurrence", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	oID, _ := ctx.Value(occurrenceIDKey{}).(string)
+	if oID != "" && !validOccurrenceID.MatchString(oID) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid occurrence ID %q", oID)
+	}
+	created, row, err := pg.newOccurrenceRow(ctx, pID, uID, oID, o, pg.timestampNow())
+	if err != nil {
+		return nil, err
+	}
+	ev := pg.auditEvent("CreateOccurrence", AuditOccurrence, pID, decodeOccurrenceID(row[1].([]byte)), nullString(uID))
+	_, err = pg.execAudited(ctx, ev, pg.prefixed(mysqlInsertOccurrence), row...)
+	if oID != "" && isDuplicateEntry(err) {
+		existing, err := pg.GetOccurrence(ReadFromPrimary(ctx), pID, oID)
+		if err != nil {
+			return nil, err
+		}
+		return existing, status.Errorf(codes.AlreadyExists, "Occurrence with name %q/%q already exists", pID, oID)
+	}
+	if isDuplicateEntry(err) {
+		return nil, status.Errorf(codes.AlreadyExists, "Occurrence with name %q/%q already exists", pID, decodeOccurrenceID(row[1].([]byte)))
+	}
+	if err != nil {
+		pg.log().Errorf("Failed to insert Occurrence %v in database: %v", row[4], err)
+		return nil, status.Error(codes.Internal, "Failed to insert Occurrence in database")
+	}
+	return created, nil
+}
 
-	var id string
-	if nr, err := uuid.NewRandom(); err != nil {
-		return nil, status.Error(codes.Internal, "Failed to generate UUID")
+// UpsertOccurrence creates the specified occurrence or, if an occurrence of the same
+// note and resource was upserted before, replaces that occurrence's data, keeping its
+// name and creation time. Scanners reporting the same findings again can use it to
+// avoid creating duplicates. Occurrences created with CreateOccurrence are not replaced.
+func (pg *MySQLStore) UpsertOccurrence(ctx context.Context, pID, uID string, o *pb.Occurrence) (_ *pb.Occurrence, err error) {
+	defer pg.observe(ctx, "UpsertOccurrence", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	_, row, err := pg.newOccurrenceRow(ctx, pID, uID, "", o, pg.timestampNow())
+	if err != nil {
+		return nil, err
+	}
+	key := upsertKey(row[2].(string), row[3].(string), o.GetResource().GetUri())
+	var data string
+	var oID, details []byte
+	var createTime, updateTime sql.NullTime
+	if pg.auditLog {
+		// The ID of the upserted occurrence is only known after the upsert, so it is
+		// read back in the same transaction to record it.
+		err = pg.withTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, pg.prefixed(mysqlUpsertOccurrence), append(row, key)...); err != nil {
+				return err
+			}
+			if err := tx.QueryRowContext(ctx, pg.prefixed(mysqlSearchUpsertedOccurrence), pID, key).Scan(&oID, &data, &details, &createTime, &updateTime); err != nil {
+				return err
+			}
+			return pg.recordAudit(ctx, tx, pg.auditEvent("UpsertOccurrence", AuditOccurrence, pID, decodeOccurrenceID(oID), nullString(uID)))
+		})
+		if err != nil {
+			pg.log().Errorf("Failed to upsert Occurrence %v in database: %v", row[4], err)
+			return nil, status.Error(codes.Internal, "Failed to upsert Occurrence in database")
+		}
 	} else {
+		if _, err := pg.writer().ExecContext(ctx, pg.prefixed(mysqlUpsertOccurrence), append(row, key)...); err != nil {
+			pg.log().Errorf("Failed to upsert Occurrence %v in database: %v", row[4], err)
+			return nil, status.Error(codes.Internal, "Failed to upsert Occurrence in database")
+		}
+		if err := pg.DB.QueryRowContext(ctx, pg.prefixed(mysqlSearchUpsertedOccurrence), pID, key).Scan(&oID, &data, &details, &createTime, &updateTime); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to query Occurrence from database")
+		}
+	}
+	var upserted pb.Occurrence
+	if err := pg.unmarshalOccurrence(data, details, createTime, updateTime, &upserted); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+	}
+	upserted.Name = name.FormatOccurrence(pID, decodeOccurrenceID(oID))
+	return &upserted, nil
+}
+
+// upsertKey returns the key identifying the occurrences of a note on a resource for
+// UpsertOccurrence. It is a hash, as the key columns would be too long for an index.
+func upsertKey(nPID, nID, resourceURL string) []byte {
+	key := sha256.Sum256([]byte(strings.Join([]string{nPID, nID, resourceURL}, "\x00")))
+	return key[:]
+}
+
+// newOccurrenceRow prepares o for insertion into project pID by user uID, with ID oID
+// or a random ID when oID is empty. It returns a copy of o with its name set and its
+// creation time set to createTime, and the values of its row in the
+// order of mysqlInsertOccurrenceRow. The update time of o, set on imported
+// occurrences, is kept. It returns an InvalidArgument error if o is nil or too large and,
+// when strict note references are configured, a FailedPrecondition error if the note
+// of o does not exist.
+func (pg *MySQLStore) newOccurrenceRow(ctx context.Context, pID, uID, oID string, o *pb.Occurrence, createTime *tspb.Timestamp) (*pb.Occurrence, []interface{}, error) {
+	if o == nil {
+		return nil, nil, status.Error(codes.InvalidArgument, "occurrence must not be nil")
+	}
+	o = proto.Clone(o).(*pb.Occurrence)
+	o.CreateTime = truncateTimestamp(createTime)
+	o.UpdateTime = truncateTimestamp(o.UpdateTime)
+
+	id := oID
+	if id == "" {
+		nr, err := uuid.NewRandom()
+		if err != nil {
+			return nil, nil, status.Error(codes.Internal, "Failed to generate UUID")
+		}
 		id = nr.String()
 	}
 	o.Name = fmt.Sprintf("projects/%s/occurrences/%s", pID, id)
 
 	nPID, nID, err := name.ParseNote(o.NoteName)
 	if err != nil {
-		log.Printf("Invalid note name: %v", o.NoteName)
-		return nil, status.Error(codes.InvalidArgument, "Invalid note name")
+		pg.log().Errorf("Invalid note name: %v", o.NoteName)
+		return nil, nil, status.Error(codes.InvalidArgument, "Invalid note name")
+	}
+	if pg.strictNoteReferences {
+		var one int
+		err := pg.DB.QueryRowContext(ctx, pg.prefixed(mysqlNoteExists), nPID, nID).Scan(&one)
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, nil, status.Errorf(codes.FailedPrecondition, "Note with name %q/%q does not Exist", nPID, nID)
+		case err != nil:
+			return nil, nil, status.Error(codes.Internal, "Failed to query Note from database")
+		}
 	}
-	occ, err := json.Marshal(o)
-    if err != nil {
-		log.Println("failed to marshal note")
+	occ, details, err := pg.marshalStored(o)
+	if err == errDocumentTooLarge {
+		return nil, nil, status.Error(codes.InvalidArgument, "occurrence too large")
 	}
-	_, err = pg.DB.Exec(mysqlInsertOccurrence, pID, id, nPID, nID, occ)
 	if err != nil {
-		log.Println("Failed to insert Occurrence in database", err, occ)
-		return nil, status.Error(codes.Internal, "Failed to insert Occurrence in database")
+		pg.log().Errorf("failed to marshal occurrence: %v", err)
+		return nil, nil, status.Error(codes.Internal, "Failed to marshal Occurrence")
 	}
-	return o, nil
+	return o, []interface{}{pID, occurrenceIDValue(id), nPID, nID, occ, nullString(uID), occurrenceKind(o), occurrenceSeverity(o), occurrenceFixable(o), nullString(o.GetResource().GetUri()), details, datetimeValue(o.CreateTime), datetimeValue(o.UpdateTime)}, nil
 }
 
-// BatchCreateOccurrence batch creates the specified occurrences in PostreSQL.
-func (pg *MySQLStore) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*pb.Occurrence) ([]*pb.Occurrence, []error) {
-	clonedOccs := []*pb.Occurrence{}
-	for _, o := range occs {
-		clonedOccs = append(clonedOccs, proto.Clone(o).(*pb.Occurrence))
-	}
-	occs = clonedOccs
+// occurrenceKind returns the kind of o, determined by its details, or its kind field
+// when it has none.
+func occurrenceKind(o *pb.Occurrence) cpb.NoteKind {
+	switch o.Details.(type) {
+	case *pb.Occurrence_Vulnerability:
+		return cpb.NoteKind_VULNERABILITY
+	case *pb.Occurrence_Build:
+		return cpb.NoteKind_BUILD
+	case *pb.Occurrence_DerivedImage:
+		return cpb.NoteKind_IMAGE
+	case *pb.Occurrence_Installation:
+		return cpb.NoteKind_PACKAGE
+	case *pb.Occurrence_Deployment:
+		return cpb.NoteKind_DEPLOYMENT
+	case *pb.Occurrence_Discovered:
+		return cpb.NoteKind_DISCOVERY
+	case *pb.Occurrence_Attestation:
+		return cpb.NoteKind_ATTESTATION
+	case *pb.Occurrence_Intoto:
+		return cpb.NoteKind_INTOTO
+	}
+	return o.Kind
+}
 
-	errs := []error{}
-	created := []*pb.Occurrence{}
+// occurrenceSeverity returns the severity of o, or NULL when o is not a vulnerability
+// occurrence.
+func occurrenceSeverity(o *pb.Occurrence) sql.NullInt64 {
+	v := o.GetVulnerability()
+	if v == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(v.Severity), Valid: true}
+}
+
+// occurrenceFixable reports whether o is a vulnerability occurrence with a fix available.
+func occurrenceFixable(o *pb.Occurrence) bool {
+	v := o.GetVulnerability()
+	return v != nil && isFixable(v)
+}
+
+// BatchCreateOccurrences batch creates the specified occurrences in a single transaction,
+// inserting them with as few multi-row INSERT statements as the statement size allows.
+// The batch is atomic: if any occurrence is invalid or the insert fails, nothing is
+// created, no occurrences are returned and the error slice holds the one failure.
+func (pg *MySQLStore) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*pb.Occurrence) (_ []*pb.Occurrence, errs []error) {
+	defer pg.observeBatch(ctx, "BatchCreateOccurrences", time.Now(), &errs)
+	if err := pg.checkWritable(); err != nil {
+		return nil, []error{err}
+	}
+	if err := checkProjectID(pID); err != nil {
+		return nil, []error{err}
+	}
+	errs = []error{}
+	created := make([]*pb.Occurrence, 0, len(occs))
+	rows := make([][]interface{}, 0, len(occs))
+	events := make([]*AuditEvent, 0, len(occs))
 	for _, o := range occs {
-		occ, err := pg.CreateOccurrence(ctx, pID, uID, o)
+		occ, row, err := pg.newOccurrenceRow(ctx, pID, uID, "", o, pg.timestampNow())
 		if err != nil {
-			// Occurrence already exists, skipping.
-			continue
-		} else {
-			created = append(created, occ)
+			return nil, append(errs, err)
+		}
+		created = append(created, occ)
+		rows = append(rows, row)
+		events = append(events, pg.auditEvent("BatchCreateOccurrences", AuditOccurrence, pID, decodeOccurrenceID(row[1].([]byte)), nullString(uID)))
+	}
+	if len(rows) == 0 {
+		return created, errs
+	}
+
+	err := pg.withTx(ctx, func(tx *sql.Tx) error {
+		for _, chunk := range insertChunks(rows) {
+			query, args := multiRowInsert(pg.prefixed(mysqlInsertOccurrences), mysqlInsertOccurrenceRow, chunk)
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return err
+			}
 		}
+		return pg.recordAudit(ctx, tx, events...)
+	})
+	if isDuplicateEntry(err) {
+		return nil, append(errs, status.Error(codes.AlreadyExists, "An Occurrence in the batch already exists"))
+	}
+	if err != nil {
+		pg.log().Errorf("Failed to insert Occurrences in database: %v", err)
+		return nil, append(errs, status.Error(codes.Internal, "Failed to insert Occurrences in database"))
 	}
 
 	return created, errs
 }
 
 // DeleteOccurrence deletes the occurrence with the given pID and oID
-func (pg *MySQLStore) DeleteOccurrence(ctx context.Context, pID, oID string) error {
-	result, err := pg.DB.Exec(mysqlDeleteOccurrence, pID, oID)
+func (pg *MySQLStore) DeleteOccurrence(ctx context.Context, pID, oID string) (err error) {
+	defer pg.observe(ctx, "DeleteOccurrence", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkOccurrenceName(pID, oID); err != nil {
+		return err
+	}
+	ev := pg.auditEvent("DeleteOccurrence", AuditOccurrence, pID, oID, userFromContext(ctx))
+	result, err := pg.execAudited(ctx, ev, pg.prefixed(mysqlDeleteOccurrence), pID, occurrenceIDValue(oID))
 	if err != nil {
 		return status.Error(codes.Internal, "Failed to delete Occurrence from database")
 	}
@@ -255,33 +1114,249 @@ func (pg *MySQLStore) DeleteOccurrence(ctx context.Context, pID, oID string) err
 	return nil
 }
 
-// UpdateOccurrence updates the existing occurrence with the given projectID and occurrenceID
-func (pg *MySQLStore) UpdateOccurrence(ctx context.Context, pID, oID string, o *pb.Occurrence, mask *fieldmaskpb.FieldMask) (*pb.Occurrence, error) {
+// DeleteOccurrencesByNote deletes the occurrences of the note with pID and nID, in any
+// project, and returns the number of occurrences deleted. The occurrences are deleted
+// by a single statement, so either all of them or none are deleted.
+func (pg *MySQLStore) DeleteOccurrencesByNote(ctx context.Context, pID, nID string) (_ int64, err error) {
+	defer pg.observe(ctx, "DeleteOccurrencesByNote", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := checkNoteName(pID, nID); err != nil {
+		return 0, err
+	}
+	ev := pg.auditEvent("DeleteOccurrencesByNote", AuditNote, pID, nID, userFromContext(ctx))
+	result, err := pg.execAudited(ctx, ev, pg.prefixed(mysqlDeleteNoteOccurrences), pID, nID)
+	if err != nil {
+		pg.log().Errorf("Failed to delete Occurrences of note %s/%s from database: %v", pID, nID, err)
+		return 0, status.Error(codes.Internal, "Failed to delete Occurrences from database")
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, status.Error(codes.Internal, "Failed to delete Occurrences from database")
+	}
+	return count, nil
+}
+
+// DeleteOccurrences deletes the occurrences of project pID with the IDs oIDs, and
+// returns the number of occurrences deleted. IDs of occurrences that do not exist are
+// ignored. Long lists are deleted in several statements within one transaction, so
+// either all of the occurrences or none are deleted.
+func (pg *MySQLStore) DeleteOccurrences(ctx context.Context, pID string, oIDs []string) (_ int64, err error) {
+	defer pg.observe(ctx, "DeleteOccurrences", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return 0, err
+	}
+	chunks := idChunks(oIDs)
+	if len(chunks) == 0 {
+		return 0, nil
+	}
+	var deleted int64
+	err = pg.withTx(ctx, func(tx *sql.Tx) error {
+		deleted = 0
+		var events []*AuditEvent
+		for _, chunk := range chunks {
+			query, args := inOccurrencesQuery(pg.prefixed(mysqlDeleteOccurrences), pID, chunk)
+			result, err := tx.ExecContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			count, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted += count
+			// The statement does not tell which of the IDs existed, so all of them are
+			// recorded when any did.
+			if count > 0 && pg.auditLog {
+				for _, oID := range chunk {
+					events = append(events, pg.auditEvent("DeleteOccurrences", AuditOccurrence, pID, oID, userFromContext(ctx)))
+				}
+			}
+		}
+		return pg.recordAudit(ctx, tx, events...)
+	})
+	if err != nil {
+		pg.log().Errorf("Failed to delete Occurrences of project %s from database: %v", pID, err)
+		return 0, status.Error(codes.Internal, "Failed to delete Occurrences from database")
+	}
+	return deleted, nil
+}
+
+// DeleteExpiredOccurrences deletes the occurrences of project pID created before
+// olderThan, and returns the number of occurrences deleted. They are deleted in
+// batches of DeleteBatchSize, each in its own statement, so that no lock is held for
+// long; if it fails part way, the occurrences deleted by the earlier batches stay
+// deleted and are counted.
+func (pg *MySQLStore) DeleteExpiredOccurrences(ctx context.Context, pID string, olderThan time.Time) (_ int64, err error) {
+	defer pg.observe(ctx, "DeleteExpiredOccurrences", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return 0, err
+	}
+	cutoff := olderThan.UTC().Format(mysqlDatetimeFormat)
+	total, err := pg.deleteInBatches(ctx, "DeleteExpiredOccurrences", pID, nil, pg.prefixed(mysqlDeleteExpiredOccurrences), pID, cutoff)
+	if err != nil {
+		pg.log().Errorf("Failed to delete expired Occurrences of project %s from database: %v", pID, err)
+		return total, status.Error(codes.Internal, "Failed to delete Occurrences from database")
+	}
+	return total, nil
+}
+
+// DeleteAllOccurrences deletes the occurrences of project pID, keeping the project and
+// its notes, and returns the number of occurrences deleted. Like
+// DeleteExpiredOccurrences, it deletes them in batches of DeleteBatchSize.
+func (pg *MySQLStore) DeleteAllOccurrences(ctx context.Context, pID string) (_ int64, err error) {
+	defer pg.observe(ctx, "DeleteAllOccurrences", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return 0, err
+	}
+	total, err := pg.deleteInBatches(ctx, "DeleteAllOccurrences", pID, nil, pg.prefixed(mysqlDeleteAllOccurrences), pID)
+	if err != nil {
+		pg.log().Errorf("Failed to delete Occurrences of project %s from database: %v", pID, err)
+		return total, status.Error(codes.Internal, "Failed to delete Occurrences from database")
+	}
+	return total, nil
+}
+
+// deleteInBatches runs query, a DELETE whose last placeholder is the LIMIT, with args
+// and the batch size until it deletes fewer rows than the batch size, and returns the
+// number of rows deleted. Each batch deleting rows is recorded in the audit log as
+// operation on project pID. When prepare is not nil, each batch runs in a transaction
+// in which prepare is called first; the batch is not run if it returns an error.
+func (pg *MySQLStore) deleteInBatches(ctx context.Context, operation, pID string, prepare func(*sql.Tx) error, query string, args ...interface{}) (int64, error) {
+	batchSize := pg.deleteBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultDeleteBatchSize
+	}
+	args = append(args, batchSize)
+	var total int64
+	for {
+		ev := pg.auditEvent(operation, AuditProject, pID, pID, userFromContext(ctx))
+		var count int64
+		var err error
+		if prepare == nil {
+			var result sql.Result
+			if result, err = pg.execAudited(ctx, ev, query, args...); err == nil {
+				count, err = result.RowsAffected()
+			}
+		} else {
+			err = pg.withTx(ctx, func(tx *sql.Tx) error {
+				if err := prepare(tx); err != nil {
+					return err
+				}
+				result, err := tx.ExecContext(ctx, query, args...)
+				if err != nil {
+					return err
+				}
+				if count, err = result.RowsAffected(); err != nil || count == 0 {
+					return err
+				}
+				return pg.recordAudit(ctx, tx, ev)
+			})
+		}
+		if err != nil {
+			return total, err
+		}
+		total += count
+		if count < int64(batchSize) {
+			return total, nil
+		}
+	}
+}
+
+// UpdateOccurrence updates the existing occurrence with the given projectID and occurrenceID.
+// When mask has paths, only those fields are copied from o onto the stored occurrence;
+// otherwise the stored occurrence is replaced. It returns an Aborted error when the
+// occurrence is updated by another request at the same time; the update can then be
+// retried.
+func (pg *MySQLStore) UpdateOccurrence(ctx context.Context, pID, oID string, o *pb.Occurrence, mask *fieldmaskpb.FieldMask) (_ *pb.Occurrence, err error) {
+	defer pg.observe(ctx, "UpdateOccurrence", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkOccurrenceName(pID, oID); err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return nil, status.Error(codes.InvalidArgument, "occurrence must not be nil")
+	}
+	var data string
+	var details []byte
+	var createTime, updateTime sql.NullTime
+	var version int64
+	err = pg.DB.QueryRowContext(ctx, pg.prefixed(mysqlSearchOccurrenceVersion), pID, occurrenceIDValue(oID)).Scan(&data, &details, &createTime, &updateTime, &version)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	case err != nil:
+		return nil, status.Error(codes.Internal, "Failed to query Occurrence from database")
+	}
 	o = proto.Clone(o).(*pb.Occurrence)
-	o.UpdateTime = ptypes.TimestampNow()
+	if len(mask.GetPaths()) > 0 {
+		var existing pb.Occurrence
+		if err := pg.unmarshalOccurrence(data, details, createTime, updateTime, &existing); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		existing.Name = name.FormatOccurrence(pID, oID)
+		if err := applyFieldMask(&existing, o, mask); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid update mask: %v", err)
+		}
+		o = &existing
+	}
+	// The creation time is kept, even when o replaces the whole occurrence.
+	o.CreateTime = timestampFromColumn(createTime)
+	o.UpdateTime = truncateTimestamp(pg.timestampNow())
+	if err := pg.updateOccurrence(ctx, pID, oID, o, version); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
 
-	occ, err := json.Marshal(o)
-    if err != nil {
-		log.Println("failed to marshal note")
+// updateOccurrence stores o as the occurrence with pID and oID if the stored occurrence
+// is still at version, and returns an Aborted error if it has changed since.
+func (pg *MySQLStore) updateOccurrence(ctx context.Context, pID, oID string, o *pb.Occurrence, version int64) error {
+	occ, details, err := pg.marshalStored(o)
+	if err == errDocumentTooLarge {
+		return status.Error(codes.InvalidArgument, "occurrence too large")
 	}
-	result, err := pg.DB.Exec(mysqlUpdateOccurrence, occ, pID, oID)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to update Occurrence")
+		pg.log().Errorf("failed to marshal occurrence: %v", err)
+		return status.Error(codes.Internal, "Failed to marshal Occurrence")
+	}
+	ev := pg.auditEvent("UpdateOccurrence", AuditOccurrence, pID, oID, userFromContext(ctx))
+	result, err := pg.execAudited(ctx, ev, pg.prefixed(mysqlUpdateOccurrence), occ, details, datetimeValue(o.UpdateTime), occurrenceKind(o), occurrenceSeverity(o), occurrenceFixable(o), nullString(o.GetResource().GetUri()), userFromContext(ctx), pID, occurrenceIDValue(oID), version)
+	if err != nil {
+		return status.Error(codes.Internal, "Failed to update Occurrence")
 	}
 	count, err := result.RowsAffected()
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to update Occurrence")
+		return status.Error(codes.Internal, "Failed to update Occurrence")
 	}
 	if count == 0 {
-		return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+		return status.Errorf(codes.Aborted, "Occurrence with name %q/%q was modified concurrently", pID, oID)
 	}
-	return o, nil
+	return nil
 }
 
 // GetOccurrence returns the occurrence with pID and oID
-func (pg *MySQLStore) GetOccurrence(ctx context.Context, pID, oID string) (*pb.Occurrence, error) {
+func (pg *MySQLStore) GetOccurrence(ctx context.Context, pID, oID string) (_ *pb.Occurrence, err error) {
+	defer pg.observe(ctx, "GetOccurrence", time.Now(), &err)
+	if err := checkOccurrenceName(pID, oID); err != nil {
+		return nil, err
+	}
 	var data string
-	err := pg.DB.QueryRow(mysqlSearchOccurrence, pID, oID).Scan(&data)
+	var details []byte
+	var createTime, updateTime sql.NullTime
+	err = pg.reader(ctx).QueryRowContext(ctx, pg.prefixed(mysqlSearchOccurrence), pID, occurrenceIDValue(oID)).Scan(&data, &details, &createTime, &updateTime)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
@@ -289,8 +1364,7 @@ func (pg *MySQLStore) GetOccurrence(ctx context.Context, pID, oID string) (*pb.O
 		return nil, status.Error(codes.Internal, "Failed to query Occurrence from database")
 	}
 	var o pb.Occurrence
-	json.Unmarshal([]byte(data), &o)
-	if err != nil {
+	if err := pg.unmarshalOccurrence(data, details, createTime, updateTime, &o); err != nil {
 		return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
 	}
 	// Set the output-only field before returning
@@ -298,100 +1372,345 @@ func (pg *MySQLStore) GetOccurrence(ctx context.Context, pID, oID string) (*pb.O
 	return &o, nil
 }
 
+// GetOccurrences returns the occurrences of project pID with the IDs oIDs, keyed by ID,
+// looking them up with as few queries as the number of IDs allows. Occurrences that
+// do not exist are left out of the map.
+func (pg *MySQLStore) GetOccurrences(ctx context.Context, pID string, oIDs []string) (_ map[string]*pb.Occurrence, err error) {
+	defer pg.observe(ctx, "GetOccurrences", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	occs := make(map[string]*pb.Occurrence, len(oIDs))
+	for _, chunk := range idChunks(oIDs) {
+		if err := pg.getOccurrences(ctx, pID, chunk, occs); err != nil {
+			return nil, err
+		}
+	}
+	return occs, nil
+}
+
+// getOccurrences adds the occurrences of project pID with the IDs oIDs to occs.
+func (pg *MySQLStore) getOccurrences(ctx context.Context, pID string, oIDs []string, occs map[string]*pb.Occurrence) error {
+	query, args := inOccurrencesQuery(pg.prefixed(mysqlSearchOccurrences), pID, oIDs)
+	rows, err := pg.reader(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return status.Error(codes.Internal, "Failed to query Occurrences from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		var storedID, details []byte
+		var createTime, updateTime sql.NullTime
+		if err := rows.Scan(&storedID, &data, &details, &createTime, &updateTime); err != nil {
+			return status.Error(codes.Internal, "Failed to scan Occurrences row")
+		}
+		oID := decodeOccurrenceID(storedID)
+		var o pb.Occurrence
+		if err := pg.unmarshalOccurrence(data, details, createTime, updateTime, &o); err != nil {
+			return status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		o.Name = name.FormatOccurrence(pID, oID)
+		occs[oID] = &o
+	}
+	if err := rows.Err(); err != nil {
+		return status.Error(codes.Internal, "Failed to query Occurrences from database")
+	}
+	return nil
+}
+
+// GetOccurrenceForUpdate returns the occurrence with pID and oID, read in tx with a
+// lock on its row. The lock is held until tx commits or rolls back, so other
+// transactions cannot update the occurrence in between, e.g.:
+//
+//	err := pg.WithTx(ctx, func(tx *sql.Tx) error {
+//		o, err := pg.GetOccurrenceForUpdate(ctx, tx, pID, oID)
+//		...
+//	})
+func (pg *MySQLStore) GetOccurrenceForUpdate(ctx context.Context, tx *sql.Tx, pID, oID string) (_ *pb.Occurrence, err error) {
+	defer pg.observe(ctx, "GetOccurrenceForUpdate", time.Now(), &err)
+	if err := checkOccurrenceName(pID, oID); err != nil {
+		return nil, err
+	}
+	var data string
+	var details []byte
+	var createTime, updateTime sql.NullTime
+	err = tx.QueryRowContext(ctx, pg.prefixed(mysqlLockOccurrence), pID, occurrenceIDValue(oID)).Scan(&data, &details, &createTime, &updateTime)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, status.Errorf(codes.NotFound, "Occurrence with name %q/%q does not Exist", pID, oID)
+	case err != nil:
+		return nil, status.Error(codes.Internal, "Failed to query Occurrence from database")
+	}
+	var o pb.Occurrence
+	if err := pg.unmarshalOccurrence(data, details, createTime, updateTime, &o); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+	}
+	o.Name = name.FormatOccurrence(pID, oID)
+	return &o, nil
+}
+
 // ListOccurrences returns up to pageSize number of occurrences for this project beginning
 // at pageToken, or from start if pageToken is the empty string.
-func (pg *MySQLStore) ListOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error) {
-	var rows *sql.Rows
-	id := decryptInt64(pageToken, pg.paginationKey, 0)
-    var filter_query, query string
-    if filter != "" {
-        var fs MysqlFilterSql
-        filter_query = "AND " +fs.ParseFilter(filter)
-    } else {
-        filter_query = ""
-    }
-    // apply the filter to the list:
-    query = fmt.Sprintf(mysqlListOccurrences, filter_query)
-	rows, err := pg.DB.Query(query, pID, id, pageSize)
+func (pg *MySQLStore) ListOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) (_ []*pb.Occurrence, _ string, err error) {
+	defer pg.observe(ctx, "ListOccurrences", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return nil, "", err
+	}
+	id, err := pg.decodePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	var filter_query, query string
+	filterArgs := []interface{}{pID}
+	if filter != "" {
+		filterSql, params, err := pg.newFilter().ParseFilter(filter)
+		if err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+		}
+		filter_query = "AND " + filterSql
+		filterArgs = append(filterArgs, params...)
+	}
+	// Fetch one row more than the page to tell whether there is a next page.
+	limit := pg.pageLimit(int(pageSize))
+	query = fmt.Sprintf(pg.prefixed(mysqlListOccurrences), filter_query)
+	rows, err := pg.reader(ctx).QueryContext(ctx, query, append(filterArgs, id, limit+1)...)
 	if err != nil {
 		return nil, "", status.Error(codes.Internal, "Failed to list Occurrences from database")
 	}
-    // apply the filter to the count:
-    query = fmt.Sprintf(mysqlOccurrenceCount, filter_query)
-	count, err := pg.count(query, pID)
+	defer rows.Close()
+	var os []*pb.Occurrence
+	var lastId int64
+	morePages := false
+	for rows.Next() {
+		if len(os) == limit {
+			morePages = true
+			break
+		}
+		var data string
+		var storedID, details []byte
+		var createTime, updateTime sql.NullTime
+		err := rows.Scan(&lastId, &storedID, &data, &details, &createTime, &updateTime)
+		if err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to scan Occurrences row")
+		}
+		var o pb.Occurrence
+		if err := pg.unmarshalOccurrence(data, details, createTime, updateTime, &o); err != nil {
+			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
+		}
+		o.Name = name.FormatOccurrence(pID, decodeOccurrenceID(storedID))
+		os = append(os, &o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", status.Error(codes.Internal, "Failed to list Occurrences from database")
+	}
+	if !morePages {
+		return os, "", nil
+	}
+	encryptedPage, err := pg.encodePageToken(lastId)
+	if err != nil {
+		return nil, "", status.Error(codes.Internal, "Failed to paginate Occurrences")
+	}
+	return os, encryptedPage, nil
+}
+
+// ListOccurrencesWithCount is like ListOccurrences, and also returns the total number of
+// occurrences of the project matching filter. The total is an estimate when
+// ApproximateCounts is configured.
+func (pg *MySQLStore) ListOccurrencesWithCount(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, int64, error) {
+	os, nextPageToken, err := pg.ListOccurrences(ctx, pID, filter, pageToken, pageSize)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	total, err := pg.countMatching(ctx, "CountOccurrences", mysqlCountOccurrences, pg.newFilter(), filter, pID)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return os, nextPageToken, total, nil
+}
+
+// ListRecentOccurrences is like ListOccurrences, but returns the most recently updated
+// occurrences first. Occurrences that were never updated are ordered by their creation
+// time. Its page tokens cannot be used with ListOccurrences, nor the other way round.
+func (pg *MySQLStore) ListRecentOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) (_ []*pb.Occurrence, _ string, err error) {
+	defer pg.observe(ctx, "ListRecentOccurrences", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return nil, "", err
+	}
+	lastTime, lastId, err := pg.decodeTimePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	var filter_query string
+	filterArgs := []interface{}{pID}
+	if filter != "" {
+		filterSql, params, err := pg.newFilter().ParseFilter(filter)
+		if err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+		}
+		filter_query = "AND " + filterSql
+		filterArgs = append(filterArgs, params...)
+	}
+	// Fetch one row more than the page to tell whether there is a next page.
+	limit := pg.pageLimit(int(pageSize))
+	query := fmt.Sprintf(pg.prefixed(mysqlListRecentOccurrences), filter_query)
+	rows, err := pg.reader(ctx).QueryContext(ctx, query, append(filterArgs, lastTime, lastTime, lastId, limit+1)...)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to count Occurrences from database")
+		return nil, "", status.Error(codes.Internal, "Failed to list Occurrences from database")
 	}
+	defer rows.Close()
 	var os []*pb.Occurrence
-	var lastId int64
+	morePages := false
 	for rows.Next() {
+		if len(os) == limit {
+			morePages = true
+			break
+		}
 		var data string
-		err := rows.Scan(&lastId, &data)
+		var storedID, details []byte
+		var createTime, updateTime sql.NullTime
+		err := rows.Scan(&lastId, &lastTime, &storedID, &data, &details, &createTime, &updateTime)
 		if err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to scan Occurrences row")
 		}
 		var o pb.Occurrence
-		json.Unmarshal([]byte(data), &o)
-		if err != nil {
+		if err := pg.unmarshalOccurrence(data, details, createTime, updateTime, &o); err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
 		}
+		o.Name = name.FormatOccurrence(pID, decodeOccurrenceID(storedID))
 		os = append(os, &o)
 	}
-	if count == lastId {
+	if err := rows.Err(); err != nil {
+		return nil, "", status.Error(codes.Internal, "Failed to list Occurrences from database")
+	}
+	if !morePages {
 		return os, "", nil
 	}
-	encryptedPage, err := encryptInt64(lastId, pg.paginationKey)
+	encryptedPage, err := pg.encodeTimePageToken(lastTime, lastId)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to paginate projects")
+		return nil, "", status.Error(codes.Internal, "Failed to paginate Occurrences")
 	}
 	return os, encryptedPage, nil
 }
 
+// iteratePageSize is the number of occurrences fetched at a time by IterateOccurrences,
+// capped at the maximum page size.
+const iteratePageSize = 500
+
+// IterateOccurrences calls fn for each occurrence of project pID matching filter,
+// fetching them a page at a time. It stops at the first error returned by fn and
+// returns it.
+func (pg *MySQLStore) IterateOccurrences(ctx context.Context, pID, filter string, fn func(*pb.Occurrence) error) error {
+	pageToken := ""
+	for {
+		os, nextPageToken, err := pg.ListOccurrences(ctx, pID, filter, pageToken, iteratePageSize)
+		if err != nil {
+			return err
+		}
+		for _, o := range os {
+			if err := fn(o); err != nil {
+				return err
+			}
+		}
+		if nextPageToken == "" {
+			return nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
 // CreateNote adds the specified note
-func (pg *MySQLStore) CreateNote(ctx context.Context, pID, nID, uID string, n *pb.Note) (*pb.Note, error) {
+func (pg *MySQLStore) CreateNote(ctx context.Context, pID, nID, uID string, n *pb.Note) (_ *pb.Note, err error) {
+	defer pg.observe(ctx, "CreateNote", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkNoteName(pID, nID); err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, status.Error(codes.InvalidArgument, "note must not be nil")
+	}
 	n = proto.Clone(n).(*pb.Note)
 	nName := name.FormatNote(pID, nID)
 	n.Name = nName
-	n.CreateTime = ptypes.TimestampNow()
-	note, err := json.Marshal(n)
-    if err != nil {
-		log.Println("failed to marshal note")
+	n.CreateTime = pg.timestampNow()
+	note, details, err := pg.marshalStored(n)
+	if err == errDocumentTooLarge {
+		return nil, status.Error(codes.InvalidArgument, "note too large")
+	}
+	if err != nil {
+		pg.log().Errorf("failed to marshal note: %v", err)
+		return nil, status.Error(codes.Internal, "Failed to marshal Note")
+	}
+	ev := pg.auditEvent("CreateNote", AuditNote, pID, nID, nullString(uID))
+	_, err = pg.execAudited(ctx, ev, pg.prefixed(mysqlInsertNote), pID, nID, note, details, nullString(uID))
+	if isDuplicateEntry(err) {
+		return nil, status.Errorf(codes.AlreadyExists, "Note with name %q/%q already exists", pID, nID)
 	}
-	_, err = pg.DB.Exec(mysqlInsertNote, pID, nID, note)
 	if err != nil {
-		log.Println("Failed to insert Note in database", err)
-		return nil, status.Error(codes.Internal, "Failed to insert Note in database")
+		pg.log().Errorf("Failed to insert Note in database: %v", err)
+		return nil, status.Errorf(codes.Internal, "Failed to insert Note %q/%q in database", pID, nID)
 	}
 	return n, nil
 }
 
-// BatchCreateNotes batch creates the specified notes in memstore.
-func (pg *MySQLStore) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*pb.Note) ([]*pb.Note, []error) {
-	clonedNotes := map[string]*pb.Note{}
-	for nID, n := range notes {
-		clonedNotes[nID] = proto.Clone(n).(*pb.Note)
-	}
-	notes = clonedNotes
+// BatchCreateNotes batch creates the specified notes. Notes that cannot be created are
+// skipped; the returned errors name the failing note and carry codes.AlreadyExists when
+// the note already exists.
+func (pg *MySQLStore) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*pb.Note) (_ []*pb.Note, errs []error) {
+	defer pg.observeBatch(ctx, "BatchCreateNotes", time.Now(), &errs)
+	if err := pg.checkWritable(); err != nil {
+		return nil, []error{err}
+	}
+	nIDs := make([]string, 0, len(notes))
+	for nID := range notes {
+		nIDs = append(nIDs, nID)
+	}
+	sort.Strings(nIDs)
 
-	errs := []error{}
+	errs = []error{}
 	created := []*pb.Note{}
-	for nID, n := range notes {
-		note, err := pg.CreateNote(ctx, pID, nID, uID, n)
+	for _, nID := range nIDs {
+		note, err := pg.CreateNote(ctx, pID, nID, uID, notes[nID])
 		if err != nil {
-			// Note already exists, skipping.
+			errs = append(errs, err)
 			continue
-		} else {
-			created = append(created, note)
 		}
-
+		created = append(created, note)
 	}
 
 	return created, errs
 }
 
-// DeleteNote deletes the note with the given pID and nID
-func (pg *MySQLStore) DeleteNote(ctx context.Context, pID, nID string) error {
-	result, err := pg.DB.Exec(mysqlDeleteNote, pID, nID)
+// DeleteNote deletes the note with the given pID and nID. When PreventOrphanedOccurrences
+// is configured, it returns a FailedPrecondition error instead if the note still has
+// occurrences; DeleteNoteAndOccurrences deletes them together.
+func (pg *MySQLStore) DeleteNote(ctx context.Context, pID, nID string) (err error) {
+	defer pg.observe(ctx, "DeleteNote", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkNoteName(pID, nID); err != nil {
+		return err
+	}
+	defer pg.notes.remove(pID, nID)
+	if pg.preventOrphans {
+		return pg.deleteNote(ctx, "DeleteNote", pID, nID, func(tx *sql.Tx) error {
+			// The shared lock keeps occurrences of the note from being created until
+			// the note is deleted.
+			var one int
+			err := tx.QueryRowContext(ctx, pg.prefixed(mysqlLockNoteOccurrence), pID, nID).Scan(&one)
+			if err == nil {
+				return status.Errorf(codes.FailedPrecondition, "Note with name %q/%q still has occurrences", pID, nID)
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+			return nil
+		})
+	}
+	ev := pg.auditEvent("DeleteNote", AuditNote, pID, nID, userFromContext(ctx))
+	result, err := pg.execAudited(ctx, ev, pg.prefixed(mysqlDeleteNote), pID, nID)
 	if err != nil {
 		return status.Error(codes.Internal, "Failed to delete Note from database")
 	}
@@ -405,35 +1724,178 @@ func (pg *MySQLStore) DeleteNote(ctx context.Context, pID, nID string) error {
 	return nil
 }
 
-// UpdateNote updates the existing note with the given pID and nID
-func (pg *MySQLStore) UpdateNote(ctx context.Context, pID, nID string, n *pb.Note, mask *fieldmaskpb.FieldMask) (*pb.Note, error) {
-	n = proto.Clone(n).(*pb.Note)
-	nName := name.FormatNote(pID, nID)
-	n.Name = nName
-	n.UpdateTime = ptypes.TimestampNow()
-
-	note, err := json.Marshal(n)
-    if err != nil {
-		log.Println("failed to marshal note")
+// DeleteAllNotes deletes the notes of project pID, keeping the project and its
+// occurrences, and returns the number of notes deleted. Like DeleteExpiredOccurrences,
+// it deletes them in batches of DeleteBatchSize. When PreventOrphanedOccurrences is
+// configured, it returns a FailedPrecondition error instead while occurrences of any
+// project refer to notes of pID; DeleteAllOccurrences deletes those of pID.
+func (pg *MySQLStore) DeleteAllNotes(ctx context.Context, pID string) (_ int64, err error) {
+	defer pg.observe(ctx, "DeleteAllNotes", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := checkProjectID(pID); err != nil {
+		return 0, err
+	}
+	defer pg.notes.removeProject(pID)
+	var prepare func(*sql.Tx) error
+	if pg.preventOrphans {
+		prepare = func(tx *sql.Tx) error {
+			// The shared lock keeps occurrences of the notes from being created until
+			// the batch is deleted.
+			var one int
+			err := tx.QueryRowContext(ctx, pg.prefixed(mysqlLockProjectNoteOccurrence), pID).Scan(&one)
+			if err == nil {
+				return status.Errorf(codes.FailedPrecondition, "Notes of project %q still have occurrences", pID)
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+			return nil
+		}
+	}
+	total, err := pg.deleteInBatches(ctx, "DeleteAllNotes", pID, prepare, pg.prefixed(mysqlDeleteAllNotes), pID)
+	if status.Code(err) == codes.FailedPrecondition {
+		return total, err
 	}
-	result, err := pg.DB.Exec(mysqlUpdateNote, note, pID, nID)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to update Note")
+		pg.log().Errorf("Failed to delete Notes of project %s from database: %v", pID, err)
+		return total, status.Error(codes.Internal, "Failed to delete Notes from database")
 	}
-	count, err := result.RowsAffected()
+	return total, nil
+}
+
+// DeleteNoteAndOccurrences deletes the note with the given pID and nID together with
+// its occurrences, in one transaction.
+func (pg *MySQLStore) DeleteNoteAndOccurrences(ctx context.Context, pID, nID string) (err error) {
+	defer pg.observe(ctx, "DeleteNoteAndOccurrences", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkNoteName(pID, nID); err != nil {
+		return err
+	}
+	defer pg.notes.remove(pID, nID)
+	return pg.deleteNote(ctx, "DeleteNoteAndOccurrences", pID, nID, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, pg.prefixed(mysqlDeleteNoteOccurrences), pID, nID)
+		return err
+	})
+}
+
+// deleteNote deletes the note with pID and nID in a transaction, after running
+// prepare in it, and records the delete as operation. Status errors returned by
+// prepare are returned as is.
+func (pg *MySQLStore) deleteNote(ctx context.Context, operation, pID, nID string, prepare func(*sql.Tx) error) error {
+	err := pg.withTx(ctx, func(tx *sql.Tx) error {
+		if err := prepare(tx); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, pg.prefixed(mysqlDeleteNote), pID, nID)
+		if err != nil {
+			return err
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return status.Errorf(codes.NotFound, "Note with name %q/%q does not Exist", pID, nID)
+		}
+		return pg.recordAudit(ctx, tx, pg.auditEvent(operation, AuditNote, pID, nID, userFromContext(ctx)))
+	})
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	pg.log().Errorf("Failed to delete Note from database: %v", err)
+	return status.Error(codes.Internal, "Failed to delete Note from database")
+}
+
+// UpdateNote updates the existing note with the given pID and nID.
+// When mask has paths, only those fields are copied from n onto the stored note;
+// otherwise the stored note is replaced, keeping its creation time. The stored note is
+// locked while it is updated, so that concurrent updates do not lose each other's
+// fields.
+func (pg *MySQLStore) UpdateNote(ctx context.Context, pID, nID string, n *pb.Note, mask *fieldmaskpb.FieldMask) (_ *pb.Note, err error) {
+	defer pg.observe(ctx, "UpdateNote", time.Now(), &err)
+	if err := pg.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkNoteName(pID, nID); err != nil {
+		return nil, err
+	}
+	if n == nil {
+		return nil, status.Error(codes.InvalidArgument, "note must not be nil")
+	}
+	// Removing the note once the update is done keeps the note cache from holding the
+	// note as it was before, even when it was cached during the update.
+	defer pg.notes.remove(pID, nID)
+	var updated *pb.Note
+	err = pg.withTx(ctx, func(tx *sql.Tx) error {
+		var data string
+		var details []byte
+		err := tx.QueryRowContext(ctx, pg.prefixed(mysqlLockNote), pID, nID).Scan(&data, &details)
+		if err == sql.ErrNoRows {
+			return status.Errorf(codes.NotFound, "Note with name %q/%q does not Exist", pID, nID)
+		}
+		if err != nil {
+			return err
+		}
+		var existing pb.Note
+		if err := pg.unmarshalStored(data, details, &existing); err != nil {
+			return status.Error(codes.Internal, "Failed to unmarshal Note from database")
+		}
+		createTime := existing.CreateTime
+		updated = proto.Clone(n).(*pb.Note)
+		if len(mask.GetPaths()) > 0 {
+			if err := applyFieldMask(&existing, updated, mask); err != nil {
+				return status.Errorf(codes.InvalidArgument, "Invalid update mask: %v", err)
+			}
+			updated = &existing
+		}
+		// The creation time is kept, even when n replaces the whole note.
+		updated.CreateTime = createTime
+		updated.Name = name.FormatNote(pID, nID)
+		updated.UpdateTime = pg.timestampNow()
+
+		note, details, err := pg.marshalStored(updated)
+		if err == errDocumentTooLarge {
+			return status.Error(codes.InvalidArgument, "note too large")
+		}
+		if err != nil {
+			pg.log().Errorf("failed to marshal note: %v", err)
+			return status.Error(codes.Internal, "Failed to marshal Note")
+		}
+		if _, err := tx.ExecContext(ctx, pg.prefixed(mysqlUpdateNote), note, details, userFromContext(ctx), pID, nID); err != nil {
+			return err
+		}
+		return pg.recordAudit(ctx, tx, pg.auditEvent("UpdateNote", AuditNote, pID, nID, userFromContext(ctx)))
+	})
 	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		pg.log().Errorf("Failed to update Note in database: %v", err)
 		return nil, status.Error(codes.Internal, "Failed to update Note")
 	}
-	if count == 0 {
-		return nil, status.Errorf(codes.NotFound, "Note with name %q/%q does not Exist", pID, nID)
-	}
-	return n, nil
+	return updated, nil
 }
 
-// GetNote returns the note with project (pID) and note ID (nID)
-func (pg *MySQLStore) GetNote(ctx context.Context, pID, nID string) (*pb.Note, error) {
+// GetNote returns the note with project (pID) and note ID (nID). When the note cache
+// is enabled, the note is returned from it unless ctx requires reading from the
+// primary.
+func (pg *MySQLStore) GetNote(ctx context.Context, pID, nID string) (_ *pb.Note, err error) {
+	defer pg.observe(ctx, "GetNote", time.Now(), &err)
+	if err := checkNoteName(pID, nID); err != nil {
+		return nil, err
+	}
+	if !readsFromPrimary(ctx) {
+		if n, ok := pg.notes.get(pID, nID); ok {
+			return n, nil
+		}
+	}
 	var data string
-	err := pg.DB.QueryRow(mysqlSearchNote, pID, nID).Scan(&data)
+	var details []byte
+	err = pg.reader(ctx).QueryRowContext(ctx, pg.prefixed(mysqlSearchNote), pID, nID).Scan(&data, &details)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, status.Errorf(codes.NotFound, "Note with name %q/%q does not Exist", pID, nID)
@@ -441,24 +1903,73 @@ func (pg *MySQLStore) GetNote(ctx context.Context, pID, nID string) (*pb.Note, e
 		return nil, status.Error(codes.Internal, "Failed to query Note from database")
 	}
 	var note pb.Note
-	json.Unmarshal([]byte(data), &note)
-	if err != nil {
+	if err := pg.unmarshalStored(data, details, &note); err != nil {
 		return nil, status.Error(codes.Internal, "Failed to unmarshal Note from database")
 	}
 	// Set the output-only field before returning
 	note.Name = name.FormatNote(pID, nID)
+	pg.notes.add(pID, nID, &note)
 	return &note, nil
 }
 
+// GetNotes returns the notes of project pID with the IDs nIDs, keyed by ID, looking
+// them up with as few queries as the number of IDs allows. Notes that do not exist
+// are left out of the map. It saves resolving the notes of a list of occurrences
+// one at a time.
+func (pg *MySQLStore) GetNotes(ctx context.Context, pID string, nIDs []string) (_ map[string]*pb.Note, err error) {
+	defer pg.observe(ctx, "GetNotes", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return nil, err
+	}
+	notes := make(map[string]*pb.Note, len(nIDs))
+	for _, chunk := range idChunks(nIDs) {
+		if err := pg.getNotes(ctx, pID, chunk, notes); err != nil {
+			return nil, err
+		}
+	}
+	return notes, nil
+}
+
+// getNotes adds the notes of project pID with the IDs nIDs to notes.
+func (pg *MySQLStore) getNotes(ctx context.Context, pID string, nIDs []string, notes map[string]*pb.Note) error {
+	query, args := inQuery(pg.prefixed(mysqlSearchNotes), pID, nIDs)
+	rows, err := pg.reader(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return status.Error(codes.Internal, "Failed to query Notes from database")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nID, data string
+		var details []byte
+		if err := rows.Scan(&nID, &data, &details); err != nil {
+			return status.Error(codes.Internal, "Failed to scan Notes row")
+		}
+		var n pb.Note
+		if err := pg.unmarshalStored(data, details, &n); err != nil {
+			return status.Error(codes.Internal, "Failed to unmarshal Note from database")
+		}
+		n.Name = name.FormatNote(pID, nID)
+		notes[nID] = &n
+	}
+	if err := rows.Err(); err != nil {
+		return status.Error(codes.Internal, "Failed to query Notes from database")
+	}
+	return nil
+}
+
 // GetOccurrenceNote gets the note for the specified occurrence from PostgreSQL.
-func (pg *MySQLStore) GetOccurrenceNote(ctx context.Context, pID, oID string) (*pb.Note, error) {
+func (pg *MySQLStore) GetOccurrenceNote(ctx context.Context, pID, oID string) (_ *pb.Note, err error) {
+	defer pg.observe(ctx, "GetOccurrenceNote", time.Now(), &err)
+	if err := checkOccurrenceName(pID, oID); err != nil {
+		return nil, err
+	}
 	o, err := pg.GetOccurrence(ctx, pID, oID)
 	if err != nil {
 		return nil, err
 	}
 	nPID, nID, err := name.ParseNote(o.NoteName)
 	if err != nil {
-		log.Printf("Error parsing name: %v", o.NoteName)
+		pg.log().Errorf("Error parsing name: %v", o.NoteName)
 		return nil, status.Error(codes.InvalidArgument, "Invalid Note name")
 	}
 	n, err := pg.GetNote(ctx, nPID, nID)
@@ -472,122 +1983,480 @@ func (pg *MySQLStore) GetOccurrenceNote(ctx context.Context, pID, oID string) (*
 
 // ListNotes returns up to pageSize number of notes for this project (pID) beginning
 // at pageToken (or from start if pageToken is the empty string).
-func (pg *MySQLStore) ListNotes(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Note, string, error) {
-	var rows *sql.Rows
-	id := decryptInt64(pageToken, pg.paginationKey, 0)
-    var filter_query, query string
-    if filter != "" {
-        var fs MysqlFilterSql
-        filter_query = "AND " +fs.ParseFilter(filter)
-    } else {
-        filter_query = ""
-    }
-    // apply the filter to the list
-    query = fmt.Sprintf(mysqlListNotes, filter_query)
-	rows, err := pg.DB.Query(query, pID, id, pageSize)
+func (pg *MySQLStore) ListNotes(ctx context.Context, pID, filter, pageToken string, pageSize int32) (_ []*pb.Note, _ string, err error) {
+	defer pg.observe(ctx, "ListNotes", time.Now(), &err)
+	if err := checkProjectID(pID); err != nil {
+		return nil, "", err
+	}
+	id, err := pg.decodePageToken(pageToken)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to list Notes from database")
+		return nil, "", err
 	}
-    // apply the filter to the count
-    query = fmt.Sprintf(mysqlNoteCount, filter_query)
-	count, err := pg.count(query, pID)
+	var filter_query, query string
+	filterArgs := []interface{}{pID}
+	if filter != "" {
+		filterSql, params, err := pg.newNoteFilter().ParseFilter(filter)
+		if err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+		}
+		filter_query = "AND " + filterSql
+		filterArgs = append(filterArgs, params...)
+	}
+	// Fetch one row more than the page to tell whether there is a next page.
+	limit := pg.pageLimit(int(pageSize))
+	query = fmt.Sprintf(pg.prefixed(mysqlListNotes), filter_query)
+	rows, err := pg.reader(ctx).QueryContext(ctx, query, append(filterArgs, id, limit+1)...)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to count Notes from database")
+		return nil, "", status.Error(codes.Internal, "Failed to list Notes from database")
 	}
+	defer rows.Close()
 	var ns []*pb.Note
 	var lastId int64
+	morePages := false
 	for rows.Next() {
+		if len(ns) == limit {
+			morePages = true
+			break
+		}
 		var data string
-		err := rows.Scan(&lastId, &data)
+		var details []byte
+		err := rows.Scan(&lastId, &data, &details)
 		if err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to scan Notes row")
 		}
 		var n pb.Note
-		json.Unmarshal([]byte(data), &n)
-		if err != nil {
+		if err := pg.unmarshalStored(data, details, &n); err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Note from database")
 		}
 		ns = append(ns, &n)
 	}
-	if count == lastId {
+	if err := rows.Err(); err != nil {
+		return nil, "", status.Error(codes.Internal, "Failed to list Notes from database")
+	}
+	if !morePages {
 		return ns, "", nil
 	}
-	encryptedPage, err := encryptInt64(lastId, pg.paginationKey)
+	encryptedPage, err := pg.encodePageToken(lastId)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to paginate projects")
+		return nil, "", status.Error(codes.Internal, "Failed to paginate Notes")
 	}
 	return ns, encryptedPage, nil
 }
 
+// ListNotesWithCount is like ListNotes, and also returns the total number of notes of
+// the project matching filter. The total is an estimate when ApproximateCounts is
+// configured.
+func (pg *MySQLStore) ListNotesWithCount(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*pb.Note, string, int64, error) {
+	ns, nextPageToken, err := pg.ListNotes(ctx, pID, filter, pageToken, pageSize)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	total, err := pg.countMatching(ctx, "CountNotes", mysqlCountNotes, pg.newNoteFilter(), filter, pID)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return ns, nextPageToken, total, nil
+}
+
+// IterateNotes calls fn for each note of project pID matching filter, fetching them a
+// page at a time. It stops at the first error returned by fn and returns it.
+func (pg *MySQLStore) IterateNotes(ctx context.Context, pID, filter string, fn func(*pb.Note) error) error {
+	pageToken := ""
+	for {
+		ns, nextPageToken, err := pg.ListNotes(ctx, pID, filter, pageToken, iteratePageSize)
+		if err != nil {
+			return err
+		}
+		for _, n := range ns {
+			if err := fn(n); err != nil {
+				return err
+			}
+		}
+		if nextPageToken == "" {
+			return nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+// maxListAllNotes is the number of notes above which ListAllNotes fails rather than
+// holding them all in memory.
+const maxListAllNotes = 100000
+
+// ListAllNotes returns all notes of project pID matching filter. It returns a
+// ResourceExhausted error if there are more than maxListAllNotes of them; IterateNotes
+// can visit any number of notes.
+func (pg *MySQLStore) ListAllNotes(ctx context.Context, pID, filter string) ([]*pb.Note, error) {
+	var ns []*pb.Note
+	err := pg.IterateNotes(ctx, pID, filter, func(n *pb.Note) error {
+		if len(ns) == maxListAllNotes {
+			return status.Errorf(codes.ResourceExhausted, "Project %q has more than %d notes", pID, maxListAllNotes)
+		}
+		ns = append(ns, n)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
 // ListNoteOccurrences returns up to pageSize number of occcurrences on the particular note (nID)
 // for this project (pID) projects beginning at pageToken (or from start if pageToken is the empty string).
-func (pg *MySQLStore) ListNoteOccurrences(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, error) {
+func (pg *MySQLStore) ListNoteOccurrences(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) (_ []*pb.Occurrence, _ string, err error) {
+	defer pg.observe(ctx, "ListNoteOccurrences", time.Now(), &err)
+	if err := checkNoteName(pID, nID); err != nil {
+		return nil, "", err
+	}
 	// Verify that note exists
 	if _, err := pg.GetNote(ctx, pID, nID); err != nil {
 		return nil, "", err
 	}
-	var rows *sql.Rows
-	id := decryptInt64(pageToken, pg.paginationKey, 0)
-    var filter_query, query string
-    if filter != "" {
-        var fs MysqlFilterSql
-        filter_query = "AND " +fs.ParseFilter(filter)
-    } else {
-        query = ""
-    }
-    query = fmt.Sprintf(mysqlListNoteOccurrences, filter_query)
-	rows, err := pg.DB.Query(query, pID, nID, id, pageSize)
+	id, err := pg.decodePageToken(pageToken)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to list Occurrences from database")
+		return nil, "", err
+	}
+	var filter_query, query string
+	filterArgs := []interface{}{pID, nID}
+	if filter != "" {
+		filterSql, params, err := pg.newFilter().ParseFilter(filter)
+		if err != nil {
+			return nil, "", status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+		}
+		filter_query = "AND " + filterSql
+		filterArgs = append(filterArgs, params...)
 	}
-    query = fmt.Sprintf(mysqlNoteOccurrencesCount, filter_query)
-	count, err := pg.count(query, pID, nID)
+	// Fetch one row more than the page to tell whether there is a next page.
+	limit := pg.pageLimit(int(pageSize))
+	query = fmt.Sprintf(pg.prefixed(mysqlListNoteOccurrences), filter_query)
+	rows, err := pg.reader(ctx).QueryContext(ctx, query, append(filterArgs, id, limit+1)...)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to count Occurrences from database")
+		return nil, "", status.Error(codes.Internal, "Failed to list Occurrences from database")
 	}
+	defer rows.Close()
 	var os []*pb.Occurrence
 	var lastId int64
+	morePages := false
 	for rows.Next() {
-		var data string
-		err := rows.Scan(&lastId, &data)
+		if len(os) == limit {
+			morePages = true
+			break
+		}
+		var oPID, data string
+		var storedID, details []byte
+		var createTime, updateTime sql.NullTime
+		err := rows.Scan(&lastId, &oPID, &storedID, &data, &details, &createTime, &updateTime)
 		if err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to scan Occurrences row")
 		}
 		var o pb.Occurrence
-		json.Unmarshal([]byte(data), &o)
-		if err != nil {
+		if err := pg.unmarshalOccurrence(data, details, createTime, updateTime, &o); err != nil {
 			return nil, "", status.Error(codes.Internal, "Failed to unmarshal Occurrence from database")
 		}
+		o.Name = name.FormatOccurrence(oPID, decodeOccurrenceID(storedID))
 		os = append(os, &o)
 	}
-	if count == lastId {
+	if err := rows.Err(); err != nil {
+		return nil, "", status.Error(codes.Internal, "Failed to list Occurrences from database")
+	}
+	if !morePages {
 		return os, "", nil
 	}
-	encryptedPage, err := encryptInt64(lastId, pg.paginationKey)
+	encryptedPage, err := pg.encodePageToken(lastId)
 	if err != nil {
-		return nil, "", status.Error(codes.Internal, "Failed to paginate projects")
+		return nil, "", status.Error(codes.Internal, "Failed to paginate Occurrences")
 	}
 	return os, encryptedPage, nil
 }
 
-// GetVulnerabilityOccurrencesSummary gets a summary of vulnerability occurrences from storage.
-func (pg *MySQLStore) GetVulnerabilityOccurrencesSummary(ctx context.Context, projectID, filter string) (*pb.VulnerabilityOccurrencesSummary, error) {
-	return &pb.VulnerabilityOccurrencesSummary{}, nil
+// ListNoteOccurrencesWithCount is like ListNoteOccurrences, and also returns the total
+// number of occurrences of the note matching filter. The total is an estimate when
+// ApproximateCounts is configured.
+func (pg *MySQLStore) ListNoteOccurrencesWithCount(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*pb.Occurrence, string, int64, error) {
+	os, nextPageToken, err := pg.ListNoteOccurrences(ctx, pID, nID, filter, pageToken, pageSize)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	total, err := pg.countMatching(ctx, "CountNoteOccurrences", mysqlCountNoteOccurrences, pg.newFilter(), filter, pID, nID)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return os, nextPageToken, total, nil
+}
+
+// countMatching runs query, a COUNT(*) query taking args with a %s verb for the
+// condition of filter translated by fs, and returns the count, or its estimate when
+// approximateCounts is set. op names the count in the metrics and the slow query log.
+func (pg *MySQLStore) countMatching(ctx context.Context, op, query string, fs *MysqlFilterSql, filter string, args ...interface{}) (total int64, err error) {
+	defer pg.observe(ctx, op, time.Now(), &err)
+	var filter_query string
+	if filter != "" {
+		filterSql, params, err := fs.ParseFilter(filter)
+		if err != nil {
+			return 0, status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+		}
+		filter_query = "AND " + filterSql
+		args = append(args, params...)
+	}
+	count := pg.count
+	if pg.approximateCounts {
+		count = pg.estimateCount
+	}
+	total, err = count(ctx, fmt.Sprintf(pg.prefixed(query), filter_query), args...)
+	if err != nil {
+		return 0, status.Error(codes.Internal, "Failed to count rows in database")
+	}
+	return total, nil
+}
+
+// GetVulnerabilityOccurrencesSummary gets a summary of vulnerability occurrences from storage,
+// with one entry per resource and severity.
+func (pg *MySQLStore) GetVulnerabilityOccurrencesSummary(ctx context.Context, projectID, filter string) (_ *pb.VulnerabilityOccurrencesSummary, err error) {
+	defer pg.observe(ctx, "GetVulnerabilityOccurrencesSummary", time.Now(), &err)
+	if err := checkProjectID(projectID); err != nil {
+		return nil, err
+	}
+	var filterQuery string
+	args := []interface{}{projectID}
+	if filter != "" {
+		filterSql, params, err := pg.newFilter().ParseFilter(filter)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid filter: %v", err)
+		}
+		filterQuery = "AND " + filterSql
+		args = append(args, params...)
+	}
+	query := fmt.Sprintf(pg.prefixed(mysqlSummarizeVulnerabilityOccurrences), filterQuery)
+	rows, err := pg.reader(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to summarize vulnerability Occurrences from database")
+	}
+	defer rows.Close()
+
+	summary := &pb.VulnerabilityOccurrencesSummary{}
+	for rows.Next() {
+		var uri sql.NullString
+		var severity vulnpb.Severity
+		var total, fixable int64
+		if err := rows.Scan(&uri, &severity, &total, &fixable); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to scan vulnerability summary row")
+		}
+		summary.Counts = append(summary.Counts, &pb.VulnerabilityOccurrencesSummary_FixableTotalByDigest{
+			Resource:     &pb.Resource{Uri: uri.String},
+			Severity:     severity,
+			FixableCount: fixable,
+			TotalCount:   total,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to summarize vulnerability Occurrences from database")
+	}
+	return summary, nil
+}
+
+// isFixable reports whether any package issue of the vulnerability has a fixed version.
+func isFixable(v *vulnpb.Details) bool {
+	for _, pi := range v.PackageIssue {
+		if loc := pi.GetFixedLocation(); loc != nil && loc.GetVersion().GetKind() != pkgpb.Version_MAXIMUM {
+			return true
+		}
+	}
+	return false
 }
 
-// CreateSourceString generates DB source path.
+// MySCreateSourceString generates DB source path.
 // username:password@protocol(address)/dbname?param=value
-// %s:%s@tcp(%s)/%s
-func MySCreateSourceString(user, password, host, dbName, SSLMode string) string {
-	if user == "" {
-		return fmt.Sprintf("tcp(%s)/%s",host, dbName)
+// The DSN is formatted by the driver so that credentials containing special
+// characters such as '@', ':' or '/' parse back unchanged.
+// When SSLMode enables TLS, the DSN refers to the config registered by registerTLSConfig.
+func MySCreateSourceString(user, password, host string, port int, dbName, SSLMode string) string {
+	return driverConfig(user, password, host, port, dbName, SSLMode).FormatDSN()
+}
+
+// driverConfig returns the driver config of the DSN built by MySCreateSourceString.
+func driverConfig(user, password, host string, port int, dbName, SSLMode string) *mysql.Config {
+	cfg := mysql.NewConfig()
+	cfg.User = user
+	cfg.Passwd = password
+	cfg.Net = "tcp"
+	cfg.Addr = mysqlAddress(host, port)
+	cfg.DBName = dbName
+	if tlsEnabled(SSLMode) {
+		cfg.TLSConfig = mysqlTLSConfigName
+	}
+	return cfg
+}
+
+// sourceString returns the DSN connecting to dbName on host and port with the
+// credentials and connection settings of config. DATETIME values are read as
+// time.Time in the configured location, UTC by default.
+func sourceString(config *config.MySQLConfig, host string, port int, dbName string) (string, error) {
+	cfg := driverConfig(config.User, config.Password, host, port, dbName, config.SSLMode)
+	charset, collation := charsetAndCollation(config)
+	cfg.Collation = collation
+	cfg.Params = map[string]string{"charset": charset}
+	cfg.ParseTime = true
+	cfg.Timeout = durationOrDefault(config.DialTimeout, defaultDialTimeout)
+	cfg.ReadTimeout = durationOrDefault(config.ReadTimeout, defaultReadTimeout)
+	cfg.WriteTimeout = durationOrDefault(config.WriteTimeout, defaultWriteTimeout)
+	cfg.Loc = time.UTC
+	if config.Loc != "" {
+		loc, err := time.LoadLocation(config.Loc)
+		if err != nil {
+			return "", fmt.Errorf("invalid loc %q: %v", config.Loc, err)
+		}
+		cfg.Loc = loc
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// durationOrDefault returns d, or def when d is not positive.
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// charsetAndCollation returns the character set and collation configured by config,
+// falling back to the defaults for unset values.
+func charsetAndCollation(config *config.MySQLConfig) (string, string) {
+	charset, collation := config.Charset, config.Collation
+	if charset == "" {
+		charset = defaultCharset
+	}
+	if collation == "" {
+		collation = defaultCollation
+	}
+	return charset, collation
+}
+
+// mysqlAddress joins host and port into a network address, bracketing IPv6 hosts.
+// For backward compatibility a host that already includes a port is used as is
+// when no port is configured; otherwise the port defaults to 3306.
+func mysqlAddress(host string, port int) string {
+	if port == 0 {
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			return host
+		}
+		port = defaultPort
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
+
+// documentMarshaler encodes notes and occurrences using the proto field names and
+// numeric enums, so that filters such as note_name="..." or kind=1 match the stored JSON.
+var documentMarshaler = &jsonpb.Marshaler{OrigName: true, EnumsAsInts: true}
+
+// marshalDocument encodes a note or occurrence for storage in a data column.
+func marshalDocument(m proto.Message) (string, error) {
+	return documentMarshaler.MarshalToString(m)
+}
+
+// unmarshalDocument decodes a data column into m. Documents written with
+// encoding/json by earlier versions are decoded with it as a fallback.
+func unmarshalDocument(data string, m proto.Message) error {
+	u := &jsonpb.Unmarshaler{AllowUnknownFields: true}
+	if err := u.Unmarshal(strings.NewReader(data), m); err != nil {
+		m.Reset()
+		return json.Unmarshal([]byte(data), m)
+	}
+	return nil
+}
+
+// isDuplicateEntry reports whether err is a MySQL duplicate key error.
+func isDuplicateEntry(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == mysqlErrDuplicateEntry
+}
+
+// Limits on the rows inserted by one multi-row INSERT, keeping the statement well
+// under the server's max_allowed_packet.
+const (
+	maxInsertRows  = 500
+	maxInsertBytes = 1 << 20
+)
+
+// insertChunks splits rows into chunks small enough to be inserted by one statement,
+// based on the number of rows and the size of their string values.
+func insertChunks(rows [][]interface{}) [][][]interface{} {
+	var chunks [][][]interface{}
+	start, size := 0, 0
+	for i, row := range rows {
+		rowSize := 0
+		for _, v := range row {
+			if s, ok := v.(string); ok {
+				rowSize += len(s)
+			}
+		}
+		if i > start && (i-start == maxInsertRows || size+rowSize > maxInsertBytes) {
+			chunks = append(chunks, rows[start:i])
+			start, size = i, 0
+		}
+		size += rowSize
 	}
-	return fmt.Sprintf("%s:%s@tcp(%s)/%s", user, password, host, dbName)
+	if start < len(rows) {
+		chunks = append(chunks, rows[start:])
+	}
+	return chunks
+}
+
+// multiRowInsert returns the INSERT statement adding rows, made of insert followed by
+// one copy of the placeholders in row per row, along with its arguments.
+func multiRowInsert(insert, row string, rows [][]interface{}) (string, []interface{}) {
+	var query strings.Builder
+	var args []interface{}
+	query.WriteString(insert)
+	for i, r := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString(row)
+		args = append(args, r...)
+	}
+	return query.String(), args
+}
+
+// maxInListIDs is the number of IDs looked up by one query, keeping it well under the
+// limit of 65535 placeholders per statement.
+const maxInListIDs = 1000
+
+// idChunks splits ids, without duplicates, into chunks of up to maxInListIDs IDs.
+func idChunks(ids []string) [][]string {
+	seen := make(map[string]bool, len(ids))
+	var chunks [][]string
+	var chunk []string
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		chunk = append(chunk, id)
+		if len(chunk) == maxInListIDs {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// inQuery returns query, taking the project ID and a %s verb for an IN list, formatted
+// with one placeholder per ID, along with its arguments.
+func inQuery(query, pID string, ids []string) (string, []interface{}) {
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, pID)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return fmt.Sprintf(query, strings.TrimPrefix(strings.Repeat(", ?", len(ids)), ", ")), args
 }
 
 // count returns the total number of entries for the specified query (assuming SELECT(*) is used)
-func (pg *MySQLStore) count(query string, args ...interface{}) (int64, error) {
-	row := pg.DB.QueryRow(query, args...)
+func (pg *MySQLStore) count(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	row := pg.reader(ctx).QueryRowContext(ctx, query, args...)
 	var count int64
 	err := row.Scan(&count)
 	if err != nil {
@@ -596,4 +2465,48 @@ func (pg *MySQLStore) count(query string, args ...interface{}) (int64, error) {
 	return count, err
 }
 
-
+// estimateCount returns the optimizer's estimate of the number of rows matched by
+// query, a COUNT(*) query, from its EXPLAIN plan. It does not read the rows, so is
+// cheap for large projects, but may be far off for selective filters on unindexed
+// fields.
+func (pg *MySQLStore) estimateCount(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	rows, err := pg.reader(ctx).QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, errors.New("EXPLAIN returned no rows")
+	}
+	values := make([]sql.NullFloat64, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i, column := range columns {
+		if column == "rows" || column == "filtered" {
+			dest[i] = &values[i]
+		} else {
+			dest[i] = new(sql.RawBytes)
+		}
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	// rows is the number of rows read using the index and filtered the percentage
+	// of them expected to match the rest of the condition.
+	estimate, filtered := 0.0, 100.0
+	for i, column := range columns {
+		switch {
+		case column == "rows" && values[i].Valid:
+			estimate = values[i].Float64
+		case column == "filtered" && values[i].Valid:
+			filtered = values[i].Float64
+		}
+	}
+	return int64(estimate*filtered/100 + 0.5), nil
+}
@@ -0,0 +1,5156 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fernet/fernet-go"
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/google/uuid"
+	"github.com/grafeas/grafeas/go/config"
+	"github.com/grafeas/grafeas/go/name"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	pb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	pkgpb "github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	vulnpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/context"
+	fieldmaskpb "google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testConfig returns a config pointing at a fresh database on the MySQL
+// server named by MYSQL_TEST_HOST, skipping the test when it is not set.
+func testConfig(t testing.TB) *config.MySQLConfig {
+	t.Helper()
+	host := os.Getenv("MYSQL_TEST_HOST")
+	if host == "" {
+		t.Skip("MYSQL_TEST_HOST not set, skipping MySQL integration test")
+	}
+	return &config.MySQLConfig{
+		Host:     host,
+		DbName:   fmt.Sprintf("grafeas_test_%d", time.Now().UnixNano()),
+		User:     os.Getenv("MYSQL_TEST_USER"),
+		Password: os.Getenv("MYSQL_TEST_PASSWORD"),
+	}
+}
+
+// newTestStore opens a store for cfg (or a default test config when nil) and
+// drops its database when the test finishes.
+func newTestStore(t testing.TB, cfg *config.MySQLConfig) *MySQLStore {
+	t.Helper()
+	if cfg == nil {
+		cfg = testConfig(t)
+	}
+	pg, err := NewMySQLStore(cfg)
+	if err != nil {
+		t.Fatalf("NewMySQLStore() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		pg.DB.Exec("DROP DATABASE " + quoteIdent(cfg.DbName))
+		pg.DB.Close()
+	})
+	return pg
+}
+
+func TestCountCanceledContext(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := pg.count(ctx, "SELECT SLEEP(10)")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("count() returned %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("count() took %v after cancellation, want it to return promptly", elapsed)
+	}
+}
+
+func TestDeadlineWaitingForConnection(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxOpenConns = 1
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	if _, err := pg.CreateProject(ctx, "p1", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+
+	// Hold the only connection of the pool, so that GetProject waits for it.
+	conn, err := pg.DB.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn() failed: %v", err)
+	}
+	defer conn.Close()
+
+	deadlineCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = pg.GetProject(deadlineCtx, "p1")
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("GetProject() with the pool exhausted returned %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetProject() took %v after its deadline, want it to return promptly", elapsed)
+	}
+	if stats := pg.Stats(); stats.WaitCount == 0 {
+		t.Errorf("Stats() = %+v, want GetProject() to have waited for a connection", stats)
+	}
+
+	conn.Close()
+	if _, err := pg.GetProject(ctx, "p1"); err != nil {
+		t.Errorf("GetProject() after releasing the connection failed: %v", err)
+	}
+}
+
+func TestContextError(t *testing.T) {
+	internal := status.Error(codes.Internal, "Failed to query Project from database")
+	notFound := status.Error(codes.NotFound, "Project not found")
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	canceled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+
+	tests := []struct {
+		desc string
+		ctx  context.Context
+		err  error
+		want codes.Code
+	}{
+		{"live context", context.Background(), internal, codes.Internal},
+		{"no error", expired, nil, codes.OK},
+		{"deadline exceeded", expired, internal, codes.DeadlineExceeded},
+		{"canceled", canceled, internal, codes.Canceled},
+		{"unwrapped error", expired, errors.New("driver: bad connection"), codes.DeadlineExceeded},
+		{"other code", expired, notFound, codes.NotFound},
+	}
+	for _, tt := range tests {
+		if got := status.Code(contextError(tt.ctx, tt.err)); got != tt.want {
+			t.Errorf("contextError(%s) has code %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+// vulnerabilityOccurrence returns a vulnerability occurrence on resource uri,
+// with a fixed version available when fixable is set.
+func vulnerabilityOccurrence(uri string, severity vulnpb.Severity, fixable bool) *pb.Occurrence {
+	kind := pkgpb.Version_MAXIMUM
+	if fixable {
+		kind = pkgpb.Version_NORMAL
+	}
+	return &pb.Occurrence{
+		Resource: &pb.Resource{Uri: uri},
+		NoteName: "projects/vuln-provider/notes/CVE-2019-1000",
+		Kind:     cpb.NoteKind_VULNERABILITY,
+		Details: &pb.Occurrence_Vulnerability{
+			Vulnerability: &vulnpb.Details{
+				Severity: severity,
+				PackageIssue: []*vulnpb.PackageIssue{{
+					FixedLocation: &vulnpb.VulnerabilityLocation{
+						CpeUri:  "cpe:/o:debian:debian_linux:9",
+						Package: "openssl",
+						Version: &pkgpb.Version{Name: "1.1.0", Kind: kind},
+					},
+				}},
+			},
+		},
+	}
+}
+
+func TestGetVulnerabilityOccurrencesSummary(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	occs := []*pb.Occurrence{
+		vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true),
+		vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, false),
+		vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, false),
+		vulnerabilityOccurrence("https://gcr.io/p/b", vulnpb.Severity_HIGH, true),
+		vulnerabilityOccurrence("https://gcr.io/p/b", vulnpb.Severity_CRITICAL, true),
+		{
+			Resource: &pb.Resource{Uri: "https://gcr.io/p/a"},
+			NoteName: "projects/build-provider/notes/build",
+			Kind:     cpb.NoteKind_BUILD,
+		},
+	}
+	for _, o := range occs {
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", o); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+
+	summary, err := pg.GetVulnerabilityOccurrencesSummary(ctx, "p", "")
+	if err != nil {
+		t.Fatalf("GetVulnerabilityOccurrencesSummary() failed: %v", err)
+	}
+	var order []string
+	for _, c := range summary.Counts {
+		order = append(order, c.Resource.Uri+"/"+c.Severity.String())
+	}
+	if want := []string{"https://gcr.io/p/a/LOW", "https://gcr.io/p/a/HIGH", "https://gcr.io/p/b/HIGH", "https://gcr.io/p/b/CRITICAL"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("summary entries are ordered %v, want %v", order, want)
+	}
+	type count struct{ fixable, total int64 }
+	want := map[string]count{
+		"https://gcr.io/p/a/HIGH":     {fixable: 1, total: 2},
+		"https://gcr.io/p/a/LOW":      {fixable: 0, total: 1},
+		"https://gcr.io/p/b/HIGH":     {fixable: 1, total: 1},
+		"https://gcr.io/p/b/CRITICAL": {fixable: 1, total: 1},
+	}
+	got := map[string]count{}
+	for _, c := range summary.Counts {
+		got[c.Resource.Uri+"/"+c.Severity.String()] = count{fixable: c.FixableCount, total: c.TotalCount}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d summary entries, want %d: %v", len(got), len(want), got)
+	}
+	for k, w := range want {
+		if got[k] != w {
+			t.Errorf("summary for %s = %+v, want %+v", k, got[k], w)
+		}
+	}
+}
+
+func TestGetProjectStatistics(t *testing.T) {
+	ctx := context.Background()
+	seed := func(s Store) {
+		for _, n := range []struct{ pID, nID string }{{"p", "n1"}, {"p", "n2"}, {"other", "n1"}} {
+			if _, err := s.CreateNote(ctx, n.pID, n.nID, "u", &pb.Note{}); err != nil {
+				t.Fatalf("CreateNote() failed: %v", err)
+			}
+		}
+		for _, o := range []struct {
+			pID string
+			o   *pb.Occurrence
+		}{
+			{"p", vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)},
+			{"p", vulnerabilityOccurrence("https://gcr.io/p/b", vulnpb.Severity_LOW, false)},
+			{"p", vulnerabilityOccurrence("https://gcr.io/p/c", vulnpb.Severity_LOW, false)},
+			{"p", &pb.Occurrence{NoteName: "projects/p/notes/n2", Kind: cpb.NoteKind_BUILD}},
+			{"p", &pb.Occurrence{NoteName: "projects/p/notes/n2"}},
+			{"other", vulnerabilityOccurrence("https://gcr.io/other/a", vulnpb.Severity_HIGH, true)},
+		} {
+			if _, err := s.CreateOccurrence(ctx, o.pID, "u", o.o); err != nil {
+				t.Fatalf("CreateOccurrence() failed: %v", err)
+			}
+		}
+	}
+	want := &ProjectStats{
+		Occurrences: 5,
+		Notes:       2,
+		OccurrencesByKind: map[cpb.NoteKind]int64{
+			cpb.NoteKind_VULNERABILITY:         3,
+			cpb.NoteKind_BUILD:                 1,
+			cpb.NoteKind_NOTE_KIND_UNSPECIFIED: 1,
+		},
+	}
+
+	for _, s := range []Store{newTestStore(t, nil), NewFakeStore(nil)} {
+		seed(s)
+		got, err := s.GetProjectStatistics(ctx, "p")
+		if err != nil {
+			t.Fatalf("%T.GetProjectStatistics() failed: %v", s, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%T.GetProjectStatistics() = %+v, want %+v", s, got, want)
+		}
+		got, err = s.GetProjectStatistics(ctx, "empty")
+		if err != nil {
+			t.Fatalf("%T.GetProjectStatistics() of an empty project failed: %v", s, err)
+		}
+		if got.Occurrences != 0 || got.Notes != 0 || len(got.OccurrencesByKind) != 0 {
+			t.Errorf("%T.GetProjectStatistics() of an empty project = %+v, want no counts", s, got)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AuditLog = true
+	clock := &fixedClock{t: time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)}
+	cfg.Clock = clock
+	pg := newTestStore(t, cfg)
+	ctx := WithUser(ReadFromPrimary(context.Background()), "alice")
+
+	if _, err := pg.CreateProject(ctx, "p", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+	if _, err := pg.CreateNote(ctx, "p", "n", "bob", &pb.Note{ShortDescription: "note"}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	o, err := pg.CreateOccurrence(WithOccurrenceID(ctx, "o1"), "p", "bob", vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, true))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	o.Resource.Uri = "https://gcr.io/p/b"
+	if _, err := pg.UpdateOccurrence(ctx, "p", "o1", o, nil); err != nil {
+		t.Fatalf("UpdateOccurrence() failed: %v", err)
+	}
+	batch, errs := pg.BatchCreateOccurrences(ctx, "p", "bob", []*pb.Occurrence{vulnerabilityOccurrence("https://gcr.io/p/c", vulnpb.Severity_LOW, true)})
+	if len(errs) != 0 {
+		t.Fatalf("BatchCreateOccurrences() failed: %v", errs)
+	}
+	_, batchID, _ := name.ParseOccurrence(batch[0].Name)
+	// Failed changes are not recorded.
+	if _, err := pg.CreateNote(ctx, "p", "n", "bob", &pb.Note{}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("CreateNote() of an existing note got %v, want AlreadyExists", err)
+	}
+	if err := pg.DeleteOccurrence(ctx, "p", "missing"); status.Code(err) != codes.NotFound {
+		t.Fatalf("DeleteOccurrence() of a missing occurrence got %v, want NotFound", err)
+	}
+	if err := pg.DeleteOccurrence(ctx, "p", "o1"); err != nil {
+		t.Fatalf("DeleteOccurrence() failed: %v", err)
+	}
+	if err := pg.DeleteNote(ctx, "p", "n"); err != nil {
+		t.Fatalf("DeleteNote() failed: %v", err)
+	}
+
+	want := []AuditEvent{
+		{Operation: "CreateProject", EntityType: AuditProject, EntityID: "p", UserID: "alice"},
+		{Operation: "CreateNote", EntityType: AuditNote, EntityID: "n", UserID: "bob"},
+		{Operation: "CreateOccurrence", EntityType: AuditOccurrence, EntityID: "o1", UserID: "bob"},
+		{Operation: "UpdateOccurrence", EntityType: AuditOccurrence, EntityID: "o1", UserID: "alice"},
+		{Operation: "BatchCreateOccurrences", EntityType: AuditOccurrence, EntityID: batchID, UserID: "bob"},
+		{Operation: "DeleteOccurrence", EntityType: AuditOccurrence, EntityID: "o1", UserID: "alice"},
+		{Operation: "DeleteNote", EntityType: AuditNote, EntityID: "n", UserID: "alice"},
+	}
+	var got []AuditEvent
+	token := ""
+	for {
+		events, next, err := pg.ListAuditEvents(ctx, "p", token, 3)
+		if err != nil {
+			t.Fatalf("ListAuditEvents() failed: %v", err)
+		}
+		for _, ev := range events {
+			if ev.ProjectID != "p" || !ev.Time.Equal(clock.t) {
+				t.Errorf("ListAuditEvents() event %+v, want project p at %v", ev, clock.t)
+			}
+			got = append(got, AuditEvent{Operation: ev.Operation, EntityType: ev.EntityType, EntityID: ev.EntityID, UserID: ev.UserID})
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListAuditEvents() = %+v, want %+v", got, want)
+	}
+	if events, _, err := pg.ListAuditEvents(ctx, "other", "", 10); err != nil || len(events) != 0 {
+		t.Errorf("ListAuditEvents() of another project = %v, %v, want no events", events, err)
+	}
+}
+
+func TestAuditLogRollsBackChange(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AuditLog = true
+	pg := newTestStore(t, cfg)
+	ctx := ReadFromPrimary(context.Background())
+	if _, err := pg.DB.Exec("DROP TABLE audit_log"); err != nil {
+		t.Fatalf("dropping audit_log failed: %v", err)
+	}
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); status.Code(err) != codes.Internal {
+		t.Fatalf("CreateNote() without an audit log got %v, want Internal", err)
+	}
+	if _, err := pg.GetNote(ctx, "p", "n"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetNote() of a note whose audit event failed got %v, want NotFound", err)
+	}
+}
+
+func TestAuditLogTransactions(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	pg.auditLog = true
+	if _, err := pg.CreateNote(context.Background(), "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	if d.execs != 2 || d.commits != 1 {
+		t.Errorf("CreateNote() ran %d statements in %d transactions, want the note and its audit event in 1", d.execs, d.commits)
+	}
+
+	pg, d = newFailingStore(t, errors.New("insert failed"), 1)
+	pg.auditLog = true
+	if _, err := pg.CreateNote(context.Background(), "p", "n", "u", &pb.Note{}); status.Code(err) != codes.Internal {
+		t.Fatalf("failing CreateNote() got %v, want Internal", err)
+	}
+	if d.execs != 1 || d.commits != 0 || d.rollbacks != 1 {
+		t.Errorf("failing CreateNote() ran %d statements, %d commits and %d rollbacks, want 1 statement rolled back", d.execs, d.commits, d.rollbacks)
+	}
+
+	pg, d = newFailingStore(t, nil, 0)
+	if _, err := pg.CreateNote(context.Background(), "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	if d.execs != 1 || d.commits != 0 {
+		t.Errorf("CreateNote() without the audit log ran %d statements in %d transactions, want 1 outside of a transaction", d.execs, d.commits)
+	}
+}
+
+func TestUpdateOccurrenceWithMask(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	o := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)
+	o.Remediation = "upgrade openssl"
+	created, err := pg.CreateOccurrence(ctx, "p", "u", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, err := name.ParseOccurrence(created.Name)
+	if err != nil {
+		t.Fatalf("ParseOccurrence(%q) failed: %v", created.Name, err)
+	}
+
+	update := &pb.Occurrence{
+		Remediation: "upgrade openssl to 1.1.1",
+		Resource:    &pb.Resource{Uri: "https://gcr.io/p/other"},
+	}
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"remediation"}}
+	if _, err := pg.UpdateOccurrence(ctx, "p", oID, update, mask); err != nil {
+		t.Fatalf("UpdateOccurrence() failed: %v", err)
+	}
+
+	got, err := pg.GetOccurrence(ctx, "p", oID)
+	if err != nil {
+		t.Fatalf("GetOccurrence() failed: %v", err)
+	}
+	if got.Remediation != update.Remediation {
+		t.Errorf("Remediation = %q, want %q", got.Remediation, update.Remediation)
+	}
+	if got.Resource.Uri != o.Resource.Uri {
+		t.Errorf("Resource.Uri = %q, want unmasked value %q", got.Resource.Uri, o.Resource.Uri)
+	}
+	if got.GetVulnerability().GetSeverity() != vulnpb.Severity_HIGH {
+		t.Errorf("vulnerability details were not preserved: %v", got.Details)
+	}
+	if !proto.Equal(got.CreateTime, created.CreateTime) {
+		t.Errorf("CreateTime = %v, want %v", got.CreateTime, created.CreateTime)
+	}
+	if got.UpdateTime == nil {
+		t.Error("UpdateTime was not set")
+	}
+}
+
+func TestUpdateOccurrenceInvalidMask(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	created, err := pg.CreateOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, false))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, _ := name.ParseOccurrence(created.Name)
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"no_such_field"}}
+	if _, err := pg.UpdateOccurrence(ctx, "p", oID, &pb.Occurrence{}, mask); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UpdateOccurrence() returned %v, want InvalidArgument", err)
+	}
+}
+
+func TestUpdateNoteWithMask(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	n := &pb.Note{
+		ShortDescription: "CVE-2019-1000",
+		LongDescription:  "A buffer overflow in openssl",
+		Kind:             cpb.NoteKind_VULNERABILITY,
+		Type: &pb.Note_Vulnerability{
+			Vulnerability: &vulnpb.Vulnerability{CvssScore: 7.5, Severity: vulnpb.Severity_HIGH},
+		},
+	}
+	created, err := pg.CreateNote(ctx, "p", "CVE-2019-1000", "u", n)
+	if err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+
+	update := &pb.Note{ShortDescription: "openssl overflow", LongDescription: "must not be written"}
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"short_description"}}
+	if _, err := pg.UpdateNote(ctx, "p", "CVE-2019-1000", update, mask); err != nil {
+		t.Fatalf("UpdateNote() failed: %v", err)
+	}
+
+	got, err := pg.GetNote(ctx, "p", "CVE-2019-1000")
+	if err != nil {
+		t.Fatalf("GetNote() failed: %v", err)
+	}
+	if got.ShortDescription != update.ShortDescription {
+		t.Errorf("ShortDescription = %q, want %q", got.ShortDescription, update.ShortDescription)
+	}
+	if got.LongDescription != n.LongDescription {
+		t.Errorf("LongDescription = %q, want unmasked value %q", got.LongDescription, n.LongDescription)
+	}
+	if !proto.Equal(got.GetVulnerability(), n.GetVulnerability()) {
+		t.Errorf("vulnerability = %v, want %v", got.GetVulnerability(), n.GetVulnerability())
+	}
+	if !proto.Equal(got.CreateTime, created.CreateTime) {
+		t.Errorf("CreateTime = %v, want %v", got.CreateTime, created.CreateTime)
+	}
+
+	mask = &fieldmaskpb.FieldMask{Paths: []string{"short_description.value"}}
+	if _, err := pg.UpdateNote(ctx, "p", "CVE-2019-1000", update, mask); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UpdateNote() with invalid mask returned %v, want InvalidArgument", err)
+	}
+}
+
+// testUpdateNoteKeepsCreateTime tests that UpdateNote of s keeps the creation time of
+// the note it replaces, whatever the creation time of the update.
+func testUpdateNoteKeepsCreateTime(t *testing.T, s Store) {
+	t.Helper()
+	ctx := ReadFromPrimary(context.Background())
+	created, err := s.CreateNote(ctx, "p", "n", "u", &pb.Note{ShortDescription: "first"})
+	if err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	for _, createTime := range []*timestamp.Timestamp{nil, {Seconds: 1}} {
+		updated, err := s.UpdateNote(ctx, "p", "n", &pb.Note{ShortDescription: "second", CreateTime: createTime}, nil)
+		if err != nil {
+			t.Fatalf("UpdateNote() failed: %v", err)
+		}
+		if !proto.Equal(updated.CreateTime, created.CreateTime) {
+			t.Errorf("UpdateNote() with create_time %v returned create_time %v, want %v", createTime, updated.CreateTime, created.CreateTime)
+		}
+		got, err := s.GetNote(ctx, "p", "n")
+		if err != nil {
+			t.Fatalf("GetNote() failed: %v", err)
+		}
+		if !proto.Equal(got.CreateTime, created.CreateTime) || got.ShortDescription != "second" {
+			t.Errorf("GetNote() after UpdateNote() with create_time %v = %v, want the update with create_time %v", createTime, got, created.CreateTime)
+		}
+	}
+}
+
+func TestUpdateNoteKeepsCreateTime(t *testing.T) {
+	testUpdateNoteKeepsCreateTime(t, newTestStore(t, nil))
+}
+
+func TestUpdateNoteConcurrentMasks(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+
+	// Updates of different fields at the same time each keep the other's field.
+	const updates = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*updates)
+	for _, path := range []string{"short_description", "long_description"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			mask := &fieldmaskpb.FieldMask{Paths: []string{path}}
+			for i := 0; i < updates; i++ {
+				v := fmt.Sprintf("%s %d", path, i)
+				if _, err := pg.UpdateNote(ctx, "p", "n", &pb.Note{ShortDescription: v, LongDescription: v}, mask); err != nil {
+					errs <- err
+				}
+			}
+		}(path)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("UpdateNote() failed: %v", err)
+	}
+	got, err := pg.GetNote(ReadFromPrimary(ctx), "p", "n")
+	if err != nil {
+		t.Fatalf("GetNote() failed: %v", err)
+	}
+	if want := fmt.Sprintf("short_description %d", updates-1); got.ShortDescription != want {
+		t.Errorf("ShortDescription = %q, want %q", got.ShortDescription, want)
+	}
+	if want := fmt.Sprintf("long_description %d", updates-1); got.LongDescription != want {
+		t.Errorf("LongDescription = %q, want %q", got.LongDescription, want)
+	}
+}
+
+// fixedClock is a Clock returning a time set by the test.
+type fixedClock struct{ t time.Time }
+
+func (c *fixedClock) Now() time.Time { return c.t }
+
+func TestClockSetsTimestamps(t *testing.T) {
+	cfg := testConfig(t)
+	clock := &fixedClock{t: time.Date(2019, 5, 1, 12, 30, 0, 123456000, time.UTC)}
+	cfg.Clock = clock
+	pg := newTestStore(t, cfg)
+	ctx := ReadFromPrimary(context.Background())
+	created := &timestamp.Timestamp{Seconds: clock.t.Unix(), Nanos: int32(clock.t.Nanosecond())}
+
+	o, err := pg.CreateOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, false))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{ShortDescription: "n"}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	_, oID, _ := name.ParseOccurrence(o.Name)
+	gotOcc, err := pg.GetOccurrence(ctx, "p", oID)
+	if err != nil {
+		t.Fatalf("GetOccurrence() failed: %v", err)
+	}
+	if !proto.Equal(gotOcc.CreateTime, created) {
+		t.Errorf("occurrence CreateTime = %v, want %v", gotOcc.CreateTime, created)
+	}
+	gotNote, err := pg.GetNote(ctx, "p", "n")
+	if err != nil {
+		t.Fatalf("GetNote() failed: %v", err)
+	}
+	if !proto.Equal(gotNote.CreateTime, created) {
+		t.Errorf("note CreateTime = %v, want %v", gotNote.CreateTime, created)
+	}
+
+	clock.t = clock.t.Add(time.Hour)
+	updated := &timestamp.Timestamp{Seconds: clock.t.Unix(), Nanos: int32(clock.t.Nanosecond())}
+	gotOcc, err = pg.UpdateOccurrence(ctx, "p", oID, &pb.Occurrence{Remediation: "upgrade"}, &fieldmaskpb.FieldMask{Paths: []string{"remediation"}})
+	if err != nil {
+		t.Fatalf("UpdateOccurrence() failed: %v", err)
+	}
+	if !proto.Equal(gotOcc.UpdateTime, updated) {
+		t.Errorf("occurrence UpdateTime = %v, want %v", gotOcc.UpdateTime, updated)
+	}
+	gotNote, err = pg.UpdateNote(ctx, "p", "n", &pb.Note{ShortDescription: "m"}, &fieldmaskpb.FieldMask{Paths: []string{"short_description"}})
+	if err != nil {
+		t.Fatalf("UpdateNote() failed: %v", err)
+	}
+	if !proto.Equal(gotNote.UpdateTime, updated) {
+		t.Errorf("note UpdateTime = %v, want %v", gotNote.UpdateTime, updated)
+	}
+}
+
+func TestOccurrenceTimestampsFromColumns(t *testing.T) {
+	cfg := testConfig(t)
+	clock := &fixedClock{t: time.Date(2019, 5, 1, 12, 30, 0, 123456789, time.UTC)}
+	cfg.Clock = clock
+	pg := newTestStore(t, cfg)
+	ctx := ReadFromPrimary(context.Background())
+	created := &timestamp.Timestamp{Seconds: clock.t.Unix(), Nanos: 123456000}
+
+	o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	if !proto.Equal(o.CreateTime, created) {
+		t.Errorf("CreateOccurrence() CreateTime = %v, want %v truncated to microseconds", o.CreateTime, created)
+	}
+	_, oID, _ := name.ParseOccurrence(o.Name)
+	clock.t = clock.t.Add(time.Hour)
+	updated := &timestamp.Timestamp{Seconds: clock.t.Unix(), Nanos: 123456000}
+	// The update carries no creation time, which is kept from the column.
+	if _, err := pg.UpdateOccurrence(ctx, "p", oID, &pb.Occurrence{NoteName: "projects/p/notes/n", Remediation: "upgrade"}, nil); err != nil {
+		t.Fatalf("UpdateOccurrence() failed: %v", err)
+	}
+	if _, err := pg.DB.Exec("UPDATE occurrences SET data = JSON_REMOVE(data, '$.create_time', '$.update_time') WHERE occurrence_id = ?", occurrenceIDValue(oID)); err != nil {
+		t.Fatalf("removing timestamps from data failed: %v", err)
+	}
+
+	check := func(method string, got *pb.Occurrence) {
+		t.Helper()
+		if got == nil {
+			t.Errorf("%s() did not return the occurrence", method)
+			return
+		}
+		if !proto.Equal(got.CreateTime, created) || !proto.Equal(got.UpdateTime, updated) {
+			t.Errorf("%s() create_time, update_time = %v, %v; want %v, %v", method, got.CreateTime, got.UpdateTime, created, updated)
+		}
+	}
+	got, err := pg.GetOccurrence(ctx, "p", oID)
+	if err != nil {
+		t.Fatalf("GetOccurrence() failed: %v", err)
+	}
+	check("GetOccurrence", got)
+	gotMap, err := pg.GetOccurrences(ctx, "p", []string{oID})
+	if err != nil {
+		t.Fatalf("GetOccurrences() failed: %v", err)
+	}
+	check("GetOccurrences", gotMap[oID])
+	gotList, _, err := pg.ListOccurrences(ctx, "p", "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	if len(gotList) != 1 {
+		t.Fatalf("ListOccurrences() returned %d occurrences, want 1", len(gotList))
+	}
+	check("ListOccurrences", gotList[0])
+}
+
+func TestTimestampColumns(t *testing.T) {
+	ts := &timestamp.Timestamp{Seconds: 1556713800, Nanos: 123456789}
+	if got, want := truncateTimestamp(ts), (&timestamp.Timestamp{Seconds: 1556713800, Nanos: 123456000}); !proto.Equal(got, want) {
+		t.Errorf("truncateTimestamp(%v) = %v, want %v", ts, got, want)
+	}
+	if got := truncateTimestamp(nil); got != nil {
+		t.Errorf("truncateTimestamp(nil) = %v, want nil", got)
+	}
+	if got, want := datetimeValue(ts), "2019-05-01 12:30:00.123456"; got != want {
+		t.Errorf("datetimeValue(%v) = %v, want %q", ts, got, want)
+	}
+	if got := datetimeValue(nil); got != nil {
+		t.Errorf("datetimeValue(nil) = %v, want nil", got)
+	}
+	column := sql.NullTime{Time: time.Date(2019, 5, 1, 12, 30, 0, 123456000, time.UTC), Valid: true}
+	if got, want := timestampFromColumn(column), truncateTimestamp(ts); !proto.Equal(got, want) {
+		t.Errorf("timestampFromColumn(%v) = %v, want %v", column.Time, got, want)
+	}
+	if got := timestampFromColumn(sql.NullTime{}); got != nil {
+		t.Errorf("timestampFromColumn(NULL) = %v, want nil", got)
+	}
+}
+
+func TestBatchCreateOccurrencesRollsBack(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	var occs []*pb.Occurrence
+	for i := 0; i < 5; i++ {
+		occs = append(occs, vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true))
+	}
+	// The third occurrence fails validation, so none of the batch is inserted.
+	occs[2].NoteName = "invalid-note-name"
+
+	created, errs := pg.BatchCreateOccurrences(ctx, "p", "u", occs)
+	if len(created) != 0 {
+		t.Errorf("BatchCreateOccurrences() created %d occurrences, want 0", len(created))
+	}
+	if len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument {
+		t.Errorf("BatchCreateOccurrences() returned errors %v, want one InvalidArgument", errs)
+	}
+	got, _, err := pg.ListOccurrences(ctx, "p", "", "", 100)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("found %d persisted occurrences after rollback, want 0", len(got))
+	}
+}
+
+func TestBatchCreateNotesReturnsFailures(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	if _, err := pg.CreateNote(ctx, "p", "existing", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+
+	notes := map[string]*pb.Note{
+		"new-1":    {ShortDescription: "first"},
+		"existing": {ShortDescription: "duplicate"},
+		"new-2":    {ShortDescription: "second"},
+	}
+	created, errs := pg.BatchCreateNotes(ctx, "p", "u", notes)
+	if len(created) != 2 {
+		t.Errorf("BatchCreateNotes() created %d notes, want 2", len(created))
+	}
+	if len(errs) != 1 {
+		t.Fatalf("BatchCreateNotes() returned %d errors, want 1: %v", len(errs), errs)
+	}
+	if status.Code(errs[0]) != codes.AlreadyExists || !strings.Contains(errs[0].Error(), "existing") {
+		t.Errorf("BatchCreateNotes() error = %v, want AlreadyExists naming the note", errs[0])
+	}
+}
+
+func TestCreateProjectAlreadyExists(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	if _, err := pg.CreateProject(ctx, "p", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+	if _, err := pg.CreateProject(ctx, "p", &prpb.Project{}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("second CreateProject() returned %v, want AlreadyExists", err)
+	}
+}
+
+func TestDeleteProjectDeletesNotesAndOccurrences(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	if _, err := pg.CreateProject(ctx, "p", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+	for _, nID := range []string{"n1", "n2"} {
+		if _, err := pg.CreateNote(ctx, "p", nID, "u", &pb.Note{}); err != nil {
+			t.Fatalf("CreateNote() failed: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n1"}); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+
+	if err := pg.DeleteProject(ctx, "p"); err != nil {
+		t.Fatalf("DeleteProject() failed: %v", err)
+	}
+	for _, table := range []string{"notes", "occurrences"} {
+		var count int
+		if err := pg.DB.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE project_id = ?", "p").Scan(&count); err != nil {
+			t.Fatalf("counting %s failed: %v", table, err)
+		}
+		if count != 0 {
+			t.Errorf("found %d %s after DeleteProject(), want 0", count, table)
+		}
+	}
+}
+
+func TestMaxOpenConns(t *testing.T) {
+	pg := newTestStore(t, nil)
+	if got := pg.DB.Stats().MaxOpenConnections; got != defaultMaxOpenConns {
+		t.Errorf("default MaxOpenConnections = %d, want %d", got, defaultMaxOpenConns)
+	}
+
+	cfg := testConfig(t)
+	cfg.MaxOpenConns = 7
+	pg = newTestStore(t, cfg)
+	if got := pg.DB.Stats().MaxOpenConnections; got != 7 {
+		t.Errorf("MaxOpenConnections = %d, want 7", got)
+	}
+}
+
+func TestIdleConnectionSettings(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxIdleConns = 1
+	cfg.ConnMaxIdleTime = 100 * time.Millisecond
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := pg.DB.Conn(ctx)
+		if err != nil {
+			t.Fatalf("Conn() failed: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if stats := pg.DB.Stats(); stats.Idle > 1 || stats.MaxIdleClosed < 2 {
+		t.Errorf("Stats() = %+v, want at most 1 idle connection and 2 closed", stats)
+	}
+
+	time.Sleep(2 * time.Second)
+	if stats := pg.DB.Stats(); stats.Idle != 0 || stats.MaxIdleTimeClosed == 0 {
+		t.Errorf("Stats() = %+v, want idle connection closed after ConnMaxIdleTime", stats)
+	}
+}
+
+func TestConnMaxLifetime(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ConnMaxLifetime = 100 * time.Millisecond
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+
+	if err := pg.DB.PingContext(ctx); err != nil {
+		t.Fatalf("PingContext() failed: %v", err)
+	}
+	time.Sleep(2 * time.Second)
+	if err := pg.DB.PingContext(ctx); err != nil {
+		t.Fatalf("PingContext() failed: %v", err)
+	}
+	if stats := pg.DB.Stats(); stats.MaxLifetimeClosed == 0 {
+		t.Errorf("Stats() = %+v, want connections recycled after ConnMaxLifetime", stats)
+	}
+}
+
+func TestMySCreateSourceString(t *testing.T) {
+	tests := []struct {
+		sslMode string
+		want    string
+	}{
+		{sslMode: "", want: "grafeas:secret@tcp(db:3306)/grafeas"},
+		{sslMode: "disable", want: "grafeas:secret@tcp(db:3306)/grafeas"},
+		{sslMode: "require", want: "grafeas:secret@tcp(db:3306)/grafeas?tls=grafeas"},
+		{sslMode: "verify-ca", want: "grafeas:secret@tcp(db:3306)/grafeas?tls=grafeas"},
+		{sslMode: "verify-full", want: "grafeas:secret@tcp(db:3306)/grafeas?tls=grafeas"},
+	}
+	for _, tt := range tests {
+		if got := MySCreateSourceString("grafeas", "secret", "db", 3306, "grafeas", tt.sslMode); got != tt.want {
+			t.Errorf("MySCreateSourceString(sslmode %q) = %q, want %q", tt.sslMode, got, tt.want)
+		}
+	}
+}
+
+func TestSourceStringCharset(t *testing.T) {
+	tests := []struct {
+		cfg                      config.MySQLConfig
+		wantCharset, wantCollate string
+	}{
+		{config.MySQLConfig{}, "utf8mb4", "utf8mb4_unicode_ci"},
+		{config.MySQLConfig{Charset: "utf8mb4", Collation: "utf8mb4_0900_ai_ci"}, "utf8mb4", "utf8mb4_0900_ai_ci"},
+	}
+	for _, tt := range tests {
+		source, err := sourceString(&tt.cfg, "db", 3306, "grafeas")
+		if err != nil {
+			t.Errorf("sourceString(%+v) failed: %v", tt.cfg, err)
+			continue
+		}
+		cfg, err := mysql.ParseDSN(source)
+		if err != nil {
+			t.Errorf("ParseDSN(%q) failed: %v", source, err)
+			continue
+		}
+		if cfg.Params["charset"] != tt.wantCharset || cfg.Collation != tt.wantCollate {
+			t.Errorf("sourceString(%+v) = %q, want charset %s and collation %s", tt.cfg, source, tt.wantCharset, tt.wantCollate)
+		}
+	}
+}
+
+func TestMySCreateSourceStringEscapesCredentials(t *testing.T) {
+	for _, password := range []string{"p@ss", "p:ss", "p/ss", "a@b:c/d?e"} {
+		source := MySCreateSourceString("grafeas", password, "db", 3306, "grafeas", "disable")
+		cfg, err := mysql.ParseDSN(source)
+		if err != nil {
+			t.Errorf("ParseDSN(%q) failed: %v", source, err)
+			continue
+		}
+		if cfg.User != "grafeas" || cfg.Passwd != password || cfg.Addr != "db:3306" || cfg.DBName != "grafeas" {
+			t.Errorf("ParseDSN(%q) = user %q, password %q, addr %q, db %q; want the original values",
+				source, cfg.User, cfg.Passwd, cfg.Addr, cfg.DBName)
+		}
+	}
+}
+
+func TestMysqlAddress(t *testing.T) {
+	tests := []struct {
+		host string
+		port int
+		want string
+	}{
+		{host: "db", want: "db:3306"},
+		{host: "db", port: 3307, want: "db:3307"},
+		{host: "db:3308", want: "db:3308"},
+		{host: "10.0.0.1", port: 3307, want: "10.0.0.1:3307"},
+		{host: "::1", want: "[::1]:3306"},
+		{host: "[::1]", port: 3307, want: "[::1]:3307"},
+		{host: "[fe80::1]:3308", want: "[fe80::1]:3308"},
+	}
+	for _, tt := range tests {
+		if got := mysqlAddress(tt.host, tt.port); got != tt.want {
+			t.Errorf("mysqlAddress(%q, %d) = %q, want %q", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tests := []struct {
+		sslMode        string
+		wantSkipVerify bool
+		wantVerifyFunc bool
+		wantErr        bool
+	}{
+		{sslMode: "require", wantSkipVerify: true},
+		{sslMode: "verify-ca", wantSkipVerify: true, wantVerifyFunc: true},
+		{sslMode: "verify-full"},
+		{sslMode: "prefer", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := newTLSConfig(&config.MySQLConfig{SSLMode: tt.sslMode, SSLServerName: "db.example.com"})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("newTLSConfig(%q) succeeded, want error", tt.sslMode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newTLSConfig(%q) failed: %v", tt.sslMode, err)
+			continue
+		}
+		if got.InsecureSkipVerify != tt.wantSkipVerify {
+			t.Errorf("newTLSConfig(%q).InsecureSkipVerify = %v, want %v", tt.sslMode, got.InsecureSkipVerify, tt.wantSkipVerify)
+		}
+		if (got.VerifyPeerCertificate != nil) != tt.wantVerifyFunc {
+			t.Errorf("newTLSConfig(%q) sets VerifyPeerCertificate = %v, want %v", tt.sslMode, got.VerifyPeerCertificate != nil, tt.wantVerifyFunc)
+		}
+		if got.ServerName != "db.example.com" {
+			t.Errorf("newTLSConfig(%q).ServerName = %q, want %q", tt.sslMode, got.ServerName, "db.example.com")
+		}
+	}
+}
+
+func TestNewMySQLStoreInvalidConfig(t *testing.T) {
+	valid := func() *config.MySQLConfig {
+		return &config.MySQLConfig{Host: "db", DbName: "grafeas", User: "grafeas", SSLMode: "disable"}
+	}
+	if err := validateConfig(valid()); err != nil {
+		t.Fatalf("validateConfig() failed: %v", err)
+	}
+	tests := []struct {
+		desc    string
+		modify  func(*config.MySQLConfig)
+		wantErr string
+	}{
+		{"empty host", func(c *config.MySQLConfig) { c.Host = "" }, "host is required"},
+		{"empty dbname", func(c *config.MySQLConfig) { c.DbName = "" }, "dbname is required"},
+		{"invalid dbname", func(c *config.MySQLConfig) { c.DbName = "grafeas;drop" }, "invalid database name"},
+		{"negative port", func(c *config.MySQLConfig) { c.Port = -1 }, "invalid port -1"},
+		{"port too large", func(c *config.MySQLConfig) { c.Port = 65536 }, "invalid port 65536"},
+		{"replica port too large", func(c *config.MySQLConfig) { c.ReplicaPort = 70000 }, "invalid replicaport 70000"},
+		{"invalid sslmode", func(c *config.MySQLConfig) { c.SSLMode = "prefer" }, `invalid sslmode "prefer"`},
+		{"idle above open conns", func(c *config.MySQLConfig) { c.MaxOpenConns, c.MaxIdleConns = 5, 10 }, "invalid maxidleconns 10"},
+		{"invalid table prefix", func(c *config.MySQLConfig) { c.TablePrefix = "a-b" }, "invalid table prefix"},
+	}
+	for _, tt := range tests {
+		cfg := valid()
+		tt.modify(cfg)
+		_, err := NewMySQLStore(cfg)
+		if err == nil {
+			t.Errorf("NewMySQLStore(%s) succeeded, want error", tt.desc)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("NewMySQLStore(%s) = %v, want error containing %q", tt.desc, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	cfg := testConfig(t)
+	newTestStore(t, cfg)
+	pg, err := NewMySQLStore(cfg)
+	if err != nil {
+		t.Fatalf("NewMySQLStore() failed: %v", err)
+	}
+	if err := pg.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if _, err := pg.GetProject(context.Background(), "p"); err == nil {
+		t.Error("GetProject() after Close() succeeded, want error")
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	cfg := testConfig(t)
+	newTestStore(t, cfg)
+	pg, err := NewMySQLStore(cfg)
+	if err != nil {
+		t.Fatalf("NewMySQLStore() failed: %v", err)
+	}
+	ctx := context.Background()
+	if err := pg.Healthcheck(ctx); err != nil {
+		t.Errorf("Healthcheck() = %v, want nil", err)
+	}
+	pg.Close()
+	if err := pg.Healthcheck(ctx); status.Code(err) != codes.Unavailable {
+		t.Errorf("Healthcheck() after Close() = %v, want Unavailable", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxOpenConns = 5
+	pg := newTestStore(t, cfg)
+	if _, err := pg.CreateProject(context.Background(), "p", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+
+	s := pg.Stats()
+	if s.MaxOpenConnections != 5 {
+		t.Errorf("Stats().MaxOpenConnections = %d, want 5", s.MaxOpenConnections)
+	}
+	if s.OpenConnections < 1 || s.OpenConnections > 5 {
+		t.Errorf("Stats().OpenConnections = %d, want between 1 and 5", s.OpenConnections)
+	}
+	if s.InUse+s.Idle != s.OpenConnections {
+		t.Errorf("Stats() InUse %d + Idle %d != OpenConnections %d", s.InUse, s.Idle, s.OpenConnections)
+	}
+	if s.WaitCount < 0 || s.WaitDuration < 0 {
+		t.Errorf("Stats() WaitCount = %d, WaitDuration = %v, want non-negative", s.WaitCount, s.WaitDuration)
+	}
+}
+
+func TestNewMySQLStoreWithMetrics(t *testing.T) {
+	cfg := testConfig(t)
+	newTestStore(t, cfg)
+	registry := prometheus.NewRegistry()
+	pg, err := NewMySQLStoreWithMetrics(cfg, registry)
+	if err != nil {
+		t.Fatalf("NewMySQLStoreWithMetrics() failed: %v", err)
+	}
+	defer pg.Close()
+	ctx := context.Background()
+
+	if _, err := pg.CreateProject(ctx, "p", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+	if _, err := pg.GetProject(ctx, "missing"); status.Code(err) != codes.NotFound {
+		t.Fatalf("GetProject() returned %v, want NotFound", err)
+	}
+
+	if got := testutil.ToFloat64(pg.metrics.errors.WithLabelValues("GetProject", "NotFound")); got != 1 {
+		t.Errorf("GetProject NotFound error count = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(pg.metrics.errors.WithLabelValues("CreateProject", "OK")); got != 0 {
+		t.Errorf("CreateProject OK error count = %v, want 0", got)
+	}
+	if got := testutil.CollectAndCount(pg.metrics.latency); got != 2 {
+		t.Errorf("latency histogram has %d series, want 2", got)
+	}
+}
+
+func TestNewMySQLStoreWithNilRegisterer(t *testing.T) {
+	cfg := testConfig(t)
+	newTestStore(t, cfg)
+	pg, err := NewMySQLStoreWithMetrics(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewMySQLStoreWithMetrics() failed: %v", err)
+	}
+	defer pg.Close()
+	if _, err := pg.GetProject(context.Background(), "missing"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetProject() returned %v, want NotFound", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+
+	var version int
+	if err := pg.DB.QueryRow(mysqlSchemaVersion).Scan(&version); err != nil {
+		t.Fatalf("reading schema version failed: %v", err)
+	}
+	if version != len(mysqlMigrations) {
+		t.Errorf("schema version after NewMySQLStore() = %d, want %d", version, len(mysqlMigrations))
+	}
+
+	// Migrating an up to date database is a no-op.
+	got, err := migrate(ctx, pg.DB, pg.log(), mysqlSchema{charset: defaultCharset, collation: defaultCollation})
+	if err != nil {
+		t.Fatalf("migrate() on migrated database failed: %v", err)
+	}
+	if got != len(mysqlMigrations) {
+		t.Errorf("migrate() = %d, want %d", got, len(mysqlMigrations))
+	}
+	var applied int
+	if err := pg.DB.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+		t.Fatalf("counting migrations failed: %v", err)
+	}
+	if applied != len(mysqlMigrations) {
+		t.Errorf("schema_migrations has %d rows, want %d", applied, len(mysqlMigrations))
+	}
+}
+
+func TestTableCharsets(t *testing.T) {
+	cfg := testConfig(t)
+	// Tables get the configured character set even in a database defaulting to
+	// another one.
+	source, err := sourceString(cfg, cfg.Host, cfg.Port, "mysql")
+	if err != nil {
+		t.Fatalf("sourceString() failed: %v", err)
+	}
+	if err := myscreateDatabase(source, cfg.DbName, "latin1", "latin1_swedish_ci"); err != nil {
+		t.Fatalf("creating a latin1 database failed: %v", err)
+	}
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	for _, table := range []string{"projects", "notes", "occurrences", "audit_log", "schema_migrations"} {
+		var collation string
+		if err := pg.DB.QueryRow("SELECT TABLE_COLLATION FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table).Scan(&collation); err != nil {
+			t.Fatalf("reading the collation of %s failed: %v", table, err)
+		}
+		if collation != defaultCollation {
+			t.Errorf("collation of table %s = %q, want %q", table, collation, defaultCollation)
+		}
+	}
+
+	schema := mysqlSchema{charset: defaultCharset, collation: defaultCollation}
+	logger := &capturingLogger{}
+	if err := checkCharsets(ctx, pg.DB, logger, schema); err != nil {
+		t.Fatalf("checkCharsets() failed: %v", err)
+	}
+	if len(logger.errors) != 0 {
+		t.Errorf("checkCharsets() of new tables logged %q, want nothing", logger.errors)
+	}
+	if _, err := pg.DB.Exec("ALTER TABLE notes MODIFY note_id VARCHAR(255) CHARACTER SET latin1 NOT NULL"); err != nil {
+		t.Fatalf("changing the character set of note_id failed: %v", err)
+	}
+	if err := checkCharsets(ctx, pg.DB, logger, schema); err != nil {
+		t.Fatalf("checkCharsets() failed: %v", err)
+	}
+	if len(logger.errors) != 1 || !strings.Contains(logger.errors[0], "notes.note_id has character set latin1") {
+		t.Errorf("checkCharsets() of a latin1 column logged %q, want notes.note_id reported", logger.errors)
+	}
+}
+
+func TestApplyMigrationSkipsUnsupportedOptionalStatements(t *testing.T) {
+	m := mysqlMigration{
+		description: "add full-text index",
+		optional:    []string{`CREATE FULLTEXT INDEX t_text ON t (text)`},
+	}
+	tests := []struct {
+		err     error
+		wantErr bool
+	}{
+		{err: &mysql.MySQLError{Number: mysqlErrTableCantHandleFullText, Message: "The used table type doesn't support FULLTEXT indexes"}},
+		{err: &mysql.MySQLError{Number: mysqlErrDuplicateKeyName, Message: "Duplicate key name 't_text'"}},
+		{err: &mysql.MySQLError{Number: 1064, Message: "You have an error in your SQL syntax"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		pg, d := newFailingStore(t, tt.err, 1)
+		conn, err := pg.DB.Conn(context.Background())
+		if err != nil {
+			t.Fatalf("Conn() failed: %v", err)
+		}
+		logger := &capturingLogger{}
+		err = applyMigration(context.Background(), conn, logger, mysqlSchema{}, 1, m)
+		conn.Close()
+		if tt.wantErr {
+			if err == nil || d.commits != 0 {
+				t.Errorf("applyMigration() failing with %v = %v with %d commits, want the error and no commit", tt.err, err, d.commits)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("applyMigration() failing with %v = %v, want nil", tt.err, err)
+		}
+		if d.execs != 2 || d.commits != 1 {
+			t.Errorf("applyMigration() failing with %v ran %d statements and %d commits, want 2 and 1", tt.err, d.execs, d.commits)
+		}
+		if unsupported(tt.err) != (len(logger.errors) == 1) {
+			t.Errorf("applyMigration() failing with %v logged %q", tt.err, logger.errors)
+		}
+	}
+}
+
+func TestListNoteOccurrencesUsesNoteIndex(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		o := &pb.Occurrence{NoteName: fmt.Sprintf("projects/p/notes/n%d", i%4)}
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", o); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	pg.DB.Exec("ANALYZE TABLE occurrences")
+
+	if key := explainKey(t, pg, fmt.Sprintf(mysqlListNoteOccurrences, ""), "p", "n1", 0, 10); key != "occurrences_note" {
+		t.Errorf("ListNoteOccurrences query uses key %q, want occurrences_note", key)
+	}
+}
+
+// explainKey returns the index MySQL chooses for the first table read by query.
+func explainKey(t *testing.T, pg *MySQLStore, query string, args ...interface{}) string {
+	t.Helper()
+	rows, err := pg.DB.Query("EXPLAIN "+query, args...)
+	if err != nil {
+		t.Fatalf("EXPLAIN failed: %v", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		t.Fatalf("Columns() failed: %v", err)
+	}
+	if !rows.Next() {
+		t.Fatal("EXPLAIN returned no rows")
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		t.Fatalf("Scan() failed: %v", err)
+	}
+	for i, column := range columns {
+		if column == "key" {
+			return values[i].String
+		}
+	}
+	return ""
+}
+
+func TestListOccurrencesFilterNestedPaths(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	occs := []*pb.Occurrence{
+		vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true),
+		vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, false),
+		vulnerabilityOccurrence("https://gcr.io/p/b", vulnpb.Severity_HIGH, false),
+	}
+	for _, o := range occs {
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", o); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		want   int
+	}{
+		{filter: `resource.uri="https://gcr.io/p/a"`, want: 2},
+		{filter: `vulnerability.severity=4`, want: 2},
+		{filter: `resource.uri="https://gcr.io/p/b" AND vulnerability.severity=4`, want: 1},
+	}
+	for _, tt := range tests {
+		got, _, err := pg.ListOccurrences(ctx, "p", tt.filter, "", 100)
+		if err != nil {
+			t.Errorf("ListOccurrences(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if len(got) != tt.want {
+			t.Errorf("ListOccurrences(%q) returned %d occurrences, want %d", tt.filter, len(got), tt.want)
+		}
+	}
+}
+
+func TestListOccurrencesFilterCreateTime(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	// CreateOccurrence stamps the current time, so move each occurrence to a known one.
+	for _, createTime := range []string{"2024-01-01T00:00:00Z", "2024-01-15T00:00:00Z", "2024-02-01T00:00:00Z"} {
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		_, oID, _ := name.ParseOccurrence(o.Name)
+		t0, _ := time.Parse(time.RFC3339, createTime)
+		if _, err := pg.DB.Exec("UPDATE occurrences SET data = JSON_SET(data, '$.create_time', ?), create_time = ? WHERE occurrence_id = ?",
+			createTime, t0.Format(mysqlDatetimeFormat), occurrenceIDValue(oID)); err != nil {
+			t.Fatalf("setting create_time failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		want   int
+	}{
+		{filter: `createTime > "2024-01-01T00:00:00Z"`, want: 2},
+		{filter: `createTime >= "2024-01-01T00:00:00Z"`, want: 3},
+		{filter: `createTime < "2024-02-01T00:00:00Z"`, want: 2},
+		{filter: `createTime <= "2024-02-01T00:00:00Z"`, want: 3},
+		{filter: `createTime >= "2024-01-01T00:00:00Z" AND createTime < "2024-02-01T00:00:00Z"`, want: 2},
+		{filter: `createTime > "2024-02-01T00:00:00Z"`, want: 0},
+	}
+	for _, tt := range tests {
+		got, _, err := pg.ListOccurrences(ctx, "p", tt.filter, "", 100)
+		if err != nil {
+			t.Errorf("ListOccurrences(%q) failed: %v", tt.filter, err)
+			continue
+		}
+		if len(got) != tt.want {
+			t.Errorf("ListOccurrences(%q) returned %d occurrences, want %d", tt.filter, len(got), tt.want)
+		}
+	}
+
+	if _, _, err := pg.ListOccurrences(ctx, "p", `createTime > "yesterday"`, "", 100); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListOccurrences() with invalid timestamp got %v, want InvalidArgument", err)
+	}
+}
+
+func TestListInvalidFilter(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	for _, filter := range []string{`note_name="unbalanced`, `note_name:"has"`, `(kind="BUILD"`} {
+		if _, _, err := pg.ListOccurrences(ctx, "p", filter, "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListOccurrences(%q) got %v, want InvalidArgument", filter, err)
+		}
+		if _, _, err := pg.ListNotes(ctx, "p", filter, "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListNotes(%q) got %v, want InvalidArgument", filter, err)
+		}
+		if _, _, err := pg.ListNoteOccurrences(ctx, "p", "n", filter, "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListNoteOccurrences(%q) got %v, want InvalidArgument", filter, err)
+		}
+	}
+}
+
+func TestListOccurrencesFilterInjection(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	for _, noteName := range []string{"projects/p/notes/a", "projects/p/notes/b"} {
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: noteName}); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	for _, filter := range []string{
+		`note_name="x' OR '1'='1"`,
+		`note_name="x\" OR \"1\"=\"1"`,
+		`note_name="x'); DROP TABLE occurrences; --"`,
+	} {
+		got, _, err := pg.ListOccurrences(ctx, "p", filter, "", 100)
+		if err != nil {
+			t.Errorf("ListOccurrences(%q) failed: %v", filter, err)
+			continue
+		}
+		if len(got) != 0 {
+			t.Errorf("ListOccurrences(%q) returned %d occurrences, want 0", filter, len(got))
+		}
+	}
+	if got, _, err := pg.ListOccurrences(ctx, "p", "", "", 100); err != nil || len(got) != 2 {
+		t.Errorf("ListOccurrences() after injection attempts = %d occurrences, %v; want 2", len(got), err)
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	tests := []struct {
+		maxPageSize int
+		pageSize    int
+		want        int
+	}{
+		{maxPageSize: 0, pageSize: 0, want: defaultPageSize},
+		{maxPageSize: 0, pageSize: -1, want: defaultPageSize},
+		{maxPageSize: 0, pageSize: 1, want: 1},
+		{maxPageSize: 0, pageSize: defaultMaxPageSize, want: defaultMaxPageSize},
+		{maxPageSize: 0, pageSize: defaultMaxPageSize + 1, want: defaultMaxPageSize},
+		{maxPageSize: 10, pageSize: 9, want: 9},
+		{maxPageSize: 10, pageSize: 10, want: 10},
+		{maxPageSize: 10, pageSize: 11, want: 10},
+		{maxPageSize: 10, pageSize: 0, want: 10},
+	}
+	for _, tt := range tests {
+		pg := &MySQLStore{maxPageSize: tt.maxPageSize}
+		if got := pg.pageLimit(tt.pageSize); got != tt.want {
+			t.Errorf("pageLimit(%d) with maxPageSize %d = %d, want %d", tt.pageSize, tt.maxPageSize, got, tt.want)
+		}
+	}
+}
+
+func TestListOccurrencesMaxPageSize(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxPageSize = 3
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"}); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	for _, pageSize := range []int32{-1, 0, 3, 4, 1000} {
+		got, _, err := pg.ListOccurrences(ctx, "p", "", "", pageSize)
+		if err != nil {
+			t.Fatalf("ListOccurrences() with page size %d failed: %v", pageSize, err)
+		}
+		if len(got) != 3 {
+			t.Errorf("ListOccurrences() with page size %d returned %d occurrences, want 3", pageSize, len(got))
+		}
+	}
+}
+
+func TestDecodePageToken(t *testing.T) {
+	var key, otherKey fernet.Key
+	if err := key.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	if err := otherKey.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	pg := &MySQLStore{paginationKeys: []*fernet.Key{&key}}
+	token, err := pg.encodePageToken(42)
+	if err != nil {
+		t.Fatalf("encodePageToken() failed: %v", err)
+	}
+	otherToken, err := (&MySQLStore{paginationKeys: []*fernet.Key{&otherKey}}).encodePageToken(42)
+	if err != nil {
+		t.Fatalf("encodePageToken() failed: %v", err)
+	}
+
+	if id, err := pg.decodePageToken(""); err != nil || id != 0 {
+		t.Errorf("decodePageToken(\"\") = %d, %v; want 0, nil", id, err)
+	}
+	if id, err := pg.decodePageToken(token); err != nil || id != 42 {
+		t.Errorf("decodePageToken(%q) = %d, %v; want 42, nil", token, id, err)
+	}
+	for _, invalid := range []string{"garbage", token[:len(token)/2], token + "x", otherToken} {
+		if id, err := pg.decodePageToken(invalid); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("decodePageToken(%q) = %d, %v; want InvalidArgument", invalid, id, err)
+		}
+	}
+}
+
+func TestPaginationKeyRotation(t *testing.T) {
+	var oldKey, newKey fernet.Key
+	if err := oldKey.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	if err := newKey.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	oldKeys, err := newPaginationKeys(&config.MySQLConfig{PaginationKey: oldKey.Encode()}, stdLogger{})
+	if err != nil {
+		t.Fatalf("newPaginationKeys() failed: %v", err)
+	}
+	oldToken, err := (&MySQLStore{paginationKeys: oldKeys}).encodePageToken(42)
+	if err != nil {
+		t.Fatalf("encodePageToken() failed: %v", err)
+	}
+
+	// The old key is made secondary to a new one: tokens it encrypted still work, and
+	// new tokens are encrypted with the new key.
+	keys, err := newPaginationKeys(&config.MySQLConfig{PaginationKey: newKey.Encode(), SecondaryPaginationKeys: []string{oldKey.Encode()}}, stdLogger{})
+	if err != nil {
+		t.Fatalf("newPaginationKeys() failed: %v", err)
+	}
+	pg := &MySQLStore{paginationKeys: keys}
+	if id, err := pg.decodePageToken(oldToken); err != nil || id != 42 {
+		t.Errorf("decodePageToken() of a token of the secondary key = %d, %v; want 42, nil", id, err)
+	}
+	newToken, err := pg.encodePageToken(7)
+	if err != nil {
+		t.Fatalf("encodePageToken() failed: %v", err)
+	}
+	if fernet.VerifyAndDecrypt([]byte(newToken), pageTokenTTL, []*fernet.Key{&newKey}) == nil {
+		t.Error("encodePageToken() did not encrypt with the primary key")
+	}
+
+	// Once the old key is removed, its tokens are rejected.
+	pg = &MySQLStore{paginationKeys: []*fernet.Key{&newKey}}
+	if _, err := pg.decodePageToken(oldToken); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("decodePageToken() of a token of a removed key got %v, want InvalidArgument", err)
+	}
+	if id, err := pg.decodePageToken(newToken); err != nil || id != 7 {
+		t.Errorf("decodePageToken() = %d, %v; want 7, nil", id, err)
+	}
+
+	if _, err := newPaginationKeys(&config.MySQLConfig{SecondaryPaginationKeys: []string{"garbage"}}, stdLogger{}); err == nil {
+		t.Error("newPaginationKeys() with an invalid secondary key succeeded, want an error")
+	}
+}
+
+func TestListInvalidPageToken(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"}); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	if got, _, err := pg.ListOccurrences(ctx, "p", "", "", 10); err != nil || len(got) != 1 {
+		t.Errorf("ListOccurrences() with empty token = %d occurrences, %v; want 1", len(got), err)
+	}
+	if _, _, err := pg.ListOccurrences(ctx, "p", "", "garbage", 10); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListOccurrences() with garbage token got %v, want InvalidArgument", err)
+	}
+	if _, _, err := pg.ListNotes(ctx, "p", "", "garbage", 10); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListNotes() with garbage token got %v, want InvalidArgument", err)
+	}
+	if _, _, err := pg.ListProjects(ctx, "", 10, "garbage"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListProjects() with garbage token got %v, want InvalidArgument", err)
+	}
+}
+
+func TestListOccurrencesPaginationAfterDeletes(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	var names []string
+	for i := 0; i < 7; i++ {
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		names = append(names, o.Name)
+	}
+	for _, i := range []int{1, 3, 6} {
+		_, oID, _ := name.ParseOccurrence(names[i])
+		if err := pg.DeleteOccurrence(ctx, "p", oID); err != nil {
+			t.Fatalf("DeleteOccurrence() failed: %v", err)
+		}
+	}
+
+	var got []string
+	var pages int
+	token := ""
+	for {
+		occs, next, err := pg.ListOccurrences(ctx, "p", "", token, 2)
+		if err != nil {
+			t.Fatalf("ListOccurrences() failed: %v", err)
+		}
+		pages++
+		for _, o := range occs {
+			got = append(got, o.Name)
+		}
+		if next == "" {
+			break
+		}
+		if pages > 10 {
+			t.Fatal("ListOccurrences() did not stop returning page tokens")
+		}
+		token = next
+	}
+	want := []string{names[0], names[2], names[4], names[5]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListOccurrences() pages returned %v, want %v", got, want)
+	}
+	if pages != 2 {
+		t.Errorf("ListOccurrences() returned %d pages, want 2", pages)
+	}
+}
+
+func TestListNoteOccurrencesPaginationWithDeletes(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	for _, nID := range []string{"n", "m"} {
+		if _, err := pg.CreateNote(ctx, "p", nID, "u", &pb.Note{}); err != nil {
+			t.Fatalf("CreateNote() failed: %v", err)
+		}
+	}
+	var names []string
+	for i := 0; i < 8; i++ {
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		names = append(names, o.Name)
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/m"}); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	deleteOccurrences := func(is ...int) {
+		for _, i := range is {
+			_, oID, _ := name.ParseOccurrence(names[i])
+			if err := pg.DeleteOccurrence(ctx, "p", oID); err != nil {
+				t.Fatalf("DeleteOccurrence() failed: %v", err)
+			}
+		}
+	}
+
+	// Deleting a returned occurrence and the next one between pages, then the last
+	// one, leaves no gap and ends on the page holding the last remaining occurrence.
+	deletes := map[int][]int{1: {1, 2}, 2: {7}}
+	var got []string
+	var pages int
+	token := ""
+	for {
+		occs, next, err := pg.ListNoteOccurrences(ctx, "p", "n", "", token, 2)
+		if err != nil {
+			t.Fatalf("ListNoteOccurrences() failed: %v", err)
+		}
+		pages++
+		for _, o := range occs {
+			got = append(got, o.Name)
+		}
+		if next == "" {
+			break
+		}
+		if pages > 10 {
+			t.Fatal("ListNoteOccurrences() did not stop returning page tokens")
+		}
+		deleteOccurrences(deletes[pages]...)
+		token = next
+	}
+	want := []string{names[0], names[1], names[3], names[4], names[5], names[6]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListNoteOccurrences() pages returned %v, want %v", got, want)
+	}
+	if pages != 3 {
+		t.Errorf("ListNoteOccurrences() returned %d pages, want 3", pages)
+	}
+}
+
+func TestListPagesVisitEachRowOnce(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	var notes, occs []string
+	create := func(i int) {
+		n, err := pg.CreateNote(ctx, "p", fmt.Sprintf("n%d", i), "u", &pb.Note{})
+		if err != nil {
+			t.Fatalf("CreateNote() failed: %v", err)
+		}
+		notes = append(notes, n.Name)
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n0"})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		occs = append(occs, o.Name)
+	}
+	for i := 0; i < 9; i++ {
+		create(i)
+	}
+
+	// Rows created while paging come after the rows already returned, so they
+	// appear once on a later page.
+	var gotNotes, gotOccs, gotNoteOccs []string
+	var noteToken, occToken, noteOccToken string
+	for pages := 0; ; pages++ {
+		if pages == 2 {
+			create(9)
+		}
+		if pages > 10 {
+			t.Fatal("lists did not stop returning page tokens")
+		}
+		ns, next, err := pg.ListNotes(ctx, "p", "", noteToken, 2)
+		if err != nil {
+			t.Fatalf("ListNotes() failed: %v", err)
+		}
+		for _, n := range ns {
+			gotNotes = append(gotNotes, n.Name)
+		}
+		noteToken = next
+		os, next, err := pg.ListOccurrences(ctx, "p", `note_name="projects/p/notes/n0"`, occToken, 2)
+		if err != nil {
+			t.Fatalf("ListOccurrences() failed: %v", err)
+		}
+		for _, o := range os {
+			gotOccs = append(gotOccs, o.Name)
+		}
+		occToken = next
+		os, next, err = pg.ListNoteOccurrences(ctx, "p", "n0", "", noteOccToken, 2)
+		if err != nil {
+			t.Fatalf("ListNoteOccurrences() failed: %v", err)
+		}
+		for _, o := range os {
+			gotNoteOccs = append(gotNoteOccs, o.Name)
+		}
+		noteOccToken = next
+		if noteToken == "" && occToken == "" && noteOccToken == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(gotNotes, notes) {
+		t.Errorf("ListNotes() pages returned %v, want %v", gotNotes, notes)
+	}
+	if !reflect.DeepEqual(gotOccs, occs) {
+		t.Errorf("ListOccurrences() pages returned %v, want %v", gotOccs, occs)
+	}
+	if !reflect.DeepEqual(gotNoteOccs, occs) {
+		t.Errorf("ListNoteOccurrences() pages returned %v, want %v", gotNoteOccs, occs)
+	}
+}
+
+func TestListProjectsPaginationAfterDeletes(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if _, err := pg.CreateProject(ctx, fmt.Sprintf("p%d", i), &prpb.Project{}); err != nil {
+			t.Fatalf("CreateProject() failed: %v", err)
+		}
+	}
+	if err := pg.DeleteProject(ctx, "p2"); err != nil {
+		t.Fatalf("DeleteProject() failed: %v", err)
+	}
+
+	projects, next, err := pg.ListProjects(ctx, "", 2, "")
+	if err != nil || len(projects) != 2 || next == "" {
+		t.Fatalf("ListProjects() first page = %d projects, token %q, %v; want 2 and a token", len(projects), next, err)
+	}
+	projects, next, err = pg.ListProjects(ctx, "", 2, next)
+	if err != nil || len(projects) != 2 || next != "" {
+		t.Errorf("ListProjects() last page = %d projects, token %q, %v; want 2 and no token", len(projects), next, err)
+	}
+}
+
+// failingDriver is a database/sql driver whose connections fail the first failures
+// statements with err and then succeed, counting the statements run. Queries are
+// counted and fail, unless rows is set: they then return rows followed by rowsErr.
+type failingDriver struct {
+	err          error
+	failures     int
+	execs        int
+	queries      int
+	commits      int
+	rollbacks    int
+	pings        int
+	pingFailures int
+	begins       int
+	beginErrors  int
+	rows         [][]driver.Value
+	rowsErr      error
+}
+
+func (d *failingDriver) Open(name string) (driver.Conn, error) {
+	return failingConn{d}, nil
+}
+
+type failingConn struct {
+	d *failingDriver
+}
+
+func (c failingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c failingConn) Close() error {
+	return nil
+}
+
+func (c failingConn) Ping(ctx context.Context) error {
+	c.d.pings++
+	if c.d.pings <= c.d.pingFailures {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (c failingConn) Begin() (driver.Tx, error) {
+	c.d.begins++
+	if c.d.begins <= c.d.beginErrors {
+		return nil, driver.ErrBadConn
+	}
+	return failingTx{c.d}, nil
+}
+
+// failingTx counts the transactions committed and rolled back.
+type failingTx struct {
+	d *failingDriver
+}
+
+func (tx failingTx) Commit() error {
+	tx.d.commits++
+	return nil
+}
+
+func (tx failingTx) Rollback() error {
+	tx.d.rollbacks++
+	return nil
+}
+
+func (c failingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.d.execs++
+	if c.d.execs <= c.d.failures {
+		return nil, c.d.err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c failingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.queries++
+	if c.d.rows == nil {
+		return nil, errors.New("not implemented")
+	}
+	return &failingRows{rows: c.d.rows, err: c.d.rowsErr}, nil
+}
+
+// failingRows returns rows and then fails with err, or ends when err is nil.
+type failingRows struct {
+	rows [][]driver.Value
+	err  error
+}
+
+func (r *failingRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *failingRows) Close() error {
+	return nil
+}
+
+func (r *failingRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		if r.err != nil {
+			return r.err
+		}
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// failingDrivers counts the registered failingDrivers, to give each a unique name.
+var failingDrivers int
+
+// newFailingStore returns a store whose statements fail failures times with err.
+func newFailingStore(t testing.TB, err error, failures int) (*MySQLStore, *failingDriver) {
+	t.Helper()
+	d := &failingDriver{err: err, failures: failures}
+	failingDrivers++
+	driverName := fmt.Sprintf("failing_%d", failingDrivers)
+	sql.Register(driverName, d)
+	db, openErr := sql.Open(driverName, "")
+	if openErr != nil {
+		t.Fatalf("sql.Open() failed: %v", openErr)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &MySQLStore{DB: db, retry: retryPolicy{maxRetries: 3, backoff: time.Millisecond}}, d
+}
+
+func TestRetryDeadlock(t *testing.T) {
+	pg, d := newFailingStore(t, &mysql.MySQLError{Number: mysqlErrDeadlock, Message: "Deadlock found"}, 2)
+	if _, err := pg.CreateProject(context.Background(), "p", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+	if d.execs != 3 {
+		t.Errorf("CreateProject() ran %d statements, want 3", d.execs)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	pg, d := newFailingStore(t, &mysql.MySQLError{Number: mysqlErrLockWaitTimeout, Message: "Lock wait timeout exceeded"}, 10)
+	if _, err := pg.CreateProject(context.Background(), "p", &prpb.Project{}); status.Code(err) != codes.Internal {
+		t.Errorf("CreateProject() got %v, want Internal", err)
+	}
+	if d.execs != 4 {
+		t.Errorf("CreateProject() ran %d statements, want 4", d.execs)
+	}
+}
+
+func TestRetryNonRetryableError(t *testing.T) {
+	pg, d := newFailingStore(t, &mysql.MySQLError{Number: mysqlErrDuplicateEntry, Message: "Duplicate entry"}, 1)
+	if _, err := pg.CreateProject(context.Background(), "p", &prpb.Project{}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateProject() got %v, want AlreadyExists", err)
+	}
+	if d.execs != 1 {
+		t.Errorf("CreateProject() ran %d statements, want 1", d.execs)
+	}
+}
+
+func TestRetryNeverRerunsWriteAfterInvalidConn(t *testing.T) {
+	pg, d := newFailingStore(t, mysql.ErrInvalidConn, 1)
+	if _, err := pg.CreateProject(context.Background(), "p", &prpb.Project{}); status.Code(err) != codes.Internal {
+		t.Errorf("CreateProject() got %v, want Internal", err)
+	}
+	if d.execs != 1 {
+		t.Errorf("CreateProject() ran %d statements, want 1", d.execs)
+	}
+
+	pg, d = newFailingStore(t, mysql.ErrInvalidConn, 1)
+	err := pg.withTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO projects (name) VALUES (?)", "p")
+		return err
+	})
+	if err != mysql.ErrInvalidConn {
+		t.Errorf("withTx() = %v, want %v", err, mysql.ErrInvalidConn)
+	}
+	if d.execs != 1 || d.commits != 0 {
+		t.Errorf("withTx() ran %d statements and %d commits, want 1 and 0", d.execs, d.commits)
+	}
+}
+
+func TestRetryBadConnAtBegin(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	// database/sql retries beginning on a bad connection itself, then gives up.
+	d.beginErrors = 3
+	err := pg.withTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT INTO projects (name) VALUES (?)", "p")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("withTx() failed: %v", err)
+	}
+	if d.execs != 1 || d.commits != 1 {
+		t.Errorf("withTx() ran %d statements and %d commits, want 1 and 1", d.execs, d.commits)
+	}
+}
+
+func TestDuplicateEntryAlreadyExists(t *testing.T) {
+	duplicate := &mysql.MySQLError{Number: mysqlErrDuplicateEntry, Message: "Duplicate entry"}
+	ctx := context.Background()
+	o := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, false)
+
+	pg, _ := newFailingStore(t, duplicate, 1)
+	if _, err := pg.CreateOccurrence(ctx, "p", "u", o); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateOccurrence() got %v, want AlreadyExists", err)
+	}
+	pg, _ = newFailingStore(t, duplicate, 1)
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("CreateNote() got %v, want AlreadyExists", err)
+	}
+	pg, _ = newFailingStore(t, duplicate, 1)
+	if _, errs := pg.BatchCreateOccurrences(ctx, "p", "u", []*pb.Occurrence{o}); len(errs) != 1 || status.Code(errs[0]) != codes.AlreadyExists {
+		t.Errorf("BatchCreateOccurrences() got %v, want one AlreadyExists", errs)
+	}
+	pg, _ = newFailingStore(t, duplicate, 1)
+	if _, errs := pg.BatchCreateNotes(ctx, "p", "u", map[string]*pb.Note{"n": {}}); len(errs) != 1 || status.Code(errs[0]) != codes.AlreadyExists {
+		t.Errorf("BatchCreateNotes() got %v, want one AlreadyExists", errs)
+	}
+}
+
+func TestInvalidIDs(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	ctx := context.Background()
+	for _, id := range []string{"", "a/b", "a b", " a", "../a"} {
+		if _, err := pg.CreateProject(ctx, id, &prpb.Project{}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateProject(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, err := pg.GetProject(ctx, id); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("GetProject(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, err := pg.CreateOccurrence(ctx, id, "u", &pb.Occurrence{}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateOccurrence(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, err := pg.GetOccurrence(ctx, "p", id); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("GetOccurrence(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, err := pg.UpdateOccurrence(ctx, "p", id, &pb.Occurrence{}, nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("UpdateOccurrence(%q) got %v, want InvalidArgument", id, err)
+		}
+		if err := pg.DeleteOccurrence(ctx, id, "o"); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("DeleteOccurrence(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, err := pg.CreateNote(ctx, "p", id, "u", &pb.Note{}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateNote(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, err := pg.GetNote(ctx, id, "n"); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("GetNote(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, err := pg.UpdateNote(ctx, "p", id, &pb.Note{}, nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("UpdateNote(%q) got %v, want InvalidArgument", id, err)
+		}
+		if err := pg.DeleteNote(ctx, "p", id); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("DeleteNote(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, _, err := pg.ListOccurrences(ctx, id, "", "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListOccurrences(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, _, _, err := pg.ListOccurrencesWithCount(ctx, id, "", "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListOccurrencesWithCount(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, _, err := pg.ListRecentOccurrences(ctx, id, "", "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListRecentOccurrences(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, _, err := pg.ListNotes(ctx, id, "", "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListNotes(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, _, _, err := pg.ListNotesWithCount(ctx, id, "", "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListNotesWithCount(%q) got %v, want InvalidArgument", id, err)
+		}
+		if _, _, err := pg.ListNoteOccurrences(ctx, id, "n", "", "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListNoteOccurrences(%q, n) got %v, want InvalidArgument", id, err)
+		}
+		if _, _, err := pg.ListNoteOccurrences(ctx, "p", id, "", "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListNoteOccurrences(p, %q) got %v, want InvalidArgument", id, err)
+		}
+		if _, _, _, err := pg.ListNoteOccurrencesWithCount(ctx, "p", id, "", "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListNoteOccurrencesWithCount(p, %q) got %v, want InvalidArgument", id, err)
+		}
+		if _, err := pg.GetVulnerabilityOccurrencesSummary(ctx, id, ""); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("GetVulnerabilityOccurrencesSummary(%q) got %v, want InvalidArgument", id, err)
+		}
+	}
+	if d.execs != 0 || d.queries != 0 {
+		t.Errorf("invalid IDs ran %d statements and %d queries, want none", d.execs, d.queries)
+	}
+}
+
+func TestNilArguments(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	for _, s := range []Store{pg, NewFakeStore(nil)} {
+		ctx := context.Background()
+		if _, err := s.CreateProject(ctx, "p", nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%T.CreateProject(nil) got %v, want InvalidArgument", s, err)
+		}
+		if _, err := s.UpdateProject(ctx, "p", nil, nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%T.UpdateProject(nil) got %v, want InvalidArgument", s, err)
+		}
+		if _, err := s.CreateOccurrence(ctx, "p", "u", nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%T.CreateOccurrence(nil) got %v, want InvalidArgument", s, err)
+		}
+		if _, err := s.UpsertOccurrence(ctx, "p", "u", nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%T.UpsertOccurrence(nil) got %v, want InvalidArgument", s, err)
+		}
+		if _, errs := s.BatchCreateOccurrences(ctx, "p", "u", []*pb.Occurrence{nil}); len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument {
+			t.Errorf("%T.BatchCreateOccurrences(nil) got %v, want one InvalidArgument", s, errs)
+		}
+		if _, err := s.UpdateOccurrence(ctx, "p", "o", nil, nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%T.UpdateOccurrence(nil) got %v, want InvalidArgument", s, err)
+		}
+		if _, err := s.CreateNote(ctx, "p", "n", "u", nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%T.CreateNote(nil) got %v, want InvalidArgument", s, err)
+		}
+		if _, errs := s.BatchCreateNotes(ctx, "p", "u", map[string]*pb.Note{"n": nil}); len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument {
+			t.Errorf("%T.BatchCreateNotes(nil) got %v, want one InvalidArgument", s, errs)
+		}
+		if _, err := s.UpdateNote(ctx, "p", "n", nil, nil); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%T.UpdateNote(nil) got %v, want InvalidArgument", s, err)
+		}
+	}
+	if d.execs != 0 || d.queries != 0 {
+		t.Errorf("nil arguments ran %d statements and %d queries, want none", d.execs, d.queries)
+	}
+}
+
+func TestMaxDocumentBytes(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	pg.clock = &fixedClock{t: time.Date(2019, 5, 1, 12, 30, 0, 0, time.UTC)}
+	ctx := WithOccurrenceID(context.Background(), "o")
+	o := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)
+	created, err := pg.CreateOccurrence(ctx, "p", "u", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	occ, err := marshalDocument(created)
+	if err != nil {
+		t.Fatalf("marshalDocument() failed: %v", err)
+	}
+	n := &pb.Note{ShortDescription: "note"}
+	createdNote, err := pg.CreateNote(ctx, "p", "n", "u", n)
+	if err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	note, err := marshalDocument(createdNote)
+	if err != nil {
+		t.Fatalf("marshalDocument() failed: %v", err)
+	}
+
+	d.execs = 0
+	pg.maxDocumentBytes = len(occ)
+	if _, err := pg.CreateOccurrence(ctx, "p", "u", o); err != nil {
+		t.Errorf("CreateOccurrence() of %d bytes with a limit of %d failed: %v", len(occ), pg.maxDocumentBytes, err)
+	}
+	pg.maxDocumentBytes = len(note)
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", n); err != nil {
+		t.Errorf("CreateNote() of %d bytes with a limit of %d failed: %v", len(note), pg.maxDocumentBytes, err)
+	}
+	if d.execs != 2 {
+		t.Errorf("creates within the limit ran %d statements, want 2", d.execs)
+	}
+
+	d.execs = 0
+	pg.maxDocumentBytes = len(occ) - 1
+	_, err = pg.CreateOccurrence(ctx, "p", "u", o)
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "occurrence too large") {
+		t.Errorf("CreateOccurrence() of %d bytes with a limit of %d got %v, want InvalidArgument", len(occ), pg.maxDocumentBytes, err)
+	}
+	if _, errs := pg.BatchCreateOccurrences(ctx, "p", "u", []*pb.Occurrence{o}); len(errs) != 1 || status.Code(errs[0]) != codes.InvalidArgument {
+		t.Errorf("BatchCreateOccurrences() over the limit got %v, want one InvalidArgument", errs)
+	}
+	if _, err := pg.UpsertOccurrence(ctx, "p", "u", o); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UpsertOccurrence() over the limit got %v, want InvalidArgument", err)
+	}
+	pg.maxDocumentBytes = len(note) - 1
+	_, err = pg.CreateNote(ctx, "p", "n", "u", n)
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "note too large") {
+		t.Errorf("CreateNote() of %d bytes with a limit of %d got %v, want InvalidArgument", len(note), pg.maxDocumentBytes, err)
+	}
+	if d.execs != 0 {
+		t.Errorf("creates over the limit ran %d statements, want none", d.execs)
+	}
+}
+
+func TestMarshalFailuresAreNotWritten(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	ctx := context.Background()
+	// jsonpb fails on timestamps past the year 9999.
+	invalid := &timestamp.Timestamp{Seconds: math.MaxInt64}
+	o := &pb.Occurrence{NoteName: "projects/p/notes/n", UpdateTime: invalid}
+	if _, err := pg.CreateOccurrence(ctx, "p", "u", o); status.Code(err) != codes.Internal {
+		t.Errorf("CreateOccurrence() of an unmarshalable occurrence got %v, want Internal", err)
+	}
+	if _, errs := pg.BatchCreateOccurrences(ctx, "p", "u", []*pb.Occurrence{o}); len(errs) != 1 || status.Code(errs[0]) != codes.Internal {
+		t.Errorf("BatchCreateOccurrences() of an unmarshalable occurrence got %v, want one Internal", errs)
+	}
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{UpdateTime: invalid}); status.Code(err) != codes.Internal {
+		t.Errorf("CreateNote() of an unmarshalable note got %v, want Internal", err)
+	}
+	if d.execs != 0 {
+		t.Errorf("creates failing to marshal ran %d statements, want none", d.execs)
+	}
+}
+
+func TestMaxDocumentBytesCompressed(t *testing.T) {
+	o := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)
+	o.Details.(*pb.Occurrence_Vulnerability).Vulnerability.LongDescription = strings.Repeat("a", 4096)
+	pg := &MySQLStore{compressDocuments: true, maxDocumentBytes: 4096}
+	if _, _, err := pg.marshalStored(o); err != errDocumentTooLarge {
+		t.Errorf("marshalStored() of compressible details over the limit got %v, want %v", err, errDocumentTooLarge)
+	}
+	pg.maxDocumentBytes = 0
+	if _, _, err := pg.marshalStored(o); err != nil {
+		t.Errorf("marshalStored() with the default limit failed: %v", err)
+	}
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	tests := []struct {
+		cfg  config.MySQLConfig
+		want retryPolicy
+	}{
+		{cfg: config.MySQLConfig{}, want: retryPolicy{maxRetries: defaultMaxRetries, backoff: defaultRetryBackoff}},
+		{cfg: config.MySQLConfig{MaxRetries: 5, RetryBackoff: time.Second}, want: retryPolicy{maxRetries: 5, backoff: time.Second}},
+		{cfg: config.MySQLConfig{MaxRetries: -1}, want: retryPolicy{maxRetries: 0, backoff: defaultRetryBackoff}},
+	}
+	for _, tt := range tests {
+		if got := newRetryPolicy(&tt.cfg); got != tt.want {
+			t.Errorf("newRetryPolicy(%+v) = %+v, want %+v", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestReadsUseReplica(t *testing.T) {
+	primary, primaryDriver := newFailingStore(t, nil, 0)
+	replica, replicaDriver := newFailingStore(t, nil, 0)
+	pg := &MySQLStore{DB: primary.DB, replica: replica.DB}
+	ctx := context.Background()
+
+	pg.GetProject(ctx, "p")
+	pg.ListProjects(ctx, "", 10, "")
+	pg.GetOccurrence(ctx, "p", "o")
+	pg.ListOccurrences(ctx, "p", "", "", 10)
+	pg.GetNote(ctx, "p", "n")
+	pg.ListNotes(ctx, "p", "", "", 10)
+	pg.GetVulnerabilityOccurrencesSummary(ctx, "p", "")
+	if replicaDriver.queries != 7 || primaryDriver.queries != 0 {
+		t.Errorf("reads ran %d queries on the replica and %d on the primary, want 7 and 0", replicaDriver.queries, primaryDriver.queries)
+	}
+
+	pg.GetProject(ReadFromPrimary(ctx), "p")
+	if primaryDriver.queries != 1 {
+		t.Errorf("read with ReadFromPrimary ran %d queries on the primary, want 1", primaryDriver.queries)
+	}
+
+	if _, err := pg.CreateProject(ctx, "p", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+	if primaryDriver.execs != 1 || replicaDriver.execs != 0 {
+		t.Errorf("CreateProject() ran %d statements on the primary and %d on the replica, want 1 and 0", primaryDriver.execs, replicaDriver.execs)
+	}
+}
+
+func TestReadFromPrimaryAfterWrite(t *testing.T) {
+	primary, primaryDriver := newFailingStore(t, nil, 0)
+	replica, replicaDriver := newFailingStore(t, nil, 0)
+	pg := &MySQLStore{DB: primary.DB, replica: replica.DB}
+	ctx := context.Background()
+
+	if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"}); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	// The lists and counts following the write must see it, so they are all sent to
+	// the primary rather than to a replica that may lag behind.
+	ctx = ReadFromPrimary(ctx)
+	pg.ListOccurrences(ctx, "p", "", "", 10)
+	pg.ListOccurrencesWithCount(ctx, "p", "", "", 10)
+	pg.ListNoteOccurrences(ctx, "p", "n", "", "", 10)
+	if primaryDriver.execs != 1 || primaryDriver.queries != 3 {
+		t.Errorf("write and reads ran %d statements and %d queries on the primary, want 1 and 3", primaryDriver.execs, primaryDriver.queries)
+	}
+	if replicaDriver.execs != 0 || replicaDriver.queries != 0 {
+		t.Errorf("write and reads ran %d statements and %d queries on the replica, want none", replicaDriver.execs, replicaDriver.queries)
+	}
+}
+
+func TestReadsWithoutReplicaUsePrimary(t *testing.T) {
+	primary, primaryDriver := newFailingStore(t, nil, 0)
+	primary.GetProject(context.Background(), "p")
+	if primaryDriver.queries != 1 {
+		t.Errorf("GetProject() ran %d queries on the primary, want 1", primaryDriver.queries)
+	}
+}
+
+func TestInsertChunks(t *testing.T) {
+	row := func(size int) []interface{} {
+		return []interface{}{"p", strings.Repeat("x", size)}
+	}
+	var small, large [][]interface{}
+	for i := 0; i < 2*maxInsertRows+1; i++ {
+		small = append(small, row(10))
+	}
+	for i := 0; i < 3; i++ {
+		large = append(large, row(maxInsertBytes/2))
+	}
+	tests := []struct {
+		rows [][]interface{}
+		want []int
+	}{
+		{rows: nil, want: nil},
+		{rows: small[:1], want: []int{1}},
+		{rows: small[:maxInsertRows], want: []int{maxInsertRows}},
+		{rows: small, want: []int{maxInsertRows, maxInsertRows, 1}},
+		{rows: large, want: []int{1, 1, 1}},
+		{rows: [][]interface{}{row(2 * maxInsertBytes)}, want: []int{1}},
+	}
+	for _, tt := range tests {
+		var got []int
+		for _, chunk := range insertChunks(tt.rows) {
+			got = append(got, len(chunk))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("insertChunks() of %d rows made chunks of %v rows, want %v", len(tt.rows), got, tt.want)
+		}
+	}
+}
+
+func TestMultiRowInsert(t *testing.T) {
+	query, args := multiRowInsert(mysqlInsertOccurrences, mysqlInsertOccurrenceRow, [][]interface{}{
+		{"p", "o1", "np", "n", "{}", "u", 0, nil, false, nil, nil, nil, nil},
+		{"p", "o2", "np", "n", "{}", "u", 0, nil, false, nil, nil, nil, nil},
+	})
+	if want := mysqlInsertOccurrences + "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"; query != want {
+		t.Errorf("multiRowInsert() query = %q, want %q", query, want)
+	}
+	if len(args) != 26 || args[1] != "o1" || args[14] != "o2" {
+		t.Errorf("multiRowInsert() args = %v, want the values of both rows", args)
+	}
+}
+
+func TestBatchCreateOccurrencesSingleStatement(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	created, errs := pg.BatchCreateOccurrences(context.Background(), "p", "u", batchOccurrences(maxInsertRows))
+	if len(errs) != 0 || len(created) != maxInsertRows {
+		t.Fatalf("BatchCreateOccurrences() = %d occurrences, %v; want %d", len(created), errs, maxInsertRows)
+	}
+	if d.execs != 1 {
+		t.Errorf("BatchCreateOccurrences() of %d occurrences ran %d statements, want 1", maxInsertRows, d.execs)
+	}
+}
+
+// batchOccurrences returns n occurrences to create in a batch.
+func batchOccurrences(n int) []*pb.Occurrence {
+	occs := make([]*pb.Occurrence, n)
+	for i := range occs {
+		occs[i] = vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)
+	}
+	return occs
+}
+
+// BenchmarkBatchCreateOccurrences measures creating batches of 500 occurrences, which
+// takes one INSERT statement per batch rather than one per occurrence.
+func BenchmarkBatchCreateOccurrences(b *testing.B) {
+	pg := newTestStore(b, nil)
+	ctx := context.Background()
+	occs := batchOccurrences(500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, errs := pg.BatchCreateOccurrences(ctx, "p", "u", occs); len(errs) != 0 {
+			b.Fatalf("BatchCreateOccurrences() failed: %v", errs)
+		}
+	}
+}
+
+func TestUpdateProject(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	if _, err := pg.CreateProject(ctx, "p", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+
+	// The name is bound to the project ID, whether replaced or copied by a mask.
+	for _, mask := range []*fieldmaskpb.FieldMask{nil, {Paths: []string{"name"}}} {
+		got, err := pg.UpdateProject(ctx, "p", &prpb.Project{Name: "projects/other"}, mask)
+		if err != nil {
+			t.Fatalf("UpdateProject() with mask %v failed: %v", mask, err)
+		}
+		if got.Name != "projects/p" {
+			t.Errorf("UpdateProject() with mask %v returned name %q, want projects/p", mask, got.Name)
+		}
+	}
+	stored, err := pg.GetProject(ctx, "p")
+	if err != nil {
+		t.Fatalf("GetProject() failed: %v", err)
+	}
+	if stored.Name != "projects/p" {
+		t.Errorf("GetProject() returned name %q, want projects/p", stored.Name)
+	}
+	if _, err := pg.GetProject(ctx, "other"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetProject(other) got %v, want NotFound", err)
+	}
+
+	if _, err := pg.UpdateProject(ctx, "p", &prpb.Project{}, &fieldmaskpb.FieldMask{Paths: []string{"no_such_field"}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UpdateProject() with invalid mask got %v, want InvalidArgument", err)
+	}
+	if _, err := pg.UpdateProject(ctx, "missing", &prpb.Project{}, nil); status.Code(err) != codes.NotFound {
+		t.Errorf("UpdateProject() of missing project got %v, want NotFound", err)
+	}
+}
+
+func TestGetProjectWithoutData(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	// Projects created before their data was stored have a NULL data column.
+	if _, err := pg.DB.Exec("INSERT INTO projects(name) VALUES (?)", "projects/legacy"); err != nil {
+		t.Fatalf("inserting project failed: %v", err)
+	}
+	got, err := pg.GetProject(ctx, "legacy")
+	if err != nil {
+		t.Fatalf("GetProject() failed: %v", err)
+	}
+	if got.Name != "projects/legacy" {
+		t.Errorf("GetProject() returned name %q, want projects/legacy", got.Name)
+	}
+}
+
+func TestProjectCreateTime(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	before := time.Now().Truncate(time.Microsecond)
+	if _, err := pg.CreateProject(ctx, "p", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+	after := time.Now()
+
+	got, err := pg.ProjectCreateTime(ctx, "p")
+	if err != nil {
+		t.Fatalf("ProjectCreateTime() failed: %v", err)
+	}
+	if got.Before(before) || got.After(after) {
+		t.Errorf("ProjectCreateTime() = %v, want between %v and %v", got, before, after)
+	}
+	if _, err := pg.ProjectCreateTime(ctx, "missing"); status.Code(err) != codes.NotFound {
+		t.Errorf("ProjectCreateTime() of missing project got %v, want NotFound", err)
+	}
+}
+
+func TestCreatedByAndUpdatedBy(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	o, err := pg.CreateOccurrence(ctx, "p", "alice", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, _ := name.ParseOccurrence(o.Name)
+	if _, errs := pg.BatchCreateOccurrences(ctx, "p", "bob", batchOccurrences(2)); len(errs) != 0 {
+		t.Fatalf("BatchCreateOccurrences() failed: %v", errs)
+	}
+	if _, err := pg.CreateNote(ctx, "p", "n", "carol", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+
+	var created int
+	if err := pg.DB.QueryRow("SELECT COUNT(*) FROM occurrences WHERE project_id = ? AND created_by = ?", "p", "bob").Scan(&created); err != nil {
+		t.Fatalf("querying created_by failed: %v", err)
+	}
+	if created != 2 {
+		t.Errorf("found %d occurrences created by bob, want 2", created)
+	}
+
+	if _, err := pg.UpdateOccurrence(WithUser(ctx, "dave"), "p", oID, &pb.Occurrence{NoteName: "projects/p/notes/n"}, nil); err != nil {
+		t.Fatalf("UpdateOccurrence() failed: %v", err)
+	}
+	if _, err := pg.UpdateNote(ctx, "p", "n", &pb.Note{}, nil); err != nil {
+		t.Fatalf("UpdateNote() failed: %v", err)
+	}
+	var createdBy, updatedBy sql.NullString
+	if err := pg.DB.QueryRow("SELECT created_by, updated_by FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&createdBy, &updatedBy); err != nil {
+		t.Fatalf("reading occurrence authors failed: %v", err)
+	}
+	if createdBy.String != "alice" || updatedBy.String != "dave" {
+		t.Errorf("occurrence created_by, updated_by = %q, %q; want alice, dave", createdBy.String, updatedBy.String)
+	}
+	if err := pg.DB.QueryRow("SELECT created_by, updated_by FROM notes WHERE note_id = ?", "n").Scan(&createdBy, &updatedBy); err != nil {
+		t.Fatalf("reading note authors failed: %v", err)
+	}
+	if createdBy.String != "carol" || updatedBy.Valid {
+		t.Errorf("note created_by, updated_by = %v, %v; want carol, NULL", createdBy, updatedBy)
+	}
+}
+
+// capturingLogger records the messages logged to it.
+type capturingLogger struct {
+	errors, infos []string
+}
+
+func (l *capturingLogger) Errorf(format string, args ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func (l *capturingLogger) Infof(format string, args ...interface{}) {
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func TestNewLogger(t *testing.T) {
+	if _, ok := newLogger(&config.MySQLConfig{}).(stdLogger); !ok {
+		t.Errorf("newLogger() without a configured logger did not return the standard logger")
+	}
+	logger := &capturingLogger{}
+	if got := newLogger(&config.MySQLConfig{Logger: logger}); got != logger {
+		t.Errorf("newLogger() = %v, want the configured logger", got)
+	}
+}
+
+func TestLoggerReceivesErrors(t *testing.T) {
+	pg, _ := newFailingStore(t, errors.New("connection refused"), 1)
+	logger := &capturingLogger{}
+	pg.logger = logger
+	if _, err := pg.CreateProject(context.Background(), "p", &prpb.Project{}); status.Code(err) != codes.Internal {
+		t.Fatalf("CreateProject() got %v, want Internal", err)
+	}
+	want := []string{"Failed to insert Project in database: connection refused"}
+	if !reflect.DeepEqual(logger.errors, want) {
+		t.Errorf("logged errors %q, want %q", logger.errors, want)
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		enabled   bool
+		threshold time.Duration
+		want      int
+	}{
+		{"disabled", false, 0, 0},
+		{"enabled with zero threshold", true, 0, 1},
+		{"high threshold", false, time.Hour, 0},
+		{"enabled with high threshold", true, time.Hour, 0},
+		{"low threshold", false, time.Nanosecond, 1},
+	} {
+		cfg := testConfig(t)
+		logger := &capturingLogger{}
+		cfg.Logger = logger
+		cfg.LogSlowQueries = tc.enabled
+		cfg.SlowQueryThreshold = tc.threshold
+		pg := newTestStore(t, cfg)
+		logger.infos = nil
+		if _, err := pg.CreateProject(context.Background(), "p", &prpb.Project{}); err != nil {
+			t.Fatalf("%s: CreateProject() failed: %v", tc.desc, err)
+		}
+		if len(logger.infos) != tc.want {
+			t.Fatalf("%s: logged %q, want %d messages", tc.desc, logger.infos, tc.want)
+		}
+		if tc.want > 0 && !strings.HasPrefix(logger.infos[0], "slow store operation CreateProject took ") {
+			t.Errorf("%s: logged %q, want the operation and its duration", tc.desc, logger.infos[0])
+		}
+	}
+}
+
+func TestOccurrenceSeverityColumn(t *testing.T) {
+	cfg := testConfig(t)
+	// Compressed occurrences have no details in the data the column could be
+	// generated from.
+	cfg.CompressDocuments = true
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	vuln, err := pg.CreateOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	build, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n", Details: &pb.Occurrence_Build{}})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	severity := func(o *pb.Occurrence) sql.NullInt64 {
+		t.Helper()
+		_, oID, _ := name.ParseOccurrence(o.Name)
+		var severity sql.NullInt64
+		if err := pg.DB.QueryRow("SELECT severity FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&severity); err != nil {
+			t.Fatalf("reading severity failed: %v", err)
+		}
+		return severity
+	}
+	if got, want := severity(vuln), (sql.NullInt64{Int64: int64(vulnpb.Severity_HIGH), Valid: true}); got != want {
+		t.Errorf("severity column = %v, want %v", got, want)
+	}
+	if got := severity(build); got.Valid {
+		t.Errorf("severity column of a build occurrence = %v, want NULL", got)
+	}
+
+	_, oID, _ := name.ParseOccurrence(vuln.Name)
+	update := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_CRITICAL, true)
+	if _, err := pg.UpdateOccurrence(ctx, "p", oID, update, nil); err != nil {
+		t.Fatalf("UpdateOccurrence() failed: %v", err)
+	}
+	if got, want := severity(vuln), (sql.NullInt64{Int64: int64(vulnpb.Severity_CRITICAL), Valid: true}); got != want {
+		t.Errorf("severity column after update = %v, want %v", got, want)
+	}
+	if _, err := pg.UpdateOccurrence(ctx, "p", oID, &pb.Occurrence{NoteName: vuln.NoteName, Details: &pb.Occurrence_Build{}}, nil); err != nil {
+		t.Fatalf("UpdateOccurrence() failed: %v", err)
+	}
+	if got := severity(vuln); got.Valid {
+		t.Errorf("severity column after update to a build = %v, want NULL", got)
+	}
+}
+
+func TestBackfillOccurrenceSeverity(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	var created []*pb.Occurrence
+	for _, o := range []*pb.Occurrence{
+		vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, true),
+		{NoteName: "projects/p/notes/n", Details: &pb.Occurrence_Vulnerability{Vulnerability: &vulnpb.Details{}}},
+		{NoteName: "projects/p/notes/n", Details: &pb.Occurrence_Build{}},
+	} {
+		c, err := pg.CreateOccurrence(ctx, "p", "u", o)
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		created = append(created, c)
+	}
+	// Occurrences written before the column was set have no severity.
+	if _, err := pg.DB.Exec("UPDATE occurrences SET severity = NULL"); err != nil {
+		t.Fatalf("clearing severities failed: %v", err)
+	}
+	for _, m := range mysqlMigrations {
+		if m.description != "write occurrence severity with the occurrence" {
+			continue
+		}
+		for _, statement := range m.statements {
+			if _, err := pg.DB.Exec(statement); err != nil {
+				t.Fatalf("running migration failed: %v", err)
+			}
+		}
+	}
+
+	want := []sql.NullInt64{
+		{Int64: int64(vulnpb.Severity_LOW), Valid: true},
+		{Int64: int64(vulnpb.Severity_SEVERITY_UNSPECIFIED), Valid: true},
+		{},
+	}
+	for i, o := range created {
+		_, oID, _ := name.ParseOccurrence(o.Name)
+		var got sql.NullInt64
+		if err := pg.DB.QueryRow("SELECT severity FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&got); err != nil {
+			t.Fatalf("reading severity failed: %v", err)
+		}
+		if got != want[i] {
+			t.Errorf("backfilled severity of occurrence %d = %v, want %v", i, got, want[i])
+		}
+		if got != occurrenceSeverity(o) {
+			t.Errorf("backfilled severity of occurrence %d = %v, occurrenceSeverity() = %v", i, got, occurrenceSeverity(o))
+		}
+	}
+}
+
+func TestOccurrenceFixableColumn(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	noVersion := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, true)
+	noVersion.GetVulnerability().PackageIssue[0].FixedLocation.Version = nil
+	mixed := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, false)
+	mixed.GetVulnerability().PackageIssue = append(mixed.GetVulnerability().PackageIssue,
+		vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, true).GetVulnerability().PackageIssue...)
+	occs := []*pb.Occurrence{
+		vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, true),
+		vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, false),
+		noVersion,
+		mixed,
+		{NoteName: "projects/p/notes/n", Details: &pb.Occurrence_Vulnerability{Vulnerability: &vulnpb.Details{}}},
+		{NoteName: "projects/p/notes/n", Details: &pb.Occurrence_Build{}},
+	}
+	var oIDs []string
+	for _, o := range occs {
+		created, err := pg.CreateOccurrence(ctx, "p", "u", o)
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		_, oID, _ := name.ParseOccurrence(created.Name)
+		oIDs = append(oIDs, oID)
+	}
+	check := func(when string) {
+		t.Helper()
+		for i, oID := range oIDs {
+			var got bool
+			if err := pg.DB.QueryRow("SELECT fixable FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&got); err != nil {
+				t.Fatalf("reading fixable failed: %v", err)
+			}
+			if want := occurrenceFixable(occs[i]); got != want {
+				t.Errorf("fixable column of occurrence %d %s = %v, want %v", i, when, got, want)
+			}
+		}
+	}
+	check("after create")
+
+	// Occurrences written before the column was added are backfilled from their data.
+	if _, err := pg.DB.Exec("UPDATE occurrences SET fixable = NOT fixable WHERE severity IS NOT NULL"); err != nil {
+		t.Fatalf("resetting fixable failed: %v", err)
+	}
+	for _, m := range mysqlMigrations {
+		if m.description != "add fixable column to occurrences" {
+			continue
+		}
+		for _, statement := range m.statements {
+			if _, err := pg.DB.Exec(statement); err != nil && !alreadyApplied(err) {
+				t.Fatalf("running migration failed: %v", err)
+			}
+		}
+	}
+	check("after backfill")
+}
+
+func TestOccurrenceIDValue(t *testing.T) {
+	generated := uuid.New().String()
+	tests := []struct {
+		oID    string
+		binary bool
+	}{
+		{oID: generated, binary: true},
+		{oID: "3f4b1c2d-8e9a-4b5c-9d6e-7f8a9b0c1d2e", binary: true},
+		{oID: "3F4B1C2D-8E9A-4B5C-9D6E-7F8A9B0C1D2E"},
+		{oID: "41414141-4141-4141-4141-414141414141"},
+		{oID: "3f4b1c2d8e9a4b5c9d6e7f8a9b0c1d2e"},
+		{oID: "ABCDEFGHIJKLMNOP"},
+		{oID: "build-1"},
+	}
+	for _, tt := range tests {
+		v := occurrenceIDValue(tt.oID)
+		if binary := len(v) == 16 && string(v) != tt.oID; binary != tt.binary {
+			t.Errorf("occurrenceIDValue(%q) = %x, stored as binary %v, want %v", tt.oID, v, binary, tt.binary)
+		}
+		if got := decodeOccurrenceID(v); got != tt.oID {
+			t.Errorf("decodeOccurrenceID(occurrenceIDValue(%q)) = %q, want %q", tt.oID, got, tt.oID)
+		}
+	}
+}
+
+func TestOccurrenceIDStoredAsBinary(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := ReadFromPrimary(context.Background())
+	o := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, true)
+	generated, err := pg.CreateOccurrence(ctx, "p", "u", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	custom, err := pg.CreateOccurrence(WithOccurrenceID(ctx, "build-1"), "p", "u", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() with an ID failed: %v", err)
+	}
+	_, oID, err := name.ParseOccurrence(generated.Name)
+	if err != nil {
+		t.Fatalf("ParseOccurrence(%q) failed: %v", generated.Name, err)
+	}
+	u, err := uuid.Parse(oID)
+	if err != nil {
+		t.Fatalf("generated occurrence ID %q is not a UUID: %v", oID, err)
+	}
+	want, err := u.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() failed: %v", err)
+	}
+	var stored []byte
+	if err := pg.DB.QueryRow("SELECT occurrence_id FROM occurrences WHERE data->>'$.name' = ?", generated.Name).Scan(&stored); err != nil {
+		t.Fatalf("reading occurrence_id failed: %v", err)
+	}
+	if !reflect.DeepEqual(stored, want) {
+		t.Errorf("occurrence_id of %q = %x, want %x", oID, stored, want)
+	}
+	if err := pg.DB.QueryRow("SELECT occurrence_id FROM occurrences WHERE occurrence_id = ?", "build-1").Scan(&stored); err != nil {
+		t.Errorf("reading the occurrence_id given with WithOccurrenceID failed: %v", err)
+	}
+
+	for _, c := range []*pb.Occurrence{generated, custom} {
+		_, id, _ := name.ParseOccurrence(c.Name)
+		got, err := pg.GetOccurrence(ctx, "p", id)
+		if err != nil {
+			t.Fatalf("GetOccurrence(%q) failed: %v", id, err)
+		}
+		if got.Name != c.Name {
+			t.Errorf("GetOccurrence(%q) name = %q, want %q", id, got.Name, c.Name)
+		}
+	}
+	occs, err := pg.GetOccurrences(ctx, "p", []string{oID, "build-1"})
+	if err != nil {
+		t.Fatalf("GetOccurrences() failed: %v", err)
+	}
+	if len(occs) != 2 || occs[oID].GetName() != generated.Name || occs["build-1"].GetName() != custom.Name {
+		t.Errorf("GetOccurrences() = %v, want %q and %q", occs, generated.Name, custom.Name)
+	}
+	upserted, err := pg.UpsertOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/b", vulnpb.Severity_LOW, true))
+	if err != nil {
+		t.Fatalf("UpsertOccurrence() failed: %v", err)
+	}
+	_, upsertedID, _ := name.ParseOccurrence(upserted.Name)
+	if _, err := uuid.Parse(upsertedID); err != nil {
+		t.Errorf("UpsertOccurrence() name = %q, want a UUID occurrence ID", upserted.Name)
+	}
+	if err := pg.DeleteOccurrence(ctx, "p", oID); err != nil {
+		t.Errorf("DeleteOccurrence(%q) failed: %v", oID, err)
+	}
+}
+
+func TestMigrateOccurrenceIDs(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := ReadFromPrimary(context.Background())
+	created, err := pg.CreateOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_LOW, true))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	custom, err := pg.CreateOccurrence(WithOccurrenceID(ctx, "41414141-4141-4141-4141-414141414141"), "p", "u", vulnerabilityOccurrence("https://gcr.io/p/b", vulnpb.Severity_LOW, true))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() with an ID failed: %v", err)
+	}
+	_, oID, _ := name.ParseOccurrence(created.Name)
+	// Occurrences written before the migration have their ID stored as text.
+	if _, err := pg.DB.Exec("UPDATE occurrences SET occurrence_id = ? WHERE occurrence_id = ?", oID, occurrenceIDValue(oID)); err != nil {
+		t.Fatalf("storing the ID as text failed: %v", err)
+	}
+	for _, m := range mysqlMigrations {
+		if m.description != "store generated occurrence IDs as binary UUIDs" {
+			continue
+		}
+		for _, statement := range m.statements {
+			if _, err := pg.DB.Exec(statement); err != nil {
+				t.Fatalf("running migration failed: %v", err)
+			}
+		}
+	}
+
+	var length int
+	if err := pg.DB.QueryRow("SELECT LENGTH(occurrence_id) FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&length); err != nil {
+		t.Fatalf("reading the migrated occurrence_id failed: %v", err)
+	}
+	if length != 16 {
+		t.Errorf("migrated occurrence_id has %d bytes, want 16", length)
+	}
+	for _, c := range []*pb.Occurrence{created, custom} {
+		_, id, _ := name.ParseOccurrence(c.Name)
+		got, err := pg.GetOccurrence(ctx, "p", id)
+		if err != nil {
+			t.Fatalf("GetOccurrence(%q) after the migration failed: %v", id, err)
+		}
+		if got.Name != c.Name {
+			t.Errorf("GetOccurrence(%q) after the migration name = %q, want %q", id, got.Name, c.Name)
+		}
+	}
+}
+
+// testExportImport exports a project of s and imports it into another project,
+// checking that the imported notes and occurrences match the exported ones.
+func testExportImport(t *testing.T, s Store) {
+	t.Helper()
+	ctx := ReadFromPrimary(context.Background())
+	for _, nID := range []string{"n1", "n2"} {
+		if _, err := s.CreateNote(ctx, "p", nID, "u", &pb.Note{ShortDescription: nID}); err != nil {
+			t.Fatalf("CreateNote() failed: %v", err)
+		}
+	}
+	var created []*pb.Occurrence
+	for i, nName := range []string{"projects/p/notes/n1", "projects/p/notes/n2", "projects/other/notes/n1"} {
+		o, err := s.CreateOccurrence(ctx, "p", "u", noteOccurrence(nName, fmt.Sprintf("https://gcr.io/p/%d", i), vulnpb.Severity_HIGH))
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		created = append(created, o)
+	}
+	// Updated occurrences keep their update time.
+	_, oID, _ := name.ParseOccurrence(created[1].Name)
+	updated, err := s.UpdateOccurrence(ctx, "p", oID, &pb.Occurrence{Remediation: "upgrade"}, &fieldmaskpb.FieldMask{Paths: []string{"remediation"}})
+	if err != nil {
+		t.Fatalf("UpdateOccurrence() failed: %v", err)
+	}
+	if updated.UpdateTime == nil {
+		t.Fatalf("UpdateOccurrence() returned no update time")
+	}
+	if _, err := s.CreateOccurrence(ctx, "q", "u", noteOccurrence("projects/p/notes/n1", "https://gcr.io/q/a", vulnpb.Severity_LOW)); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+
+	var export bytes.Buffer
+	if err := s.ExportProject(ctx, "p", &export); err != nil {
+		t.Fatalf("ExportProject() failed: %v", err)
+	}
+	if lines := strings.Count(export.String(), "\n"); lines != 5 {
+		t.Errorf("ExportProject() wrote %d lines, want 5:\n%s", lines, export.String())
+	}
+	if err := s.ImportProject(ctx, "r", bytes.NewReader(export.Bytes())); err != nil {
+		t.Fatalf("ImportProject() failed: %v", err)
+	}
+
+	wantNotes, err := s.ListAllNotes(ctx, "p", "")
+	if err != nil {
+		t.Fatalf("ListAllNotes() failed: %v", err)
+	}
+	for _, n := range wantNotes {
+		n.Name = strings.Replace(n.Name, "projects/p/", "projects/r/", 1)
+	}
+	gotNotes, err := s.ListAllNotes(ctx, "r", "")
+	if err != nil {
+		t.Fatalf("ListAllNotes() of the imported project failed: %v", err)
+	}
+	if describe(gotNotes) != describe(wantNotes) {
+		t.Errorf("imported notes = %s, want %s", describe(gotNotes), describe(wantNotes))
+	}
+	wantOccs, _, err := s.ListOccurrences(ctx, "p", "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	for _, o := range wantOccs {
+		o.Name = strings.Replace(o.Name, "projects/p/", "projects/r/", 1)
+		o.NoteName = strings.Replace(o.NoteName, "projects/p/", "projects/r/", 1)
+	}
+	gotOccs, _, err := s.ListOccurrences(ctx, "r", "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() of the imported project failed: %v", err)
+	}
+	if describe(gotOccs) != describe(wantOccs) {
+		t.Errorf("imported occurrences = %s, want %s", describe(gotOccs), describe(wantOccs))
+	}
+
+	if err := s.ImportProject(ctx, "r", bytes.NewReader(export.Bytes())); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("ImportProject() into a project holding the notes got %v, want AlreadyExists", err)
+	}
+}
+
+func TestExportImportProject(t *testing.T) {
+	testExportImport(t, newTestStore(t, nil))
+}
+
+func TestImportInvalidExport(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	for _, export := range []string{
+		`{"note": {"name": "projects/p/notes/n"}} not json`,
+		`{"project": {"name": "projects/p"}}`,
+		`{"note": {"name": "projects/p/notes/n"}, "occurrence": {"name": "projects/p/occurrences/o"}}`,
+		`{"note": {"name": "notes/n"}}`,
+		`{"occurrence": {"name": "projects/p/occurrences/not valid"}}`,
+		`{"occurrence": {"unknown_type": 1, "name": 2}}`,
+	} {
+		for _, s := range []Store{pg, NewFakeStore(nil)} {
+			if err := s.ImportProject(context.Background(), "p", strings.NewReader(export)); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("%T.ImportProject(%s) got %v, want InvalidArgument", s, export, err)
+			}
+		}
+	}
+	if d.execs != 0 {
+		t.Errorf("invalid imports ran %d statements, want none", d.execs)
+	}
+}
+
+// searchOccurrence returns a vulnerability occurrence of uri with the given
+// descriptions and remediation.
+func searchOccurrence(uri, short, long, remediation string) *pb.Occurrence {
+	o := vulnerabilityOccurrence(uri, vulnpb.Severity_HIGH, true)
+	o.GetVulnerability().ShortDescription = short
+	o.GetVulnerability().LongDescription = long
+	o.Remediation = remediation
+	return o
+}
+
+// testSearchOccurrences tests the SearchOccurrences method of s, which must be empty.
+func testSearchOccurrences(t *testing.T, s Store) {
+	t.Helper()
+	ctx := ReadFromPrimary(context.Background())
+	seeded := map[string]*pb.Occurrence{
+		"libpng": searchOccurrence("https://gcr.io/p/a", "Heap overflow in libpng",
+			"A heap overflow in libpng allows code execution through a crafted libpng image.", ""),
+		"openssl": searchOccurrence("https://gcr.io/p/b", "Use after free in openssl", "",
+			"Upgrade openssl; the bundled libpng is not affected."),
+		"kernel": searchOccurrence("https://gcr.io/p/c", "Race condition in the kernel scheduler", "", ""),
+	}
+	names := map[string]string{}
+	for _, key := range []string{"libpng", "openssl", "kernel"} {
+		created, err := s.CreateOccurrence(ctx, "p", "u", seeded[key])
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		names[created.Name] = key
+	}
+	other := searchOccurrence("https://gcr.io/q/a", "libpng in another project", "", "")
+	if _, err := s.CreateOccurrence(ctx, "q", "u", other); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// The occurrence mentioning libpng most often ranks first.
+		{"libpng", []string{"libpng", "openssl"}},
+		{"LIBPNG", []string{"libpng", "openssl"}},
+		{"scheduler race", []string{"kernel"}},
+		{"openssl upgrade", []string{"openssl"}},
+		{"nonexistentword", nil},
+	}
+	for _, tt := range tests {
+		os, err := s.SearchOccurrences(ctx, "p", tt.query, 10)
+		if err != nil {
+			t.Errorf("SearchOccurrences(%q) failed: %v", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, o := range os {
+			got = append(got, names[o.Name])
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SearchOccurrences(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	if os, err := s.SearchOccurrences(ctx, "p", "libpng", 1); err != nil || len(os) != 1 || names[os[0].Name] != "libpng" {
+		t.Errorf("SearchOccurrences(libpng, pageSize 1) = %v, %v, want the libpng occurrence", os, err)
+	}
+	if _, err := s.SearchOccurrences(ctx, "p", "  ", 10); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SearchOccurrences() with an empty query returned %v, want InvalidArgument", err)
+	}
+}
+
+func TestSearchOccurrences(t *testing.T) {
+	testSearchOccurrences(t, newTestStore(t, nil))
+}
+
+func TestSearchOccurrencesOfUnsearchableDocuments(t *testing.T) {
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	for _, pg := range []*MySQLStore{{compressDocuments: true}, {dataKeys: []*fernet.Key{&key}}} {
+		if _, err := pg.SearchOccurrences(context.Background(), "p", "libpng", 10); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("SearchOccurrences() with compressDocuments %v and %d data keys = %v, want FailedPrecondition", pg.compressDocuments, len(pg.dataKeys), err)
+		}
+	}
+}
+
+func TestSearchOccurrencesWithoutFullTextIndex(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := ReadFromPrimary(context.Background())
+	if _, err := pg.DB.Exec("ALTER TABLE occurrences DROP INDEX occurrences_search_text"); err != nil {
+		t.Fatalf("dropping the FULLTEXT index failed: %v", err)
+	}
+	first, err := pg.CreateOccurrence(ctx, "p", "u", searchOccurrence("https://gcr.io/p/a", "Heap overflow in libpng", "", ""))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	second, err := pg.CreateOccurrence(ctx, "p", "u", searchOccurrence("https://gcr.io/p/b", "Integer overflow in libpng 100%", "", ""))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+
+	// Without the index, occurrences containing every word are returned, most
+	// recently modified first.
+	os, err := pg.SearchOccurrences(ctx, "p", "libpng overflow", 10)
+	if err != nil {
+		t.Fatalf("SearchOccurrences() failed: %v", err)
+	}
+	if len(os) != 2 || os[0].Name != second.Name || os[1].Name != first.Name {
+		t.Errorf("SearchOccurrences(libpng overflow) = %s, want [%s, %s]", describe(os), second.Name, first.Name)
+	}
+	os, err = pg.SearchOccurrences(ctx, "p", "100%", 10)
+	if err != nil {
+		t.Fatalf("SearchOccurrences() failed: %v", err)
+	}
+	if len(os) != 1 || os[0].Name != second.Name {
+		t.Errorf("SearchOccurrences(100%%) = %s, want [%s]", describe(os), second.Name)
+	}
+}
+
+func TestLikeSearchQuery(t *testing.T) {
+	query, args := likeSearchQuery(mysqlLikeSearchOccurrences, "p", []string{"heap", "50%_off", `a\b`})
+	if want := "WHERE project_id = ? AND search_text LIKE ? AND search_text LIKE ? AND search_text LIKE ? ORDER BY"; !strings.Contains(query, want) {
+		t.Errorf("likeSearchQuery() = %q, want it to contain %q", query, want)
+	}
+	wantArgs := []interface{}{"p", "%heap%", `%50\%\_off%`, `%a\\b%`}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("likeSearchQuery() args = %q, want %q", args, wantArgs)
+	}
+}
+
+func TestCorruptDocuments(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	corrupt := `{"resource": 5}`
+	if _, err := pg.DB.Exec(mysqlInsertOccurrence, "p", "o", "p", "n", corrupt, nil, 0, nil, false, nil, nil, nil, nil); err != nil {
+		t.Fatalf("inserting occurrence failed: %v", err)
+	}
+	if _, err := pg.DB.Exec(mysqlInsertNote, "p", "n", corrupt, nil, nil); err != nil {
+		t.Fatalf("inserting note failed: %v", err)
+	}
+
+	if o, err := pg.GetOccurrence(ctx, "p", "o"); status.Code(err) != codes.Internal {
+		t.Errorf("GetOccurrence() = %v, %v; want Internal error", o, err)
+	}
+	if os, _, err := pg.ListOccurrences(ctx, "p", "", "", 0); status.Code(err) != codes.Internal {
+		t.Errorf("ListOccurrences() = %v, %v; want Internal error", os, err)
+	}
+	if n, err := pg.GetNote(ctx, "p", "n"); status.Code(err) != codes.Internal {
+		t.Errorf("GetNote() = %v, %v; want Internal error", n, err)
+	}
+	if ns, _, err := pg.ListNotes(ctx, "p", "", "", 0); status.Code(err) != codes.Internal {
+		t.Errorf("ListNotes() = %v, %v; want Internal error", ns, err)
+	}
+}
+
+func TestListRowsError(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	d.rows = [][]driver.Value{{int64(1), []byte("o"), `{"note_name": "projects/p/notes/n"}`, nil, nil, nil}}
+	d.rowsErr = errors.New("connection reset")
+	if os, _, err := pg.ListOccurrences(context.Background(), "p", "", "", 0); status.Code(err) != codes.Internal {
+		t.Errorf("ListOccurrences() = %v, %v; want Internal error", os, err)
+	}
+	if ns, _, err := pg.ListNotes(context.Background(), "p", "", "", 0); status.Code(err) != codes.Internal {
+		t.Errorf("ListNotes() = %v, %v; want Internal error", ns, err)
+	}
+}
+
+func TestNoteCache(t *testing.T) {
+	if c := newNoteCache(0); c != nil {
+		t.Errorf("newNoteCache(0) = %v, want nil", c)
+	}
+	pg, d := newFailingStore(t, nil, 0)
+	pg.notes = newNoteCache(2)
+	d.rows = [][]driver.Value{{`{"short_description": "openssl"}`, nil}}
+	ctx := context.Background()
+	getNote := func(nID string, wantQueries int) {
+		t.Helper()
+		n, err := pg.GetNote(ctx, "p", nID)
+		if err != nil {
+			t.Fatalf("GetNote(%q) failed: %v", nID, err)
+		}
+		if n.ShortDescription != "openssl" {
+			t.Errorf("GetNote(%q) = %v, want the stored note", nID, n)
+		}
+		if d.queries != wantQueries {
+			t.Errorf("after GetNote(%q), ran %d queries, want %d", nID, d.queries, wantQueries)
+		}
+		// Changing the returned note must not change the cached one.
+		n.ShortDescription = "changed"
+	}
+
+	getNote("n1", 1)
+	getNote("n1", 1)
+	if _, err := pg.GetNote(ReadFromPrimary(ctx), "p", "n1"); err != nil || d.queries != 2 {
+		t.Errorf("GetNote() from the primary got %v and ran %d queries, want it to query", err, d.queries)
+	}
+
+	if _, err := pg.UpdateNote(ctx, "p", "n1", &pb.Note{ShortDescription: "openssl"}, nil); err != nil {
+		t.Fatalf("UpdateNote() failed: %v", err)
+	}
+	getNote("n1", 3)
+
+	if err := pg.DeleteNote(ctx, "p", "n1"); err != nil {
+		t.Fatalf("DeleteNote() failed: %v", err)
+	}
+	getNote("n1", 4)
+
+	// n1 is the least recently used note when n3 is added.
+	getNote("n2", 5)
+	getNote("n3", 6)
+	getNote("n3", 6)
+	getNote("n2", 6)
+	getNote("n1", 7)
+
+	if err := pg.DeleteProject(ctx, "p"); err != nil {
+		t.Fatalf("DeleteProject() failed: %v", err)
+	}
+	getNote("n1", 8)
+}
+
+func TestOccurrenceKind(t *testing.T) {
+	tests := []struct {
+		o    *pb.Occurrence
+		want cpb.NoteKind
+	}{
+		{vulnerabilityOccurrence("u", vulnpb.Severity_HIGH, true), cpb.NoteKind_VULNERABILITY},
+		{&pb.Occurrence{Details: &pb.Occurrence_Discovered{}}, cpb.NoteKind_DISCOVERY},
+		{&pb.Occurrence{Kind: cpb.NoteKind_VULNERABILITY, Details: &pb.Occurrence_Build{}}, cpb.NoteKind_BUILD},
+		{&pb.Occurrence{Kind: cpb.NoteKind_DEPLOYMENT}, cpb.NoteKind_DEPLOYMENT},
+		{&pb.Occurrence{}, cpb.NoteKind_NOTE_KIND_UNSPECIFIED},
+	}
+	for _, tt := range tests {
+		if got := occurrenceKind(tt.o); got != tt.want {
+			t.Errorf("occurrenceKind(%v) = %v, want %v", tt.o, got, tt.want)
+		}
+	}
+}
+
+func TestOccurrenceKindColumn(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	vuln, err := pg.CreateOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		o := &pb.Occurrence{NoteName: "projects/p/notes/n", Details: &pb.Occurrence_Discovered{}}
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", o); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	_, oID, _ := name.ParseOccurrence(vuln.Name)
+	var kind cpb.NoteKind
+	if err := pg.DB.QueryRow("SELECT kind FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&kind); err != nil {
+		t.Fatalf("reading kind failed: %v", err)
+	}
+	if kind != cpb.NoteKind_VULNERABILITY {
+		t.Errorf("kind column = %v, want VULNERABILITY", kind)
+	}
+
+	build := &pb.Occurrence{NoteName: vuln.NoteName, Details: &pb.Occurrence_Build{}}
+	if _, err := pg.UpdateOccurrence(ctx, "p", oID, build, nil); err != nil {
+		t.Fatalf("UpdateOccurrence() failed: %v", err)
+	}
+	if err := pg.DB.QueryRow("SELECT kind FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&kind); err != nil {
+		t.Fatalf("reading kind failed: %v", err)
+	}
+	if kind != cpb.NoteKind_BUILD {
+		t.Errorf("kind column after update = %v, want BUILD", kind)
+	}
+
+	os, _, err := pg.ListOccurrences(ctx, "p", `kind="BUILD"`, "", 100)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	if len(os) != 1 || os[0].Name != vuln.Name {
+		t.Errorf("ListOccurrences(kind=\"BUILD\") = %v, want the updated occurrence", os)
+	}
+
+	pg.DB.Exec("ANALYZE TABLE occurrences")
+	var fs MysqlFilterSql
+	filterSql, params, err := fs.ParseFilter(`kind="BUILD"`)
+	if err != nil {
+		t.Fatalf("ParseFilter() failed: %v", err)
+	}
+	args := append(append([]interface{}{"p"}, params...), 0, 100)
+	if key := explainKey(t, pg, fmt.Sprintf(mysqlListOccurrences, "AND "+filterSql), args...); key != "occurrences_kind" {
+		t.Errorf("kind filter uses key %q, want occurrences_kind", key)
+	}
+}
+
+func TestListOccurrencesFilterHas(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	scored := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)
+	scored.GetVulnerability().CvssScore = 7.5
+	scored, err := pg.CreateOccurrence(ctx, "p", "u", scored)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	unscored, err := pg.CreateOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/b", vulnpb.Severity_LOW, false))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/build", Details: &pb.Occurrence_Build{}}); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		filter string
+		want   string
+	}{
+		{`has(vulnerability.cvss_score)`, scored.Name},
+		{`kind="VULNERABILITY" AND NOT has(vulnerability.cvss_score)`, unscored.Name},
+	} {
+		os, _, err := pg.ListOccurrences(ctx, "p", tt.filter, "", 100)
+		if err != nil {
+			t.Fatalf("ListOccurrences(%q) failed: %v", tt.filter, err)
+		}
+		if len(os) != 1 || os[0].Name != tt.want {
+			t.Errorf("ListOccurrences(%q) = %v, want %s", tt.filter, os, tt.want)
+		}
+	}
+}
+
+func TestListOccurrencesFilterCvssScore(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	names := map[float32]string{}
+	for _, score := range []float32{6.9, 7, 8.9, 9, 0} {
+		o := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)
+		// A score of 0 is left out of the data, like a missing score.
+		o.GetVulnerability().CvssScore = score
+		created, err := pg.CreateOccurrence(ctx, "p", "u", o)
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		names[score] = created.Name
+	}
+
+	for _, tt := range []struct {
+		filter string
+		want   []float32
+	}{
+		{`vulnerability.cvssScore >= 7 AND vulnerability.cvssScore < 9`, []float32{7, 8.9}},
+		{`vulnerability.cvss_score > 7 AND vulnerability.cvss_score <= 9`, []float32{8.9, 9}},
+		{`vulnerability.cvssScore < 7`, []float32{6.9}},
+		{`vulnerability.cvssScore = 8.9`, []float32{8.9}},
+	} {
+		os, _, err := pg.ListOccurrences(ctx, "p", tt.filter, "", 100)
+		if err != nil {
+			t.Fatalf("ListOccurrences(%q) failed: %v", tt.filter, err)
+		}
+		var got, want []string
+		for _, o := range os {
+			got = append(got, o.Name)
+		}
+		for _, score := range tt.want {
+			want = append(want, names[score])
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ListOccurrences(%q) = %v, want %v", tt.filter, got, want)
+		}
+	}
+}
+
+func TestListOccurrencesFilterSeverity(t *testing.T) {
+	ctx := context.Background()
+	pg := newTestStore(t, nil)
+	for _, s := range []Store{pg, NewFakeStore(nil)} {
+		names := map[vulnpb.Severity]string{}
+		for severity := vulnpb.Severity_MINIMAL; severity <= vulnpb.Severity_CRITICAL; severity++ {
+			o, err := s.CreateOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/a", severity, true))
+			if err != nil {
+				t.Fatalf("CreateOccurrence() failed: %v", err)
+			}
+			names[severity] = o.Name
+		}
+		if _, err := s.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/build", Details: &pb.Occurrence_Build{}}); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+
+		for severity, want := range names {
+			filter := fmt.Sprintf(`vulnerability.severity="%s"`, severity)
+			os, _, err := s.ListOccurrences(ctx, "p", filter, "", 100)
+			if err != nil {
+				t.Fatalf("%T.ListOccurrences(%q) failed: %v", s, filter, err)
+			}
+			if len(os) != 1 || os[0].Name != want {
+				t.Errorf("%T.ListOccurrences(%q) = %v, want %s", s, filter, os, want)
+			}
+		}
+		if _, _, err := s.ListOccurrences(ctx, "p", `vulnerability.severity="SEVERE"`, "", 100); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%T.ListOccurrences() with an unknown severity got %v, want InvalidArgument", s, err)
+		}
+	}
+
+	os, _, err := pg.ListOccurrences(ctx, "p", `vulnerability.severity >= "HIGH"`, "", 100)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	if len(os) != 2 {
+		t.Errorf("ListOccurrences(severity >= HIGH) returned %d occurrences, want 2", len(os))
+	}
+
+	pg.DB.Exec("ANALYZE TABLE occurrences")
+	var fs MysqlFilterSql
+	filterSql, params, err := fs.ParseFilter(`vulnerability.severity="CRITICAL"`)
+	if err != nil {
+		t.Fatalf("ParseFilter() failed: %v", err)
+	}
+	args := append(append([]interface{}{"p"}, params...), 0, 100)
+	if key := explainKey(t, pg, fmt.Sprintf(mysqlListOccurrences, "AND "+filterSql), args...); key != "occurrences_severity" {
+		t.Errorf("severity filter uses key %q, want occurrences_severity", key)
+	}
+}
+
+func TestListOccurrencesFilterResourceUrl(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	var want []string
+	for i := 0; i < 6; i++ {
+		uri := fmt.Sprintf("https://gcr.io/p/image%d@sha256:0123", i%3)
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n", Resource: &pb.Resource{Uri: uri}})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		if i%3 == 1 {
+			want = append(want, o.Name)
+		}
+	}
+	for _, filter := range []string{
+		`resourceUrl="https://gcr.io/p/image1@sha256:0123"`,
+		`resource_url="https://gcr.io/p/image1@sha256:0123"`,
+		`resourceUrl IN ("https://gcr.io/p/image1@sha256:0123", "https://gcr.io/p/missing")`,
+	} {
+		os, _, err := pg.ListOccurrences(ctx, "p", filter, "", 100)
+		if err != nil {
+			t.Fatalf("ListOccurrences(%q) failed: %v", filter, err)
+		}
+		var got []string
+		for _, o := range os {
+			got = append(got, o.Name)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ListOccurrences(%q) = %v, want %v", filter, got, want)
+		}
+	}
+}
+
+func TestUpdateOccurrenceConcurrentUpdate(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, _ := name.ParseOccurrence(o.Name)
+	var version int64
+	if err := pg.DB.QueryRow("SELECT version FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&version); err != nil {
+		t.Fatalf("reading version failed: %v", err)
+	}
+
+	// Both updates read the occurrence at the same version before either writes.
+	first := &pb.Occurrence{NoteName: o.NoteName, Remediation: "first"}
+	if err := pg.updateOccurrence(ctx, "p", oID, first, version); err != nil {
+		t.Fatalf("first update failed: %v", err)
+	}
+	second := &pb.Occurrence{NoteName: o.NoteName, Remediation: "second"}
+	if err := pg.updateOccurrence(ctx, "p", oID, second, version); status.Code(err) != codes.Aborted {
+		t.Errorf("second update got %v, want Aborted", err)
+	}
+	got, err := pg.GetOccurrence(ctx, "p", oID)
+	if err != nil {
+		t.Fatalf("GetOccurrence() failed: %v", err)
+	}
+	if got.Remediation != "first" {
+		t.Errorf("Remediation = %q, want the first update", got.Remediation)
+	}
+
+	// A retried update reads the new version and succeeds.
+	if _, err := pg.UpdateOccurrence(ctx, "p", oID, second, nil); err != nil {
+		t.Errorf("UpdateOccurrence() after conflict failed: %v", err)
+	}
+}
+
+func TestWithTxCommits(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	err := pg.withTx(context.Background(), func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("withTx() failed: %v", err)
+	}
+	if d.commits != 1 || d.rollbacks != 0 {
+		t.Errorf("withTx() made %d commits and %d rollbacks, want 1 commit", d.commits, d.rollbacks)
+	}
+}
+
+func TestWithTxRollsBackOnError(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	want := errors.New("failed")
+	if err := pg.withTx(context.Background(), func(tx *sql.Tx) error { return want }); err != want {
+		t.Errorf("withTx() got %v, want %v", err, want)
+	}
+	if d.commits != 0 || d.rollbacks != 1 {
+		t.Errorf("withTx() made %d commits and %d rollbacks, want 1 rollback", d.commits, d.rollbacks)
+	}
+}
+
+func TestWithTxRollsBackOnPanic(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("withTx() panicked with %v, want boom", p)
+		}
+		if d.commits != 0 || d.rollbacks != 1 {
+			t.Errorf("withTx() made %d commits and %d rollbacks, want 1 rollback", d.commits, d.rollbacks)
+		}
+	}()
+	pg.withTx(context.Background(), func(tx *sql.Tx) error { panic("boom") })
+}
+
+func TestWithTxRetriesDeadlocks(t *testing.T) {
+	pg, d := newFailingStore(t, &mysql.MySQLError{Number: mysqlErrDeadlock, Message: "Deadlock found"}, 1)
+	calls := 0
+	err := pg.withTx(context.Background(), func(tx *sql.Tx) error {
+		calls++
+		_, err := tx.Exec("INSERT")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("withTx() failed: %v", err)
+	}
+	if calls != 2 || d.commits != 1 || d.rollbacks != 1 {
+		t.Errorf("withTx() made %d calls, %d commits and %d rollbacks; want 2, 1 and 1", calls, d.commits, d.rollbacks)
+	}
+}
+
+func TestUpsertOccurrence(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	o := &pb.Occurrence{
+		NoteName:    "projects/p/notes/n",
+		Resource:    &pb.Resource{Uri: "https://gcr.io/p/a"},
+		Remediation: "first",
+	}
+	first, err := pg.UpsertOccurrence(ctx, "p", "u", o)
+	if err != nil {
+		t.Fatalf("UpsertOccurrence() failed: %v", err)
+	}
+	o.Remediation = "second"
+	second, err := pg.UpsertOccurrence(ctx, "p", "u", o)
+	if err != nil {
+		t.Fatalf("second UpsertOccurrence() failed: %v", err)
+	}
+	if second.Name != first.Name || second.Remediation != "second" {
+		t.Errorf("second UpsertOccurrence() = %v, want %s with the new remediation", second, first.Name)
+	}
+	if !proto.Equal(second.CreateTime, first.CreateTime) || second.UpdateTime == nil {
+		t.Errorf("second UpsertOccurrence() create_time, update_time = %v, %v; want %v and an update time",
+			second.CreateTime, second.UpdateTime, first.CreateTime)
+	}
+
+	o.Resource = &pb.Resource{Uri: "https://gcr.io/p/b"}
+	other, err := pg.UpsertOccurrence(ctx, "p", "u", o)
+	if err != nil {
+		t.Fatalf("UpsertOccurrence() of another resource failed: %v", err)
+	}
+	if other.Name == first.Name {
+		t.Errorf("UpsertOccurrence() of another resource replaced %s", first.Name)
+	}
+	var count int
+	if err := pg.DB.QueryRow("SELECT COUNT(*) FROM occurrences WHERE project_id = ?", "p").Scan(&count); err != nil {
+		t.Fatalf("counting occurrences failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("found %d occurrences, want 2", count)
+	}
+}
+
+func TestNewStartupPolicy(t *testing.T) {
+	tests := []struct {
+		cfg  config.MySQLConfig
+		want startupPolicy
+	}{
+		{config.MySQLConfig{}, startupPolicy{retries: defaultStartupRetries, interval: defaultStartupRetryInterval}},
+		{config.MySQLConfig{StartupRetries: 10, StartupRetryInterval: time.Second}, startupPolicy{retries: 10, interval: time.Second}},
+		{config.MySQLConfig{StartupRetries: -1}, startupPolicy{retries: 0, interval: defaultStartupRetryInterval}},
+	}
+	for _, tt := range tests {
+		if got := newStartupPolicy(&tt.cfg); got != tt.want {
+			t.Errorf("newStartupPolicy(%+v) = %+v, want %+v", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestStartupPingRetries(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	d.pingFailures = 2
+	logger := &capturingLogger{}
+	startup := startupPolicy{retries: 3, interval: time.Millisecond}
+	if err := startup.do(logger, pg.DB.Ping); err != nil {
+		t.Fatalf("startup.do(Ping) failed: %v", err)
+	}
+	if d.pings != 3 {
+		t.Errorf("pinged %d times, want 3", d.pings)
+	}
+	if len(logger.infos) != 2 {
+		t.Errorf("logged %q, want the two failed attempts", logger.infos)
+	}
+}
+
+func TestStartupPingGivesUp(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	d.pingFailures = 10
+	startup := startupPolicy{retries: 2, interval: time.Millisecond}
+	err := startup.do(&capturingLogger{}, pg.DB.Ping)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("startup.do(Ping) got %v, want an error after 3 attempts", err)
+	}
+	if d.pings != 3 {
+		t.Errorf("pinged %d times, want 3", d.pings)
+	}
+}
+
+func TestMyscreateDatabase(t *testing.T) {
+	cfg := testConfig(t)
+	source, err := sourceString(cfg, cfg.Host, cfg.Port, "mysql")
+	if err != nil {
+		t.Fatalf("sourceString() failed: %v", err)
+	}
+	db, err := sql.Open("mysql", source)
+	if err != nil {
+		t.Fatalf("sql.Open() failed: %v", err)
+	}
+	defer db.Close()
+	defer db.Exec("DROP DATABASE " + quoteIdent(cfg.DbName))
+
+	exists := func() bool {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM information_schema.schemata WHERE schema_name = ?", cfg.DbName).Scan(&count); err != nil {
+			t.Fatalf("querying schemata failed: %v", err)
+		}
+		return count == 1
+	}
+	if exists() {
+		t.Fatalf("database %s exists before the test", cfg.DbName)
+	}
+	if err := myscreateDatabase(source, cfg.DbName, defaultCharset, defaultCollation); err != nil {
+		t.Fatalf("myscreateDatabase() of a missing database failed: %v", err)
+	}
+	if !exists() {
+		t.Errorf("myscreateDatabase() did not create %s", cfg.DbName)
+	}
+	// Creating the database again would fail if it were not found.
+	if err := myscreateDatabase(source, cfg.DbName, defaultCharset, defaultCollation); err != nil {
+		t.Errorf("myscreateDatabase() of an existing database failed: %v", err)
+	}
+}
+
+func TestNoteRoundTripsUTF8(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	description := "Vulnérabilité critique 🔒 — 修正済み"
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{ShortDescription: description}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	n, err := pg.GetNote(ctx, "p", "n")
+	if err != nil {
+		t.Fatalf("GetNote() failed: %v", err)
+	}
+	if n.ShortDescription != description {
+		t.Errorf("ShortDescription = %q, want %q", n.ShortDescription, description)
+	}
+	var charset string
+	if err := pg.DB.QueryRow("SELECT @@character_set_database").Scan(&charset); err != nil {
+		t.Fatalf("reading database charset failed: %v", err)
+	}
+	if charset != defaultCharset {
+		t.Errorf("database charset = %q, want %q", charset, defaultCharset)
+	}
+}
+
+func TestSourceStringLoc(t *testing.T) {
+	tests := []struct {
+		loc  string
+		want string
+	}{
+		{"", "UTC"},
+		{"UTC", "UTC"},
+		{"Europe/Paris", "Europe/Paris"},
+	}
+	for _, tt := range tests {
+		source, err := sourceString(&config.MySQLConfig{Loc: tt.loc}, "db", 3306, "grafeas")
+		if err != nil {
+			t.Errorf("sourceString(loc %q) failed: %v", tt.loc, err)
+			continue
+		}
+		cfg, err := mysql.ParseDSN(source)
+		if err != nil {
+			t.Errorf("ParseDSN(%q) failed: %v", source, err)
+			continue
+		}
+		if !cfg.ParseTime || cfg.Loc.String() != tt.want {
+			t.Errorf("sourceString(loc %q) = %q, want parseTime with loc %s", tt.loc, source, tt.want)
+		}
+	}
+	if _, err := sourceString(&config.MySQLConfig{Loc: "Nowhere/Special"}, "db", 3306, "grafeas"); err == nil {
+		t.Error("sourceString() with an unknown loc succeeded, want error")
+	}
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	pg := newTestStore(t, nil)
+	if _, err := pg.DB.Exec("CREATE TEMPORARY TABLE times (t DATETIME(6))"); err != nil {
+		t.Fatalf("creating table failed: %v", err)
+	}
+	want := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.FixedZone("CET", 3600))
+	if _, err := pg.DB.Exec("INSERT INTO times VALUES (?)", want); err != nil {
+		t.Fatalf("inserting time failed: %v", err)
+	}
+	var got time.Time
+	var text string
+	if err := pg.DB.QueryRow("SELECT t, CAST(t AS CHAR) FROM times").Scan(&got, &text); err != nil {
+		t.Fatalf("reading time failed: %v", err)
+	}
+	if !got.Equal(want) || got.Location() != time.UTC {
+		t.Errorf("read %v, want %v in UTC", got, want)
+	}
+	if text != "2024-01-02 02:04:05.000006" {
+		t.Errorf("stored %q, want the UTC time", text)
+	}
+}
+
+func TestSourceStringTimeouts(t *testing.T) {
+	tests := []struct {
+		cfg    config.MySQLConfig
+		params []string
+	}{
+		{config.MySQLConfig{}, []string{"timeout=10s", "readTimeout=30s", "writeTimeout=30s"}},
+		{config.MySQLConfig{DialTimeout: time.Second, ReadTimeout: 5 * time.Second, WriteTimeout: time.Minute},
+			[]string{"timeout=1s", "readTimeout=5s", "writeTimeout=1m0s"}},
+	}
+	for _, tt := range tests {
+		source, err := sourceString(&tt.cfg, "db", 3306, "grafeas")
+		if err != nil {
+			t.Errorf("sourceString(%+v) failed: %v", tt.cfg, err)
+			continue
+		}
+		for _, param := range tt.params {
+			if !strings.Contains(source, param) {
+				t.Errorf("sourceString(%+v) = %q, want it to contain %s", tt.cfg, source, param)
+			}
+		}
+	}
+}
+
+func TestIterateOccurrences(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxPageSize = 3
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	want := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		want[o.Name] = true
+	}
+	seen := map[string]int{}
+	err := pg.IterateOccurrences(ctx, "p", "", func(o *pb.Occurrence) error {
+		seen[o.Name]++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateOccurrences() failed: %v", err)
+	}
+	if len(seen) != len(want) {
+		t.Errorf("IterateOccurrences() saw %d occurrences, want %d", len(seen), len(want))
+	}
+	for name, count := range seen {
+		if !want[name] || count != 1 {
+			t.Errorf("IterateOccurrences() saw %s %d times, want once", name, count)
+		}
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = pg.IterateOccurrences(ctx, "p", "", func(o *pb.Occurrence) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("IterateOccurrences() = %v after %d calls, want %v after 1", err, calls, stop)
+	}
+}
+
+func TestListNoteOccurrencesFilter(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	occs := []*pb.Occurrence{
+		{NoteName: "projects/p/notes/n", Resource: &pb.Resource{Uri: "https://gcr.io/p/a"}},
+		{NoteName: "projects/p/notes/n", Resource: &pb.Resource{Uri: "https://gcr.io/p/b"}},
+		{NoteName: "projects/p/notes/other", Resource: &pb.Resource{Uri: "https://gcr.io/p/a"}},
+	}
+	for _, o := range occs {
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", o); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"", []string{"https://gcr.io/p/a", "https://gcr.io/p/b"}},
+		{`resourceUrl="https://gcr.io/p/a"`, []string{"https://gcr.io/p/a"}},
+	}
+	for _, tt := range tests {
+		os, _, err := pg.ListNoteOccurrences(ctx, "p", "n", tt.filter, "", 10)
+		if err != nil {
+			t.Fatalf("ListNoteOccurrences(%q) failed: %v", tt.filter, err)
+		}
+		var got []string
+		for _, o := range os {
+			got = append(got, o.Resource.Uri)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ListNoteOccurrences(%q) returned resources %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteOccurrencesByNote(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	for i, noteName := range []string{
+		"projects/p/notes/n", "projects/p/notes/n", "projects/p/notes/other", "projects/p/notes/n",
+	} {
+		pID := fmt.Sprintf("p%d", i%2)
+		if _, err := pg.CreateOccurrence(ctx, pID, "u", &pb.Occurrence{NoteName: noteName}); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	count, err := pg.DeleteOccurrencesByNote(ctx, "p", "n")
+	if err != nil {
+		t.Fatalf("DeleteOccurrencesByNote() failed: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("DeleteOccurrencesByNote() = %d, want 3", count)
+	}
+	var remaining int
+	if err := pg.DB.QueryRow("SELECT COUNT(*) FROM occurrences WHERE note_id = ?", "n").Scan(&remaining); err != nil {
+		t.Fatalf("counting occurrences failed: %v", err)
+	}
+	if remaining != 0 {
+		t.Errorf("%d occurrences of the note remain, want 0", remaining)
+	}
+	if count, err := pg.DeleteOccurrencesByNote(ctx, "p", "n"); err != nil || count != 0 {
+		t.Errorf("DeleteOccurrencesByNote() again = %d, %v; want 0, nil", count, err)
+	}
+	os, _, err := pg.ListOccurrences(ctx, "p0", "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	if len(os) != 1 || os[0].NoteName != "projects/p/notes/other" {
+		t.Errorf("ListOccurrences() = %v, want only the occurrence of the other note", os)
+	}
+}
+
+func TestDeleteNotePreventsOrphanedOccurrences(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.PreventOrphanedOccurrences = true
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	if err := pg.DeleteNote(ctx, "p", "n"); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("DeleteNote() with occurrences got %v, want FailedPrecondition", err)
+	}
+	if _, err := pg.GetNote(ctx, "p", "n"); err != nil {
+		t.Errorf("GetNote() after blocked delete failed: %v", err)
+	}
+
+	_, oID, _ := name.ParseOccurrence(o.Name)
+	if err := pg.DeleteOccurrence(ctx, "p", oID); err != nil {
+		t.Fatalf("DeleteOccurrence() failed: %v", err)
+	}
+	if err := pg.DeleteNote(ctx, "p", "n"); err != nil {
+		t.Errorf("DeleteNote() without occurrences failed: %v", err)
+	}
+	if err := pg.DeleteNote(ctx, "p", "n"); status.Code(err) != codes.NotFound {
+		t.Errorf("DeleteNote() of deleted note got %v, want NotFound", err)
+	}
+}
+
+func TestDeleteNoteAndOccurrences(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.PreventOrphanedOccurrences = true
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"}); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	if err := pg.DeleteNoteAndOccurrences(ctx, "p", "n"); err != nil {
+		t.Fatalf("DeleteNoteAndOccurrences() failed: %v", err)
+	}
+	if _, err := pg.GetNote(ctx, "p", "n"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetNote() after delete got %v, want NotFound", err)
+	}
+	if os, _, err := pg.ListOccurrences(ctx, "p", "", "", 10); err != nil || len(os) != 0 {
+		t.Errorf("ListOccurrences() after delete = %v, %v; want no occurrences", os, err)
+	}
+	if err := pg.DeleteNoteAndOccurrences(ctx, "p", "n"); status.Code(err) != codes.NotFound {
+		t.Errorf("DeleteNoteAndOccurrences() of deleted note got %v, want NotFound", err)
+	}
+}
+
+func TestCreateOccurrenceStrictNoteReferences(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StrictNoteReferences = true
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	tests := []struct {
+		noteName string
+		want     codes.Code
+	}{
+		{"projects/p/notes/n", codes.OK},
+		{"not-a-note-name", codes.InvalidArgument},
+		{"projects/p/notes/missing", codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: tt.noteName}); status.Code(err) != tt.want {
+			t.Errorf("CreateOccurrence() of note %q got %v, want %v", tt.noteName, err, tt.want)
+		}
+	}
+	occs := []*pb.Occurrence{{NoteName: "projects/p/notes/n"}, {NoteName: "projects/p/notes/missing"}}
+	if _, errs := pg.BatchCreateOccurrences(ctx, "p", "u", occs); len(errs) != 1 || status.Code(errs[0]) != codes.FailedPrecondition {
+		t.Errorf("BatchCreateOccurrences() with a missing note got %v, want FailedPrecondition", errs)
+	}
+}
+
+func TestCreateOccurrenceMissingNoteAllowedByDefault(t *testing.T) {
+	pg := newTestStore(t, nil)
+	if _, err := pg.CreateOccurrence(context.Background(), "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/missing"}); err != nil {
+		t.Errorf("CreateOccurrence() of a missing note failed: %v", err)
+	}
+}
+
+func TestIterateNotes(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxPageSize = 3
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	var want []string
+	for i := 0; i < 10; i++ {
+		n, err := pg.CreateNote(ctx, "p", fmt.Sprintf("n%02d", i), "u", &pb.Note{})
+		if err != nil {
+			t.Fatalf("CreateNote() failed: %v", err)
+		}
+		want = append(want, n.Name)
+	}
+	var got []string
+	err := pg.IterateNotes(ctx, "p", "", func(n *pb.Note) error {
+		got = append(got, n.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("IterateNotes() failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IterateNotes() visited %v, want %v", got, want)
+	}
+
+	ns, err := pg.ListAllNotes(ctx, "p", "")
+	if err != nil {
+		t.Fatalf("ListAllNotes() failed: %v", err)
+	}
+	got = nil
+	for _, n := range ns {
+		got = append(got, n.Name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListAllNotes() = %v, want %v", got, want)
+	}
+}
+
+func TestListWithCount(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	for i := 0; i < 7; i++ {
+		uri := fmt.Sprintf("https://gcr.io/p/image%d", i%2)
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n", Resource: &pb.Resource{Uri: uri}}); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	tests := []struct {
+		filter string
+		want   int64
+	}{
+		{"", 7},
+		{`resourceUrl="https://gcr.io/p/image0"`, 4},
+		{`resourceUrl="https://gcr.io/p/missing"`, 0},
+	}
+	for _, tt := range tests {
+		for _, pageSize := range []int32{1, 3, 100} {
+			_, _, total, err := pg.ListOccurrencesWithCount(ctx, "p", tt.filter, "", pageSize)
+			if err != nil {
+				t.Fatalf("ListOccurrencesWithCount(%q, %d) failed: %v", tt.filter, pageSize, err)
+			}
+			if total != tt.want {
+				t.Errorf("ListOccurrencesWithCount(%q, %d) total = %d, want %d", tt.filter, pageSize, total, tt.want)
+			}
+			_, _, total, err = pg.ListNoteOccurrencesWithCount(ctx, "p", "n", tt.filter, "", pageSize)
+			if err != nil {
+				t.Fatalf("ListNoteOccurrencesWithCount(%q, %d) failed: %v", tt.filter, pageSize, err)
+			}
+			if total != tt.want {
+				t.Errorf("ListNoteOccurrencesWithCount(%q, %d) total = %d, want %d", tt.filter, pageSize, total, tt.want)
+			}
+		}
+	}
+
+	ns, _, total, err := pg.ListNotesWithCount(ctx, "p", "", "", 10)
+	if err != nil {
+		t.Fatalf("ListNotesWithCount() failed: %v", err)
+	}
+	if len(ns) != 1 || total != 1 {
+		t.Errorf("ListNotesWithCount() returned %d notes, total %d, want 1, 1", len(ns), total)
+	}
+}
+
+func TestListWithApproximateCount(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ApproximateCounts = true
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	if _, errs := pg.BatchCreateOccurrences(ctx, "p", "u", batchOccurrences(100)); len(errs) != 0 {
+		t.Fatalf("BatchCreateOccurrences() failed: %v", errs)
+	}
+	if _, err := pg.DB.Exec("ANALYZE TABLE occurrences"); err != nil {
+		t.Fatalf("ANALYZE TABLE failed: %v", err)
+	}
+	os, _, total, err := pg.ListOccurrencesWithCount(ctx, "p", "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrencesWithCount() failed: %v", err)
+	}
+	if len(os) != 10 {
+		t.Errorf("ListOccurrencesWithCount() returned %d occurrences, want 10", len(os))
+	}
+	if total < 50 || total > 200 {
+		t.Errorf("ListOccurrencesWithCount() total = %d, want an estimate of 100", total)
+	}
+}
+
+// BenchmarkListOccurrencesWithCount compares listing a page of the occurrences of a
+// large project with an exact and an approximate total count.
+func BenchmarkListOccurrencesWithCount(b *testing.B) {
+	for _, approximate := range []bool{false, true} {
+		b.Run(fmt.Sprintf("approximate=%v", approximate), func(b *testing.B) {
+			cfg := testConfig(b)
+			cfg.ApproximateCounts = approximate
+			pg := newTestStore(b, cfg)
+			ctx := context.Background()
+			occs := batchOccurrences(500)
+			for i := 0; i < 100; i++ {
+				if _, errs := pg.BatchCreateOccurrences(ctx, "p", "u", occs); len(errs) != 0 {
+					b.Fatalf("BatchCreateOccurrences() failed: %v", errs)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, _, err := pg.ListOccurrencesWithCount(ctx, "p", "", "", 20); err != nil {
+					b.Fatalf("ListOccurrencesWithCount() failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateOccurrenceWithID(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := WithOccurrenceID(context.Background(), "scan-42")
+	created, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n", Remediation: "first"})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	if want := "projects/p/occurrences/scan-42"; created.Name != want {
+		t.Errorf("CreateOccurrence() name = %q, want %q", created.Name, want)
+	}
+
+	got, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n", Remediation: "retry"})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("CreateOccurrence() with a used ID got %v, want AlreadyExists", err)
+	}
+	if got == nil || got.Name != created.Name || got.Remediation != "first" {
+		t.Errorf("CreateOccurrence() with a used ID returned %v, want the original %v", got, created)
+	}
+	os, _, err := pg.ListOccurrences(context.Background(), "p", "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	if len(os) != 1 {
+		t.Errorf("found %d occurrences after a duplicate create, want 1", len(os))
+	}
+}
+
+func TestCreateOccurrenceInvalidID(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	for _, oID := range []string{"-leading-dash", "has/slash", "has space", strings.Repeat("a", 37)} {
+		ctx := WithOccurrenceID(context.Background(), oID)
+		if _, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateOccurrence() with ID %q got %v, want InvalidArgument", oID, err)
+		}
+	}
+	if d.execs != 0 {
+		t.Errorf("CreateOccurrence() with invalid IDs ran %d statements, want 0", d.execs)
+	}
+}
+
+func TestCompressedDocumentsRoundTrip(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CompressDocuments = true
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	o := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)
+	o.Remediation = strings.Repeat("upgrade ", 1000)
+	created, err := pg.CreateOccurrence(ctx, "p", "u", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, err := name.ParseOccurrence(created.Name)
+	if err != nil {
+		t.Fatalf("ParseOccurrence() failed: %v", err)
+	}
+	var details []byte
+	if err := pg.DB.QueryRow("SELECT compressed_details FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&details); err != nil {
+		t.Fatalf("querying compressed_details failed: %v", err)
+	}
+	if len(details) == 0 || details[0] != detailsGzip {
+		t.Errorf("stored details %q, want gzip-compressed details", details)
+	}
+	got, err := pg.GetOccurrence(ctx, "p", oID)
+	if err != nil {
+		t.Fatalf("GetOccurrence() failed: %v", err)
+	}
+	if !proto.Equal(got, created) {
+		t.Errorf("GetOccurrence() = %v, want %v", got, created)
+	}
+	// Fields outside the details can still be filtered on.
+	os, _, err := pg.ListOccurrences(ctx, "p", `resource_url="https://gcr.io/p/a"`, "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	if len(os) != 1 || !proto.Equal(os[0], created) {
+		t.Errorf("ListOccurrences() = %v, want [%v]", os, created)
+	}
+
+	n, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{ShortDescription: "note", Type: &pb.Note_Vulnerability{Vulnerability: &vulnpb.Vulnerability{CvssScore: 7.5}}})
+	if err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	gotNote, err := pg.GetNote(ctx, "p", "n")
+	if err != nil {
+		t.Fatalf("GetNote() failed: %v", err)
+	}
+	if !proto.Equal(gotNote, n) {
+		t.Errorf("GetNote() = %v, want %v", gotNote, n)
+	}
+}
+
+func TestUncompressedDocumentsReadWithCompression(t *testing.T) {
+	cfg := testConfig(t)
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	created, err := pg.CreateOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, err := name.ParseOccurrence(created.Name)
+	if err != nil {
+		t.Fatalf("ParseOccurrence() failed: %v", err)
+	}
+
+	pg.compressDocuments = true
+	got, err := pg.GetOccurrence(ctx, "p", oID)
+	if err != nil {
+		t.Fatalf("GetOccurrence() failed: %v", err)
+	}
+	if !proto.Equal(got, created) {
+		t.Errorf("GetOccurrence() of an uncompressed occurrence = %v, want %v", got, created)
+	}
+}
+
+func TestUnmarshalStored(t *testing.T) {
+	want := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)
+	pg := &MySQLStore{compressDocuments: true}
+	data, details, err := pg.marshalStored(want)
+	if err != nil {
+		t.Fatalf("marshalStored() failed: %v", err)
+	}
+	if strings.Contains(data, "vulnerability") {
+		t.Errorf("marshalStored() data %s holds the details", data)
+	}
+	legacy, err := marshalDocument(want)
+	if err != nil {
+		t.Fatalf("marshalDocument() failed: %v", err)
+	}
+	plainDetails, err := marshalDocument(&pb.Occurrence{Details: want.Details})
+	if err != nil {
+		t.Fatalf("marshalDocument() failed: %v", err)
+	}
+	tests := []struct {
+		desc    string
+		data    string
+		details []byte
+	}{
+		{"gzip", data, details},
+		{"uncompressed row", legacy, nil},
+		{"uncompressed details", data, append([]byte{detailsJSON}, plainDetails...)},
+	}
+	for _, tt := range tests {
+		var got pb.Occurrence
+		if err := pg.unmarshalStored(tt.data, tt.details, &got); err != nil {
+			t.Errorf("unmarshalStored() of %s failed: %v", tt.desc, err)
+			continue
+		}
+		if !proto.Equal(&got, want) {
+			t.Errorf("unmarshalStored() of %s = %v, want %v", tt.desc, &got, want)
+		}
+	}
+	var got pb.Occurrence
+	if err := pg.unmarshalStored(data, []byte{9, 0}, &got); err == nil {
+		t.Error("unmarshalStored() of an unknown format succeeded, want an error")
+	}
+}
+
+func TestEncryptedDetails(t *testing.T) {
+	var oldKey, newKey fernet.Key
+	if err := oldKey.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	if err := newKey.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	want := vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true)
+	plain, err := marshalDocument(want)
+	if err != nil {
+		t.Fatalf("marshalDocument() failed: %v", err)
+	}
+	for _, compress := range []bool{false, true} {
+		old := &MySQLStore{compressDocuments: compress, dataKeys: []*fernet.Key{&oldKey}}
+		data, details, err := old.marshalStored(want)
+		if err != nil {
+			t.Fatalf("marshalStored() failed: %v", err)
+		}
+		if len(details) == 0 || details[0] != detailsFernet {
+			t.Fatalf("marshalStored() details = %q, want encrypted details", details)
+		}
+		if strings.Contains(data, "vulnerability") || strings.Contains(string(details), "openssl") {
+			t.Errorf("marshalStored() = %s, %q, want the details encrypted", data, details)
+		}
+
+		// Rows with only their details encrypted, as written by earlier versions.
+		rest, onlyDetails := splitDetails(want)
+		restData, err := marshalDocument(rest)
+		if err != nil {
+			t.Fatalf("marshalDocument() failed: %v", err)
+		}
+		detailsData, err := marshalDocument(onlyDetails)
+		if err != nil {
+			t.Fatalf("marshalDocument() failed: %v", err)
+		}
+		encodedDetails, err := old.encodeDetails(detailsData)
+		if err != nil {
+			t.Fatalf("encodeDetails() failed: %v", err)
+		}
+		encryptedDetails, err := old.encryptDetails(encodedDetails)
+		if err != nil {
+			t.Fatalf("encryptDetails() failed: %v", err)
+		}
+
+		// Rows encrypted with a rotated key are read with the secondary keys, and rows
+		// written without a data key are read as before.
+		rotated := &MySQLStore{dataKeys: []*fernet.Key{&newKey, &oldKey}}
+		for desc, row := range map[string][]interface{}{
+			"encrypted with the old key":  {data, details},
+			"with only details encrypted": {restData, encryptedDetails},
+			"unencrypted":                 {plain, []byte(nil)},
+		} {
+			var got pb.Occurrence
+			if err := rotated.unmarshalStored(row[0].(string), row[1].([]byte), &got); err != nil {
+				t.Errorf("unmarshalStored() of a row %s failed: %v", desc, err)
+				continue
+			}
+			if !proto.Equal(&got, want) {
+				t.Errorf("unmarshalStored() of a row %s = %v, want %v", desc, &got, want)
+			}
+		}
+
+		var got pb.Occurrence
+		for _, pg := range []*MySQLStore{{}, {dataKeys: []*fernet.Key{&newKey}}} {
+			if err := pg.unmarshalStored(data, details, &got); err == nil {
+				t.Errorf("unmarshalStored() with data keys %v succeeded, want an error", pg.dataKeys)
+			}
+		}
+	}
+}
+
+func TestNewDataKeys(t *testing.T) {
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	tests := []struct {
+		cfg     config.MySQLConfig
+		keys    int
+		wantErr bool
+	}{
+		{cfg: config.MySQLConfig{}},
+		{cfg: config.MySQLConfig{DataKey: key.Encode()}, keys: 1},
+		{cfg: config.MySQLConfig{DataKey: key.Encode(), SecondaryDataKeys: []string{key.Encode()}}, keys: 2},
+		{cfg: config.MySQLConfig{DataKey: "not a key"}, wantErr: true},
+		{cfg: config.MySQLConfig{DataKey: key.Encode(), SecondaryDataKeys: []string{"not a key"}}, wantErr: true},
+		{cfg: config.MySQLConfig{SecondaryDataKeys: []string{key.Encode()}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		keys, err := newDataKeys(&tt.cfg)
+		if (err != nil) != tt.wantErr || len(keys) != tt.keys {
+			t.Errorf("newDataKeys(%+v) = %d keys, %v, want %d keys, error %v", tt.cfg, len(keys), err, tt.keys, tt.wantErr)
+		}
+	}
+}
+
+func TestEncryptedDocumentsRoundTrip(t *testing.T) {
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	cfg := testConfig(t)
+	cfg.DataKey = key.Encode()
+	pg := newTestStore(t, cfg)
+	ctx := ReadFromPrimary(context.Background())
+	created, err := pg.CreateOccurrence(ctx, "p", "u", vulnerabilityOccurrence("https://gcr.io/p/a", vulnpb.Severity_HIGH, true))
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, err := name.ParseOccurrence(created.Name)
+	if err != nil {
+		t.Fatalf("ParseOccurrence() failed: %v", err)
+	}
+	var data string
+	var details []byte
+	if err := pg.DB.QueryRow("SELECT data, compressed_details FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&data, &details); err != nil {
+		t.Fatalf("reading the stored occurrence failed: %v", err)
+	}
+	if strings.Contains(data, "openssl") || strings.Contains(string(details), "openssl") {
+		t.Errorf("stored occurrence %s, %q holds the details in plaintext", data, details)
+	}
+	got, err := pg.GetOccurrence(ctx, "p", oID)
+	if err != nil {
+		t.Fatalf("GetOccurrence() failed: %v", err)
+	}
+	if !proto.Equal(got, created) {
+		t.Errorf("GetOccurrence() = %v, want %v", got, created)
+	}
+
+	// Occurrences without details and notes are encrypted whole, too.
+	remediated, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{
+		NoteName:    "projects/p/notes/secret-note",
+		Resource:    &pb.Resource{Uri: "https://gcr.io/p/secret-image"},
+		Remediation: "rotate the secret-credentials",
+	})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, _ = name.ParseOccurrence(remediated.Name)
+	if err := pg.DB.QueryRow("SELECT data, compressed_details FROM occurrences WHERE occurrence_id = ?", occurrenceIDValue(oID)).Scan(&data, &details); err != nil {
+		t.Fatalf("reading the stored occurrence failed: %v", err)
+	}
+	if strings.Contains(data, "secret") || len(details) == 0 || details[0] != detailsFernet {
+		t.Errorf("stored occurrence %s, %q is not encrypted", data, details)
+	}
+	got, err = pg.GetOccurrence(ctx, "p", oID)
+	if err != nil {
+		t.Fatalf("GetOccurrence() failed: %v", err)
+	}
+	if !proto.Equal(got, remediated) {
+		t.Errorf("GetOccurrence() = %v, want %v", got, remediated)
+	}
+
+	n, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{
+		ShortDescription: "secret short description",
+		LongDescription:  "secret long description",
+		Type:             &pb.Note_Vulnerability{Vulnerability: &vulnpb.Vulnerability{CvssScore: 7.5, Severity: vulnpb.Severity_HIGH}},
+	})
+	if err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	var severity sql.NullInt64
+	if err := pg.DB.QueryRow("SELECT data, compressed_details, severity FROM notes WHERE note_id = ?", "n").Scan(&data, &details, &severity); err != nil {
+		t.Fatalf("reading the stored note failed: %v", err)
+	}
+	if strings.Contains(data, "secret") || strings.Contains(data, "7.5") {
+		t.Errorf("stored note data %s holds fields in plaintext", data)
+	}
+	if len(details) == 0 || details[0] != detailsFernet {
+		t.Errorf("stored note details = %q, want an encrypted note", details)
+	}
+	if severity.Int64 != int64(vulnpb.Severity_HIGH) {
+		t.Errorf("stored note severity = %v, want the indexed severity %d", severity, vulnpb.Severity_HIGH)
+	}
+	gotNote, err := pg.GetNote(ctx, "p", "n")
+	if err != nil {
+		t.Fatalf("GetNote() failed: %v", err)
+	}
+	if !proto.Equal(gotNote, n) {
+		t.Errorf("GetNote() = %v, want %v", gotNote, n)
+	}
+}
+
+func TestEncryptedUpsertKeepsName(t *testing.T) {
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	cfg := testConfig(t)
+	cfg.DataKey = key.Encode()
+	pg := newTestStore(t, cfg)
+	ctx := ReadFromPrimary(context.Background())
+	o := &pb.Occurrence{
+		NoteName:    "projects/p/notes/n",
+		Resource:    &pb.Resource{Uri: "https://gcr.io/p/a"},
+		Remediation: "first",
+	}
+	first, err := pg.UpsertOccurrence(ctx, "p", "u", o)
+	if err != nil {
+		t.Fatalf("UpsertOccurrence() failed: %v", err)
+	}
+	o.Remediation = "second"
+	if _, err := pg.UpsertOccurrence(ctx, "p", "u", o); err != nil {
+		t.Fatalf("second UpsertOccurrence() failed: %v", err)
+	}
+	os, _, err := pg.ListOccurrences(ctx, "p", "", "", 10)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	if len(os) != 1 || os[0].Name != first.Name || os[0].Remediation != "second" {
+		t.Errorf("ListOccurrences() = %s, want [%s] with the second remediation", describe(os), first.Name)
+	}
+}
+
+func TestListedNamesFromOccurrenceID(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := ReadFromPrimary(context.Background())
+	o := searchOccurrence("https://gcr.io/q/a", "Heap overflow in libpng", "", "")
+	o.NoteName = "projects/p/notes/n"
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	created, err := pg.CreateOccurrence(ctx, "q", "u", o)
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	// The name in the data is not the occurrence's.
+	if _, err := pg.DB.Exec(`UPDATE occurrences SET data = JSON_SET(data, '$.name', 'projects/q/occurrences/stale')`); err != nil {
+		t.Fatalf("changing the stored name failed: %v", err)
+	}
+
+	check := func(method string, os []*pb.Occurrence, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s() failed: %v", method, err)
+		}
+		if len(os) != 1 || os[0].Name != created.Name {
+			t.Errorf("%s() = %s, want [%s]", method, describe(os), created.Name)
+		}
+	}
+	os, _, err := pg.ListOccurrences(ctx, "q", "", "", 10)
+	check("ListOccurrences", os, err)
+	os, _, err = pg.ListRecentOccurrences(ctx, "q", "", "", 10)
+	check("ListRecentOccurrences", os, err)
+	os, _, err = pg.ListNoteOccurrences(ctx, "p", "n", "", "", 10)
+	check("ListNoteOccurrences", os, err)
+	os, err = pg.SearchOccurrences(ctx, "q", "libpng", 10)
+	check("SearchOccurrences", os, err)
+}
+
+func TestGetOccurrenceForUpdateLocksRow(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	created, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, err := name.ParseOccurrence(created.Name)
+	if err != nil {
+		t.Fatalf("ParseOccurrence() failed: %v", err)
+	}
+
+	locked := make(chan struct{}, 1)
+	release := make(chan struct{})
+	first := make(chan error, 1)
+	go func() {
+		first <- pg.WithTx(ctx, func(tx *sql.Tx) error {
+			if _, err := pg.GetOccurrenceForUpdate(ctx, tx, "p", oID); err != nil {
+				return err
+			}
+			select {
+			case locked <- struct{}{}:
+			default:
+			}
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+
+	second := make(chan error, 1)
+	go func() {
+		second <- pg.WithTx(ctx, func(tx *sql.Tx) error {
+			_, err := pg.GetOccurrenceForUpdate(ctx, tx, "p", oID)
+			return err
+		})
+	}()
+	select {
+	case err := <-second:
+		t.Fatalf("second GetOccurrenceForUpdate() returned %v while the row was locked, want it to block", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	if err := <-first; err != nil {
+		t.Errorf("first transaction failed: %v", err)
+	}
+	if err := <-second; err != nil {
+		t.Errorf("second GetOccurrenceForUpdate() failed after the first committed: %v", err)
+	}
+
+	err = pg.WithTx(ctx, func(tx *sql.Tx) error {
+		_, err := pg.GetOccurrenceForUpdate(ctx, tx, "p", "missing")
+		return err
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetOccurrenceForUpdate() of a missing occurrence got %v, want NotFound", err)
+	}
+}
+
+func TestGetOccurrences(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	want := map[string]*pb.Occurrence{}
+	var oIDs []string
+	for i := 0; i < 3; i++ {
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n", Remediation: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		_, oID, err := name.ParseOccurrence(o.Name)
+		if err != nil {
+			t.Fatalf("ParseOccurrence() failed: %v", err)
+		}
+		want[oID] = o
+		oIDs = append(oIDs, oID)
+	}
+	if _, err := pg.CreateOccurrence(ctx, "other", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"}); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+
+	got, err := pg.GetOccurrences(ctx, "p", append(oIDs, "missing", oIDs[0]))
+	if err != nil {
+		t.Fatalf("GetOccurrences() failed: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("GetOccurrences() returned %d occurrences, want %d", len(got), len(want))
+	}
+	for oID, o := range want {
+		if !proto.Equal(got[oID], o) {
+			t.Errorf("GetOccurrences()[%q] = %v, want %v", oID, got[oID], o)
+		}
+	}
+	if got, err := pg.GetOccurrences(ctx, "p", nil); err != nil || len(got) != 0 {
+		t.Errorf("GetOccurrences() of no IDs = %v, %v; want an empty map", got, err)
+	}
+}
+
+func TestGetOccurrencesChunksIDs(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	d.rows = [][]driver.Value{}
+	oIDs := make([]string, 2*maxInListIDs+1)
+	for i := range oIDs {
+		oIDs[i] = fmt.Sprint(i)
+	}
+	if _, err := pg.GetOccurrences(context.Background(), "p", oIDs); err != nil {
+		t.Fatalf("GetOccurrences() failed: %v", err)
+	}
+	if d.queries != 3 {
+		t.Errorf("GetOccurrences() of %d IDs ran %d queries, want 3", len(oIDs), d.queries)
+	}
+}
+
+func TestIdChunks(t *testing.T) {
+	ids := make([]string, maxInListIDs+1)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+	}
+	chunks := idChunks(append(ids, "0", "1"))
+	if len(chunks) != 2 || len(chunks[0]) != maxInListIDs || !reflect.DeepEqual(chunks[1], []string{fmt.Sprint(maxInListIDs)}) {
+		t.Errorf("idChunks() returned %d chunks of sizes %d, %d, want the IDs without duplicates in chunks of %d", len(chunks), len(chunks[0]), len(chunks[len(chunks)-1]), maxInListIDs)
+	}
+	if chunks := idChunks(nil); len(chunks) != 0 {
+		t.Errorf("idChunks(nil) = %v, want no chunks", chunks)
+	}
+}
+
+func TestInQuery(t *testing.T) {
+	query, args := inQuery(mysqlSearchOccurrences, "p", []string{"a", "b"})
+	if !strings.HasSuffix(query, "occurrence_id IN (?, ?)") {
+		t.Errorf("inQuery() = %q, want an IN list of 2 placeholders", query)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"p", "a", "b"}) {
+		t.Errorf("inQuery() args = %v, want [p a b]", args)
+	}
+	oID := uuid.New().String()
+	_, args = inOccurrencesQuery(mysqlSearchOccurrences, "p", []string{oID, "b"})
+	if !reflect.DeepEqual(args, []interface{}{"p", occurrenceIDValue(oID), []byte("b")}) {
+		t.Errorf("inOccurrencesQuery() args = %v, want the stored form of the IDs", args)
+	}
+}
+
+func TestGetNotes(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	want := map[string]*pb.Note{}
+	for _, nID := range []string{"a", "b", "c"} {
+		n, err := pg.CreateNote(ctx, "p", nID, "u", &pb.Note{ShortDescription: nID})
+		if err != nil {
+			t.Fatalf("CreateNote() failed: %v", err)
+		}
+		want[nID] = n
+	}
+	if _, err := pg.CreateNote(ctx, "other", "d", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+
+	got, err := pg.GetNotes(ctx, "p", []string{"a", "b", "a", "missing", "d", "c", "b"})
+	if err != nil {
+		t.Fatalf("GetNotes() failed: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("GetNotes() returned notes %v, want %v", got, want)
+	}
+	for nID, n := range want {
+		if !proto.Equal(got[nID], n) {
+			t.Errorf("GetNotes()[%q] = %v, want %v", nID, got[nID], n)
+		}
+	}
+}
+
+func TestGetNotesQueriesDuplicatesOnce(t *testing.T) {
+	pg, d := newFailingStore(t, nil, 0)
+	d.rows = [][]driver.Value{}
+	nIDs := make([]string, 2*maxInListIDs)
+	for i := range nIDs {
+		nIDs[i] = fmt.Sprint(i % maxInListIDs)
+	}
+	if _, err := pg.GetNotes(context.Background(), "p", nIDs); err != nil {
+		t.Fatalf("GetNotes() failed: %v", err)
+	}
+	if d.queries != 1 {
+		t.Errorf("GetNotes() of %d distinct IDs ran %d queries, want 1", maxInListIDs, d.queries)
+	}
+}
+
+// unprefixedTable matches references to the store's tables that have no tenant1_ prefix.
+var unprefixedTable = regexp.MustCompile(`(^|[^_\w])(projects|notes|occurrences|audit_log|schema_migrations)\b`)
+
+func TestPrefixTables(t *testing.T) {
+	queries := []string{
+		mysqlInsertProject, mysqlSearchProject, mysqlUpdateProject, mysqlDeleteProject, mysqlListProjects,
+		mysqlProjectCreateTime, mysqlDeleteProjectOccurrences, mysqlDeleteProjectNotes,
+		mysqlInsertOccurrence, mysqlUpsertOccurrence, mysqlSearchUpsertedOccurrence, mysqlSearchOccurrence,
+		mysqlSearchOccurrenceVersion, mysqlLockOccurrence, mysqlUpdateOccurrence, mysqlDeleteOccurrence,
+		mysqlDeleteOccurrences, mysqlDeleteExpiredOccurrences, mysqlListRecentOccurrences,
+		mysqlListOccurrences, mysqlCountOccurrences, mysqlSearchOccurrences, mysqlSummarizeVulnerabilityOccurrences,
+		mysqlFullTextSearchOccurrences, mysqlLikeSearchOccurrences, mysqlDeleteAllOccurrences, mysqlDeleteAllNotes,
+		mysqlLockProjectNoteOccurrence,
+		mysqlCountOccurrencesByKind,
+		mysqlInsertNote, mysqlSearchNote, mysqlNoteExists, mysqlLockNote, mysqlUpdateNote, mysqlDeleteNote, mysqlListNotes,
+		mysqlCountNotes, mysqlSearchNotes, mysqlDeleteNoteOccurrences, mysqlLockNoteOccurrence,
+		mysqlListNoteOccurrences, mysqlCountNoteOccurrences, mysqlInsertAuditEvents, mysqlListAuditEvents,
+		mysqlCreateSchemaMigrations, mysqlSchemaVersion, mysqlInsertMigration,
+	}
+	for _, m := range mysqlMigrations {
+		queries = append(append(queries, m.statements...), m.optional...)
+	}
+	for _, query := range queries {
+		prefixed := prefixTables("tenant1_", query)
+		if loc := unprefixedTable.FindStringIndex(prefixed); loc != nil {
+			t.Errorf("prefixTables(%q) = %q, which has an unprefixed table at %q", query, prefixed, prefixed[loc[0]:loc[1]])
+		}
+		if !strings.Contains(prefixed, "tenant1_") {
+			t.Errorf("prefixTables(%q) = %q, want a prefixed table", query, prefixed)
+		}
+		if got := prefixTables("", query); got != query {
+			t.Errorf("prefixTables(\"\", %q) = %q, want the query unchanged", query, got)
+		}
+	}
+	if got, want := prefixTables("t_", "CREATE INDEX occurrences_note ON occurrences (note_id)"), "CREATE INDEX occurrences_note ON `t_occurrences` (note_id)"; got != want {
+		t.Errorf("prefixTables() = %q, want %q", got, want)
+	}
+}
+
+func TestSchemaStatement(t *testing.T) {
+	schema := mysqlSchema{prefix: "t_", charset: "utf8mb4", collation: "utf8mb4_bin"}
+	got := schema.statement("CREATE TABLE IF NOT EXISTS notes (id BIGINT) " + mysqlTableOptions)
+	if want := "CREATE TABLE IF NOT EXISTS `t_notes` (id BIGINT) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin"; got != want {
+		t.Errorf("statement() = %q, want %q", got, want)
+	}
+	for _, query := range mysqlCreateTables {
+		if !strings.HasSuffix(query, mysqlTableOptions) {
+			t.Errorf("table created by %q has no table options", query)
+		}
+	}
+}
+
+func TestQuoteIdent(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"occurrences", "`occurrences`"},
+		{"", "``"},
+		// Reserved words are identifiers once quoted.
+		{"select", "`select`"},
+		{"order", "`order`"},
+		{"foo`bar", "`foo``bar`"},
+		{"`", "````"},
+		{"a`; DROP TABLE notes; --", "`a``; DROP TABLE notes; --`"},
+		{"grafeas db", "`grafeas db`"},
+	}
+	for _, tt := range tests {
+		if got := quoteIdent(tt.name); got != tt.want {
+			t.Errorf("quoteIdent(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	// Even a prefix rejected by checkTablePrefix stays within the quoted names.
+	got := prefixTables("foo`bar", "DELETE FROM notes WHERE project_id = ?")
+	if want := "DELETE FROM `foo``barnotes` WHERE project_id = ?"; got != want {
+		t.Errorf("prefixTables(foo`bar) = %q, want %q", got, want)
+	}
+}
+
+func TestCheckTablePrefix(t *testing.T) {
+	for _, prefix := range []string{"", "tenant1_", "T_2"} {
+		if err := checkTablePrefix(prefix); err != nil {
+			t.Errorf("checkTablePrefix(%q) failed: %v", prefix, err)
+		}
+	}
+	for _, prefix := range []string{"tenant-1", "a b", "x`; DROP TABLE notes; --", strings.Repeat("a", 41)} {
+		if err := checkTablePrefix(prefix); err == nil {
+			t.Errorf("checkTablePrefix(%q) succeeded, want an error", prefix)
+		}
+	}
+}
+
+func TestTablePrefixSeparatesStores(t *testing.T) {
+	cfg1 := testConfig(t)
+	cfg1.TablePrefix = "tenant1_"
+	cfg2 := *cfg1
+	cfg2.TablePrefix = "tenant2_"
+	pg1 := newTestStore(t, cfg1)
+	pg2, err := NewMySQLStore(&cfg2)
+	if err != nil {
+		t.Fatalf("NewMySQLStore() failed: %v", err)
+	}
+	defer pg2.Close()
+	ctx := context.Background()
+
+	if _, err := pg1.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"}); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	if os, _, err := pg1.ListOccurrences(ctx, "p", "", "", 10); err != nil || len(os) != 1 {
+		t.Errorf("ListOccurrences() of the first store = %d occurrences, %v; want 1", len(os), err)
+	}
+	if os, _, err := pg2.ListOccurrences(ctx, "p", "", "", 10); err != nil || len(os) != 0 {
+		t.Errorf("ListOccurrences() of the second store = %d occurrences, %v; want 0", len(os), err)
+	}
+	var count int
+	if err := pg1.DB.QueryRow("SELECT COUNT(*) FROM tenant1_occurrences").Scan(&count); err != nil || count != 1 {
+		t.Errorf("tenant1_occurrences holds %d rows, %v; want 1", count, err)
+	}
+}
+
+func TestListRecentOccurrences(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	var names, oIDs []string
+	for i := 0; i < 4; i++ {
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		_, oID, err := name.ParseOccurrence(o.Name)
+		if err != nil {
+			t.Fatalf("ParseOccurrence() failed: %v", err)
+		}
+		names = append(names, o.Name)
+		oIDs = append(oIDs, oID)
+		time.Sleep(time.Millisecond)
+	}
+	for _, i := range []int{2, 0, 3} {
+		if _, err := pg.UpdateOccurrence(ctx, "p", oIDs[i], &pb.Occurrence{NoteName: "projects/p/notes/n", Remediation: "updated"}, nil); err != nil {
+			t.Fatalf("UpdateOccurrence() failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var got []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("ListRecentOccurrences() did not stop returning page tokens")
+		}
+		os, next, err := pg.ListRecentOccurrences(ctx, "p", "", token, 1)
+		if err != nil {
+			t.Fatalf("ListRecentOccurrences() failed: %v", err)
+		}
+		for _, o := range os {
+			got = append(got, o.Name)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	want := []string{names[3], names[0], names[2], names[1]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListRecentOccurrences() pages returned %v, want %v", got, want)
+	}
+
+	os, _, err := pg.ListRecentOccurrences(ctx, "p", `remediation="updated"`, "", 10)
+	if err != nil {
+		t.Fatalf("ListRecentOccurrences() with a filter failed: %v", err)
+	}
+	if len(os) != 3 || os[0].Name != names[3] {
+		t.Errorf("ListRecentOccurrences() with a filter returned %d occurrences, want the 3 updated ones", len(os))
+	}
+}
+
+func TestTimePageToken(t *testing.T) {
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		t.Fatalf("Generate() failed: %v", err)
+	}
+	pg := &MySQLStore{paginationKeys: []*fernet.Key{&key}}
+	want := time.Date(2020, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	token, err := pg.encodeTimePageToken(want, 42)
+	if err != nil {
+		t.Fatalf("encodeTimePageToken() failed: %v", err)
+	}
+	if got, id, err := pg.decodeTimePageToken(token); err != nil || !got.Equal(want) || id != 42 {
+		t.Errorf("decodeTimePageToken() = %v, %d, %v; want %v, 42, nil", got, id, err, want)
+	}
+	if got, id, err := pg.decodeTimePageToken(""); err != nil || !got.Equal(maxModifyTime) || id != math.MaxInt64 {
+		t.Errorf("decodeTimePageToken(\"\") = %v, %d, %v; want the first page", got, id, err)
+	}
+	idToken, err := pg.encodePageToken(42)
+	if err != nil {
+		t.Fatalf("encodePageToken() failed: %v", err)
+	}
+	for _, invalid := range []string{"garbage", idToken} {
+		if _, _, err := pg.decodeTimePageToken(invalid); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("decodeTimePageToken(%q) got %v, want InvalidArgument", invalid, err)
+		}
+	}
+}
+
+func TestDeleteExpiredOccurrences(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DeleteBatchSize = 2
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	now := time.Now()
+	ages := []time.Duration{time.Hour, 40 * 24 * time.Hour, 31 * 24 * time.Hour, 29 * 24 * time.Hour, 90 * 24 * time.Hour, 365 * 24 * time.Hour, 0}
+	var want []string
+	for _, age := range ages {
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		_, oID, err := name.ParseOccurrence(o.Name)
+		if err != nil {
+			t.Fatalf("ParseOccurrence() failed: %v", err)
+		}
+		created := now.Add(-age).UTC()
+		if _, err := pg.DB.Exec("UPDATE occurrences SET data = JSON_SET(data, '$.create_time', ?), create_time = ? WHERE occurrence_id = ?",
+			created.Format(time.RFC3339Nano), created.Format(mysqlDatetimeFormat), occurrenceIDValue(oID)); err != nil {
+			t.Fatalf("setting create_time failed: %v", err)
+		}
+		if age < 30*24*time.Hour {
+			want = append(want, o.Name)
+		}
+	}
+	if _, err := pg.CreateOccurrence(ctx, "other", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"}); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+
+	deleted, err := pg.DeleteExpiredOccurrences(ctx, "p", now.Add(-30*24*time.Hour))
+	if err != nil {
+		t.Fatalf("DeleteExpiredOccurrences() failed: %v", err)
+	}
+	if deleted != 4 {
+		t.Errorf("DeleteExpiredOccurrences() = %d, want 4", deleted)
+	}
+	os, _, err := pg.ListOccurrences(ctx, "p", "", "", 100)
+	if err != nil {
+		t.Fatalf("ListOccurrences() failed: %v", err)
+	}
+	var got []string
+	for _, o := range os {
+		got = append(got, o.Name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("occurrences left after DeleteExpiredOccurrences() = %v, want %v", got, want)
+	}
+	if os, _, err := pg.ListOccurrences(ctx, "other", "", "", 100); err != nil || len(os) != 1 {
+		t.Errorf("DeleteExpiredOccurrences() left %d occurrences of another project, %v; want 1", len(os), err)
+	}
+}
+
+// testDeleteAll tests the DeleteAllOccurrences and DeleteAllNotes methods of s, which
+// must be empty.
+func testDeleteAll(t *testing.T, s Store) {
+	t.Helper()
+	ctx := ReadFromPrimary(context.Background())
+	for _, pID := range []string{"p", "q"} {
+		if _, err := s.CreateProject(ctx, pID, &prpb.Project{}); err != nil {
+			t.Fatalf("CreateProject() failed: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		nID := fmt.Sprintf("n%d", i)
+		if _, err := s.CreateNote(ctx, "p", nID, "u", &pb.Note{ShortDescription: nID}); err != nil {
+			t.Fatalf("CreateNote() failed: %v", err)
+		}
+		o := noteOccurrence(name.FormatNote("p", nID), fmt.Sprintf("https://gcr.io/p/%d", i), vulnpb.Severity_HIGH)
+		if _, err := s.CreateOccurrence(ctx, "p", "u", o); err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+	}
+	if _, err := s.CreateNote(ctx, "q", "n0", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	if _, err := s.CreateOccurrence(ctx, "q", "u", noteOccurrence("projects/q/notes/n0", "https://gcr.io/q/a", vulnpb.Severity_LOW)); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+
+	if deleted, err := s.DeleteAllOccurrences(ctx, "p"); err != nil || deleted != 5 {
+		t.Errorf("DeleteAllOccurrences() = %d, %v, want 5", deleted, err)
+	}
+	if deleted, err := s.DeleteAllNotes(ctx, "p"); err != nil || deleted != 5 {
+		t.Errorf("DeleteAllNotes() = %d, %v, want 5", deleted, err)
+	}
+	if deleted, err := s.DeleteAllOccurrences(ctx, "p"); err != nil || deleted != 0 {
+		t.Errorf("DeleteAllOccurrences() of an emptied project = %d, %v, want 0", deleted, err)
+	}
+	if deleted, err := s.DeleteAllNotes(ctx, "p"); err != nil || deleted != 0 {
+		t.Errorf("DeleteAllNotes() of an emptied project = %d, %v, want 0", deleted, err)
+	}
+
+	if _, err := s.GetProject(ctx, "p"); err != nil {
+		t.Errorf("GetProject() after deleting its notes and occurrences failed: %v", err)
+	}
+	if os, _, err := s.ListOccurrences(ctx, "p", "", "", 100); err != nil || len(os) != 0 {
+		t.Errorf("ListOccurrences() after DeleteAllOccurrences() = %d occurrences, %v; want none", len(os), err)
+	}
+	if ns, _, err := s.ListNotes(ctx, "p", "", "", 100); err != nil || len(ns) != 0 {
+		t.Errorf("ListNotes() after DeleteAllNotes() = %d notes, %v; want none", len(ns), err)
+	}
+	if _, err := s.GetNote(ctx, "p", "n0"); status.Code(err) != codes.NotFound {
+		t.Errorf("GetNote() of a deleted note returned %v, want NotFound", err)
+	}
+	if os, _, err := s.ListOccurrences(ctx, "q", "", "", 100); err != nil || len(os) != 1 {
+		t.Errorf("DeleteAllOccurrences() left %d occurrences of another project, %v; want 1", len(os), err)
+	}
+	if ns, _, err := s.ListNotes(ctx, "q", "", "", 100); err != nil || len(ns) != 1 {
+		t.Errorf("DeleteAllNotes() left %d notes of another project, %v; want 1", len(ns), err)
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DeleteBatchSize = 2
+	cfg.NoteCacheSize = 10
+	testDeleteAll(t, newTestStore(t, cfg))
+}
+
+func TestDeleteAllNotesPreventsOrphans(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.PreventOrphanedOccurrences = true
+	pg := newTestStore(t, cfg)
+	ctx := context.Background()
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	if _, err := pg.CreateOccurrence(ctx, "q", "u", noteOccurrence("projects/p/notes/n", "https://gcr.io/q/a", vulnpb.Severity_LOW)); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+
+	// The occurrence of another project still refers to the note.
+	if _, err := pg.DeleteAllOccurrences(ctx, "p"); err != nil {
+		t.Fatalf("DeleteAllOccurrences() failed: %v", err)
+	}
+	if _, err := pg.DeleteAllNotes(ctx, "p"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("DeleteAllNotes() with occurrences left returned %v, want FailedPrecondition", err)
+	}
+	if _, err := pg.GetNote(ctx, "p", "n"); err != nil {
+		t.Errorf("GetNote() after the failed DeleteAllNotes() failed: %v", err)
+	}
+
+	if _, err := pg.DeleteAllOccurrences(ctx, "q"); err != nil {
+		t.Fatalf("DeleteAllOccurrences() failed: %v", err)
+	}
+	if deleted, err := pg.DeleteAllNotes(ctx, "p"); err != nil || deleted != 1 {
+		t.Errorf("DeleteAllNotes() = %d, %v, want 1", deleted, err)
+	}
+}
+
+func TestDeleteOccurrences(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	var oIDs []string
+	for i := 0; i < 5; i++ {
+		o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+		if err != nil {
+			t.Fatalf("CreateOccurrence() failed: %v", err)
+		}
+		_, oID, _ := name.ParseOccurrence(o.Name)
+		oIDs = append(oIDs, oID)
+	}
+	other, err := pg.CreateOccurrence(ctx, "other", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, otherID, _ := name.ParseOccurrence(other.Name)
+
+	deleted, err := pg.DeleteOccurrences(ctx, "p", []string{oIDs[1], oIDs[3], oIDs[3], "missing", otherID})
+	if err != nil {
+		t.Fatalf("DeleteOccurrences() failed: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("DeleteOccurrences() = %d, want 2", deleted)
+	}
+	got, err := pg.GetOccurrences(ctx, "p", oIDs)
+	if err != nil {
+		t.Fatalf("GetOccurrences() failed: %v", err)
+	}
+	for i, oID := range oIDs {
+		_, ok := got[oID]
+		if want := i != 1 && i != 3; ok != want {
+			t.Errorf("occurrence %d present = %v, want %v", i, ok, want)
+		}
+	}
+	if _, err := pg.GetOccurrence(ctx, "other", otherID); err != nil {
+		t.Errorf("DeleteOccurrences() deleted an occurrence of another project: %v", err)
+	}
+	if deleted, err := pg.DeleteOccurrences(ctx, "p", nil); err != nil || deleted != 0 {
+		t.Errorf("DeleteOccurrences() of no IDs = %d, %v; want 0, nil", deleted, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	pg := newTestStore(t, nil)
+	ctx := context.Background()
+	if _, err := pg.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	o, err := pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+	if err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	_, oID, _ := name.ParseOccurrence(o.Name)
+
+	pg.SetReadOnly(true)
+	if !pg.ReadOnly() {
+		t.Fatal("ReadOnly() = false after SetReadOnly(true)")
+	}
+	if _, err := pg.GetOccurrence(ctx, "p", oID); err != nil {
+		t.Errorf("GetOccurrence() in read-only mode failed: %v", err)
+	}
+	if _, err := pg.GetNote(ctx, "p", "n"); err != nil {
+		t.Errorf("GetNote() in read-only mode failed: %v", err)
+	}
+	if os, _, err := pg.ListOccurrences(ctx, "p", "", "", 10); err != nil || len(os) != 1 {
+		t.Errorf("ListOccurrences() in read-only mode = %d occurrences, %v; want 1", len(os), err)
+	}
+
+	writes := map[string]error{}
+	_, writes["CreateProject"] = pg.CreateProject(ctx, "p2", &prpb.Project{})
+	_, writes["CreateOccurrence"] = pg.CreateOccurrence(ctx, "p", "u", &pb.Occurrence{NoteName: "projects/p/notes/n"})
+	_, writes["UpdateOccurrence"] = pg.UpdateOccurrence(ctx, "p", oID, &pb.Occurrence{}, nil)
+	writes["DeleteOccurrence"] = pg.DeleteOccurrence(ctx, "p", oID)
+	_, writes["CreateNote"] = pg.CreateNote(ctx, "p", "n2", "u", &pb.Note{})
+	_, writes["UpdateNote"] = pg.UpdateNote(ctx, "p", "n", &pb.Note{}, nil)
+	writes["DeleteNote"] = pg.DeleteNote(ctx, "p", "n")
+	_, errs := pg.BatchCreateOccurrences(ctx, "p", "u", []*pb.Occurrence{{NoteName: "projects/p/notes/n"}})
+	writes["BatchCreateOccurrences"] = errs[0]
+	for method, err := range writes {
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("%s() in read-only mode got %v, want FailedPrecondition", method, err)
+		}
+	}
+	if _, err := pg.GetOccurrence(ctx, "p", oID); err != nil {
+		t.Errorf("occurrence was deleted in read-only mode: %v", err)
+	}
+
+	pg.SetReadOnly(false)
+	if err := pg.DeleteOccurrence(ctx, "p", oID); err != nil {
+		t.Errorf("DeleteOccurrence() after SetReadOnly(false) failed: %v", err)
+	}
+}
+
+func TestFlavorFromVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    serverFlavor
+	}{
+		{"8.0.36", flavorMySQL},
+		{"5.7.44-log", flavorMySQL},
+		{"8.0.35-google", flavorMySQL},
+		{"10.11.6-MariaDB-1:10.11.6+maria~ubu2204", flavorMariaDB},
+		{"5.5.5-10.6.12-MariaDB", flavorMariaDB},
+		{"11.2.2-mariadb-log", flavorMariaDB},
+	}
+	for _, tt := range tests {
+		if got := flavorFromVersion(tt.version); got != tt.want {
+			t.Errorf("flavorFromVersion(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestFilterDialect(t *testing.T) {
+	tests := []struct {
+		filter      string
+		wantMySQL   string
+		wantMariaDB string
+	}{
+		{`note_name="n1"`,
+			`(JSON_EXTRACT(data, '$.note_name') = ?)`,
+			`(JSON_UNQUOTE(JSON_EXTRACT(data, '$.note_name')) = ?)`},
+		{`resource.uri!="https://gcr.io/p/a"`,
+			`(JSON_EXTRACT(data, '$.resource.uri') != ?)`,
+			`(JSON_UNQUOTE(JSON_EXTRACT(data, '$.resource.uri')) != ?)`},
+		// Numbers compare equal either way, and ordering comparisons cast the field.
+		{`vulnerability.cvss_version=3`,
+			`(JSON_EXTRACT(data, '$.vulnerability.cvss_version') = ?)`,
+			`(JSON_EXTRACT(data, '$.vulnerability.cvss_version') = ?)`},
+		{`vulnerability.cvss_version>2`,
+			`(CAST(JSON_EXTRACT(data, '$.vulnerability.cvss_version') AS DECIMAL(65,30)) > ?)`,
+			`(CAST(JSON_EXTRACT(data, '$.vulnerability.cvss_version') AS DECIMAL(65,30)) > ?)`},
+		// Indexed columns are not JSON.
+		{`kind="BUILD"`, `(kind = ?)`, `(kind = ?)`},
+		{`resource_url="https://gcr.io/p/a"`, `(resource_url = ?)`, `(resource_url = ?)`},
+	}
+	mysqlStore := &MySQLStore{flavor: flavorMySQL}
+	mariaDBStore := &MySQLStore{flavor: flavorMariaDB}
+	for _, tt := range tests {
+		for _, c := range []struct {
+			pg   *MySQLStore
+			want string
+		}{{mysqlStore, tt.wantMySQL}, {mariaDBStore, tt.wantMariaDB}} {
+			got, _, err := c.pg.newFilter().ParseFilter(tt.filter)
+			if err != nil {
+				t.Errorf("ParseFilter(%q) on %v failed: %v", tt.filter, c.pg.flavor, err)
+				continue
+			}
+			if got != c.want {
+				t.Errorf("ParseFilter(%q) on %v = %s, want %s", tt.filter, c.pg.flavor, got, c.want)
+			}
+		}
+	}
+}
+
+// testFilterNotesOnOccurrenceColumns tests that s rejects filters of notes on the
+// fields only occurrences have columns for, and accepts them for occurrences.
+func testFilterNotesOnOccurrenceColumns(t *testing.T, s Store) {
+	t.Helper()
+	ctx := ReadFromPrimary(context.Background())
+	if _, err := s.CreateNote(ctx, "p", "n", "u", &pb.Note{}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	if _, err := s.CreateOccurrence(ctx, "p", "u", noteOccurrence("projects/p/notes/n", "https://gcr.io/p/a", vulnpb.Severity_HIGH)); err != nil {
+		t.Fatalf("CreateOccurrence() failed: %v", err)
+	}
+	for _, filter := range []string{`resourceUrl="https://gcr.io/p/a"`, `resource_url="https://gcr.io/p/a"`} {
+		if _, _, err := s.ListNotes(ctx, "p", filter, "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListNotes(%q) got %v, want InvalidArgument", filter, err)
+		}
+		if _, _, _, err := s.ListNotesWithCount(ctx, "p", filter, "", 10); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListNotesWithCount(%q) got %v, want InvalidArgument", filter, err)
+		}
+		if os, _, err := s.ListOccurrences(ctx, "p", filter, "", 10); err != nil || len(os) != 1 {
+			t.Errorf("ListOccurrences(%q) = %d occurrences, %v; want 1", filter, len(os), err)
+		}
+	}
+}
+
+func TestFilterNotesOnOccurrenceColumns(t *testing.T) {
+	testFilterNotesOnOccurrenceColumns(t, newTestStore(t, nil))
+	pg := &MySQLStore{}
+	if _, _, err := pg.newNoteFilter().ParseFilter(`resourceUrl IN ("https://gcr.io/p/a")`); err == nil {
+		t.Errorf("note filter ParseFilter() of resourceUrl IN succeeded, want an error")
+	}
+}
+
+func TestDetectFlavor(t *testing.T) {
+	pg := newTestStore(t, nil)
+	var version string
+	if err := pg.DB.QueryRow("SELECT VERSION()").Scan(&version); err != nil {
+		t.Fatalf("SELECT VERSION() failed: %v", err)
+	}
+	if want := flavorFromVersion(version); pg.flavor != want {
+		t.Errorf("flavor of store on server %q = %v, want %v", version, pg.flavor, want)
+	}
+	// Filters on strings in the data match on either server.
+	ctx := context.Background()
+	if _, err := pg.CreateProject(ctx, "p1", &prpb.Project{}); err != nil {
+		t.Fatalf("CreateProject() failed: %v", err)
+	}
+	if _, err := pg.CreateNote(ctx, "p1", "n1", "u", &pb.Note{ShortDescription: "flavor"}); err != nil {
+		t.Fatalf("CreateNote() failed: %v", err)
+	}
+	notes, _, err := pg.ListNotes(ctx, "p1", `short_description="flavor"`, "", 10)
+	if err != nil {
+		t.Fatalf("ListNotes() failed: %v", err)
+	}
+	if len(notes) != 1 {
+		t.Errorf("ListNotes() on %v returned %d notes, want 1", pg.flavor, len(notes))
+	}
+}
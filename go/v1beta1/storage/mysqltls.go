@@ -0,0 +1,114 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/grafeas/grafeas/go/config"
+)
+
+// mysqlTLSConfigName is the name the TLS config built from MySQLConfig is registered
+// under with the driver, and referenced by in the DSN.
+const mysqlTLSConfigName = "grafeas"
+
+// tlsEnabled reports whether sslMode requires the connection to use TLS.
+func tlsEnabled(sslMode string) bool {
+	return sslMode != "" && sslMode != "disable"
+}
+
+// registerTLSConfig builds the TLS config described by config and registers it with the
+// driver. It does nothing when TLS is disabled.
+func registerTLSConfig(config *config.MySQLConfig) error {
+	if !tlsEnabled(config.SSLMode) {
+		return nil
+	}
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	return mysql.RegisterTLSConfig(mysqlTLSConfigName, tlsConfig)
+}
+
+// newTLSConfig builds a TLS config for the given SSLMode:
+//
+//	require     encrypts the connection without verifying the server certificate
+//	verify-ca   also verifies the server certificate was signed by a trusted CA
+//	verify-full also verifies the server host name matches its certificate
+func newTLSConfig(config *config.MySQLConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: config.SSLServerName}
+	if config.SSLRootCert != "" {
+		pem, err := ioutil.ReadFile(config.SSLRootCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sslrootcert: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in sslrootcert %q", config.SSLRootCert)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if config.SSLCert != "" || config.SSLKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.SSLCert, config.SSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load sslcert/sslkey: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	switch config.SSLMode {
+	case "require":
+		tlsConfig.InsecureSkipVerify = true
+	case "verify-ca":
+		// Skip the default verification, which includes the host name, and check
+		// only the certificate chain.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verifyCertificateChain(tlsConfig.RootCAs)
+	case "verify-full":
+		// The driver fills in ServerName from the host when it is empty.
+	default:
+		return nil, fmt.Errorf("invalid sslmode %q; must be one of disable, require, verify-ca, verify-full", config.SSLMode)
+	}
+	return tlsConfig, nil
+}
+
+// verifyCertificateChain returns a tls.Config.VerifyPeerCertificate function that
+// verifies the server certificate chain against roots, ignoring the host name.
+func verifyCertificateChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server presented no certificates")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 The Grafeas Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+
+	"golang.org/x/net/context"
+)
+
+// withTx runs fn in a transaction on the primary, committing it if fn returns nil
+// and rolling it back if fn returns an error or panics. A deadlock rolls back the
+// whole transaction, so when the transaction fails with a retryable error, or cannot
+// be begun on a broken connection, it is run again from the start according to the
+// store's retry policy; fn must therefore be safe to call more than once.
+func (pg *MySQLStore) withTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return pg.retry.do(ctx, func() error {
+		return runTx(ctx, pg.DB, fn)
+	})
+}
+
+// WithTx runs fn in a transaction on the primary like withTx, for callers combining
+// their own statements with GetOccurrenceForUpdate.
+func (pg *MySQLStore) WithTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return pg.withTx(ctx, fn)
+}
+
+// runTx runs fn in one transaction on db, see withTx.
+func runTx(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err == driver.ErrBadConn {
+		return beginError{err}
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}